@@ -0,0 +1,470 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"kingsford/kpath/arithc"
+)
+
+// An ArchiveReader holds everything needed to decode an archive: the model
+// and, for each segment, the buckets and their counts, the flipped bits and N
+// locations, and a decoder for the encoded tails.
+type ArchiveReader struct {
+	segs    []*archiveSegment
+	km      KmerModel
+	readLen int // the read length of the first segment
+	seed    string
+	enc     *os.File
+	meta    *ArchiveMeta
+}
+
+// openArchive() reads the archive with basename archive, using the reference
+// in refFile to build the model. If archive.model exists, the model is read
+// from it and refFile is not needed. The pieces are read in parallel.
+func openArchive(refFile, archive string) *ArchiveReader {
+	return openArchiveWith(refFile, archive, nil)
+}
+
+// openArchiveWith() reads the archive as openArchive() does, but takes the
+// model built from the reference from models, if it is not nil, so that
+// archives encoded against one reference share the work of building it.
+func openArchiveWith(refFile, archive string, models *modelCache) *ArchiveReader {
+	ar := &ArchiveReader{}
+
+	// count the kmers in the reference, or load the stored model
+	modelFN := archive + ".model"
+	haveModel := fileExists(modelFN)
+	DIE_IF(!haveModel && refFile == "",
+		"Must specify gzipped fasta as reference with -ref (no %s found)", modelFN)
+
+	// make sure we have the same k and reference that the encoder used
+	checkRef := refFile
+	if haveModel {
+		checkRef = ""
+	}
+	archiveBucketK, nsegs, meta := archiveLayout(archive, checkRef)
+	DIE_ON_ERR(setSeed(meta.Seed), "Bad seed in %s", archive+".meta")
+	DIE_ON_ERR(setArchiveBackoff(meta), "Bad backoff in %s", archive+".meta")
+	ar.seed = meta.Seed
+	ar.meta = meta
+	refIUPACOption = iupacFor(meta)
+	adaptivePseudoOption = meta.AdaptivePseudo
+	if !haveModel {
+		DIE_ON_ERR(archiveDictionary(meta, dictionaryOption), "Can't decode %s", archive)
+	}
+	waitForReference := make(chan struct{})
+	go func() {
+		refStart := time.Now()
+		if haveModel {
+			ar.km, _ = loadKmerModel(modelFN)
+		} else {
+			ar.km = models.referenceModel(refFile, meta)
+		}
+		if mphfOption && !updateReference {
+			ar.km = NewMPHFKmerModel(ar.km, uint(globalK))
+		}
+		log.Printf("Time: Took %v seconds to read reference.",
+			time.Now().Sub(refStart).Seconds())
+		close(waitForReference)
+		return
+	}()
+
+	// open encoded read file
+	tailsFN := archive + ".enc"
+	var err error
+	ar.enc, err = os.Open(tailsFN)
+	DIE_ON_ERR(err, "Can't open encoded read file %s", tailsFN)
+
+	offset := int64(0)
+	for i := 0; i < nsegs; i++ {
+		DIE_IF(offset < 0, "%s has %d segments but %s has only 1", archive+".meta", nsegs, tailsFN)
+		seg := &archiveSegment{}
+		segOffset := offset
+		var h *segmentHeader
+		seg.decoder, h, offset = openSegment(ar.enc, offset)
+		seg.ntails = -1
+		if h != nil {
+			seg.ntails = int(h.ntails)
+
+			// make sure the files of the segment all come from one encode
+			DIE_ON_ERR(checkSidecarIDs(segmentBase(archive, i), h.id),
+				"Segment %d of %s mixes files from different encodes", i, archive)
+		}
+		DIE_ON_ERR(checkSidecars(meta, i, segmentBase(archive, i), partialOption),
+			"Segment %d of %s is incomplete (use -partial to decode without .flipped or .ns)", i, archive)
+		readSegment(segmentBase(archive, i), archiveBucketK, seg)
+
+		// the coder restarts at each block of an indexed archive
+		if idxFN := segmentBase(archive, i) + ".idx"; fileExists(idxFN) {
+			seg.blocks = loadBlockIndex(idxFN)
+			enc := ar.enc
+			seg.openBlock = func(offset int64) *arithc.Decoder {
+				return decoderAt(enc, segOffset, offset)
+			}
+		}
+		ar.segs = append(ar.segs, seg)
+	}
+	ar.readLen = ar.segs[0].readLen
+
+	<-waitForReference
+
+	// put the buckets in the order they were coded in, which may need the
+	// model as it is before any reads are decoded
+	for _, seg := range ar.segs {
+		seg.kmers, seg.counts = codingOrder(bucketOrderFor(meta), seg.kmers, seg.counts,
+			ar.km, seg.readLen-archiveBucketK)
+	}
+	log.Printf("Read length = %d", ar.readLen)
+	return ar
+}
+
+// A modelCache holds the models built from references, so that they can be
+// used for several archives. The model depends on the reference, k, the
+// spaced seed, how IUPAC codes were handled and the dictionary, so a model
+// is only shared by archives that agree on all of them.
+type modelCache struct {
+	models map[string]KmerModel
+	built  int // # of models built
+}
+
+func newModelCache() *modelCache {
+	return &modelCache{models: make(map[string]KmerModel)}
+}
+
+// referenceModel() returns the model for decoding the archive with the given
+// metadata using the reference in refFile, building it unless c has it. The
+// decoder updates the model as it goes if updateReference is set, so then
+// each archive gets a copy of it, which starts from the reference alone. If
+// c is nil, the model is simply built.
+func (c *modelCache) referenceModel(refFile string, meta *ArchiveMeta) KmerModel {
+	if c == nil {
+		return countKmersInReference(globalK, readReferenceFile(refFile))
+	}
+	key := fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%s", refFile, globalK, meta.Seed, iupacFor(meta), meta.DictMD5)
+	km, ok := c.models[key]
+	if !ok {
+		km = countKmersInReference(globalK, readReferenceFile(refFile))
+		c.models[key] = km
+		c.built++
+	} else {
+		log.Printf("Using the model already built from %s", refFile)
+	}
+	if updateReference {
+		return cloneKmerModel(km, uint(globalK))
+	}
+	return km
+}
+
+// archiveLayout() returns the bucket prefix length and number of segments of
+// the archive, as recorded in its metadata, and the metadata itself (which is
+// empty if the archive has none), after checking that it can be decoded with
+// the current -k and the reference in refFile (which is not checked if it is
+// "", and otherwise must be one an archive with no metadata can be decoded
+// with; see checkArchiveFormat()).
+func archiveLayout(archive, refFile string) (int, int, *ArchiveMeta) {
+	archiveBucketK := bucketK
+	nsegs := 1
+	meta := loadArchiveMeta(archive + ".meta")
+	if meta != nil {
+		DIE_ON_ERR(checkArchiveReference(meta, refFile, globalK),
+			"Can't decode %s with these options", archive)
+		DIE_ON_ERR(checkArchiveMul(meta, observationWeight),
+			"Can't decode %s with these options", archive)
+		DIE_ON_ERR(checkArchiveUpdate(meta, updateReference),
+			"Can't decode %s with these options", archive)
+		if w := versionWarning(meta); w != "" {
+			log.Println(w)
+		}
+		if meta.BucketK > 0 {
+			archiveBucketK = meta.BucketK
+		}
+		if meta.Segments > 1 {
+			nsegs = meta.Segments
+		}
+	} else if refFile != "" {
+		DIE_ON_ERR(checkArchiveFormat(nil), "Can't decode %s with -ref", archive)
+	}
+	if archiveBucketK <= 0 {
+		archiveBucketK = globalK
+	}
+	log.Printf("Using bucket prefix length = %d", archiveBucketK)
+	if meta == nil {
+		meta = &ArchiveMeta{}
+	}
+	return archiveBucketK, nsegs, meta
+}
+
+// readSegment() reads the buckets, counts, runs, flipped bits and N
+// locations of a segment from the files with the given basename into seg. The
+// pieces are read in parallel, once the counts give the number of reads to
+// make room for.
+func readSegment(base string, bucketK int, seg *archiveSegment) {
+	headsFN := base + ".bittree"
+	countsFN := base + ".counts"
+
+	log.Printf("Reading from %s and %s", headsFN, countsFN)
+
+	// read the bucket names
+	waitForBuckets := make(chan struct{})
+	go func() {
+		seg.kmers = decodeKmersFromFile(headsFN, bucketK)
+		sort.Strings(seg.kmers)
+		close(waitForBuckets)
+	}()
+
+	// read the NLocations, which might be 0-length if no file could be
+	// found; this indicates that the Ns were recorded some other way.
+	waitForNLocations := make(chan struct{})
+	go func() {
+		seg.nLocations = readNLocations(base + ".ns")
+		close(waitForNLocations)
+	}()
+
+	// read the bucket counts
+	seg.counts, seg.readLen = readBucketCounts(countsFN)
+	nreads := sumAbs(seg.counts)
+
+	// read the flipped bits --- flipped by be 0-length if no file could be
+	// found; this indicates that either nothing was flipped or we don't
+	// care about orientation
+	waitForFlipped := make(chan struct{})
+	go func() {
+		seg.isFlipped = readFlipped(base+".flipped", nreads)
+		close(waitForFlipped)
+	}()
+
+	// the runs, homopolymer, exceptions and corrections files are small, and absent if
+	// there are none
+	seg.runs = readRuns(base + ".runs")
+	seg.homopolymers = readHomopolymers(base + ".homo")
+	seg.exceptions = readExceptions(base+".exc", nreads)
+	seg.corrections = readCorrections(base+".ecc", nreads)
+	seg.gc = readGC(base + ".gc")
+	seg.order = readOrder(base + ".order")
+	seg.positions = readPositions(base + ".pos")
+
+	<-waitForBuckets
+	<-waitForFlipped
+	<-waitForNLocations
+	DIE_ON_ERR(checkBucketCounts(seg.kmers, seg.counts),
+		"%s and %s don't match", headsFN, countsFN)
+}
+
+// writePrefixes() writes the bucket prefix of each read of the archive with
+// basename archive to w, in the order a full decode would write the reads,
+// and returns the number written. Only the buckets and counts (and the Ns and
+// exceptions, if archive.ns and archive.exc exist) are read: the tails are
+// never decoded, so archive.enc is not needed, and neither is the reference
+// unless the buckets were coded with -bucketorder=walk, which takes the
+// model to put them in order (see walkModel()). Flipped reads are not
+// unflipped, since the prefix of a flipped read comes from the end of the
+// original read, and so they don't get their exceptions back.
+func writePrefixes(refFile, archive string, w SeqWriter) int {
+	archiveBucketK, nsegs, meta := archiveLayout(archive, "")
+	var km KmerModel
+	if bucketOrderFor(meta) == "walk" {
+		km = walkModel(refFile, archive, meta)
+	}
+	n := 0
+	for i := 0; i < nsegs; i++ {
+		seg := &archiveSegment{}
+		DIE_ON_ERR(checkSidecars(meta, i, segmentBase(archive, i), partialOption),
+			"Segment %d of %s is incomplete (use -partial to decode without .flipped or .ns)", i, archive)
+		readSegment(segmentBase(archive, i), archiveBucketK, seg)
+		seg.kmers, seg.counts = codingOrder(bucketOrderFor(meta), seg.kmers, seg.counts,
+			km, seg.readLen-archiveBucketK)
+		segN := 0
+		for b, c := range seg.counts {
+			for j := 0; j < AbsInt(c); j++ {
+				s := seg.kmers[b]
+				if seg.corrections != nil {
+					s = putbackPrefixExceptions(s, seg.corrections[segN])
+				}
+				if seg.nLocations != nil {
+					s = putbackPrefixNs(s, seg.nLocations[segN])
+				}
+				flipped := seg.isFlipped != nil && seg.isFlipped[segN]
+				if seg.exceptions != nil && !flipped {
+					s = putbackPrefixExceptions(s, seg.exceptions[segN])
+				}
+				w.Write("R"+strconv.Itoa(n), s, nil)
+				segN++
+				n++
+			}
+		}
+	}
+	DIE_ON_ERR(w.Flush(), "Couldn't write the prefixes")
+	return n
+}
+
+// walkModel() returns the model the buckets of the archive with basename
+// archive and the given metadata were put in order with by
+// -bucketorder=walk: the one in archive.model, if it exists, and otherwise
+// the one built from the reference in refFile.
+func walkModel(refFile, archive string, meta *ArchiveMeta) KmerModel {
+	DIE_ON_ERR(setSeed(meta.Seed), "Bad seed in %s", archive+".meta")
+	modelFN := archive + ".model"
+	if fileExists(modelFN) {
+		km, _ := loadKmerModel(modelFN)
+		return km
+	}
+	DIE_IF(refFile == "",
+		"Must specify gzipped fasta as reference with -ref to order the buckets of %s (no %s found)", archive, modelFN)
+	DIE_ON_ERR(checkArchiveReference(meta, refFile, globalK),
+		"Can't decode %s with these options", archive)
+	refIUPACOption = iupacFor(meta)
+	DIE_ON_ERR(archiveDictionary(meta, dictionaryOption), "Can't decode %s", archive)
+	return countKmersInReference(globalK, readReferenceFile(refFile))
+}
+
+// putbackPrefixNs() puts back the Ns at the given positions of a read that
+// fall within its prefix s.
+func putbackPrefixNs(s string, p []byte) string {
+	inPrefix := make([]byte, 0, len(p))
+	for _, v := range p {
+		if int(v) < len(s) {
+			inPrefix = append(inPrefix, v)
+		}
+	}
+	return putbackNs(s, inPrefix)
+}
+
+// putbackPrefixExceptions() puts back the exceptions of a read that fall
+// within its prefix s.
+func putbackPrefixExceptions(s string, exc []byte) string {
+	inPrefix := make([]byte, 0, len(exc))
+	for i := 0; i < len(exc); i += 2 {
+		if int(exc[i]) < len(s) {
+			inPrefix = append(inPrefix, exc[i], exc[i+1])
+		}
+	}
+	return putbackExceptions(s, inPrefix)
+}
+
+// bucketCounts() returns the bucket prefixes of the archive with basename
+// archive, in sorted order, and the number of reads with each prefix (summed
+// over the segments). Only the buckets and counts are read.
+func bucketCounts(archive string) ([]string, []int) {
+	archiveBucketK, nsegs, _ := archiveLayout(archive, "")
+	total := make(map[string]int)
+	for i := 0; i < nsegs; i++ {
+		base := segmentBase(archive, i)
+		kmers := decodeKmersFromFile(base+".bittree", archiveBucketK)
+		sort.Strings(kmers)
+		counts, _ := readBucketCounts(base + ".counts")
+		DIE_ON_ERR(checkBucketCounts(kmers, counts),
+			"%s and %s don't match", base+".bittree", base+".counts")
+		for b, c := range counts {
+			total[kmers[b]] += AbsInt(c)
+		}
+	}
+
+	prefixes := make([]string, 0, len(total))
+	for p := range total {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	counts := make([]int, len(prefixes))
+	for i, p := range prefixes {
+		counts[i] = total[p]
+	}
+	return prefixes, counts
+}
+
+// writeBucketCounts() writes the prefixes and their counts to w as tab
+// separated lines.
+func writeBucketCounts(w io.Writer, prefixes []string, counts []int) error {
+	buf := bufio.NewWriter(w)
+	for i, p := range prefixes {
+		fmt.Fprintf(buf, "%s\t%d\n", p, counts[i])
+	}
+	return buf.Flush()
+}
+
+// Reads() returns an iterator over the reads of the archive. The adaptive
+// state in st must be fresh, and not shared with any other stream. The model
+// is used up by decoding, so Reads() can be called only once.
+func (ar *ArchiveReader) Reads(st *codingState) *ReadIterator {
+	// a single segment can use the model directly, as can any number if
+	// they don't change it; otherwise each segment starts from its own copy
+	base := ar.km
+	newModel := func() KmerModel { return base }
+	if len(ar.segs) > 1 && updateReference {
+		newModel = func() KmerModel { return cloneKmerModel(base, uint(globalK)) }
+	}
+	return newSegmentIterator(st, ar.segs, newModel)
+}
+
+// checkReadCount() returns an error if n, the number of reads decoded from
+// the whole archive, is not the number its metadata records.
+func (ar *ArchiveReader) checkReadCount(n int) error {
+	return checkReadCount(ar.meta, len(ar.segs), n)
+}
+
+// Close() closes the encoded tails file.
+func (ar *ArchiveReader) Close() error {
+	return ar.enc.Close()
+}
+
+// compareArchives() decodes the archives with basenames archive1 and archive2
+// in lockstep and returns the index of the first read at which they differ,
+// or -1 if they decode to the same reads. If one archive is a prefix of the
+// other, the index is the number of reads in the shorter one. Both archives
+// are decoded with the current options, so options that the archive does not
+// record (such as -mul and -update) must be the same for both.
+func compareArchives(refFile, archive1, archive2 string) int {
+	ar1 := openArchive(refFile, archive1)
+	defer ar1.Close()
+	ar2 := openArchive(refFile, archive2)
+	defer ar2.Close()
+	DIE_IF(ar1.seed != ar2.seed, "Can't compare archives encoded with different -seed")
+
+	// each archive is decoded with its own adaptive state
+	it1 := ar1.Reads(newCodingState())
+	it2 := ar2.Reads(newCodingState())
+	for i := 0; ; i++ {
+		r1, ok1 := it1.Next()
+		r2, ok2 := it2.Next()
+		if !ok1 && !ok2 {
+			return -1
+		}
+		if ok1 != ok2 || r1 != r2 {
+			return i
+		}
+	}
+}
+
+// compareReport() describes the result of compareArchives().
+func compareReport(archive1, archive2 string, diff int) string {
+	if diff < 0 {
+		return fmt.Sprintf("%s and %s decode to identical reads", archive1, archive2)
+	}
+	return fmt.Sprintf("%s and %s first differ at read %d", archive1, archive2, diff)
+}
@@ -0,0 +1,500 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tamperNs() changes the N locations recorded for read i of the archive,
+// keeping the archive id.
+func tamperNs(t *testing.T, archive string, i int) {
+	f, err := os.Open(archive + ".ns")
+	if err != nil {
+		t.Fatalf("Couldn't open Ns: %v", err)
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't unzip Ns: %v", err)
+	}
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(z)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	f.Close()
+
+	if lines[i] == "" {
+		lines[i] = "0"
+	} else {
+		lines[i] = ""
+	}
+
+	f, err = os.Create(archive + ".ns")
+	if err != nil {
+		t.Fatalf("Couldn't rewrite Ns: %v", err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	defer w.Close()
+	w.Comment = z.Comment
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s\n", l)
+	}
+}
+
+func TestCompareArchives(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 15, 500, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("a"))
+	if diff := compareArchives(td.refFile, td.path("a"), td.path("a")); diff != -1 {
+		t.Fatalf("Archive differs from itself at read %d", diff)
+	}
+
+	// a different bucket length gives different files but the same reads
+	bucketK = 6
+	encodeArchive(td.refFile, td.readFN, td.path("b"))
+	bucketK = 0
+	if diff := compareArchives(td.refFile, td.path("a"), td.path("b")); diff != -1 {
+		t.Fatalf("Archives with different -bucketk differ at read %d", diff)
+	}
+
+	encodeArchive(td.refFile, td.readFN, td.path("c"))
+	tamperNs(t, td.path("c"), 123)
+	if diff := compareArchives(td.refFile, td.path("a"), td.path("c")); diff != 123 {
+		t.Fatalf("Tampered archive reported as differing at %d, not 123", diff)
+	}
+}
+
+func TestAppendArchive(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 18, 600, 40)
+	defer td.Close()
+
+	// encode the reads in three batches
+	batches := [][]string{td.reads[:250], td.reads[250:450], td.reads[450:]}
+	for i, b := range batches {
+		fn := td.path(fmt.Sprintf("batch%d.fq", i))
+		writeTestReads(t, fn, b)
+		if i == 0 {
+			encodeArchive(td.refFile, fn, td.path("appended"))
+		} else {
+			appendArchive(td.refFile, fn, td.path("appended"))
+		}
+	}
+	if meta := loadArchiveMeta(td.path("appended.meta")); meta.Segments != 3 {
+		t.Fatalf("Archive has %d segments, not 3", meta.Segments)
+	}
+
+	encodeArchive(td.refFile, td.readFN, td.path("combined"))
+	decodeArchive(td.refFile, td.path("combined"), td.path("combined.fa"))
+	decodeArchive(td.refFile, td.path("appended"), td.path("appended.fa"))
+	appended := readDecodedSeqs(t, td.path("appended.fa"))
+	if !sameReads(appended, readDecodedSeqs(t, td.path("combined.fa"))) {
+		t.Fatalf("Appended archive decodes to different reads than the combined one")
+	}
+
+	// the segments come out in the order they were added
+	if !sameReads(appended[:250], batches[0]) || !sameReads(appended[450:], batches[2]) {
+		t.Fatalf("Segments decoded out of order")
+	}
+
+	// -n works across the segment boundaries
+	maxDecodeReads = 300
+	decodeArchive(td.refFile, td.path("appended"), td.path("first.fa"))
+	maxDecodeReads = 0
+	if got := readDecodedSeqs(t, td.path("first.fa")); !sameReads(got, appended[:300]) {
+		t.Fatalf("-n=300 gave %d reads that are not the first of the full decode", len(got))
+	}
+}
+
+func TestDecodeBucketRanges(t *testing.T) {
+	setTestOptions(8)
+	updateReference = false
+	indexBlockBuckets = 7
+	// record the duplicates as runs rather than uniform buckets
+	dupsOption = false
+	dupRunsOption = true
+	td := newTestData(t, 20, 500, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("full.fa"))
+	full := readDecodedSeqs(t, td.path("full.fa"))
+
+	// shards that start in the middle of blocks and at their starts
+	counts, _ := readBucketCounts(td.path("out.counts"))
+	bounds := []int{0, 1, 19, 21, 22, 50, len(counts) / 2, len(counts)}
+	sharded := make([]string, 0)
+	for i := 0; i+1 < len(bounds); i++ {
+		bucketRange = fmt.Sprintf("%d:%d", bounds[i], bounds[i+1])
+		decodeArchive(td.refFile, td.path("out"), td.path("shard.fa"))
+		shard := readDecodedSeqs(t, td.path("shard.fa"))
+		if want := sumAbs(counts[bounds[i]:bounds[i+1]]); len(shard) != want {
+			t.Fatalf("Shard %s has %d reads, not %d", bucketRange, len(shard), want)
+		}
+		sharded = append(sharded, shard...)
+	}
+	if strings.Join(sharded, " ") != strings.Join(full, " ") {
+		t.Fatalf("Concatenated shards differ from the full decode")
+	}
+}
+
+// encodedID() returns the archive id in the header of the first segment of
+// the given .enc file.
+func encodedID(t *testing.T, fn string) archiveID {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", fn, err)
+	}
+	defer f.Close()
+	_, h, _ := openSegment(f, 0)
+	if h == nil {
+		t.Fatalf("%s has no segment header", fn)
+	}
+	return h.id
+}
+
+func TestMixedArchiveFiles(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 22, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("a"))
+	writeTestReads(t, td.readFN, td.reads[:250])
+	encodeArchive(td.refFile, td.readFN, td.path("b"))
+
+	idA := encodedID(t, td.path("a.enc"))
+	idB := encodedID(t, td.path("b.enc"))
+	if idA == idB {
+		t.Fatalf("Two encodes of different reads have the same id %v", idA)
+	}
+	if err := checkSidecarIDs(td.path("a"), idA); err != nil {
+		t.Fatalf("Files of one encode rejected: %v", err)
+	}
+
+	// the counts of one encode with the rest of the other
+	if err := copyFile(td.path("b.counts"), td.path("a.counts")); err != nil {
+		t.Fatalf("Couldn't copy counts: %v", err)
+	}
+	if err := checkSidecarIDs(td.path("a"), idA); err == nil {
+		t.Fatalf("Counts from another encode accepted")
+	}
+
+	// the tails of one encode with the rest of the other
+	if err := checkSidecarIDs(td.path("b"), idA); err == nil {
+		t.Fatalf("Tails from another encode accepted")
+	}
+
+	// encoding the same reads again gives the same id
+	encodeArchive(td.refFile, td.readFN, td.path("c"))
+	if id := encodedID(t, td.path("c.enc")); id != idB {
+		t.Fatalf("Encoding the same reads gave ids %v and %v", idB, id)
+	}
+}
+
+func TestDecodePrefixes(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 18, 500, 40)
+	defer td.Close()
+
+	// without -flip the decoded reads are in their original orientation, so
+	// the prefixes are theirs; the tails are never needed
+	flipReadsOption = false
+	encodeArchive(td.refFile, td.readFN, td.path("noflip"))
+	decodeArchive(td.refFile, td.path("noflip"), td.path("noflip.fa"))
+	noflip := readDecodedSeqs(t, td.path("noflip.fa"))
+	os.Remove(td.path("noflip.enc"))
+	prefixOnlyOption = true
+	decodeArchive("", td.path("noflip"), td.path("prefixes.fa"))
+	prefixes := readDecodedSeqs(t, td.path("prefixes.fa"))
+	if len(prefixes) != len(noflip) {
+		t.Fatalf("Decoded %d prefixes for %d reads", len(prefixes), len(noflip))
+	}
+	for i, p := range prefixes {
+		if p != noflip[i][:globalK] {
+			t.Fatalf("Prefix %d is %s, but the read is %s", i, p, noflip[i])
+		}
+	}
+}
+
+func TestIndexCounts(t *testing.T) {
+	setTestOptions(8)
+	flipReadsOption = false
+	td := newTestData(t, 25, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	appendArchive(td.refFile, td.readFN, td.path("out"))
+
+	// the reads are not flipped, so the prefixes are those of the reads,
+	// whose Ns are coded as As; every read is in the archive twice
+	want := make(map[string]int)
+	for _, r := range td.reads {
+		want[strings.Replace(r[:8], "N", "A", -1)] += 2
+	}
+
+	indexCounts(td.path("out"), td.path("counts.tsv"))
+	f, err := os.Open(td.path("counts.tsv"))
+	if err != nil {
+		t.Fatalf("Couldn't open counts: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	prev := ""
+	n := 0
+	for scanner.Scan() {
+		var p string
+		var c int
+		if _, err := fmt.Sscanf(scanner.Text(), "%s\t%d", &p, &c); err != nil {
+			t.Fatalf("Bad line %q: %v", scanner.Text(), err)
+		}
+		if p <= prev {
+			t.Fatalf("Prefix %s follows %s", p, prev)
+		}
+		if c != want[p] {
+			t.Fatalf("Prefix %s has count %d, not %d", p, c, want[p])
+		}
+		prev = p
+		n++
+	}
+	if n != len(want) {
+		t.Fatalf("Wrote %d prefixes, not %d", n, len(want))
+	}
+}
+
+func TestBatchDecode(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 19, 600, 40)
+	defer td.Close()
+
+	// three archives against one reference, the last with a spaced seed
+	// and so a model of its own
+	batches := [][]string{td.reads[:250], td.reads[250:450], td.reads[450:]}
+	archives := make([]string, len(batches))
+	for i, b := range batches {
+		setTestOptions(8)
+		if i == 2 {
+			seedOption = "11101111"
+		}
+		fn := td.path(fmt.Sprintf("batch%d.fq", i))
+		writeTestReads(t, fn, b)
+		archives[i] = td.path(fmt.Sprintf("batch%d", i))
+		encodeArchive(td.refFile, fn, archives[i])
+	}
+
+	setTestOptions(8)
+	outDir := td.path("decoded")
+	DIE_ON_ERR(os.Mkdir(outDir, 0755), "Couldn't create %s", outDir)
+	models := newModelCache()
+	for _, archive := range archives {
+		decodeArchiveWith(td.refFile, archive, filepath.Join(outDir, filepath.Base(archive)+".fa"), models)
+	}
+	if models.built != 2 {
+		t.Fatalf("Built %d models for archives needing 2", models.built)
+	}
+	batchDecode(td.refFile, archives, outDir)
+
+	// each is what decoding it alone gives
+	for i, archive := range archives {
+		setTestOptions(8)
+		decodeArchive(td.refFile, archive, archive+".fa")
+		alone, errA := ioutil.ReadFile(archive + ".fa")
+		batch, errB := ioutil.ReadFile(filepath.Join(outDir, filepath.Base(archive)+".fa"))
+		if errA != nil || errB != nil || !bytes.Equal(alone, batch) {
+			t.Fatalf("%s decodes differently in a batch (%v, %v)", archive, errA, errB)
+		}
+		if !sameReads(readDecodedSeqs(t, archive+".fa"), batches[i]) {
+			t.Fatalf("%s decodes to the wrong reads", archive)
+		}
+	}
+}
+
+func TestRawStreams(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 23, 400, 40)
+	defer td.Close()
+
+	zipped := td.path("zipped")
+	encodeArchive(td.refFile, td.readFN, zipped)
+	setTestOptions(8)
+	rawStreamsOption = true
+	raw := td.path("raw")
+	encodeArchive(td.refFile, td.readFN, raw)
+
+	// the raw files hold what the gzipped ones unzip to
+	for _, ext := range []string{".counts", ".flipped", ".ns"} {
+		b, err := ioutil.ReadFile(raw + ext)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", raw+ext, err)
+		}
+		if bytes.HasPrefix(b, gzipMagic) {
+			t.Fatalf("%s is gzipped with -rawstreams", raw+ext)
+		}
+		if !bytes.Equal(b, readGoldenFile(t, zipped+ext)) {
+			t.Fatalf("%s differs from the unzipped %s", raw+ext, zipped+ext)
+		}
+	}
+
+	// and either decodes without the option
+	setTestOptions(8)
+	for _, archive := range []string{zipped, raw} {
+		decodeArchive(td.refFile, archive, archive+".fa")
+		if !sameReads(readDecodedSeqs(t, archive+".fa"), td.reads) {
+			t.Fatalf("%s decodes to the wrong reads", archive)
+		}
+	}
+}
+
+func TestReadCount(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 24, 500, 40)
+	defer td.Close()
+
+	archive := td.path("a")
+	encodeArchive(td.refFile, td.readFN, archive)
+	meta := loadArchiveMeta(archive + ".meta")
+	if n := recordedReads(meta, 1); n != len(td.reads) {
+		t.Fatalf("Recorded %d reads, not %d", n, len(td.reads))
+	}
+	if err := checkReadCount(meta, 1, len(td.reads)); err != nil {
+		t.Fatalf("Right number of reads rejected: %v", err)
+	}
+	if recordedReads(&ArchiveMeta{}, 1) != -1 {
+		t.Fatalf("Archive without read counts has a count")
+	}
+
+	// take one read out of a uniform bucket, keeping the archive id; only
+	// one tail is coded for the bucket, so the stream decodes as before
+	f, err := os.Open(archive + ".counts")
+	if err != nil {
+		t.Fatalf("Couldn't open counts: %v", err)
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't unzip counts: %v", err)
+	}
+	b, err := ioutil.ReadAll(z)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Couldn't read counts: %v", err)
+	}
+	counts := strings.Fields(string(b))
+	tampered := false
+	for i := 1; i < len(counts) && !tampered; i++ {
+		var c int
+		fmt.Sscan(counts[i], &c)
+		if c < -1 {
+			counts[i] = fmt.Sprint(c + 1)
+			tampered = true
+		}
+	}
+	if !tampered {
+		t.Fatalf("No uniform bucket of several reads to tamper with")
+	}
+	f, err = os.Create(archive + ".counts")
+	if err != nil {
+		t.Fatalf("Couldn't rewrite counts: %v", err)
+	}
+	w := gzip.NewWriter(f)
+	w.Comment = z.Comment
+	fmt.Fprintln(w, strings.Join(counts, " "))
+	w.Close()
+	f.Close()
+
+	ar := openArchive(td.refFile, archive)
+	defer ar.Close()
+	it := ar.Reads(newCodingState())
+	for _, ok := it.Next(); ok; _, ok = it.Next() {
+	}
+	if err := ar.checkReadCount(it.n); err == nil {
+		t.Fatalf("%d reads decoded from corrupted counts not caught", it.n)
+	}
+}
+
+// splitGzipMembers() rewrites the gzipped file fn as two concatenated gzip
+// members, each holding half of its contents and its archive id.
+func splitGzipMembers(t *testing.T, fn string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", fn, err)
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't unzip %s: %v", fn, err)
+	}
+	b, err := ioutil.ReadAll(z)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fn, err)
+	}
+
+	var out bytes.Buffer
+	for _, part := range [][]byte{b[:len(b)/2], b[len(b)/2:]} {
+		w := gzip.NewWriter(&out)
+		w.Comment = z.Comment
+		w.Write(part)
+		w.Close()
+	}
+	if err := ioutil.WriteFile(fn, out.Bytes(), 0644); err != nil {
+		t.Fatalf("Couldn't rewrite %s: %v", fn, err)
+	}
+}
+
+func TestConcatenatedSidecars(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 25, 500, 40)
+	defer td.Close()
+
+	archive := td.path("a")
+	encodeArchive(td.refFile, td.readFN, archive)
+	counts, readLen := readBucketCounts(archive + ".counts")
+	flipped := readFlipped(archive+".flipped", 0)
+	ns := readNLocations(archive + ".ns")
+
+	for _, ext := range []string{".counts", ".flipped", ".ns"} {
+		splitGzipMembers(t, archive+ext)
+	}
+	counts2, readLen2 := readBucketCounts(archive + ".counts")
+	if readLen2 != readLen || !reflect.DeepEqual(counts2, counts) {
+		t.Fatalf("Counts read from two gzip members differ")
+	}
+	if !reflect.DeepEqual(readFlipped(archive+".flipped", 0), flipped) {
+		t.Fatalf("Flipped bits read from two gzip members differ")
+	}
+	if !reflect.DeepEqual(readNLocations(archive+".ns"), ns) {
+		t.Fatalf("N locations read from two gzip members differ")
+	}
+
+	decodeArchive(td.refFile, archive, archive+".fa")
+	if !sameReads(readDecodedSeqs(t, archive+".fa"), td.reads) {
+		t.Fatalf("Archive with concatenated sidecars decodes to the wrong reads")
+	}
+}
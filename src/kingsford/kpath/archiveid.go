@@ -0,0 +1,186 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+Each segment of an archive has an archive id, which is written into the
+header of every file of the segment: the segment header of the .enc file,
+and the comment of the gzip header ("kpath archive ID") of the gzipped files.
+The decoder checks that they agree, so that files from two encodes that
+happen to share a basename are not silently decoded together.
+
+The id is a hash of the processed reads (with their orientations and Ns),
+the reference, and the options that decide the buckets, so encoding the same
+reads the same way always gives the same archive.
+*/
+
+const archiveIDLen = 8
+
+// An archiveID identifies the encode that wrote a segment.
+type archiveID [archiveIDLen]byte
+
+func (id archiveID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+const sidecarIDPrefix = "kpath archive "
+
+// sidecarExts are the gzipped files of a segment whose ids are checked.
+var sidecarExts = []string{".bittree", ".counts", ".flipped", ".ns", ".exc", ".ecc", ".runs", ".homo", ".gc", ".order", ".pos", ".idx"}
+
+// newArchiveID() returns the id of a segment holding the given processed
+// reads, encoded against the reference with the given md5 hash. It must be
+// called once bucketK is final and the reads are in the order they are
+// coded, as the buckets depend on both.
+func newArchiveID(reads readStream, refMD5 string) archiveID {
+	h := md5.New()
+	fmt.Fprintf(h, "k %d bucketk %d dups %v runs %v ref %s\n",
+		globalK, bucketK, dupsOption, dupRunsOption, refMD5)
+	DIE_ON_ERR(reads.each(func(r *FastQ) error {
+		flip := byte(0)
+		if r.IsFlipped {
+			flip = 1
+		}
+		h.Write(r.Seq)
+		h.Write([]byte{flip, byte(len(r.NLocations))})
+		h.Write(r.NLocations)
+		if len(r.Exceptions) > 0 {
+			h.Write([]byte{'e', byte(len(r.Exceptions))})
+			h.Write(r.Exceptions)
+		}
+		if len(r.Corrections) > 0 {
+			h.Write([]byte{'c', byte(len(r.Corrections))})
+			h.Write(r.Corrections)
+		}
+		return nil
+	}), "Couldn't read the sorted reads")
+	var id archiveID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// setSidecarID() records the archive id in the header of a gzipped file; it
+// must be called before anything is written to z.
+func setSidecarID(z *gzip.Writer, id archiveID) {
+	z.Comment = sidecarIDPrefix + id.String()
+}
+
+// sidecarID() returns the archive id recorded in the header of a gzipped
+// file, or an error if there is none.
+func sidecarID(z *gzip.Reader) (archiveID, error) {
+	var id archiveID
+	if !strings.HasPrefix(z.Comment, sidecarIDPrefix) {
+		return id, fmt.Errorf("no archive id")
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(z.Comment, sidecarIDPrefix))
+	if err != nil || len(b) != archiveIDLen {
+		return id, fmt.Errorf("bad archive id %q", strings.TrimPrefix(z.Comment, sidecarIDPrefix))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// newSidecarWriter() returns a writer for a sidecar file that writes to w:
+// a gzipper with the archive id in its header, or, with -rawstreams, w
+// itself, so that the file can be read with standard tools. A raw file has
+// no id to check.
+func newSidecarWriter(w io.Writer, id archiveID) (io.WriteCloser, error) {
+	if rawStreamsOption {
+		return nopCloser{w}, nil
+	}
+	z, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	setSidecarID(z, id)
+	return z, nil
+}
+
+// openSidecar() returns a reader for the sidecar file read by r, unzipping
+// it unless it was written raw (see newSidecarWriter()). A gzipped file
+// made by concatenating several gzip members is read through to the end.
+func openSidecar(r io.Reader) (io.ReadCloser, error) {
+	in := bufio.NewReader(r)
+	if !isGzipped(in) {
+		return ioutil.NopCloser(in), nil
+	}
+	z, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	// this is the default, but the readers rely on it
+	z.Multistream(true)
+	return z, nil
+}
+
+// isGzipped() returns true if in starts with the gzip magic number and the
+// deflate method, as every gzipped sidecar does. Of the raw sidecars, only a
+// .flipped file could, if its first 24 reads happened to be flipped just so.
+func isGzipped(in *bufio.Reader) bool {
+	b, err := in.Peek(len(gzipMagic) + 1)
+	return err == nil && bytes.Equal(b[:len(gzipMagic)], gzipMagic) && b[len(gzipMagic)] == 8
+}
+
+// checkSidecarIDs() returns an error if any of the gzipped files of the
+// segment with the given basename was written for an archive other than id.
+// Files that don't exist are skipped: they are either optional, or will be
+// missed when they are read.
+func checkSidecarIDs(base string, id archiveID) error {
+	for _, ext := range sidecarExts {
+		fn := base + ext
+		f, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+		in := bufio.NewReader(f)
+		if !isGzipped(in) {
+			// written with -rawstreams, with no id
+			f.Close()
+			continue
+		}
+		z, err := gzip.NewReader(in)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("couldn't read %s: %v", fn, err)
+		}
+		if !strings.HasPrefix(z.Comment, sidecarIDPrefix) {
+			return fmt.Errorf("%s has no archive id, but the encoded reads have id %v", fn, id)
+		}
+		if got := strings.TrimPrefix(z.Comment, sidecarIDPrefix); got != id.String() {
+			return fmt.Errorf("%s is from archive %s, but the encoded reads are from archive %v",
+				fn, got, id)
+		}
+	}
+	return nil
+}
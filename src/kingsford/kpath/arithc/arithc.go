@@ -66,6 +66,18 @@ type Encoder struct {
 	width            uint64
 	lo               uint64
 	bits_outstanding uint64
+	bits_written     uint64
+	stats            Stats
+}
+
+// Stats counts the work an encoder has done since it was created, for
+// finding distributions that make the coder spend too many bits. Reset()
+// does not clear them.
+type Stats struct {
+	Symbols          uint64 // # of symbols encoded
+	Renormalizations uint64 // # of times the interval was doubled
+	PendingBits      uint64 // # of bits held back until their value was known
+	MaxPending       uint64 // the most bits held back at once
 }
 
 const (
@@ -74,9 +86,14 @@ const (
 	quarterInterval uint64 = 1 << (moffetB - 2)
 )
 
+// MaxTotal is the largest total that Encode() and Decode() can take. The
+// interval is always wider than this, so every symbol of a distribution with
+// such a total still has a range of its own.
+const MaxTotal uint64 = quarterInterval
+
 // NewEncoder() sreates a new arithmetic coder that will output to the given bit writer
 func NewEncoder(bw *bitio.Writer) *Encoder {
-	return &Encoder{bw, halfInterval, 0, 0}
+	return &Encoder{writer: bw, width: halfInterval}
 }
 
 // outputBitPlusFollow() outputs the bits we know for sure at this point
@@ -87,6 +104,7 @@ func (ac *Encoder) outputBitPlusFollow(b byte) error {
 	} else {
 		b = 1
 	}
+	ac.bits_written += 1 + ac.bits_outstanding
 	for ac.bits_outstanding > 0 {
 		ac.writer.WriteBit(b)
 		ac.bits_outstanding--
@@ -94,6 +112,27 @@ func (ac *Encoder) outputBitPlusFollow(b byte) error {
 	return nil
 }
 
+// BitPosition() returns the number of bits the encoder has committed to since
+// it was created or reset: those written to the stream plus those it is
+// holding back until it knows their value. After Finish() it is the exact
+// length of the encoded stream.
+func (ac *Encoder) BitPosition() uint64 {
+	return ac.bits_written + ac.bits_outstanding
+}
+
+// Reset() puts the encoder back into the state NewEncoder() creates, writing
+// to the given bit writer. Finish() should be called before Reset() or the
+// previous stream will be lost. A stream started after Reset() is decoded
+// independently of what came before it (see Decoder.Reset()).
+func (ac *Encoder) Reset(bw *bitio.Writer) {
+	*ac = Encoder{writer: bw, width: halfInterval, stats: ac.stats}
+}
+
+// Stats() returns the counts of the work done by the encoder so far.
+func (ac *Encoder) Stats() Stats {
+	return ac.stats
+}
+
 // renormalize() outputs the known bits and readjust the range
 func (ac *Encoder) renormalize() error {
 	for ac.width <= quarterInterval {
@@ -106,9 +145,14 @@ func (ac *Encoder) renormalize() error {
 		} else {
 			ac.bits_outstanding++
 			ac.lo -= quarterInterval
+			ac.stats.PendingBits++
+			if ac.bits_outstanding > ac.stats.MaxPending {
+				ac.stats.MaxPending = ac.bits_outstanding
+			}
 		}
 		ac.lo <<= 1
 		ac.width <<= 1
+		ac.stats.Renormalizations++
 	}
 	return nil
 }
@@ -120,6 +164,7 @@ func (ac *Encoder) Encode(c, d, total uint64) error {
 	//if d <= c { panic("0-length range in Encode!") }
 
 	// update the range (lo, width)
+	ac.stats.Symbols++
 	r := ac.width / total
 	ac.lo += r * c
 	if d < total {
@@ -148,22 +193,43 @@ func (ac *Encoder) Finish() error {
 type LookupFunc func(uint64) (uint64, uint64, uint64)
 
 type Decoder struct {
-	reader *bitio.Reader
-	inbuf  uint64
-	width  uint64
+	reader    *bitio.Reader
+	inbuf     uint64
+	width     uint64
+	bits_read uint64
 }
 
 // NewDecoder() creates a new decoder to read from a bit stream.
 func NewDecoder(r *bitio.Reader) (*Decoder, error) {
+	ad := &Decoder{}
+	if err := ad.Reset(r); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// Reset() puts the decoder into the state NewDecoder() creates, reading the
+// start of a new stream from r. After the last symbol of a stream has been
+// decoded, the reader is positioned exactly at the end of that stream, so
+// streams written one after another with Encoder.Reset() can be decoded by
+// calling Reset() with the same reader.
+func (ad *Decoder) Reset(r *bitio.Reader) error {
 	var d uint64
 	for i := uint8(1); i <= moffetB; i++ {
 		b, err := r.ReadBit()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		d = (d << 1) + uint64(b)
 	}
-	return &Decoder{r, d, halfInterval}, nil
+	*ad = Decoder{r, d, halfInterval, uint64(moffetB)}
+	return nil
+}
+
+// BitPosition() returns the number of bits read from the stream since the
+// decoder was created or reset.
+func (ad *Decoder) BitPosition() uint64 {
+	return ad.bits_read
 }
 
 // min64() computes the minimum of 2 uint64s.
@@ -198,6 +264,7 @@ func (ad *Decoder) Decode(total uint64, lookup LookupFunc) (uint64, error) {
 		if err != nil || (b != 0 && b != 1) {
 			return 0, err
 		}
+		ad.bits_read++
 		ad.inbuf = (ad.inbuf << 1) + uint64(b)
 	}
 	return symb, nil
@@ -0,0 +1,181 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package arithc
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"kingsford/kpath/bitio"
+)
+
+// a fixed distribution over 4 symbols
+var testDist = [4]uint64{5, 1, 3, 7}
+
+func testInterval(s int) (uint64, uint64, uint64) {
+	var a, total uint64
+	for i, w := range testDist {
+		if i < s {
+			a += w
+		}
+		total += w
+	}
+	return a, a + testDist[s], total
+}
+
+func testLookup(t uint64) (uint64, uint64, uint64) {
+	var sum uint64
+	for i, w := range testDist {
+		if t < sum+w {
+			return sum, sum + w, uint64(i)
+		}
+		sum += w
+	}
+	panic("target out of range")
+}
+
+func randomSymbols(rng *rand.Rand, n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = rng.Intn(len(testDist))
+	}
+	return s
+}
+
+func encodeSymbols(t *testing.T, enc *Encoder, symbs []int) {
+	for _, s := range symbs {
+		a, b, total := testInterval(s)
+		if err := enc.Encode(a, b, total); err != nil {
+			t.Fatalf("Couldn't encode: %v", err)
+		}
+	}
+	enc.Finish()
+}
+
+func decodeSymbols(t *testing.T, dec *Decoder, want []int) {
+	_, _, total := testInterval(0)
+	for i, s := range want {
+		got, err := dec.Decode(total, testLookup)
+		if err != nil {
+			t.Fatalf("Couldn't decode symbol %d: %v", i, err)
+		}
+		if int(got) != s {
+			t.Fatalf("Symbol %d is %d, not %d", i, got, s)
+		}
+	}
+}
+
+// two segments written one after the other to the same stream
+func TestResetSameStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	seg1 := randomSymbols(rng, 1000)
+	seg2 := randomSymbols(rng, 777)
+
+	var buf bytes.Buffer
+	bw := bitio.NewWriter(&buf)
+	enc := NewEncoder(bw)
+	encodeSymbols(t, enc, seg1)
+	len1 := enc.BitPosition()
+	enc.Reset(bw)
+	if enc.BitPosition() != 0 {
+		t.Fatalf("Reset didn't clear the bit position")
+	}
+	encodeSymbols(t, enc, seg2)
+	bw.Close()
+
+	br := bitio.NewReader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	dec, err := NewDecoder(br)
+	if err != nil {
+		t.Fatalf("Couldn't create decoder: %v", err)
+	}
+	decodeSymbols(t, dec, seg1)
+	if dec.BitPosition() != len1 {
+		t.Fatalf("Decoder read %d bits of a %d bit segment", dec.BitPosition(), len1)
+	}
+	if err := dec.Reset(br); err != nil {
+		t.Fatalf("Couldn't reset decoder: %v", err)
+	}
+	decodeSymbols(t, dec, seg2)
+}
+
+// two segments written to different streams by the same encoder
+func TestResetNewStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	segs := [][]int{randomSymbols(rng, 500), randomSymbols(rng, 900)}
+
+	var bufs [2]bytes.Buffer
+	var enc *Encoder
+	for i := range segs {
+		bw := bitio.NewWriter(&bufs[i])
+		if enc == nil {
+			enc = NewEncoder(bw)
+		} else {
+			enc.Reset(bw)
+		}
+		encodeSymbols(t, enc, segs[i])
+		bw.Close()
+	}
+
+	// decode the second one first to make sure they are independent
+	var dec *Decoder
+	for _, i := range []int{1, 0} {
+		br := bitio.NewReader(bufio.NewReader(bytes.NewReader(bufs[i].Bytes())))
+		var err error
+		if dec == nil {
+			dec, err = NewDecoder(br)
+		} else {
+			err = dec.Reset(br)
+		}
+		if err != nil {
+			t.Fatalf("Couldn't start decoding segment %d: %v", i, err)
+		}
+		decodeSymbols(t, dec, segs[i])
+	}
+}
+
+func TestStats(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bitio.NewWriter(&buf)
+	enc := NewEncoder(bw)
+	enc.Finish()
+	if s := enc.Stats(); s != (Stats{}) {
+		t.Fatalf("An empty encode has stats %+v", s)
+	}
+
+	rng := rand.New(rand.NewSource(3))
+	encodeSymbols(t, enc, randomSymbols(rng, 1000))
+	s := enc.Stats()
+	if s.Symbols != 1000 || s.Renormalizations == 0 || s.PendingBits == 0 || s.MaxPending == 0 {
+		t.Fatalf("Encoding 1000 symbols gave stats %+v", s)
+	}
+
+	// each renormalization step writes or holds back one bit, and the
+	// stats carry on past a reset
+	if s.Renormalizations > enc.BitPosition() {
+		t.Fatalf("%d renormalizations but only %d bits", s.Renormalizations, enc.BitPosition())
+	}
+	enc.Reset(bw)
+	if enc.Stats() != s {
+		t.Fatalf("Reset changed the stats from %+v to %+v", s, enc.Stats())
+	}
+}
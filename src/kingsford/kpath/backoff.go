@@ -0,0 +1,194 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxBackoffOrder is the longest context a backoff model keeps counts for;
+// each order o takes 4^o distributions.
+const maxBackoffOrder = 10
+
+// backoffOrders are the lengths of the shorter contexts to back off to,
+// longest first; see setBackoff().
+var backoffOrders []int
+
+// A backoffModel holds the counts of the shorter contexts that a base is
+// coded in when its k-mer context is missing from the model or has been seen
+// fewer than backoffMinOption times (see -backoff): the longest of them that
+// has been seen that often is used. The counts are summed over the contexts of
+// the k-mer model that end with each shorter context, so the encoder and the
+// decoder derive the same counts from the same model, and are updated along
+// with the model by -update. Which context codes a base depends only on these
+// counts and the model, which the decoder has before it decodes the base, so
+// unlike PPM no escape has to be coded to say how far it backed off.
+type backoffModel struct {
+	masks []Kmer                    // keep the last orders[i] bases of a context
+	dists [][][len(ALPHA)]KmerCount // dists[i] is indexed by a context of orders[i]
+}
+
+// parseBackoffOrders() parses the comma separated list of context lengths
+// given to -backoff. They must be shorter than k and be given longest first.
+func parseBackoffOrders(s string, k int) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	longest := k - 1
+	if longest > maxBackoffOrder {
+		longest = maxBackoffOrder
+	}
+	var orders []int
+	for _, f := range strings.Split(s, ",") {
+		o, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad context length %q", f)
+		}
+		if o < 1 || o > longest {
+			return nil, fmt.Errorf("context length %d must be between 1 and %d", o, longest)
+		}
+		if len(orders) > 0 && o >= orders[len(orders)-1] {
+			return nil, fmt.Errorf("context lengths must be given longest first")
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+// setBackoff() sets the shorter contexts the coder backs off to, as given to
+// -backoff ("" to code as if there were none).
+func setBackoff(s string) error {
+	orders, err := parseBackoffOrders(s, globalK)
+	if err != nil {
+		return err
+	}
+	backoffOrders = orders
+	return nil
+}
+
+// setArchiveBackoff() sets the shorter contexts, and the observations a
+// context needs, that the archive with the given metadata was coded with.
+func setArchiveBackoff(meta *ArchiveMeta) error {
+	if meta.Backoff != "" {
+		backoffMinOption = meta.BackoffMin
+	}
+	return setBackoff(meta.Backoff)
+}
+
+// newBackoffModel() sums the counts of km into distributions for the shorter
+// contexts orders. A context of order o is the last o bases of the (seeded)
+// k-mer contexts of the model. The sums are scaled down, keeping their
+// proportions, so that none is more than MAX_OBSERVATION-1.
+func newBackoffModel(km KmerModel, orders []int) *backoffModel {
+	bm := &backoffModel{masks: make([]Kmer, len(orders)), dists: make([][][len(ALPHA)]KmerCount, len(orders))}
+	sums := make([][][len(ALPHA)]uint64, len(orders))
+	for i, o := range orders {
+		bm.masks[i] = kmerMask(o)
+		sums[i] = make([][len(ALPHA)]uint64, 1<<uint(2*o))
+	}
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		for i, mask := range bm.masks {
+			s := &sums[i][k&mask]
+			for c, n := range dist {
+				s[c] += uint64(n)
+			}
+		}
+	})
+	for i := range sums {
+		bm.dists[i] = make([][len(ALPHA)]KmerCount, len(sums[i]))
+		for j, s := range sums[i] {
+			most := uint64(0)
+			for _, n := range s {
+				if n > most {
+					most = n
+				}
+			}
+			for c, n := range s {
+				if most > MAX_OBSERVATION-1 {
+					n = n * (MAX_OBSERVATION - 1) / most
+				}
+				bm.dists[i][j][c] = KmerCount(n)
+			}
+		}
+	}
+	return bm
+}
+
+// observations() returns the number of times the context with the given
+// distribution has been seen.
+func observations(dist [len(ALPHA)]KmerCount) uint64 {
+	n := uint64(0)
+	for _, c := range dist {
+		n += uint64(c)
+	}
+	return n
+}
+
+// find() returns the distribution of the longest of the shorter contexts of
+// the (seeded) k-mer context that has been seen at least backoffMinOption
+// times, or false if none has.
+func (bm *backoffModel) find(context Kmer) ([len(ALPHA)]KmerCount, bool) {
+	for i, mask := range bm.masks {
+		if dist := bm.dists[i][context&mask]; observations(dist) >= uint64(backoffMinOption) {
+			return dist, true
+		}
+	}
+	return [len(ALPHA)]KmerCount{}, false
+}
+
+// update() counts base c after each of the shorter contexts of the (seeded)
+// k-mer context. A distribution that would go past MAX_OBSERVATION-1 is
+// halved first, so that it keeps adapting.
+func (bm *backoffModel) update(context Kmer, c byte) {
+	for i, mask := range bm.masks {
+		d := &bm.dists[i][context&mask]
+		if d[c] >= MAX_OBSERVATION-1 {
+			for j := range d {
+				d[j] /= 2
+			}
+		}
+		d[c]++
+	}
+}
+
+// backoffFor() returns the distribution a base after the (seeded) context
+// is coded in if the coder backs off from the k-mer context, whose
+// distribution in km is dist if it exists; it returns false if the base is
+// coded as without -backoff, in the k-mer context if km has it and otherwise
+// in the default distribution. The backoff model of st is made from km the
+// first time it is needed, which is before km is first updated.
+func backoffFor(st *codingState, km KmerModel, context Kmer, exists bool, dist [len(ALPHA)]KmerCount) ([len(ALPHA)]KmerCount, bool) {
+	if len(backoffOrders) == 0 || (exists && observations(dist) >= uint64(backoffMinOption)) {
+		return dist, false
+	}
+	return st.backoffModel(km).find(context)
+}
+
+// backoffModel() returns the backoff model of the stream, making it from km
+// if it has none yet.
+func (st *codingState) backoffModel(km KmerModel) *backoffModel {
+	if st.backoff == nil {
+		st.backoff = newBackoffModel(km, backoffOrders)
+	}
+	return st.backoff
+}
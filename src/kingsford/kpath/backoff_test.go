@@ -0,0 +1,145 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// markovSequence() returns a sequence of length n from a random chain in
+// which each base depends on the 3 before it, strongly enough that short
+// contexts predict it.
+func markovSequence(rng *rand.Rand, table [][len(ALPHA)]int, n int) string {
+	s := make([]byte, n)
+	ctx := 0
+	for i := range s {
+		w := table[ctx]
+		x := rng.Intn(w[0] + w[1] + w[2] + w[3])
+		c := 0
+		for x >= w[c] {
+			x -= w[c]
+			c++
+		}
+		s[i] = ALPHA[c]
+		ctx = (ctx<<2 | c) & 63
+	}
+	return string(s)
+}
+
+func TestParseBackoffOrders(t *testing.T) {
+	if orders, err := parseBackoffOrders("10,6,2", 16); err != nil || len(orders) != 3 || orders[1] != 6 {
+		t.Fatalf("Orders are %v (%v)", orders, err)
+	}
+	if orders, err := parseBackoffOrders("", 16); err != nil || orders != nil {
+		t.Fatalf("No orders are %v (%v)", orders, err)
+	}
+	for _, bad := range []string{"6,10", "8", "0", "11", "x", "6,6"} {
+		if _, err := parseBackoffOrders(bad, 8); err == nil {
+			t.Fatalf("Orders %q accepted with k = 8", bad)
+		}
+	}
+}
+
+func TestBackoffModel(t *testing.T) {
+	setTestOptions(4)
+	km := countKmersInReference(4, []string{"ACGTACGTACGTACGTAAAAA"})
+	bm := newBackoffModel(km, []int{2, 1})
+
+	// GT is followed by A four times; T by A four times too
+	backoffMinOption = 1
+	dist, ok := bm.find(stringToKmer("CCGT"))
+	if !ok || dist[0] == 0 || dist[1]+dist[2]+dist[3] != 0 {
+		t.Fatalf("Context GT has %v (%v)", dist, ok)
+	}
+	// TT is never seen, so T is used
+	if dist, ok = bm.find(stringToKmer("CCTT")); !ok || dist[0] == 0 {
+		t.Fatalf("Context TT backed off to %v (%v)", dist, ok)
+	}
+	backoffMinOption = 1000
+	if _, ok := bm.find(stringToKmer("CCGT")); ok {
+		t.Fatalf("Context seen too rarely was used")
+	}
+
+	// counts that would overflow are halved
+	backoffMinOption = 1
+	d := &bm.dists[1][stringToKmer("T")]
+	d[0], d[1] = MAX_OBSERVATION-1, 6
+	bm.update(stringToKmer("T"), 0)
+	if d[0] != (MAX_OBSERVATION-1)/2+1 || d[1] != 3 {
+		t.Fatalf("Full distribution updated to %v", d)
+	}
+}
+
+func TestBackoffRoundTrip(t *testing.T) {
+	setTestOptions(12)
+	td := newTestData(t, 36, 1, 60)
+	defer td.Close()
+
+	// the reads come from a sequence the reference doesn't have, but from
+	// the same chain, so its short contexts predict them
+	rng := rand.New(rand.NewSource(36))
+	table := make([][len(ALPHA)]int, 64)
+	for i := range table {
+		for c := range table[i] {
+			table[i][c] = 1 + rng.Intn(4)
+		}
+		table[i][rng.Intn(len(ALPHA))] += 20
+	}
+	ref := []string{markovSequence(rng, table, 20000)}
+	writeTestReference(t, td.refFile, ref)
+	reads := sampleReads(rng, []string{markovSequence(rng, table, 20000)}, 2000, 60, 0.01)
+	writeTestReads(t, td.readFN, reads)
+
+	sizes := make(map[string]int64)
+	for _, update := range []bool{true, false} {
+		for _, backoff := range []string{"", "6,3"} {
+			setTestOptions(12)
+			updateReference = update
+			backoffOption = backoff
+			out := td.path("backoff" + strings.Replace(backoff, ",", "-", -1))
+			encodeArchive(td.refFile, td.readFN, out)
+			meta := loadArchiveMeta(out + ".meta")
+			if meta.Backoff != backoff || (backoff != "" && meta.BackoffMin != 2) {
+				t.Fatalf("Recorded -backoff=%q -backoffmin=%d, not %q", meta.Backoff, meta.BackoffMin, backoff)
+			}
+
+			// decoding takes the orders from the archive
+			backoffOption = ""
+			decodeArchive(td.refFile, out, out+".fa")
+			if !sameReads(readDecodedSeqs(t, out+".fa"), reads) {
+				t.Fatalf("Decoded reads differ with -backoff=%s -update=%v", backoff, update)
+			}
+			fi, err := os.Stat(out + ".enc")
+			if err != nil {
+				t.Fatalf("Couldn't stat %s: %v", out+".enc", err)
+			}
+			sizes[backoff] = fi.Size()
+		}
+		t.Logf("Encoded tails with -update=%v: %d bytes at k=12, %d backing off to 6,3",
+			update, sizes[""], sizes["6,3"])
+		if sizes["6,3"] >= sizes[""] {
+			t.Fatalf("Backing off made the tails no smaller (-update=%v)", update)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// bgzfBlockBytes() compresses data as a single bgzf block: a gzip member
+// whose extra field holds the "BC" subfield giving the block size.
+func bgzfBlockBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	bsize := 0
+	// the compressed size doesn't depend on the value of BSIZE, so compress
+	// once to find it and again to record it
+	for pass := 0; pass < 2; pass++ {
+		buf.Reset()
+		z := gzip.NewWriter(&buf)
+		z.Header.Extra = []byte{'B', 'C', 2, 0, byte(bsize), byte(bsize >> 8)}
+		if _, err := z.Write(data); err != nil {
+			t.Fatalf("Couldn't compress block: %v", err)
+		}
+		z.Close()
+		bsize = buf.Len() - 1
+	}
+	return buf.Bytes()
+}
+
+// writeTestBGZFReference() writes the sequences as a bgzf multifasta file with
+// small blocks. A bgzf file (as made by bgzip) is a series of gzip members of
+// at most 64KB of uncompressed data each, so it is also a valid gzip file.
+func writeTestBGZFReference(t *testing.T, fn string, seqs []string, blockSize int) {
+	var text bytes.Buffer
+	for i, s := range seqs {
+		fmt.Fprintf(&text, ">seq%d\n", i)
+		for len(s) > 60 {
+			fmt.Fprintf(&text, "%s\n", s[:60])
+			s = s[60:]
+		}
+		fmt.Fprintf(&text, "%s\n", s)
+	}
+
+	var out bytes.Buffer
+	data := text.Bytes()
+	for u := 0; u < len(data); u += blockSize {
+		end := u + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		out.Write(bgzfBlockBytes(t, data[u:end]))
+	}
+	// bgzip ends every file with an empty block
+	out.Write(bgzfBlockBytes(t, nil))
+
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %v", fn, err)
+	}
+	f.Write(out.Bytes())
+	f.Close()
+}
+
+func TestBGZFReference(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 10, 10, 40)
+	defer td.Close()
+
+	rng := rand.New(rand.NewSource(11))
+	seqs := []string{
+		randomSequence(rng, 3000),
+		randomSequence(rng, 2000),
+		randomSequence(rng, 1000),
+	}
+	writeTestReference(t, td.path("ref.fa.gz"), seqs)
+	writeTestBGZFReference(t, td.path("ref.fa.bgz"), seqs, 1000)
+
+	// read sequentially, bgzf must give the same model as plain gzip
+	km1 := countKmersInReference(8, readReferenceFile(td.path("ref.fa.gz")))
+	km2 := countKmersInReference(8, readReferenceFile(td.path("ref.fa.bgz")))
+	n := 0
+	km1.Iterate(func(k Kmer, d1 [len(ALPHA)]KmerCount) {
+		if _, d2 := km2.Distribution(k); d1 != d2 {
+			t.Fatalf("Models differ at %s: %v != %v", kmerToString(k, 8), d1, d2)
+		}
+		n++
+	})
+	m := 0
+	km2.Iterate(func(k Kmer, d [len(ALPHA)]KmerCount) { m++ })
+	if n == 0 || n != m {
+		t.Fatalf("Models have %d and %d contexts", n, m)
+	}
+}
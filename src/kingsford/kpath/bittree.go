@@ -24,6 +24,7 @@ import (
 	"bufio"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -40,6 +41,10 @@ Write out the kmer code using a pre-order traversal:
 // ALPHA is the alphabet we are working over. Some code assumes it is ACGT.
 const ALPHA string = "ACGT"
 
+// bitTreeBuffer is the number of bits (or kmers) that can be waiting between
+// the stages that read or write a bittree; it only has to keep them busy.
+const bitTreeBuffer = 1 << 16
+
 // children() computes the children of the given kmer "node" in the kmer list.
 func children(kmers []string, start, end, depth int) [len(ALPHA)][2]int {
 	var p [len(ALPHA)][2]int
@@ -105,8 +110,11 @@ func traverseToBitTree(kmers []string, bits chan<- byte) {
 
 // decodeBitTree() reads bits from the given channel and outputs kmers on the
 // output channel that were stored in the bittree. The output kmers are in no
-// particular order.
-func decodeBitTree(bits <-chan byte, k int, out chan<- string) {
+// particular order. It closes the output channel when done, and returns an
+// error if the bits run out before the tree is complete.
+func decodeBitTree(bits <-chan byte, k int, out chan<- string) error {
+	defer close(out)
+
 	// stack starts with the root string
 	stack := make([]string, 0)
 	stack = append(stack, "")
@@ -117,8 +125,12 @@ func decodeBitTree(bits <-chan byte, k int, out chan<- string) {
 		cur := stack[len(stack)-1]
 		stack = stack[:len(stack)-1]
 
+		bit, ok := <-bits
+		if !ok {
+			return fmt.Errorf("bittree ends after %d bits, before the tree is complete", bitsread)
+		}
 		bitsread++
-		if <-bits != 0 {
+		if bit != 0 {
 			if len(cur) == k {
 				out <- cur
 			} else {
@@ -129,14 +141,14 @@ func decodeBitTree(bits <-chan byte, k int, out chan<- string) {
 		}
 	}
 	log.Printf("Processed %v bits", bitsread)
-	close(out)
+	return nil
 }
 
 // given a list of kmers, encode them to a file using the bittree scheme. The
 // kmers must be sorted and they must be unique.
 func encodeKmersToFile(kmers []string, out *bitio.Writer) {
 	log.Printf("Encoding %v kmers to bittree file...", len(kmers))
-	bits := make(chan byte, 1000000)
+	bits := make(chan byte, bitTreeBuffer)
 	go traverseToBitTree(kmers, bits)
 
 	count := 0
@@ -166,32 +178,67 @@ func readBits(in *bitio.Reader, bits chan<- byte) {
 // stored kmers.
 func decodeKmersFromFile(filename string, k int) []string {
 	log.Printf("Decoding kmer buckets from %v", filename)
-	// open the file and wrap a bit reader around it
 	bittree, err := os.Open(filename)
 	DIE_ON_ERR(err, "Couldn't open bitree file %s", filename)
 	defer bittree.Close()
 
-	bittreeZ, err := gzip.NewReader(bittree)
-	DIE_ON_ERR(err, "Couldn't create gzipper")
+	kmers, err := readKmers(bittree, k)
+	DIE_ON_ERR(err, "Couldn't decode bittree file %s", filename)
+	log.Printf("done; found %v kmers", len(kmers))
+	return kmers
+}
+
+// readKmers() extracts the kmers stored in the gzipped bittree read from r. It
+// returns an error if the bittree is truncated, or has more than the padding
+// of its last byte left over once the tree is complete.
+func readKmers(r io.Reader, k int) ([]string, error) {
+	bittreeZ, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
 	defer bittreeZ.Close()
 
 	in := bitio.NewReader(bufio.NewReader(bittreeZ))
 	defer in.Close()
 
 	// start a routine to produce the bits
-	bits := make(chan byte, 1000000)
+	bits := make(chan byte, bitTreeBuffer)
 	go readBits(in, bits)
 
 	// make a channel to get the output
-	out := make(chan string, 1000000)
+	out := make(chan string, bitTreeBuffer)
 
 	// decode and pass the input to the decoded output
-	go decodeBitTree(bits, k, out)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- decodeBitTree(bits, k, out)
+	}()
 
 	kmers := make([]string, 0)
 	for s := range out {
 		kmers = append(kmers, s)
 	}
-	log.Printf("done; found %v kmers", len(kmers))
-	return kmers
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	// only the zero bits padding out the last byte should be left
+	extra, ones := 0, 0
+	for b := range bits {
+		extra++
+		ones += int(b)
+	}
+	if extra >= 8 || ones > 0 {
+		return nil, fmt.Errorf("bittree has %d bits past the end of the tree", extra)
+	}
+	return kmers, nil
+}
+
+// checkBucketCounts() returns an error unless there is one count for each
+// bucket.
+func checkBucketCounts(kmers []string, counts []int) error {
+	if len(kmers) != len(counts) {
+		return fmt.Errorf("bittree has %d buckets but the counts list %d", len(kmers), len(counts))
+	}
+	return nil
 }
@@ -1,5 +1,10 @@
 package main
 
+import (
+    "math/bits"
+    "sync/atomic"
+)
+
 type BitVec struct {
     length uint64
     data []uint64
@@ -22,6 +27,12 @@ func (bv *BitVec) SetOn(i uint64) {
     bv.data[i/64] |= (1 << (i%64))
 }
 
+// SetOnAtomic() sets bit i like SetOn(), but is safe to call from several
+// goroutines at once.
+func (bv *BitVec) SetOnAtomic(i uint64) {
+    atomic.OrUint64(&bv.data[i/64], 1 << (i%64))
+}
+
 
 func (bv *BitVec) Set(i uint64, b bool) {
     word := i / 64
@@ -32,3 +43,12 @@ func (bv *BitVec) Set(i uint64, b bool) {
         bv.data[word] &= ^(1 << bit)
     }
 }
+
+// Count() returns the number of bits that are on.
+func (bv *BitVec) Count() uint64 {
+    n := 0
+    for _, w := range bv.data {
+        n += bits.OnesCount64(w)
+    }
+    return uint64(n)
+}
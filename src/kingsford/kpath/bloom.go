@@ -0,0 +1,121 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"log"
+	"math"
+)
+
+// A BitSet is a set of kmers, given by their values. A BitVec holds every
+// kmer exactly; a BloomBits holds them in less space but sometimes says a
+// kmer is in the set when it isn't.
+type BitSet interface {
+	Get(i uint64) bool
+	SetOn(i uint64)
+	SetOnAtomic(i uint64)
+	Count() uint64
+}
+
+// bloomHashes is the number of bits a BloomBits sets for each kmer. With
+// about 8 bits per kmer, 4 gives a false positive rate of about 2.4%; more
+// bits per kmer give fewer.
+const bloomHashes = 4
+
+// A BloomBits is a Bloom filter: each kmer sets bloomHashes bits of a BitVec
+// chosen by hashing it. It never says a kmer that was set isn't in the set.
+type BloomBits struct {
+	bv   *BitVec
+	bits uint64
+}
+
+// NewBloomBits() returns an empty Bloom filter of the given number of bits.
+func NewBloomBits(bits uint64) *BloomBits {
+	return &BloomBits{NewBitVec(bits), bits}
+}
+
+// mix64() scrambles the bits of x (the finalizer of splitmix64), so that
+// kmers that differ in a few bits get unrelated hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// bloomBit() returns the bit set by the j'th hash of kmer i, by double
+// hashing: h1 + j*h2.
+func (b *BloomBits) bloomBit(i uint64, j int) uint64 {
+	h := mix64(i)
+	h1, h2 := h&0xffffffff, h>>32|1
+	return (h1 + uint64(j)*h2) % b.bits
+}
+
+func (b *BloomBits) Get(i uint64) bool {
+	for j := 0; j < bloomHashes; j++ {
+		if !b.bv.Get(b.bloomBit(i, j)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BloomBits) SetOn(i uint64) {
+	for j := 0; j < bloomHashes; j++ {
+		b.bv.SetOn(b.bloomBit(i, j))
+	}
+}
+
+// SetOnAtomic() sets kmer i like SetOn(), but is safe to call from several
+// goroutines at once.
+func (b *BloomBits) SetOnAtomic(i uint64) {
+	for j := 0; j < bloomHashes; j++ {
+		b.bv.SetOnAtomic(b.bloomBit(i, j))
+	}
+}
+
+// Count() returns an estimate of the number of kmers set, from the fraction
+// of the bits that are on.
+func (b *BloomBits) Count() uint64 {
+	on := b.bv.Count()
+	if on >= b.bits {
+		return b.bits
+	}
+	m := float64(b.bits)
+	return uint64(-m / bloomHashes * math.Log(1-float64(on)/m))
+}
+
+// newKmerBits() returns an empty set for the kmers of length k: a BitVec
+// with a bit for every kmer if that takes at most bvBitsOption bits, and
+// otherwise a BloomBits of bvBitsOption bits. Only the flip set may be a
+// BloomBits, since a kmer it wrongly holds only sways which way a read is
+// stored, and the .flipped file records that.
+func newKmerBits(k int) BitSet {
+	all := uint64(1) << (2 * uint(k))
+	if all <= bvBitsOption {
+		return NewBitVec(all)
+	}
+	log.Printf("A bit for each of the %d %d-mers would take more than -bvbits=%d bits; "+
+		"using a Bloom filter instead", all, k, bvBitsOption)
+	return NewBloomBits(bvBitsOption)
+}
@@ -0,0 +1,123 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBloomBits(t *testing.T) {
+	// about 8 bits per kmer
+	const n = 4000
+	rng := rand.New(rand.NewSource(60))
+	b := NewBloomBits(8 * n)
+	set := make(map[uint64]bool)
+	for len(set) < n {
+		i := uint64(rng.Uint32())
+		set[i] = true
+		b.SetOn(i)
+	}
+	for i := range set {
+		if !b.Get(i) {
+			t.Fatalf("Kmer %d was set but isn't in the filter", i)
+		}
+	}
+	fp := 0
+	for tried := 0; tried < 10000; {
+		i := uint64(rng.Uint32())
+		if set[i] {
+			continue
+		}
+		tried++
+		if b.Get(i) {
+			fp++
+		}
+	}
+	if fp > 500 {
+		t.Fatalf("%d false positives in 10000, more than 5%%", fp)
+	}
+	if c := b.Count(); c < n*9/10 || c > n*11/10 {
+		t.Fatalf("Estimated %d kmers in a filter of %d", c, n)
+	}
+}
+
+func TestBloomFlip(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 61, 2000, 60)
+	defer td.Close()
+	seqs := readReferenceFile(td.refFile)
+
+	// half of the reads come from the other strand
+	rng := rand.New(rand.NewSource(61))
+	reads := make([]string, len(td.reads))
+	for i, r := range td.reads {
+		reads[i] = r
+		if rng.Intn(2) == 0 {
+			reads[i] = reverseComplement(r)
+		}
+	}
+	flips := func() []bool {
+		ks := kmerSetFromReference(8, seqs)
+		block := make([]*FastQ, len(reads))
+		for i, r := range reads {
+			block[i] = NewFastQ([]byte(r), nil)
+		}
+		flipRange(block, ks)
+		flipped := make([]bool, len(block))
+		for i, fq := range block {
+			flipped[i] = string(fq.Seq) != reads[i]
+		}
+		return flipped
+	}
+	exact := flips()
+
+	// with a bit for every 8-mer there is no filter; with a budget of 8
+	// bits for each kmer of the reference the filter flips nearly all the
+	// same reads
+	bvBitsOption = 1 << 16
+	if _, ok := kmerSetFromReference(8, seqs).bv.(*BitVec); !ok {
+		t.Fatalf("A budget of a bit per kmer didn't give a BitVec")
+	}
+	bvBitsOption = 8 * uint64(len(seqs[0]))
+	if _, ok := kmerSetFromReference(8, seqs).bv.(*BloomBits); !ok {
+		t.Fatalf("A small budget didn't give a Bloom filter")
+	}
+	bloom := flips()
+	differ := 0
+	for i := range exact {
+		if exact[i] != bloom[i] {
+			differ++
+		}
+	}
+	t.Logf("%d of %d reads flipped differently with a Bloom filter", differ, len(exact))
+	if differ > len(exact)/50 {
+		t.Fatalf("%d of %d reads flipped differently with a Bloom filter", differ, len(exact))
+	}
+
+	// the archive still decodes to the reads, as the flips are recorded
+	writeTestReads(t, td.readFN, reads)
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("out.fa"))
+	if got := readDecodedSeqs(t, td.path("out.fa")); !sameReads(got, reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads with a Bloom filter")
+	}
+}
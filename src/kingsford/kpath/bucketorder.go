@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+The buckets are normally coded in the sorted order of their prefixes, so the
+first contexts of consecutive buckets have little to do with each other and
+each bucket starts its tails with a cold cache. With -bucketorder=walk the
+buckets are instead coded in the order of a walk along the model: starting at
+the first bucket not yet coded, the walk follows the most likely next base,
+from the contexts the tails of the bucket are coded in, and codes the first
+bucket it meets that has not been coded yet. The tails of consecutive buckets
+then share many of their contexts.
+
+The order depends only on the bucket prefixes and the model before any reads
+are coded, so the decoder rebuilds it from the buckets in the .bittree and
+the model. The .bittree and .counts files keep the sorted order, so the
+buckets and their counts can still be read without the model; everything
+else (the tails, .flipped, .ns, .runs and the others) is in the coding order.
+*/
+
+// checkBucketOrder() returns an error if order is not a known value of
+// -bucketorder.
+func checkBucketOrder(order string) error {
+	if order != "prefix" && order != "walk" {
+		return fmt.Errorf("-bucketorder must be prefix or walk, not %q", order)
+	}
+	return nil
+}
+
+// bucketOrderFor() returns the order the buckets of the archive with the
+// given metadata were coded in.
+func bucketOrderFor(meta *ArchiveMeta) string {
+	if meta.BucketOrder != "" {
+		return meta.BucketOrder
+	}
+	return "prefix"
+}
+
+// walkBucketOrder() returns the order to code the buckets in with
+// -bucketorder=walk: the ith bucket coded is buckets[order[i]]. The buckets
+// must be sorted and all of the same length. Each walk takes at most steps
+// bases, the length of the tails, and stops early at a context the model has
+// never seen.
+func walkBucketOrder(buckets []string, km KmerModel, steps int) []int {
+	if len(buckets) == 0 {
+		return nil
+	}
+	index := make(map[Kmer]int, len(buckets))
+	for b, s := range buckets {
+		index[stringToKmer(s)] = b
+	}
+	mask := kmerMask(len(buckets[0]))
+	visited := make([]bool, len(buckets))
+	order := make([]int, 0, len(buckets))
+	for start := range buckets {
+		if visited[start] {
+			continue
+		}
+		for b := start; b >= 0; {
+			visited[b] = true
+			order = append(order, b)
+			ctx := stringToKmer(buckets[b])
+			b = -1
+			for i := 0; i < steps && b < 0; i++ {
+				next, ok := likeliestBase(km, ctx)
+				if !ok {
+					break
+				}
+				ctx = shiftKmer(ctx, next)
+				if n, found := index[ctx&mask]; found && !visited[n] {
+					b = n
+				}
+			}
+		}
+	}
+	return order
+}
+
+// likeliestBase() returns the base the model gives the highest count after
+// the context ctx (the first, if there is a tie), and false if the model has
+// no counts for it.
+func likeliestBase(km KmerModel, ctx Kmer) (byte, bool) {
+	exists, dist := km.Distribution(seedContext(ctx))
+	if !exists {
+		return 0, false
+	}
+	best := 0
+	for c := 1; c < len(dist); c++ {
+		if dist[c] > dist[best] {
+			best = c
+		}
+	}
+	return byte(best), dist[best] > 0
+}
+
+// orderReadsByBuckets() returns the sorted reads with their buckets in the
+// order given by walkBucketOrder(); the reads of each bucket keep their
+// order.
+func orderReadsByBuckets(reads []*FastQ, km KmerModel, steps int) []*FastQ {
+	var buckets []string
+	var starts []int
+	for i, r := range reads {
+		if i == 0 || string(r.Seq[:bucketK]) != buckets[len(buckets)-1] {
+			buckets = append(buckets, string(r.Seq[:bucketK]))
+			starts = append(starts, i)
+		}
+	}
+	starts = append(starts, len(reads))
+
+	ordered := make([]*FastQ, 0, len(reads))
+	for _, b := range walkBucketOrder(buckets, km, steps) {
+		ordered = append(ordered, reads[starts[b]:starts[b+1]]...)
+	}
+	return ordered
+}
+
+// sortedBuckets() returns the buckets, in coding order, and their counts in
+// the sorted order of the buckets, as the .bittree and .counts files keep
+// them.
+func sortedBuckets(buckets []string, counts []int) ([]string, []int) {
+	perm := make([]int, len(buckets))
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.Slice(perm, func(i, j int) bool { return buckets[perm[i]] < buckets[perm[j]] })
+	sorted := make([]string, len(buckets))
+	sortedCounts := make([]int, len(counts))
+	for i, b := range perm {
+		sorted[i] = buckets[b]
+		sortedCounts[i] = counts[b]
+	}
+	return sorted, sortedCounts
+}
+
+// codingOrder() returns the sorted buckets and their counts, as read from the
+// .bittree and .counts files, in the order they were coded in, which for
+// -bucketorder=walk is rebuilt with the model km from before any reads were
+// coded (see walkBucketOrder()).
+func codingOrder(order string, buckets []string, counts []int, km KmerModel, steps int) ([]string, []int) {
+	if order != "walk" {
+		return buckets, counts
+	}
+	coded := make([]string, len(buckets))
+	codedCounts := make([]int, len(counts))
+	for i, b := range walkBucketOrder(buckets, km, steps) {
+		coded[i] = buckets[b]
+		codedCounts[i] = counts[b]
+	}
+	return coded, codedCounts
+}
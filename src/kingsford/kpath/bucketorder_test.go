@@ -0,0 +1,346 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalkBucketOrder(t *testing.T) {
+	setTestOptions(10)
+	bucketK = 10
+	rng := rand.New(rand.NewSource(67))
+	ref := randomSequence(rng, 200)
+	km := countKmersInReference(10, []string{ref})
+
+	// buckets every 5 bases along the reference, with tails of 5 bases, so
+	// the walk from each bucket meets the next one just as its tail ends
+	pos := make(map[string]int)
+	buckets := make([]string, 0)
+	for p := 0; p+10 <= len(ref); p += 5 {
+		pos[ref[p:p+10]] = p
+		buckets = append(buckets, ref[p:p+10])
+	}
+	sort.Strings(buckets)
+
+	order := walkBucketOrder(buckets, km, 5)
+	seen := make(map[int]bool)
+	for _, b := range order {
+		if seen[b] {
+			t.Fatalf("Bucket %d is in the order twice", b)
+		}
+		seen[b] = true
+	}
+	if len(order) != len(buckets) {
+		t.Fatalf("The order has %d of the %d buckets", len(order), len(buckets))
+	}
+
+	// the first walk starts at the first bucket and follows the reference
+	// to its end
+	for i, p := 0, pos[buckets[0]]; p+10 <= len(ref); i, p = i+1, p+5 {
+		if got := pos[buckets[order[i]]]; got != p {
+			t.Fatalf("Bucket %d of the walk is at %d in the reference, not %d", i, got, p)
+		}
+	}
+
+	// the sorted order of the .bittree and .counts files goes back to the
+	// coding order
+	counts := make([]int, len(buckets))
+	for b := range counts {
+		counts[b] = b + 1
+	}
+	coded, codedCounts := codingOrder("walk", buckets, counts, km, 5)
+	sorted, sortedCounts := sortedBuckets(coded, codedCounts)
+	for b := range buckets {
+		if coded[b] != buckets[order[b]] || codedCounts[b] != order[b]+1 {
+			t.Fatalf("Bucket %d is coded as %s (%d), not %s", b, coded[b], codedCounts[b], buckets[order[b]])
+		}
+		if sorted[b] != buckets[b] || sortedCounts[b] != counts[b] {
+			t.Fatalf("Bucket %d is sorted as %s (%d), not %s", b, sorted[b], sortedCounts[b], buckets[b])
+		}
+	}
+	if coded, _ := codingOrder("prefix", buckets, counts, nil, 5); strings.Join(coded, " ") != strings.Join(buckets, " ") {
+		t.Fatalf("-bucketorder=prefix doesn't keep the sorted order")
+	}
+}
+
+func TestBucketOrderRoundTrip(t *testing.T) {
+	setTestOptions(12)
+	td := newTestData(t, 71, 2000, 60)
+	defer td.Close()
+
+	configs := []struct {
+		name string
+		set  func()
+	}{
+		{"plain", func() {}},
+		{"runs", func() {
+			dupsOption = false
+			dupRunsOption = true
+		}},
+		{"keeporder", func() { keepOrderOption = true }},
+		{"index", func() {
+			updateReference = false
+			indexBlockBuckets = 5
+		}},
+		{"noflip", func() { flipReadsOption = false }},
+	}
+	for _, c := range configs {
+		prefix, walk := td.path(c.name+".prefix"), td.path(c.name+".walk")
+		setTestOptions(12)
+		c.set()
+		encodeArchive(td.refFile, td.readFN, prefix)
+		setTestOptions(12)
+		c.set()
+		bucketOrderOption = "walk"
+		encodeArchive(td.refFile, td.readFN, walk)
+		if meta := loadArchiveMeta(walk + ".meta"); meta.BucketOrder != "walk" {
+			t.Fatalf("%s: the archive records the bucket order %q, not walk", c.name, meta.BucketOrder)
+		}
+
+		// the buckets and counts are stored in sorted order either way
+		if got, want := decodeKmersFromFile(walk+".bittree", 12), decodeKmersFromFile(prefix+".bittree", 12); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("%s: the walk order changed the bittree", c.name)
+		}
+		got, _ := readBucketCounts(walk + ".counts")
+		want, _ := readBucketCounts(prefix + ".counts")
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: the walk order changed the counts", c.name)
+		}
+
+		// the decoder doesn't need -bucketorder, and the reads are the same
+		for _, out := range []string{prefix, walk} {
+			setTestOptions(12)
+			c.set()
+			decodeArchive(td.refFile, out, out+".fa")
+		}
+		walkReads := readDecodedSeqs(t, walk+".fa")
+		prefixReads := readDecodedSeqs(t, prefix+".fa")
+		if !sameReads(walkReads, td.reads) {
+			t.Fatalf("%s: decoded reads differ from the encoded reads", c.name)
+		}
+		same := strings.Join(walkReads, " ") == strings.Join(prefixReads, " ")
+		if c.name == "keeporder" && !same {
+			t.Fatalf("%s: the walk order changed the reads decoded in input order", c.name)
+		} else if c.name != "keeporder" && same {
+			t.Fatalf("%s: the walk order decoded the reads in the sorted order", c.name)
+		}
+
+		if c.name == "noflip" {
+			setTestOptions(12)
+			c.set()
+			prefixOnlyOption = true
+			decodeArchive(td.refFile, walk, walk+".prefixes.fa")
+			for i, p := range readDecodedSeqs(t, walk+".prefixes.fa") {
+				if p != walkReads[i][:12] {
+					t.Fatalf("Prefix %d is %s, but the read is %s", i, p, walkReads[i])
+				}
+			}
+		}
+	}
+}
+
+func TestBucketOrderAppendReencode(t *testing.T) {
+	setTestOptions(12)
+	td := newTestData(t, 73, 1000, 60)
+	defer td.Close()
+	first, second := td.path("first.fq"), td.path("second.fq")
+	writeTestReads(t, first, td.reads[:600])
+	writeTestReads(t, second, td.reads[600:])
+
+	// appending keeps the order recorded in the archive
+	bucketOrderOption = "walk"
+	encodeArchive(td.refFile, first, td.path("out"))
+	setTestOptions(12)
+	appendArchive(td.refFile, second, td.path("out"))
+	setTestOptions(12)
+	decodeArchive(td.refFile, td.path("out"), td.path("out.fa"))
+	got := readDecodedSeqs(t, td.path("out.fa"))
+	if !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+	setTestOptions(12)
+	bucketOrderOption = "walk"
+	encodeArchive(td.refFile, second, td.path("second"))
+	decodeArchive(td.refFile, td.path("second"), td.path("second.fa"))
+	if strings.Join(got[600:], " ") != strings.Join(readDecodedSeqs(t, td.path("second.fa")), " ") {
+		t.Fatalf("The appended segment wasn't coded in the walk order")
+	}
+
+	// re-encoding the tails follows the order as well
+	setTestOptions(12)
+	bucketOrderOption = "walk"
+	keepSortedOption = true
+	encodeArchive(td.refFile, first, td.path("kept"))
+	setTestOptions(12)
+	bucketOrderOption = "walk"
+	updateReference = false
+	encodeArchive(td.refFile, first, td.path("full"))
+	setTestOptions(12)
+	updateReference = false
+	reencodeArchive(td.refFile, td.path("kept"), td.path("tails"))
+	full, err := ioutil.ReadFile(td.path("full.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't read full encode: %v", err)
+	}
+	tails, err := ioutil.ReadFile(td.path("tails.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't read re-encode: %v", err)
+	}
+	if string(full) != string(tails) {
+		t.Fatalf("Re-encoded tails (%d bytes) differ from a full encode (%d bytes)", len(tails), len(full))
+	}
+}
+
+// simulatedCacheMisses() returns the number of the model lookups made to code
+// the tails of the reads, in order, that miss an LRU cache of the given
+// number of 64-byte lines, if the model is the array model, whose 4 counts
+// per context put 16 consecutive contexts on a line. Only the first of a run
+// of identical reads is counted, as only it is coded.
+func simulatedCacheMisses(reads []*FastQ, lines int) int {
+	cache := list.New()
+	where := make(map[Kmer]*list.Element)
+	misses := 0
+	for i, r := range reads {
+		if i > 0 && string(r.Seq) == string(reads[i-1].Seq) {
+			continue
+		}
+		ctx := stringToKmer(string(r.Seq[:bucketK]))
+		for j := bucketK; j < len(r.Seq); j++ {
+			line := seedContext(ctx) / 16
+			if e, ok := where[line]; ok {
+				cache.MoveToFront(e)
+			} else {
+				misses++
+				where[line] = cache.PushFront(line)
+				if cache.Len() > lines {
+					delete(where, cache.Remove(cache.Back()).(Kmer))
+				}
+			}
+			ctx = shiftKmer(ctx, acgt(r.Seq[j]))
+		}
+	}
+	return misses
+}
+
+// forwardReads() draws n reads of length readLen from the forward strand of
+// ref, with the given per-base error rate, as the encoder codes reads once
+// it has flipped them.
+func forwardReads(rng *rand.Rand, ref string, n, readLen int, errRate float64) []string {
+	reads := make([]string, n)
+	for i := range reads {
+		p := rng.Intn(len(ref) - readLen)
+		r := []byte(ref[p : p+readLen])
+		for j := range r {
+			if rng.Float64() < errRate {
+				r[j] = ALPHA[rng.Intn(len(ALPHA))]
+			}
+		}
+		reads[i] = string(r)
+	}
+	return reads
+}
+
+// sortedTestReads() returns the reads sorted, as the encoder sorts them
+// before it buckets them.
+func sortedTestReads(seqs []string) []*FastQ {
+	reads := make([]*FastQ, len(seqs))
+	for i, s := range seqs {
+		reads[i] = &FastQ{Seq: []byte(s)}
+	}
+	sort.Stable(Lexicographically(reads))
+	return reads
+}
+
+func TestWalkOrderCacheMisses(t *testing.T) {
+	setTestOptions(12)
+	bucketK = 12
+	rng := rand.New(rand.NewSource(79))
+	ref := randomSequence(rng, 50000)
+	reads := sortedTestReads(forwardReads(rng, ref, 20000, 100, 0.01))
+	km := countKmersInReference(12, []string{ref})
+	walk := orderReadsByBuckets(reads, km, 100-bucketK)
+	for _, lines := range []int{256, 4096} {
+		prefixMisses := simulatedCacheMisses(reads, lines)
+		walkMisses := simulatedCacheMisses(walk, lines)
+		t.Logf("%d lines: %d misses in prefix order, %d in walk order", lines, prefixMisses, walkMisses)
+		if 2*walkMisses > prefixMisses {
+			t.Fatalf("With %d cache lines, the walk order misses %d times, more than half the %d of the prefix order",
+				lines, walkMisses, prefixMisses)
+		}
+	}
+}
+
+// BenchmarkBucketOrder reports the time to decode the tails of reads coded
+// in each bucket order with the array model, and the cache misses of the
+// decode: as counted by the hardware, where the kernel lets this process
+// count them, and as simulated by simulatedCacheMisses() for a 512 KB cache.
+func BenchmarkBucketOrder(b *testing.B) {
+	dir, err := ioutil.TempDir("", "kpath-bench-")
+	if err != nil {
+		b.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	rng := rand.New(rand.NewSource(83))
+	ref := []string{randomSequence(rng, 500000)}
+	refFN := filepath.Join(dir, "ref.fa.gz")
+	writeTestReference(b, refFN, ref)
+	readFN := filepath.Join(dir, "reads.fq")
+	sampled := forwardReads(rng, ref[0], 100000, 100, 0.01)
+	writeTestReads(b, readFN, sampled)
+
+	// the reads aren't flipped, so the simulation sees the reads as coded
+	setTestOptions(12)
+	bucketK = 12
+	reads := sortedTestReads(sampled)
+	simulated := map[string]int{
+		"prefix": simulatedCacheMisses(reads, 8192),
+		"walk":   simulatedCacheMisses(orderReadsByBuckets(reads, countKmersInReference(12, ref), 100-bucketK), 8192),
+	}
+
+	for _, order := range []string{"prefix", "walk"} {
+		b.Run("bucketorder="+order, func(b *testing.B) {
+			setTestOptions(12)
+			bigmemOption = "true"
+			flipReadsOption = false
+			bucketOrderOption = order
+			out := filepath.Join(dir, order)
+			encodeArchive(refFN, readFN, out)
+
+			counter, err := openCacheMissCounter()
+			if err != nil {
+				b.Logf("Not counting hardware cache misses: %v", err)
+			} else {
+				defer counter.close()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				setTestOptions(12)
+				bigmemOption = "true"
+				resetModelState()
+				ar := openArchive(refFN, out)
+				it := ar.Reads(coding)
+				if counter != nil {
+					counter.start()
+				}
+				b.StartTimer()
+				for _, ok := it.Next(); ok; _, ok = it.Next() {
+				}
+				b.StopTimer()
+				if counter != nil {
+					b.ReportMetric(float64(counter.stop()), "cache-misses/op")
+				}
+				ar.Close()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(simulated[order]), "sim-misses/op")
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+//===================================================================
+// Concurrent kmer model
+//===================================================================
+
+// A ConcurrentKmerModel is a KmerModel that can be used by several goroutines
+// at once. The contexts are split into shards by a hash of the context kmer;
+// each shard is a separate SmallKmerModel guarded by its own lock, so updates
+// to different shards do not contend.
+//
+// The wrapper makes each call atomic, but it cannot make the ORDER of calls
+// from different goroutines deterministic. The decoder replays the model
+// updates in exactly the order the encoder made them, so a parallel encode
+// that shares one adaptive model would produce a stream that cannot be
+// decoded. A parallel encode must therefore either give every segment its own
+// copy of the model or run with updateReference turned off (-update=false).
+// Counting the reference is safe, since SetCount() is idempotent.
+type ConcurrentKmerModel struct {
+	order  uint
+	shift  uint
+	shards []kmerShard
+}
+
+type kmerShard struct {
+	sync.Mutex
+	km *SmallKmerModel
+}
+
+// Create a new concurrent model with at least the given number of shards
+// (rounded up to a power of 2).
+func NewConcurrentKmerModel(order uint, nshards int) *ConcurrentKmerModel {
+	bits := uint(0)
+	for (1 << bits) < nshards {
+		bits++
+	}
+	log.Printf("Creating concurrent kmer count model with %d shards.", 1<<bits)
+	cm := &ConcurrentKmerModel{
+		order:  order,
+		shift:  32 - bits,
+		shards: make([]kmerShard, 1<<bits),
+	}
+	for i := range cm.shards {
+		cm.shards[i].km = &SmallKmerModel{
+			order:    order,
+			overflow: make([][len(ALPHA)]KmerCount, 0),
+			dist:     make(map[Kmer][len(ALPHA)]uint8),
+		}
+	}
+	return cm
+}
+
+// return the shard responsible for the given kmer
+func (cm *ConcurrentKmerModel) shard(k Kmer) *kmerShard {
+	if cm.shift >= 32 {
+		return &cm.shards[0]
+	}
+	// multiplicative hash so that neighbouring kmers land in different shards
+	return &cm.shards[(uint32(k)*2654435761)>>cm.shift]
+}
+
+// Return count for given kmer
+func (cm *ConcurrentKmerModel) NextCount(k Kmer, c byte) KmerCount {
+	s := cm.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.km.NextCount(k, c)
+}
+
+// return the distribution for the given kmer
+func (cm *ConcurrentKmerModel) Distribution(k Kmer) (bool, [len(ALPHA)]KmerCount) {
+	s := cm.shard(k)
+	s.Lock()
+	defer s.Unlock()
+	return s.km.Distribution(k)
+}
+
+// set the value of the given parameter
+func (cm *ConcurrentKmerModel) SetCount(k Kmer, c, v byte) {
+	s := cm.shard(k)
+	s.Lock()
+	s.km.SetCount(k, c, v)
+	s.Unlock()
+}
+
+// increment the value of the given count
+func (cm *ConcurrentKmerModel) Increment(k Kmer, c, by byte) {
+	s := cm.shard(k)
+	s.Lock()
+	s.km.Increment(k, c, by)
+	s.Unlock()
+}
+
+// call f for every kmer that exists in the model, in increasing kmer order
+func (cm *ConcurrentKmerModel) Iterate(f func(k Kmer, dist [len(ALPHA)]KmerCount)) {
+	keys := make([]Kmer, 0)
+	dists := make(map[Kmer][len(ALPHA)]KmerCount)
+	for i := range cm.shards {
+		s := &cm.shards[i]
+		s.Lock()
+		s.km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+			keys = append(keys, k)
+			dists[k] = dist
+		})
+		s.Unlock()
+	}
+	sort.Sort(kmerSlice(keys))
+	for _, k := range keys {
+		f(k, dists[k])
+	}
+}
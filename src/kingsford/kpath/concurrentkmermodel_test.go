@@ -0,0 +1,83 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// run with -race to check the locking
+func TestConcurrentKmerModel(t *testing.T) {
+	setTestOptions(8)
+	cm := NewConcurrentKmerModel(8, 16)
+	kmers := []Kmer{
+		stringToKmer("AAAAAAAA"), stringToKmer("ACGTACGT"),
+		stringToKmer("TTTTTTTT"), stringToKmer("GATTACAA"),
+	}
+
+	const workers = 8
+	const rounds = 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for _, k := range kmers {
+					cm.Increment(k, byte(w%len(ALPHA)), 1)
+					cm.Distribution(k)
+				}
+				// every worker also touches contexts of its own
+				cm.SetCount(Kmer(1000*w+i+1), 1, byte(seenThreshold))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, k := range kmers {
+		exists, dist := cm.Distribution(k)
+		if !exists {
+			t.Fatalf("Kmer %s is missing", kmerToString(k, 8))
+		}
+		want := KmerCount(workers / len(ALPHA) * rounds)
+		for c := range dist {
+			if dist[c] != want {
+				t.Fatalf("Count for %s/%d is %d, not %d", kmerToString(k, 8), c, dist[c], want)
+			}
+			if cm.NextCount(k, byte(c)) != dist[c] {
+				t.Fatalf("NextCount disagrees with Distribution")
+			}
+		}
+	}
+
+	n := 0
+	prev := Kmer(0)
+	cm.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		if n > 0 && k <= prev {
+			t.Fatalf("Iterate is not in kmer order")
+		}
+		prev = k
+		n++
+	})
+	if n != len(kmers)+workers*rounds {
+		t.Fatalf("Iterate found %d kmers", n)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+)
+
+// correctErrors() replaces the read bases that are likely sequencing errors
+// by the base the model expects, so that they are cheaper to encode, and
+// records the original bases in the Corrections of each read. It returns the
+// number of bases corrected.
+func correctErrors(reads []*FastQ, km KmerModel) (n int) {
+	for _, fq := range reads {
+		n += correctRead(fq, km)
+	}
+	return n
+}
+
+// correctRead() corrects the likely errors of a single read, walking its
+// tail with the same contexts encodeSingleReadWithBucket() uses. A base is a
+// likely error if the model has seen exactly one base after its context, not
+// this one, and has seen the next base of the read after that base; a count
+// below seenThreshold is unseen, as when coding. Ns are left alone, as they
+// are put back over whatever base is decoded.
+func correctRead(fq *FastQ, km KmerModel) (n int) {
+	seq := fq.Seq
+	if len(seq) <= bucketK {
+		return 0
+	}
+	isN := make(map[int]bool, len(fq.NLocations))
+	for _, p := range fq.NLocations {
+		isN[int(p)] = true
+	}
+	contextMer := stringToKmer(string(seq[:bucketK]))
+	for i := bucketK; i < len(seq); i++ {
+		char := acgt(seq[i])
+		if best, ok := onlySeen(km, contextMer); ok && best != char && !isN[i] {
+			next := shiftKmer(contextMer, best)
+			if i+1 == len(seq) || hasCount(km, seedContext(next), acgt(seq[i+1]), seenThreshold) {
+				fq.Corrections = append(fq.Corrections, byte(i), seq[i])
+				seq[i] = baseFromBits(best)
+				char = best
+				n++
+			}
+		}
+		contextMer = shiftKmer(contextMer, char)
+	}
+	return n
+}
+
+// onlySeen() returns the base seen after the given context, and true, if the
+// model has seen exactly one.
+func onlySeen(km KmerModel, contextMer Kmer) (byte, bool) {
+	exists, dist := km.Distribution(seedContext(contextMer))
+	if !exists {
+		return 0, false
+	}
+	seen, n := byte(0), 0
+	for c := range dist {
+		if dist[c] >= seenThreshold {
+			seen = byte(c)
+			n++
+		}
+	}
+	return seen, n == 1
+}
+
+// writeCorrections() writes out the corrections of each read in the same
+// format as writeExceptions().
+func writeCorrections(f io.Writer, reads readStream) error {
+	w := bufio.NewWriter(f)
+	c := 0
+	err := reads.each(func(fq *FastQ) error {
+		for i := 0; i < len(fq.Corrections); i += 2 {
+			if i > 0 {
+				fmt.Fprintf(w, " ")
+			}
+			fmt.Fprintf(w, "%d:%d", fq.Corrections[i], fq.Corrections[i+1])
+			c++
+		}
+		_, err := fmt.Fprintf(w, "\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Done; wrote %d corrections.", c)
+	return nil
+}
+
+// hasCorrections() returns true if any of the reads has a correction.
+func hasCorrections(reads readStream) bool {
+	return anyRead(reads, func(fq *FastQ) bool { return len(fq.Corrections) > 0 })
+}
+
+// readCorrections() reads the compressed corrections file written by
+// writeCorrections() and returns, for each of the nreads reads (0 if the
+// number isn't known), its (position, base) pairs (nil if it has none). If
+// the file is not found, it returns nil.
+func readCorrections(eccFN string, nreads int) [][]byte {
+	return readBytePairs(eccFN, "corrections", nreads)
+}
@@ -0,0 +1,122 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCorrectRead(t *testing.T) {
+	setTestOptions(8)
+	bucketK = 8
+	rng := rand.New(rand.NewSource(61))
+	ref := randomSequence(rng, 2000)
+	km := countKmersInReference(8, []string{ref})
+
+	want := ref[500:560]
+	for _, p := range []int{20, 35, 59} {
+		seq := []byte(want)
+		seq[p] = ALPHA[(acgt(seq[p])+1)%4]
+		fq := NewFastQ(seq, nil)
+		if n := correctRead(fq, km); n != 1 {
+			t.Fatalf("error at %d: corrected %d bases, not 1", p, n)
+		}
+		if string(fq.Seq) != want {
+			t.Fatalf("error at %d: corrected to %s, not %s", p, fq.Seq, want)
+		}
+		if fq.Original() != string(seq) {
+			t.Fatalf("error at %d: original %s, not %s", p, fq.Original(), seq)
+		}
+	}
+
+	// a read that matches is left alone, as is an error in the bucket
+	// prefix, which has no context to be judged by
+	for _, p := range []int{-1, 3} {
+		seq := []byte(want)
+		if p >= 0 {
+			seq[p] = ALPHA[(acgt(seq[p])+1)%4]
+		}
+		fq := NewFastQ(seq, nil)
+		if n := correctRead(fq, km); n != 0 || string(fq.Seq) != string(seq) {
+			t.Fatalf("error at %d: corrected %d bases to give %s", p, n, fq.Seq)
+		}
+	}
+
+	// nor is a base whose context has been followed by more than one base
+	seq := []byte(want)
+	seq[30] = ALPHA[(acgt(seq[30])+2)%4]
+	km.SetCount(stringToKmer(want[22:30]), (acgt(want[30])+1)%4, byte(seenThreshold))
+	if n := correctRead(NewFastQ(seq, nil), km); n != 0 {
+		t.Fatalf("corrected %d bases after an ambiguous context", n)
+	}
+}
+
+func TestECCRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kpath-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rng := rand.New(rand.NewSource(62))
+	ref := []string{randomSequence(rng, 3000), randomSequence(rng, 2000)}
+	refFN := filepath.Join(dir, "ref.fa.gz")
+	writeTestReference(t, refFN, ref)
+	reads := sampleReads(rng, ref, 2000, 60, 0.02)
+	readFN := filepath.Join(dir, "reads.fq")
+	writeTestReads(t, readFN, reads)
+
+	size := make(map[bool]int64)
+	for _, ecc := range []bool{false, true} {
+		setTestOptions(8)
+		updateReference = false
+		eccOption = ecc
+		out := filepath.Join(dir, "out")
+		encodeArchive(refFN, readFN, out)
+		if fileExists(out+".ecc") != ecc {
+			t.Fatalf("-ecc=%v: %s exists = %v", ecc, out+".ecc", fileExists(out+".ecc"))
+		}
+		decodeArchive(refFN, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, reads) {
+			t.Fatalf("-ecc=%v: decoded reads differ from the encoded reads", ecc)
+		}
+		fi, err := os.Stat(out + ".enc")
+		if err != nil {
+			t.Fatalf("Couldn't stat the archive: %v", err)
+		}
+		size[ecc] = fi.Size()
+		if ecc {
+			fi, err := os.Stat(out + ".ecc")
+			if err != nil {
+				t.Fatalf("Couldn't stat the corrections: %v", err)
+			}
+			size[ecc] += fi.Size()
+		}
+	}
+	if size[true] >= size[false] {
+		t.Fatalf("-ecc gives %d bytes, not fewer than %d", size[true], size[false])
+	}
+	t.Logf("%d bytes without -ecc, %d with", size[false], size[true])
+}
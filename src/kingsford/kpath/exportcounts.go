@@ -0,0 +1,76 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// writeModelCounts() writes the transition counts of the model, whose
+// contexts are of length k, to w as a TSV: a header line, then one line per
+// context, in increasing kmer order, giving the context and the counts of A,
+// C, G and T after it. Counts that have overflowed a byte are written in
+// full.
+func writeModelCounts(w io.Writer, km KmerModel, k int) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("context\tA\tC\tG\tT\n")
+	km.Iterate(func(c Kmer, dist [len(ALPHA)]KmerCount) {
+		buf.WriteString(kmerToString(c, k))
+		for _, v := range dist {
+			buf.WriteByte('\t')
+			buf.WriteString(strconv.Itoa(int(v)))
+		}
+		buf.WriteByte('\n')
+	})
+	return buf.Flush()
+}
+
+// exportCounts() writes the counts of the model that encoding with the
+// reference in refFile (and the dictionary, if one is given) would start
+// from to outFile, or to stdout if outFile is "". With no reference, the
+// counts of the dictionary itself are written.
+func exportCounts(refFile, outFile string) {
+	DIE_IF(refFile == "" && dictionaryOption == "",
+		"Must give the reference with -ref, or a saved model with -dictionary")
+	resetModelState()
+	var km KmerModel
+	if refFile != "" {
+		DIE_ON_ERR(setSeed(seedOption), "Bad value for -seed")
+		loadDictionary(dictionaryOption)
+		km = countKmersInReference(globalK, readReferenceFile(refFile))
+	} else {
+		km, _ = loadKmerModel(dictionaryOption)
+	}
+
+	out := os.Stdout
+	if outFile != "" {
+		var err error
+		out, err = os.Create(outFile)
+		DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+		defer out.Close()
+		log.Printf("Writing the counts to %s", outFile)
+	}
+	DIE_ON_ERR(writeModelCounts(out, km, globalK), "Couldn't write the counts")
+}
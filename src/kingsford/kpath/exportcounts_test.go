@@ -0,0 +1,62 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestExportCounts(t *testing.T) {
+	setTestOptions(2)
+	td := newTestData(t, 48, 1, 10)
+	defer td.Close()
+
+	// by hand: ACGTAC has AC>G, CG>T, GT>A, TA>C and ACA has AC>A, each
+	// seen once in the reference
+	writeTestReference(t, td.refFile, []string{"ACGTAC", "ACA"})
+	s := seenThreshold
+	want := fmt.Sprintf("context\tA\tC\tG\tT\n"+
+		"AC\t%d\t0\t%d\t0\n"+
+		"CG\t0\t0\t0\t%d\n"+
+		"GT\t%d\t0\t0\t0\n"+
+		"TA\t0\t%d\t0\t0\n", s, s, s, s, s)
+	exportCounts(td.refFile, td.path("counts.tsv"))
+	if got, err := ioutil.ReadFile(td.path("counts.tsv")); err != nil || string(got) != want {
+		t.Fatalf("Exported counts are\n%s(%v), not\n%s", got, err, want)
+	}
+
+	// a saved model is exported as it is, with counts too large for a
+	// byte in full
+	km := NewSmallKmerModel(2)
+	km.SetCount(stringToKmer("TT"), 1, 7)
+	for i := 0; i < 3; i++ {
+		km.Increment(stringToKmer("GA"), 3, 100)
+	}
+	saveKmerModel(td.path("saved.model"), km, 2)
+	dictionaryOption = td.path("saved.model")
+	exportCounts("", td.path("saved.tsv"))
+	want = "context\tA\tC\tG\tT\nGA\t0\t0\t0\t300\nTT\t0\t7\t0\t0\n"
+	if got, err := ioutil.ReadFile(td.path("saved.tsv")); err != nil || string(got) != want {
+		t.Fatalf("Exported counts are\n%s(%v), not\n%s", got, err, want)
+	}
+}
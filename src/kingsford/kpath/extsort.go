@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+With -sortbatch=N, the encoder never holds more than N of the reads in memory
+at once. The reads are read in batches of N, and each batch is flipped,
+corrected and sorted as readAndFlipReads() does the whole set, and written as
+a run to a temporary file. Whenever the encoder goes through the reads (to
+find the buckets, the archive id, and to write each of the files of the
+archive) the runs are merged, which reads one read of each run at a time.
+Ties go to the earlier run, so the order is that of the stable sort of all
+the reads at once, and the archive is the same.
+
+Each read in a run is written as a uvarint length and the bases, a byte
+that is 1 if the read was flipped, its index as a uvarint, and then each of
+its N locations, exceptions and corrections as a uvarint length and the
+bytes. The qualities are left out, as nothing after flipping uses them.
+*/
+
+// A readStream goes through the sorted reads of a segment, as many times as
+// needed: each() calls f with each read in turn, and stops at the first
+// error, which it returns. f must not change the read or hold on to it.
+type readStream interface {
+	each(f func(fq *FastQ) error) error
+	count() int   // the number of reads
+	readLen() int // the length of every read
+}
+
+// A readSlice is a readStream of reads held in memory.
+type readSlice []*FastQ
+
+func (s readSlice) each(f func(fq *FastQ) error) error {
+	for _, fq := range s {
+		if err := f(fq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s readSlice) count() int { return len(s) }
+
+func (s readSlice) readLen() int {
+	if len(s) == 0 {
+		return 0
+	}
+	return len(s[0].Seq)
+}
+
+// runBufferSize is the size of the buffer for each run when the runs are
+// merged.
+const runBufferSize = 1 << 16
+
+// A sortedRuns is a readStream of reads sorted in runs in a temporary file
+// and merged as they are gone through.
+type sortedRuns struct {
+	f      *os.File
+	ends   []int64 // the offset of the end of each run
+	n      int
+	length int
+}
+
+func (s *sortedRuns) count() int { return s.n }
+
+func (s *sortedRuns) readLen() int { return s.length }
+
+// Close() removes the temporary file.
+func (s *sortedRuns) Close() error {
+	s.f.Close()
+	keepOnDie(s.f.Name())
+	return os.Remove(s.f.Name())
+}
+
+// A runReader reads the reads of a run in turn; fq is the current one.
+type runReader struct {
+	in  *bufio.Reader
+	run int
+	fq  *FastQ
+}
+
+// next() reads the next read of the run into r.fq, and returns false if
+// there is none.
+func (r *runReader) next() (bool, error) {
+	fq, err := readRunRecord(r.in)
+	if err == io.EOF {
+		return false, nil
+	}
+	r.fq = fq
+	return err == nil, err
+}
+
+// A runHeap orders the runs being merged by their current reads, and the
+// runs with equal reads by the order they were written.
+type runHeap []*runReader
+
+func (h runHeap) Len() int { return len(h) }
+
+func (h runHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].fq.Seq, h[j].fq.Seq); c != 0 {
+		return c < 0
+	}
+	return h[i].run < h[j].run
+}
+
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// each() merges the runs, calling f with each read in the sorted order. It
+// can be called by several goroutines at once.
+func (s *sortedRuns) each(f func(fq *FastQ) error) error {
+	h := make(runHeap, 0, len(s.ends))
+	start := int64(0)
+	for i, end := range s.ends {
+		r := &runReader{
+			in:  bufio.NewReaderSize(io.NewSectionReader(s.f, start, end-start), runBufferSize),
+			run: i,
+		}
+		start = end
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, r)
+		}
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		r := h[0]
+		if err := f(r.fq); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// appendRunRecord() appends the record of the read in a run to buf.
+func appendRunRecord(buf []byte, fq *FastQ) []byte {
+	buf = appendRunBytes(buf, fq.Seq)
+	flip := byte(0)
+	if fq.IsFlipped {
+		flip = 1
+	}
+	buf = append(buf, flip)
+	var v [binary.MaxVarintLen64]byte
+	buf = append(buf, v[:binary.PutUvarint(v[:], uint64(fq.Index))]...)
+	buf = appendRunBytes(buf, fq.NLocations)
+	buf = appendRunBytes(buf, fq.Exceptions)
+	return appendRunBytes(buf, fq.Corrections)
+}
+
+// appendRunBytes() appends b to buf as a uvarint length and the bytes.
+func appendRunBytes(buf, b []byte) []byte {
+	var v [binary.MaxVarintLen64]byte
+	buf = append(buf, v[:binary.PutUvarint(v[:], uint64(len(b)))]...)
+	return append(buf, b...)
+}
+
+// readRunRecord() reads the next read written by appendRunRecord() from r.
+// It returns io.EOF if there are no more.
+func readRunRecord(r *bufio.Reader) (*FastQ, error) {
+	fq := &FastQ{}
+	var err error
+	if fq.Seq, err = readRunBytes(r); err != nil {
+		return nil, err
+	}
+	flip, err := r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	fq.IsFlipped = flip == 1
+	index, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	fq.Index = int(index)
+	for _, b := range []*[]byte{&fq.NLocations, &fq.Exceptions, &fq.Corrections} {
+		if *b, err = readRunBytes(r); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	return fq, nil
+}
+
+// readRunBytes() reads bytes written by appendRunBytes(), returning nil for
+// none.
+func readRunBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// sortReadsExternally() reads the reads as readAndFlipReads() does, but
+// holds at most batch of them in memory at once: each batch is processed by
+// prepareReads() and written as a run to a temporary file, and the sorted
+// reads are returned as the merge of the runs. The reads are read twice,
+// first to find the most common read length for the readFilter. The dropped
+// reads are returned in memory, as readAndFlipReads() returns them.
+func sortReadsExternally(
+	readFile string,
+	ks *kmerSet,
+	eccModel KmerModel,
+	flipReadsOption bool,
+	batch int,
+) (*sortedRuns, []*FastQ) {
+	log.Printf("Reading reads in batches of %d...", batch)
+	readStart := time.Now()
+	lengths := make(map[int]int)
+	fq := make(chan *FastQ, readBufferSize)
+	go ReadFastQ(readFile, fq)
+	for rec := range fq {
+		countReadLength(lengths, rec)
+	}
+	filter := newReadFilter(lengths)
+
+	f, err := ioutil.TempFile("", "kpath-sort-")
+	DIE_ON_ERR(err, "Couldn't create a temporary file in %s for -sortbatch", os.TempDir())
+	removeOnDie(f.Name())
+	runs := &sortedRuns{f: f, length: filter.readLen}
+	w := bufio.NewWriterSize(f, runBufferSize)
+	end := int64(0)
+	var rec []byte
+
+	// writeRun() sorts the batch and writes it as the next run
+	writeRun := func(reads []*FastQ) {
+		DIE_ON_ERR(checkReadLengths(reads, filter.readLen, runs.n),
+			"Can't encode reads of different lengths")
+		prepareReads(reads, ks, eccModel, flipReadsOption)
+		for _, fq := range reads {
+			rec = appendRunRecord(rec[:0], fq)
+			w.Write(rec)
+			end += int64(len(rec))
+		}
+		runs.ends = append(runs.ends, end)
+		runs.n += len(reads)
+	}
+
+	reads := make([]*FastQ, 0, batch)
+	dropped := make([]*FastQ, 0)
+	fq = make(chan *FastQ, readBufferSize)
+	go ReadFastQ(readFile, fq)
+	for r := range fq {
+		if !filter.keep(r) {
+			dropped = append(dropped, r)
+			continue
+		}
+		r.Index = runs.n + len(reads)
+		reads = append(reads, r)
+		if len(reads) == batch {
+			writeRun(reads)
+			reads = reads[:0]
+		}
+	}
+	if len(reads) > 0 {
+		writeRun(reads)
+	}
+	DIE_ON_ERR(w.Flush(), "Couldn't write the sorted runs to %s", f.Name())
+	log.Printf("Time: read and sorted %v reads in %d runs; spent %v seconds.",
+		runs.n+len(dropped), len(runs.ends), time.Now().Sub(readStart).Seconds())
+	filter.report()
+	DIE_IF(runs.n == 0, "No reads to encode.")
+	log.Printf("Read %v reads; flipped %v of them.", runs.n, flipped)
+	return runs, dropped
+}
+
+// checkSortBatch() returns an error if the reads can't be sorted in batches
+// of the given size with the other options.
+func checkSortBatch(batch int) error {
+	switch {
+	case batch < 0:
+		return fmt.Errorf("-sortbatch must not be negative")
+	case batch > 0 && bucketOrderOption == "walk":
+		return fmt.Errorf("-bucketorder=walk reorders the reads in memory, so it can't be used with -sortbatch")
+	}
+	return nil
+}
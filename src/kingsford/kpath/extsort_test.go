@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeGzippedTestReads() writes the reads as a gzipped fastq file.
+func writeGzippedTestReads(t *testing.T, fn string, reads []string) {
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	for i, r := range reads {
+		fmt.Fprintf(z, "@r%d\n%s\n+\n%s\n", i, r, strings.Repeat("I", len(r)))
+	}
+	z.Close()
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Couldn't write gzipped reads: %v", err)
+	}
+}
+
+// sameArchives() fails the test unless the archives a and b have the same
+// files with the same contents; their metadata may differ only in the
+// options given in ignore.
+func sameArchives(t *testing.T, a, b string, ignore ...string) {
+	files, _ := filepath.Glob(a + ".*")
+	other, _ := filepath.Glob(b + ".*")
+	if len(files) != len(other) {
+		t.Fatalf("%s has %d files, %s has %d", a, len(files), b, len(other))
+	}
+	for _, fn := range files {
+		ext := strings.TrimPrefix(fn, a)
+		if ext == ".meta" {
+			ma, mb := loadArchiveMeta(a+ext), loadArchiveMeta(b+ext)
+			for _, o := range ignore {
+				delete(ma.Options, o)
+				delete(mb.Options, o)
+			}
+			if !reflect.DeepEqual(ma, mb) {
+				t.Fatalf("The metadata differs:\n%+v\n%+v", ma, mb)
+			}
+			continue
+		}
+		x, err := ioutil.ReadFile(a + ext)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", a+ext, err)
+		}
+		y, err := ioutil.ReadFile(b + ext)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", b+ext, err)
+		}
+		if !bytes.Equal(x, y) {
+			t.Fatalf("%s differs from %s", a+ext, b+ext)
+		}
+	}
+}
+
+func TestSortBatchSameArchive(t *testing.T) {
+	setTestOptions(10)
+	td := newTestData(t, 83, 3000, 50)
+	defer td.Close()
+
+	// identical reads in different batches, one with an N, so the merge
+	// must keep them in the order they were read
+	reads := append([]string{}, td.reads...)
+	reads[1500] = reads[3]
+	reads[2900] = reads[3][:5] + "N" + reads[3][6:]
+	reads[40] = strings.Repeat("A", 50)
+	reads[2000] = strings.Repeat("A", 50)
+	reads[700] = strings.ToLower(reads[700][:10]) + reads[700][10:]
+	writeTestReads(t, td.path("reads.fq"), reads)
+	writeGzippedTestReads(t, td.path("reads.fq.gz"), reads)
+
+	// and reads of other lengths, and with many Ns, for the options that
+	// drop them
+	odd := append([]string{}, reads...)
+	odd[10] = odd[10][:45]
+	odd[1200] = odd[1200][:20]
+	odd[2500] = odd[2500] + "ACGT"
+	odd[2600] = strings.Repeat("N", 10) + odd[2600][10:]
+	writeTestReads(t, td.path("odd.fq"), odd)
+	writeGzippedTestReads(t, td.path("odd.fq.gz"), odd)
+
+	tmp := td.path("tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatalf("Couldn't create %s: %v", tmp, err)
+	}
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	configs := []struct {
+		name  string
+		reads string
+		set   func()
+	}{
+		{"plain", "reads", func() {}},
+		{"sidecars", "reads", func() {
+			keepOrderOption = true
+			gcOption = true
+			lowComplexOption = true
+			exactCaseOption = true
+			dupsOption = false
+			dupRunsOption = true
+			eccOption = true
+		}},
+		{"dropped", "odd", func() {
+			dropOddOption = true
+			minLenOption = 30
+			maxNOption = 3
+			keepDroppedOption = true
+			keepOrderOption = true
+			maxBucketsOption = 40
+		}},
+		{"index", "reads", func() {
+			updateReference = false
+			indexBlockBuckets = 5
+			flipReadsOption = false
+		}},
+	}
+	for _, c := range configs {
+		mem, ext := td.path(c.name+".mem"), td.path(c.name+".ext")
+		setTestOptions(10)
+		c.set()
+		encodeArchive(td.refFile, td.path(c.reads+".fq"), mem)
+		setTestOptions(10)
+		c.set()
+		sortBatchOption = 97
+		encodeArchive(td.refFile, td.path(c.reads+".fq.gz"), ext)
+		sameArchives(t, mem, ext, "sortbatch")
+
+		if left, _ := ioutil.ReadDir(tmp); len(left) != 0 {
+			t.Fatalf("%s: -sortbatch left %d files in the temporary directory", c.name, len(left))
+		}
+	}
+
+	// the archive still decodes, with the lowercase read in uppercase
+	setTestOptions(10)
+	decodeArchive(td.refFile, td.path("plain.ext"), td.path("plain.fa"))
+	reads[700] = strings.ToUpper(reads[700])
+	if !sameReads(readDecodedSeqs(t, td.path("plain.fa")), reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+func TestCheckSortBatch(t *testing.T) {
+	setTestOptions(10)
+	if err := checkSortBatch(0); err != nil {
+		t.Fatalf("Refused no -sortbatch: %v", err)
+	}
+	if err := checkSortBatch(1000); err != nil {
+		t.Fatalf("Refused -sortbatch=1000: %v", err)
+	}
+	if err := checkSortBatch(-1); err == nil {
+		t.Fatalf("Allowed a negative -sortbatch")
+	}
+	bucketOrderOption = "walk"
+	if err := checkSortBatch(0); err != nil {
+		t.Fatalf("Refused -bucketorder=walk without -sortbatch: %v", err)
+	}
+	if err := checkSortBatch(1000); err == nil {
+		t.Fatalf("Allowed -bucketorder=walk with -sortbatch")
+	}
+}
@@ -22,7 +22,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"strings"
 )
@@ -30,36 +34,74 @@ import (
 // Represents a fastQ record
 type FastQ struct {
 	Seq []byte
-	//Quals []byte
+	// the qualities, if they were kept (see keepQuals()); they are in the
+	// same orientation as Seq
+	Quals      []byte
 	NLocations []byte
 	IsFlipped  bool
+
+	// the bytes of the sequence other than ACGT and N, as (position,
+	// original byte) pairs; the positions are in the original orientation
+	Exceptions []byte
+
+	// the bases changed by correctErrors(), as (position, original base)
+	// pairs; the positions are in the same orientation as Seq
+	Corrections []byte
+
+	// the place of the read among those kept for encoding, in the order
+	// they were read (see -keeporder)
+	Index int
 }
 
-// NewFastQ creates a new, empty fastq record
+// NewFastQ creates a new fastq record from the sequence and qualities. The
+// qualities are left out if quals is empty.
 func NewFastQ(seq []byte, quals []byte) *FastQ {
 	f := FastQ{
-		Seq: make([]byte, len(seq)),
-		//Quals: make([]byte, len(quals)),
+		Seq:        make([]byte, len(seq)),
 		NLocations: make([]byte, 0),
 		IsFlipped:  false,
 	}
 	copy(f.Seq, seq)
-	//copy(f.Quals, quals)
+	if len(quals) > 0 {
+		f.Quals = append([]byte(nil), quals...)
+	}
 	f.RemoveNs()
 	return &f
 }
 
 // RemoveNs replaces any 'N's in the sequence with 'A' and records the position
-// of the Ns in NLocations.
+// of the Ns in NLocations. Any other byte that is not A, C, G or T is recorded
+// in Exceptions and replaced by its uppercase if that is one of ACGT, and by
+// 'A' otherwise.
 func (q *FastQ) RemoveNs() {
 	for i, c := range q.Seq {
-		if c == 'N' {
+		switch c {
+		case 'A', 'C', 'G', 'T':
+		case 'N':
 			q.Seq[i] = 'A'
 			q.NLocations = append(q.NLocations, byte(i))
+		default:
+			q.Exceptions = append(q.Exceptions, byte(i), c)
+			q.Seq[i] = 'A'
+			if u := c - ('a' - 'A'); isACGT(rune(u)) {
+				q.Seq[i] = u
+			}
 		}
 	}
 }
 
+// Original() returns the sequence of the read as it was read: in its
+// original orientation, and with its corrections, Ns and exceptions put
+// back.
+func (q *FastQ) Original() string {
+	s := putbackExceptions(string(q.Seq), q.Corrections)
+	s = putbackNs(s, q.NLocations)
+	if q.IsFlipped {
+		s = reverseComplement(s)
+	}
+	return putbackExceptions(s, q.Exceptions)
+}
+
 // ReverseComplement() will reverse complement a FastQ record, including
 // reversing its quality values and updating it's Nlocations.
 func (q *FastQ) SetReverseComplement(rc string) {
@@ -68,9 +110,9 @@ func (q *FastQ) SetReverseComplement(rc string) {
 	q.Seq = []byte(rc)
 
 	// reverse the quality array
-	//for i, j := 0, len(q.Quals)-1; i < j; i, j = i+1, j-1 {
-	//    q.Quals[i], q.Quals[j] = q.Quals[j], q.Quals[i]
-	//}
+	for i, j := 0, len(q.Quals)-1; i < j; i, j = i+1, j-1 {
+		q.Quals[i], q.Quals[j] = q.Quals[j], q.Quals[i]
+	}
 
 	// reverse complement the locations
 	for i, v := range q.NLocations {
@@ -84,18 +126,126 @@ func (q *FastQ) SetReverseComplement(rc string) {
 // PrintFastQ prints out the fastq record (used only for debugging).
 func PrintFastQ(q *FastQ) {
 	fmt.Println(string(q.Seq))
-	//fmt.Println(string(q.Quals))
+	fmt.Println(string(q.Quals))
 	fmt.Printf("%v\n", q.NLocations)
 }
 
 // ReadFastQ reads fastq records from the file and pushes them out along the
 // given channel. It will remove Ns from the sequence and replace them with As.
-func ReadFastQ(filename string, out chan<- *FastQ) {
-	// open the file
-	in, err := os.Open(filename)
-	DIE_ON_ERR(err, "Couldn't open read file %s", filename)
+// A malformed record is a fatal error unless lenientFastQOption is set, in
+// which case it is skipped. filenames may be a comma-separated list of files
+// (such as the lanes of one sample), whose records are read in turn as one
+// set. Each file may be gzipped (see openReadFile()). With -readformat=fasta
+// the files hold fasta reads instead (see parseFastaReads()).
+func ReadFastQ(filenames string, out chan<- *FastQ) {
+	parse := parseFastQ
+	if readFormatOption == "fasta" {
+		parse = parseFastaReads
+	}
+	for _, filename := range strings.Split(filenames, ",") {
+		// open the file
+		in, err := openReadFile(filename)
+		DIE_ON_ERR(err, "Couldn't open read file %s", filename)
+
+		err = parse(in, out)
+		DIE_ON_ERR(err, "Bad read file %s", filename)
+		in.Close()
+	}
+	close(out)
+}
+
+// gzipMagic starts every gzip file.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// A readsFile reads the (decompressed) data from an open file of reads.
+type readsFile struct {
+	io.Reader
+	z *gzip.Reader // nil if the file isn't gzipped
+	f *os.File
+}
+
+func (r *readsFile) Close() error {
+	if r.z != nil {
+		r.z.Close()
+	}
+	return r.f.Close()
+}
+
+// openReadFile() opens a file of reads. If it starts with the gzip magic
+// number, whatever its name, it is decompressed as it is read, so only the
+// records parsed so far are ever held in memory, not the whole decompressed
+// file. Concatenated gzip files (as made by "cat a.gz b.gz") are read
+// straight through.
+func openReadFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	in := bufio.NewReader(f)
+	if magic, _ := in.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return &readsFile{Reader: in, f: f}, nil
+	}
+	z, err := gzip.NewReader(in)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readsFile{Reader: z, z: z, f: f}, nil
+}
+
+// estimateReadCount() estimates the number of records in the fastq files
+// (a comma-separated list, as for ReadFastQ()) from their total size and the
+// size of the records at the start of the first file, so that the reads can
+// be held in a slice of about the right size. It returns 0 if the files can't
+// be examined, or are gzipped, when their size says little about the number
+// of records.
+func estimateReadCount(filenames string) int {
+	files := strings.Split(filenames, ",")
+	total := int64(0)
+	for _, filename := range files {
+		st, err := os.Stat(filename)
+		if err != nil {
+			return 0
+		}
+		total += st.Size()
+	}
+
+	in, err := os.Open(files[0])
+	if err != nil {
+		return 0
+	}
 	defer in.Close()
+	buf := make([]byte, 1<<16)
+	n, _ := io.ReadFull(in, buf)
+	if bytes.HasPrefix(buf[:n], gzipMagic) {
+		return 0
+	}
+	perRecord := int64(4)
+	if readFormatOption == "fasta" {
+		perRecord = 2
+	}
+	lines := bytes.Count(buf[:n], []byte{'\n'})
+	if int64(lines) < perRecord {
+		return 0
+	}
+	// the whole lines read hold lines/perRecord records
+	sampled := bytes.LastIndexByte(buf[:n], '\n') + 1
+	return int(total*int64(lines)/(perRecord*int64(sampled))) + 1
+}
 
+// keepQuals() returns true if the reads need their qualities, which otherwise
+// are not kept to save memory.
+func keepQuals() bool {
+	return writeQualOption || qualFlipOption
+}
+
+// parseFastQ() reads fastq records from r and pushes them out along the given
+// channel. Each record must be a line starting with @, the sequence, a line
+// starting with +, and a quality string of the same length as the sequence
+// (the sequence and qualities may be wrapped over several lines). If a record
+// is malformed, parseFastQ() returns an error giving its number, or, if
+// lenientFastQOption is set, skips it and carries on with the next record.
+func parseFastQ(r io.Reader, out chan<- *FastQ) error {
 	const (
 		BETWEEN int = iota
 		INSEQ
@@ -107,34 +257,75 @@ func ReadFastQ(filename string, out chan<- *FastQ) {
 	quals := make([]byte, 0)
 	var emptyQuals = make([]byte, 0)
 
-	scanner := bufio.NewScanner(in)
+	record := 0
+	skipped := 0
+
+	// bad() handles a malformed record: it returns the error to stop
+	// with, or nil if the record is just skipped
+	bad := func(format string, args ...interface{}) error {
+		if !lenientFastQOption {
+			return fmt.Errorf("record %d: %s", record, fmt.Sprintf(format, args...))
+		}
+		skipped++
+		state = BETWEEN
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		// read a line, remove white space
-		r := strings.TrimSpace(strings.ToUpper(scanner.Text()))
-		if len(r) == 0 {
+		// read a line, remove white space; the sequence keeps its case if
+		// exactCaseOption is set
+		raw := strings.TrimSpace(scanner.Text())
+		line := strings.ToUpper(raw)
+		if len(line) == 0 {
 			continue
 		}
 
+		// a header in the middle of a sequence means the + line is missing;
+		// the header then starts the next record
+		if state == INSEQ && line[0] == '@' {
+			if err := bad("no + line after the sequence"); err != nil {
+				return err
+			}
+		}
+
 		// depending on state, manage record
 		switch {
 
-		case state == BETWEEN && r[0] == '@':
+		case state == BETWEEN && line[0] == '@':
+			record++
 			seq = seq[0:0]
 			quals = quals[0:0]
 			state = INSEQ
 
-		case state == INSEQ && r[0] == '+':
+		case state == BETWEEN:
+			// a stray line; in lenient mode, skip until the next header
+			if !lenientFastQOption {
+				return fmt.Errorf("record %d: expected a line starting with @, found %q",
+					record+1, line)
+			}
+
+		case state == INSEQ && line[0] == '+':
 			state = INQUALS
 
+		case state == INSEQ && exactCaseOption:
+			seq = append(seq, []byte(raw)...)
+
 		case state == INSEQ:
-			seq = append(seq, []byte(r)...)
+			seq = append(seq, []byte(line)...)
 
 		case state == INQUALS:
-			quals = append(quals, []byte(r)...)
+			// qualities are case sensitive
+			quals = append(quals, []byte(raw)...)
 
-			if len(quals) >= len(seq) {
+			if len(quals) > len(seq) {
+				if err := bad("quality length %d does not match sequence length %d",
+					len(quals), len(seq)); err != nil {
+					return err
+				}
+			} else if len(quals) == len(seq) {
 				state = BETWEEN
-				if writeQualOption {
+				if keepQuals() {
 					out <- NewFastQ(seq, quals)
 				} else {
 					out <- NewFastQ(seq, emptyQuals)
@@ -142,6 +333,87 @@ func ReadFastQ(filename string, out chan<- *FastQ) {
 			}
 		}
 	}
-	//DIE_ON_ERR(scanner.Err(), "Couldn't read reads file to completion")
-	close(out)
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// the last record was cut off
+	if state != BETWEEN {
+		if err := bad("truncated at the end of the file"); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d malformed fastq records.", skipped)
+	}
+	return nil
+}
+
+// parseFastaReads() reads fasta records from r, each a header line starting
+// with > followed by the sequence (which may be wrapped over several lines),
+// and pushes them out along the given channel as records without qualities.
+// A record with no sequence, or a stray line before the first header, is
+// malformed, and handled as parseFastQ() handles malformed records.
+func parseFastaReads(r io.Reader, out chan<- *FastQ) error {
+	seq := make([]byte, 0)
+	var emptyQuals = make([]byte, 0)
+	record := 0
+	skipped := 0
+	inRecord := false
+
+	// finish() sends the record read so far, if it has a sequence
+	finish := func() error {
+		if !inRecord {
+			return nil
+		}
+		if len(seq) == 0 {
+			if !lenientFastQOption {
+				return fmt.Errorf("record %d: no sequence", record)
+			}
+			skipped++
+			return nil
+		}
+		out <- NewFastQ(seq, emptyQuals)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		raw := strings.TrimSpace(scanner.Text())
+		if len(raw) == 0 {
+			continue
+		}
+		switch {
+		case raw[0] == '>':
+			if err := finish(); err != nil {
+				return err
+			}
+			record++
+			seq = seq[0:0]
+			inRecord = true
+
+		case !inRecord:
+			// a stray line; in lenient mode, skip until the next header
+			if !lenientFastQOption {
+				return fmt.Errorf("record %d: expected a line starting with >, found %q",
+					record+1, raw)
+			}
+
+		case exactCaseOption:
+			seq = append(seq, []byte(raw)...)
+
+		default:
+			seq = append(seq, []byte(strings.ToUpper(raw))...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d malformed fasta records.", skipped)
+	}
+	return nil
 }
@@ -21,7 +21,12 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -36,3 +41,176 @@ func TestReadFastQ(t *testing.T) {
 		PrintFastQ(fq)
 	}
 }
+
+// parseTestFastQ() parses the given fastq text and returns the sequences of
+// the records it found.
+func parseTestFastQ(text string) ([]string, error) {
+	records := make(chan *FastQ, 100)
+	err := parseFastQ(strings.NewReader(text), records)
+	close(records)
+	seqs := make([]string, 0)
+	for fq := range records {
+		seqs = append(seqs, string(fq.Seq))
+	}
+	return seqs, err
+}
+
+func TestMalformedFastQ(t *testing.T) {
+	good := "@r1\nACGT\n+\nIIII\n@r2\nCCGG\n+\nIIII\n"
+	tests := []struct {
+		name    string
+		text    string
+		lenient []string // the reads kept in lenient mode
+	}{
+		{"truncated final record", good + "@r3\nTTTT\n+\nII\n", []string{"ACGT", "CCGG"}},
+		{"no quality", good + "@r3\nTTTT\n", []string{"ACGT", "CCGG"}},
+		{"quality too long", "@r1\nACGT\n+\nIIIIII\n" + good, []string{"ACGT", "CCGG"}},
+		{"missing +", "@r1\nACGT\nIIII\n@r2\nCCGG\n+\nIIII\n", []string{"CCGG"}},
+		{"missing @", "@r1\nACGT\n+\nIIII\nr2\nCCGG\n+\nIIII\n@r3\nTTTT\n+\nIIII\n",
+			[]string{"ACGT", "TTTT"}},
+	}
+
+	for _, test := range tests {
+		lenientFastQOption = false
+		if _, err := parseTestFastQ(test.text); err == nil {
+			t.Fatalf("%s: no error", test.name)
+		} else if !strings.Contains(err.Error(), "record ") {
+			t.Fatalf("%s: error doesn't give the record: %v", test.name, err)
+		}
+
+		lenientFastQOption = true
+		seqs, err := parseTestFastQ(test.text)
+		if err != nil {
+			t.Fatalf("%s: error in lenient mode: %v", test.name, err)
+		}
+		if strings.Join(seqs, " ") != strings.Join(test.lenient, " ") {
+			t.Fatalf("%s: lenient mode kept %v, not %v", test.name, seqs, test.lenient)
+		}
+	}
+	lenientFastQOption = false
+
+	if seqs, err := parseTestFastQ(good); err != nil || len(seqs) != 2 {
+		t.Fatalf("Good fastq gave %v, %v", seqs, err)
+	}
+	if _, err := parseTestFastQ("@r1\nACGT\n+\nIIII\n@r2\nCCGG\n+\nIII\n"); err == nil ||
+		!strings.Contains(err.Error(), "record 2") {
+		t.Fatalf("Short quality in record 2 reported as %v", err)
+	}
+}
+
+func TestEstimateReadCount(t *testing.T) {
+	td := newTestData(t, 30, 5000, 100)
+	defer td.Close()
+	est := estimateReadCount(td.readFN)
+	if est < len(td.reads) || est > len(td.reads)*21/20 {
+		t.Fatalf("Estimated %d reads in a file of %d", est, len(td.reads))
+	}
+	if est := estimateReadCount(td.readFN + "," + td.readFN); est < 2*len(td.reads) || est > 2*len(td.reads)*21/20 {
+		t.Fatalf("Estimated %d reads in two files of %d", est, len(td.reads))
+	}
+	if est := estimateReadCount(td.path("missing.fq")); est != 0 {
+		t.Fatalf("Estimated %d reads in a missing file", est)
+	}
+
+	// the slice of reads is about the size of the input, not millions long
+	setTestOptions(8)
+	reads, _ := readAndFlipReads(td.readFN, nil, nil, false)
+	if cap(reads) > len(reads)*21/20 {
+		t.Fatalf("Slice of %d reads has capacity %d", len(reads), cap(reads))
+	}
+}
+
+func TestGzippedReads(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 31, 2000, 60)
+	defer td.Close()
+
+	// gzip the reads, in two members as "cat a.gz b.gz" would give
+	plain, err := ioutil.ReadFile(td.readFN)
+	DIE_ON_ERR(err, "Couldn't read %s", td.readFN)
+	half := bytes.Index(plain[len(plain)/2:], []byte("\n@")) + len(plain)/2 + 1
+	var zipped bytes.Buffer
+	for _, part := range [][]byte{plain[:half], plain[half:]} {
+		z := gzip.NewWriter(&zipped)
+		z.Write(part)
+		z.Close()
+	}
+	gzFN := td.path("reads.fq.gz")
+	DIE_ON_ERR(ioutil.WriteFile(gzFN, zipped.Bytes(), 0644), "Couldn't write %s", gzFN)
+
+	if est := estimateReadCount(gzFN); est != 0 {
+		t.Fatalf("Estimated %d reads from the size of a gzipped file", est)
+	}
+
+	// the streamed, decompressed reads give the same archive as the plain
+	// ones
+	encodeArchive(td.refFile, td.readFN, td.path("plain"))
+	encodeArchive(td.refFile, gzFN, td.path("gz"))
+	exts, err := filepath.Glob(td.path("plain.*"))
+	DIE_ON_ERR(err, "Couldn't list the archive")
+	for _, fn := range exts {
+		ext := strings.TrimPrefix(fn, td.path("plain"))
+		a, errA := ioutil.ReadFile(fn)
+		b, errB := ioutil.ReadFile(td.path("gz" + ext))
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			t.Fatalf("%s differs between plain and gzipped reads (%v, %v)", ext, errA, errB)
+		}
+	}
+
+	decodeArchive(td.refFile, td.path("gz"), td.path("gz.seq"))
+	if got := readDecodedSeqs(t, td.path("gz.seq")); !sameReads(got, td.reads) {
+		t.Fatalf("Reads encoded from a gzipped file don't decode to the input")
+	}
+}
+
+func TestFastaReads(t *testing.T) {
+	setTestOptions(8)
+	readFormatOption = "fasta"
+	td := newTestData(t, 50, 500, 40)
+	defer td.Close()
+
+	// write the reads as fasta, wrapping some of them
+	var buf bytes.Buffer
+	for i, r := range td.reads {
+		fmt.Fprintf(&buf, ">r%d some description\n", i)
+		if i%3 == 0 {
+			fmt.Fprintf(&buf, "%s\n%s\n", strings.ToLower(r[:25]), r[25:])
+		} else {
+			fmt.Fprintf(&buf, "%s\n", r)
+		}
+	}
+	fastaFN := td.path("reads.fa")
+	DIE_ON_ERR(ioutil.WriteFile(fastaFN, buf.Bytes(), 0644), "Couldn't write %s", fastaFN)
+	if est := estimateReadCount(fastaFN); est < len(td.reads)/2 || est > 2*len(td.reads) {
+		t.Fatalf("Estimated %d fasta reads, not about %d", est, len(td.reads))
+	}
+
+	encodeArchive(td.refFile, fastaFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded fasta reads differ from the encoded reads")
+	}
+
+	// malformed records
+	parse := func(text string) ([]string, error) {
+		records := make(chan *FastQ, 100)
+		err := parseFastaReads(strings.NewReader(text), records)
+		close(records)
+		seqs := make([]string, 0)
+		for fq := range records {
+			seqs = append(seqs, string(fq.Seq))
+		}
+		return seqs, err
+	}
+	for _, text := range []string{"ACGT\n>r1\nACGT\n", ">r1\n>r2\nACGT\n", ">r1\nACGT\n>r2\n"} {
+		lenientFastQOption = false
+		if _, err := parse(text); err == nil || !strings.Contains(err.Error(), "record ") {
+			t.Fatalf("%q: got error %v", text, err)
+		}
+		lenientFastQOption = true
+		if seqs, err := parse(text); err != nil || len(seqs) != 1 || seqs[0] != "ACGT" {
+			t.Fatalf("%q: lenient mode gave %v, %v", text, seqs, err)
+		}
+	}
+	lenientFastQOption = false
+}
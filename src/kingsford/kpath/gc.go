@@ -0,0 +1,102 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// gcCount() returns the number of Gs and Cs (in either case) in s; Ns and
+// other bytes don't count.
+func gcCount(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'G', 'C', 'g', 'c':
+			n++
+		}
+	}
+	return n
+}
+
+// writeGC() writes the GC count of each of the reads, in the order they are
+// encoded, as unsigned varints. The count is of the read as it was read, so
+// its Ns and exceptions don't count unless they were g or c.
+func writeGC(w io.Writer, reads readStream) error {
+	buf := bufio.NewWriter(w)
+	var v [binary.MaxVarintLen64]byte
+	err := reads.each(func(fq *FastQ) error {
+		_, err := buf.Write(v[:binary.PutUvarint(v[:], uint64(gcCount(fq.Original())))])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// readGC() reads the GC counts written by writeGC(). If the file does not
+// exist, returns nil.
+func readGC(gcFN string) []int {
+	in, err := os.Open(gcFN)
+	if err != nil {
+		return nil
+	}
+	defer in.Close()
+	log.Printf("Reading GC counts from %v", gcFN)
+
+	inZ, err := openSidecar(in)
+	DIE_ON_ERR(err, "Couldn't create unzipper for %s", gcFN)
+	defer inZ.Close()
+
+	gc, err := parseGC(bufio.NewReader(inZ))
+	DIE_ON_ERR(err, "Bad GC counts in %s", gcFN)
+	return gc
+}
+
+// parseGC() parses the varints written by writeGC().
+func parseGC(in io.ByteReader) ([]int, error) {
+	gc := make([]int, 0, 1024)
+	for {
+		n, err := binary.ReadUvarint(in)
+		if err == io.EOF {
+			return gc, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %d: %v", len(gc), err)
+		}
+		gc = append(gc, int(n))
+	}
+}
+
+// gcName() returns the id of the read decoded just now by the iterator with
+// its GC count added, as in "R12 gc=31" (see -gc).
+func (it *ReadIterator) gcName(id string) string {
+	DIE_IF(it.seg.gc == nil, "%s has no GC counts (encode with -gc to record them)", id)
+	DIE_IF(it.segN > len(it.seg.gc), "The GC counts end before %s", id)
+	return id + " gc=" + strconv.Itoa(it.seg.gc[it.segN-1])
+}
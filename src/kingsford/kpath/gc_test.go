@@ -0,0 +1,84 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseGC(t *testing.T) {
+	gc, err := parseGC(bytes.NewReader([]byte{0, 31, 200, 1}))
+	if err != nil || len(gc) != 3 || gc[0] != 0 || gc[1] != 31 || gc[2] != 200 {
+		t.Fatalf("Parsed %v, %v", gc, err)
+	}
+	if _, err := parseGC(bytes.NewReader([]byte{3, 0x80})); err == nil {
+		t.Fatalf("Parsed a truncated varint")
+	}
+}
+
+func TestGCRoundTrip(t *testing.T) {
+	for _, runs := range []bool{false, true} {
+		setTestOptions(8)
+		td := newTestData(t, 25, 600, 40)
+		defer td.Close()
+
+		gcOption = true
+		dupRunsOption = runs
+		archive := td.path("gc")
+		encodeArchive(td.refFile, td.readFN, archive)
+		decodeArchive(td.refFile, archive, archive+".fa")
+
+		f, err := os.Open(archive + ".fa")
+		if err != nil {
+			t.Fatalf("Couldn't open decoded reads: %v", err)
+		}
+		defer f.Close()
+		seqs := make([]string, 0)
+		scanner := bufio.NewScanner(f)
+		gc := -1
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, ">") {
+				i := strings.Index(line, " gc=")
+				if i < 0 {
+					t.Fatalf("No GC count in %q", line)
+				}
+				gc, err = strconv.Atoi(line[i+len(" gc="):])
+				if err != nil {
+					t.Fatalf("Bad GC count in %q", line)
+				}
+				continue
+			}
+			if n := gcCount(line); n != gc {
+				t.Fatalf("Read %q has %d Gs and Cs, but was recorded with %d", line, n, gc)
+			}
+			seqs = append(seqs, line)
+		}
+		if !sameReads(seqs, td.reads) {
+			t.Fatalf("The reads decoded with -gc are wrong (runs %v)", runs)
+		}
+	}
+}
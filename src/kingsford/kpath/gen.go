@@ -0,0 +1,179 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// genSeqLen is the length of each sequence of a generated reference; the
+// last one may be shorter.
+const genSeqLen = 1 << 20
+
+// A genSpec describes the synthetic data written by generateData(): a random
+// reference of the given number of bases, and reads sampled from it.
+type genSpec struct {
+	refBases int     // the total length of the reference
+	reads    int     // the number of reads
+	readLen  int     // the length of every read
+	errRate  float64 // the chance that a base of a read is changed
+	nRate    float64 // the chance that a base of a read is an N
+	dupRate  float64 // the chance that a read repeats the one before it
+	seed     int64   // the seed of the random numbers, so data can be reproduced
+}
+
+// check() returns an error if the spec can't be generated.
+func (g genSpec) check() error {
+	switch {
+	case g.refBases <= 0:
+		return fmt.Errorf("the reference must have some bases")
+	case g.readLen <= 0 || g.readLen > g.refBases:
+		return fmt.Errorf("the read length must be between 1 and the reference length, %d", g.refBases)
+	case g.readLen > genSeqLen:
+		return fmt.Errorf("the read length must be at most %d", genSeqLen)
+	case g.reads < 0:
+		return fmt.Errorf("the number of reads must not be negative")
+	}
+	for _, p := range []float64{g.errRate, g.nRate, g.dupRate} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("rates must be between 0 and 1, not %v", p)
+		}
+	}
+	return nil
+}
+
+// generateReference() returns the random sequences of the reference.
+func generateReference(rng *rand.Rand, bases int) []string {
+	seqs := make([]string, 0, bases/genSeqLen+1)
+	for bases > 0 {
+		n := bases
+		if n > genSeqLen {
+			n = genSeqLen
+		}
+		s := make([]byte, n)
+		for i := range s {
+			s[i] = ALPHA[rng.Intn(len(ALPHA))]
+		}
+		seqs = append(seqs, string(s))
+		bases -= n
+	}
+	return seqs
+}
+
+// writeGeneratedReference() writes the sequences to w as multifasta, with
+// lines of 60 bases.
+func writeGeneratedReference(w io.Writer, seqs []string) error {
+	out := bufio.NewWriter(w)
+	for i, s := range seqs {
+		fmt.Fprintf(out, ">gen%d\n", i+1)
+		for len(s) > 60 {
+			out.WriteString(s[:60])
+			out.WriteByte('\n')
+			s = s[60:]
+		}
+		out.WriteString(s)
+		out.WriteByte('\n')
+	}
+	return out.Flush()
+}
+
+// writeGeneratedReads() writes spec.reads reads sampled from the sequences
+// long enough for them to w as fastq. Each read comes from a random place on
+// either strand; its bases are then changed to another base with probability
+// spec.errRate or to N with probability spec.nRate. With probability
+// spec.dupRate a read is instead a copy of the one before it, as a PCR
+// duplicate would be.
+func writeGeneratedReads(w io.Writer, rng *rand.Rand, seqs []string, spec genSpec) error {
+	long := make([]string, 0, len(seqs))
+	for _, s := range seqs {
+		if len(s) >= spec.readLen {
+			long = append(long, s)
+		}
+	}
+	out := newFastqWriter(w)
+	r := make([]byte, spec.readLen)
+	for i := 0; i < spec.reads; i++ {
+		if i == 0 || rng.Float64() >= spec.dupRate {
+			s := long[rng.Intn(len(long))]
+			p := rng.Intn(len(s) - spec.readLen + 1)
+			copy(r, s[p:p+spec.readLen])
+			if rng.Intn(2) == 0 {
+				copy(r, reverseComplement(string(r)))
+			}
+			for j := range r {
+				switch x := rng.Float64(); {
+				case x < spec.nRate:
+					r[j] = 'N'
+				case x < spec.nRate+spec.errRate:
+					r[j] = ALPHA[(int(acgt(r[j]))+1+rng.Intn(len(ALPHA)-1))%len(ALPHA)]
+				}
+			}
+		}
+		if err := out.Write("G"+strconv.Itoa(i), string(r), nil); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// createGzipped() creates the file fn and calls write() with a gzipper for
+// it.
+func createGzipped(fn string, write func(w io.Writer) error) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	z := gzip.NewWriter(f)
+	if err := write(z); err != nil {
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// generateData() writes a synthetic reference to refFile (gzipped
+// multifasta) and reads sampled from it to readFile (gzipped fastq), as
+// described by spec. The same spec always gives the same files.
+func generateData(spec genSpec, refFile, readFile string) {
+	DIE_ON_ERR(spec.check(), "Can't generate the data")
+	rng := rand.New(rand.NewSource(spec.seed))
+
+	log.Printf("Writing a reference of %d bases to %s", spec.refBases, refFile)
+	seqs := generateReference(rng, spec.refBases)
+	DIE_ON_ERR(createGzipped(refFile, func(w io.Writer) error {
+		return writeGeneratedReference(w, seqs)
+	}), "Couldn't write %s", refFile)
+
+	log.Printf("Writing %d reads of length %d to %s", spec.reads, spec.readLen, readFile)
+	DIE_ON_ERR(createGzipped(readFile, func(w io.Writer) error {
+		return writeGeneratedReads(w, rng, seqs, spec)
+	}), "Couldn't write %s", readFile)
+}
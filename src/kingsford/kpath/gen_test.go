@@ -0,0 +1,102 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// readGeneratedReads() returns the sequences of the reads in the gzipped
+// fastq file fn, Ns and all.
+func readGeneratedReads(fn string) []string {
+	fq := make(chan *FastQ, readBufferSize)
+	go ReadFastQ(fn, fq)
+	reads := make([]string, 0)
+	for rec := range fq {
+		reads = append(reads, string(rec.Original()))
+	}
+	return reads
+}
+
+func TestGenSpec(t *testing.T) {
+	good := genSpec{refBases: 100, reads: 10, readLen: 100, dupRate: 1}
+	if err := good.check(); err != nil {
+		t.Fatalf("Good spec rejected: %v", err)
+	}
+	for _, bad := range []genSpec{
+		{refBases: 0, reads: 10, readLen: 10},
+		{refBases: 100, reads: 10, readLen: 101},
+		{refBases: 100, reads: -1, readLen: 10},
+		{refBases: 100, reads: 10, readLen: 10, errRate: 1.5},
+		{refBases: 100, reads: 10, readLen: 10, nRate: -0.1},
+	} {
+		if err := bad.check(); err == nil {
+			t.Fatalf("Bad spec %+v accepted", bad)
+		}
+	}
+}
+
+func TestGenerateData(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 35, 1, 40)
+	defer td.Close()
+
+	spec := genSpec{refBases: 6000, reads: 500, readLen: 50, errRate: 0.01, nRate: 0.01, dupRate: 0.2, seed: 7}
+	refFile, readFile := td.path("gen.fa.gz"), td.path("gen.fq.gz")
+	generateData(spec, refFile, readFile)
+	reads := readGeneratedReads(readFile)
+	if len(reads) != spec.reads {
+		t.Fatalf("Generated %d reads, not %d", len(reads), spec.reads)
+	}
+	dups, ns := 0, 0
+	for i, r := range reads {
+		if len(r) != spec.readLen {
+			t.Fatalf("Read %d has length %d, not %d", i, len(r), spec.readLen)
+		}
+		if i > 0 && r == reads[i-1] {
+			dups++
+		}
+		ns += strings.Count(r, "N")
+	}
+	if dups < 50 || dups > 150 || ns == 0 {
+		t.Fatalf("%d duplicates and %d Ns in 500 reads, for a rate of 0.2 and 0.01", dups, ns)
+	}
+
+	// the same spec gives the same files
+	generateData(spec, td.path("again.fa.gz"), td.path("again.fq.gz"))
+	for _, pair := range [][2]string{{refFile, td.path("again.fa.gz")}, {readFile, td.path("again.fq.gz")}} {
+		a, errA := ioutil.ReadFile(pair[0])
+		b, errB := ioutil.ReadFile(pair[1])
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			t.Fatalf("%s and %s differ (%v, %v)", pair[0], pair[1], errA, errB)
+		}
+	}
+
+	// and the data round trips
+	encodeArchive(refFile, readFile, td.path("out"))
+	decodeArchive(refFile, td.path("out"), td.path("decoded.fa"))
+	if !sameReads(readDecodedSeqs(t, td.path("decoded.fa")), reads) {
+		t.Fatalf("Generated reads don't decode to themselves")
+	}
+}
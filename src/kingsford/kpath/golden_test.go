@@ -0,0 +1,170 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The golden tests encode the fixtures in testdata/golden and check that the
+// archives are the same as the ones stored there, which were made when the
+// fixture was added. Each fixture directory holds a reference (ref.fa.gz),
+// reads (reads.fq), the encode options (options), and the archive (out.*).
+// If a change to the archive format is intended, rerun the tests with
+// -golden to rewrite the stored archives, and check the difference in.
+var updateGolden = flag.Bool("golden", false, "rewrite the archives in testdata/golden")
+
+// goldenFiles are the archive files that are compared. All but .enc and
+// .meta are gzipped and are compared after unzipping, since the gzip
+// container itself can change with the version of Go.
+var goldenFiles = []string{".enc", ".meta", ".bittree", ".counts", ".flipped", ".ns", ".runs", ".idx"}
+
+// provenanceKeys are the keys of the metadata that record where an archive
+// came from rather than how to decode it. They are left out of the
+// comparison, since the command line differs from run to run.
+var provenanceKeys = []string{"version ", "command ", "model ", "option "}
+
+// readGoldenFile() returns the contents of the archive file fn, unzipped if
+// need be and without the provenanceKeys of .meta, or nil if the file does
+// not exist.
+func readGoldenFile(t *testing.T, fn string) []byte {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", fn, err)
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if ext := filepath.Ext(fn); ext != ".enc" && ext != ".meta" {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Couldn't unzip %s: %v", fn, err)
+		}
+		defer z.Close()
+		in = z
+	}
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fn, err)
+	}
+	if filepath.Ext(fn) == ".meta" {
+		var kept bytes.Buffer
+		for _, line := range strings.SplitAfter(string(b), "\n") {
+			provenance := false
+			for _, key := range provenanceKeys {
+				provenance = provenance || strings.HasPrefix(line, key)
+			}
+			if !provenance {
+				kept.WriteString(line)
+			}
+		}
+		b = kept.Bytes()
+	}
+	return b
+}
+
+// readTestReads() reads the sequences of a fastq file written by
+// writeTestReads().
+func readTestReads(t *testing.T, fn string) []string {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open reads: %v", err)
+	}
+	defer f.Close()
+	reads := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan(); i++ {
+		if i%4 == 1 {
+			reads = append(reads, scanner.Text())
+		}
+	}
+	return reads
+}
+
+// setGoldenOptions() sets the options given in the fixture's options file.
+func setGoldenOptions(t *testing.T, dir string) {
+	opts, err := ioutil.ReadFile(filepath.Join(dir, "options"))
+	if err != nil {
+		t.Fatalf("Couldn't read options: %v", err)
+	}
+	setTestOptions(8)
+	if err := encodeFlags.Parse(strings.Fields(string(opts))); err != nil {
+		t.Fatalf("Bad options in %s: %v", dir, err)
+	}
+	setShiftKmerMask()
+}
+
+func TestGoldenArchives(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("No golden fixtures found: %v", err)
+	}
+	for _, dir := range fixtures {
+		tmp, err := ioutil.TempDir("", "kpath-golden-")
+		if err != nil {
+			t.Fatalf("Couldn't create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tmp)
+
+		refFN := filepath.Join(dir, "ref.fa.gz")
+		readsFN := filepath.Join(dir, "reads.fq")
+		golden := filepath.Join(dir, "out")
+		setGoldenOptions(t, dir)
+		encodeArchive(refFN, readsFN, filepath.Join(tmp, "out"))
+
+		for _, ext := range goldenFiles {
+			got := readGoldenFile(t, filepath.Join(tmp, "out"+ext))
+			if *updateGolden {
+				os.Remove(golden + ext)
+				if got != nil {
+					if err := copyFile(filepath.Join(tmp, "out"+ext), golden+ext); err != nil {
+						t.Fatalf("Couldn't update %s: %v", golden+ext, err)
+					}
+				}
+				continue
+			}
+			want := readGoldenFile(t, golden+ext)
+			if (got == nil) != (want == nil) || !bytes.Equal(got, want) {
+				t.Errorf("%s: out%s differs from the golden archive", dir, ext)
+			}
+		}
+
+		// the golden archive must still decode to the reads
+		setGoldenOptions(t, dir)
+		decodeArchive(refFN, golden, filepath.Join(tmp, "decoded.fa"))
+		got := readDecodedSeqs(t, filepath.Join(tmp, "decoded.fa"))
+		if !sameReads(got, readTestReads(t, readsFN)) {
+			t.Errorf("%s: golden archive decodes to the wrong reads", dir)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+With -lowcomplex, reads that are a single base repeated (such as polyA or
+polyG reads, which some protocols produce in large numbers) are not coded base
+by base. Their prefix is one of the 4 homopolymer buckets, and in each of
+those buckets the homopolymer reads sort together, so their tails are just
+recorded in the .homo file as a range of the bucket's tails: the decoder
+fills them with the bucket's base instead of decoding them, and the
+arithmetic coder never sees them. A read that is one base apart from Ns counts
+too; its Ns are stored as As like any other, but are put back from the .ns
+file as usual.
+*/
+
+// A homopolymerTails is the range of tails of a bucket, numbered from 0 in
+// the order they are encoded, that are all the bucket's base.
+type homopolymerTails struct {
+	first int
+	n     int
+}
+
+// homopolymerBase() returns the base the read consists of, ignoring its Ns,
+// or 0 if it has more than one base (or none).
+func homopolymerBase(q *FastQ) byte {
+	isN := make(map[byte]bool, len(q.NLocations))
+	for _, p := range q.NLocations {
+		isN[p] = true
+	}
+	var base byte
+	for i, c := range q.Seq {
+		switch {
+		case isN[byte(i)]:
+		case base == 0:
+			base = c
+		case c != base:
+			return 0
+		}
+	}
+	return base
+}
+
+// fillHomopolymerNs() replaces the Ns of each read that is one base apart
+// from its Ns by that base, so that the processed read is a homopolymer, and
+// returns the number of homopolymer reads. The Ns are still in NLocations.
+func fillHomopolymerNs(reads []*FastQ) int {
+	n := 0
+	for _, q := range reads {
+		base := homopolymerBase(q)
+		if base == 0 {
+			continue
+		}
+		for _, p := range q.NLocations {
+			q.Seq[p] = base
+		}
+		n++
+	}
+	return n
+}
+
+// isHomopolymer() returns true if s is a single base repeated.
+func isHomopolymer(s []byte) bool {
+	for _, c := range s {
+		if c != s[0] {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// listHomopolymers() returns, for each bucket with homopolymer reads, the
+// range of its tails that they have, given the sorted reads and the counts
+// and runs found by listBuckets(). The tails are numbered as
+// encodeReadsFromTempFile() encodes them: one for each run of identical
+// reads.
+func listHomopolymers(reads readStream, counts []int, runs map[int][]int) map[int]homopolymerTails {
+	homopolymers := make(map[int]homopolymerTails)
+	b, t := -1, 0
+	var tails []int
+	left := 0 // the reads of tail t of bucket b still to go
+	DIE_ON_ERR(reads.each(func(fq *FastQ) error {
+		if left == 0 {
+			// the read starts the next tail
+			if t++; b < 0 || t == len(tails) {
+				b, t = b+1, 0
+				tails = bucketTails(counts[b], runs[b])
+			}
+			left = tails[t]
+			if isHomopolymer(fq.Seq) {
+				h, ok := homopolymers[b]
+				if !ok {
+					h.first = t
+				}
+				h.n++
+				homopolymers[b] = h
+			}
+		}
+		left--
+		return nil
+	}), "Couldn't read the sorted reads")
+	return homopolymers
+}
+
+// bucketTails() returns the number of reads of each tail of a bucket with
+// count c and the given runs, as listBuckets() finds them.
+func bucketTails(c int, runs []int) []int {
+	if c < 0 {
+		return []int{-c}
+	}
+	tails := append([]int(nil), runs...)
+	left := c
+	for _, length := range tails {
+		left -= length
+	}
+	for ; left > 0; left-- {
+		tails = append(tails, 1)
+	}
+	return tails
+}
+
+// writeHomopolymers() writes the ranges of homopolymer tails, one bucket per
+// line: the bucket, the first tail and the number of tails.
+func writeHomopolymers(f io.Writer, homopolymers map[int]homopolymerTails) error {
+	bs := make([]int, 0, len(homopolymers))
+	for b := range homopolymers {
+		bs = append(bs, b)
+	}
+	sort.Ints(bs)
+
+	w := bufio.NewWriter(f)
+	for _, b := range bs {
+		h := homopolymers[b]
+		fmt.Fprintf(w, "%d %d %d\n", b, h.first, h.n)
+	}
+	return w.Flush()
+}
+
+// readHomopolymers() reads the ranges written by writeHomopolymers(). If the
+// file does not exist, returns nil.
+func readHomopolymers(homoFN string) map[int]homopolymerTails {
+	in, err := os.Open(homoFN)
+	if err != nil {
+		return nil
+	}
+	defer in.Close()
+	log.Printf("Reading homopolymer reads from %v", homoFN)
+
+	z, err := gzip.NewReader(in)
+	DIE_ON_ERR(err, "Couldn't create gzip reader for %s", homoFN)
+	defer z.Close()
+
+	homopolymers := make(map[int]homopolymerTails)
+	scanner := bufio.NewScanner(z)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		DIE_IF(len(fields) != 3, "Bad line in %s: %q", homoFN, scanner.Text())
+		var v [3]int
+		for i := range v {
+			v[i], err = strconv.Atoi(fields[i])
+			DIE_IF(err != nil || v[i] < 0, "Bad line in %s: %q", homoFN, scanner.Text())
+		}
+		homopolymers[v[0]] = homopolymerTails{v[1], v[2]}
+	}
+	DIE_ON_ERR(scanner.Err(), "Couldn't read %s", homoFN)
+	return homopolymers
+}
+
+// contains() returns true if the t-th tail of the bucket is in the range.
+func (h homopolymerTails) contains(t int) bool {
+	return t >= h.first && t < h.first+h.n
+}
@@ -0,0 +1,240 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"kingsford/kpath/arithc"
+	"kingsford/kpath/bitio"
+)
+
+/*
+An archive encoded with -index=N restarts the arithmetic coder (and the
+default distribution) on a byte boundary every N buckets, so each block of N
+buckets can be decoded without decoding the ones before it. Since the model
+is not updated (-update=false is required), the model at the start of every
+block is just the reference model. OUT.idx (gzipped) has one line per block:
+
+    bucket offset reads
+
+giving the first bucket of the block, the byte offset of its stream from the
+start of the segment's stream, and the number of reads in the buckets before
+it (which is where the block's reads start in the .ns and .flipped files).
+*/
+
+// A blockIndexEntry describes the start of one block.
+type blockIndexEntry struct {
+	bucket int
+	offset int64
+	reads  int
+}
+
+// A blockIndexWriter writes a block index file.
+type blockIndexWriter struct {
+	f *os.File
+	z *gzip.Writer
+}
+
+// createBlockIndex() creates the block index file with the given name for
+// the segment with the given archive id.
+func createBlockIndex(filename string, id archiveID) *blockIndexWriter {
+	f, err := os.Create(filename)
+	DIE_ON_ERR(err, "Couldn't create index file %s", filename)
+	z, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	DIE_ON_ERR(err, "Couldn't create gzipper for index file")
+	setSidecarID(z, id)
+	return &blockIndexWriter{f, z}
+}
+
+// Add() writes the entry for the next block.
+func (w *blockIndexWriter) Add(e blockIndexEntry) {
+	_, err := fmt.Fprintf(w.z, "%d %d %d\n", e.bucket, e.offset, e.reads)
+	DIE_ON_ERR(err, "Couldn't write to index file %s", w.f.Name())
+}
+
+// Close() finishes the index file.
+func (w *blockIndexWriter) Close() error {
+	if err := w.z.Close(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+// readBlockIndex() parses a block index written by blockIndexWriter.
+func readBlockIndex(r io.Reader) ([]blockIndexEntry, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	index := make([]blockIndexEntry, 0)
+	scanner := bufio.NewScanner(z)
+	for scanner.Scan() {
+		var e blockIndexEntry
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &e.bucket, &e.offset, &e.reads); err != nil {
+			return nil, fmt.Errorf("bad index line %q: %v", scanner.Text(), err)
+		}
+		index = append(index, e)
+	}
+	return index, scanner.Err()
+}
+
+// loadBlockIndex() reads the block index file with the given name.
+func loadBlockIndex(filename string) []blockIndexEntry {
+	f, err := os.Open(filename)
+	DIE_ON_ERR(err, "Couldn't open index file %s (encode with -index to create it)", filename)
+	defer f.Close()
+	index, err := readBlockIndex(f)
+	DIE_ON_ERR(err, "Couldn't read index file %s", filename)
+	return index
+}
+
+// parseRange() parses START:END, as given to -buckets and -readrange. Either
+// may be omitted, meaning the first and one past the last respectively.
+func parseRange(s string) (start, end int, err error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("%q is not of the form START:END", s)
+	}
+	end = math.MaxInt32
+	if fields[0] != "" {
+		if start, err = strconv.Atoi(fields[0]); err != nil {
+			return
+		}
+	}
+	if fields[1] != "" {
+		if end, err = strconv.Atoi(fields[1]); err != nil {
+			return
+		}
+	}
+	if start < 0 || end < start {
+		err = fmt.Errorf("%q is not a range", s)
+	}
+	return
+}
+
+// BucketRange() returns an iterator over the reads of buckets start to end-1
+// of the archive with basename archive, which must have a single segment and
+// have been encoded with -index. Decoding starts at the block containing
+// bucket start; the reads of the block before it are decoded and dropped.
+func (ar *ArchiveReader) BucketRange(archive string, start, end int, st *codingState) *ReadIterator {
+	DIE_IF(len(ar.segs) != 1, "Can't decode a range of buckets from an archive with appended reads")
+	seg := ar.segs[0]
+	if end > len(seg.counts) {
+		end = len(seg.counts)
+	}
+	if start > end {
+		start = end
+	}
+
+	// find the block holding the first bucket
+	DIE_IF(seg.blocks == nil, "No index file %s (encode with -index to create it)", archive+".idx")
+	b := 0
+	for b+1 < len(seg.blocks) && seg.blocks[b+1].bucket <= start {
+		b++
+	}
+	block := seg.blocks[b]
+	log.Printf("Decoding buckets [%d, %d) starting from block %d at bucket %d",
+		start, end, b, block.bucket)
+
+	part := &archiveSegment{
+		kmers:     seg.kmers[block.bucket:end],
+		counts:    seg.counts[block.bucket:end],
+		readLen:   seg.readLen,
+		decoder:   seg.openBlock(block.offset),
+		ntails:    -1,
+		openBlock: seg.openBlock,
+	}
+	// the part's buckets are numbered from the start of the block
+	if seg.runs != nil {
+		part.runs = make(map[int][]int)
+		for b, r := range seg.runs {
+			if b >= block.bucket && b < end {
+				part.runs[b-block.bucket] = r
+			}
+		}
+	}
+	if seg.homopolymers != nil {
+		part.homopolymers = make(map[int]homopolymerTails)
+		for b, h := range seg.homopolymers {
+			if b >= block.bucket && b < end {
+				part.homopolymers[b-block.bucket] = h
+			}
+		}
+	}
+	for _, e := range seg.blocks[b:] {
+		if e.bucket < end {
+			e.bucket -= block.bucket
+			part.blocks = append(part.blocks, e)
+		}
+	}
+	if seg.isFlipped != nil {
+		part.isFlipped = seg.isFlipped[block.reads:]
+	}
+	if seg.nLocations != nil {
+		part.nLocations = seg.nLocations[block.reads:]
+	}
+	if seg.exceptions != nil {
+		part.exceptions = seg.exceptions[block.reads:]
+	}
+	if seg.corrections != nil {
+		part.corrections = seg.corrections[block.reads:]
+	}
+	if seg.gc != nil {
+		part.gc = seg.gc[block.reads:]
+	}
+	if seg.positions != nil {
+		part.positions = seg.positions[block.bucket:end]
+	}
+	if seg.order != nil {
+		part.order = seg.order[block.reads:]
+	}
+
+	km := ar.km
+	it := newSegmentIterator(st, []*archiveSegment{part}, func() KmerModel { return km })
+	skip := sumAbs(seg.counts[block.bucket:start])
+	for i := 0; i < skip; i++ {
+		it.Next()
+	}
+	return it
+}
+
+// decoderAt() returns a decoder for the block that starts at the given byte
+// offset into the stream of the segment that starts at segOffset of f.
+func decoderAt(f *os.File, segOffset int64, offset int64) *arithc.Decoder {
+	h, err := readSegmentHeader(io.NewSectionReader(f, segOffset, segmentHeaderLen))
+	DIE_ON_ERR(err, "Couldn't read segment header from %s", f.Name())
+	start := segOffset + segmentHeaderLen + offset
+	section := io.NewSectionReader(f, start, int64(h.nbytes)-offset)
+	decoder, err := arithc.NewDecoder(bitio.NewReader(bufio.NewReader(section)))
+	DIE_ON_ERR(err, "Couldn't create decoder!")
+	return decoder
+}
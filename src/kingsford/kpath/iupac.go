@@ -0,0 +1,174 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+A reference may have IUPAC codes for ambiguous bases (R for A or G, and so
+on), which have no 2-bit code. Before the kmers of the reference are counted,
+resolveIUPAC() rewrites the sequences so that they have none, in one of two
+ways, chosen with -iupac:
+
+    expand: each window that covers ambiguous bases is seeded once for each
+            base they could be, so a degenerate region of the reference gives
+            the model all of its possible contexts.
+    skip:   the windows that cover ambiguous bases are left out.
+
+N is not ambiguous in this sense: as always, it counts as A. The choice
+changes the model, so the encoder records it in OUT.meta and the decoder
+follows the archive.
+*/
+
+// iupacBases gives the bases each ambiguous IUPAC code stands for.
+var iupacBases = map[byte]string{
+	'R': "AG", 'Y': "CT", 'S': "CG", 'W': "AT", 'K': "GT", 'M': "AC",
+	'B': "CGT", 'D': "AGT", 'H': "ACT", 'V': "ACG",
+}
+
+// maxIUPACExpansions is the number of sequences a cluster of nearby
+// ambiguous bases may expand to; the windows of a cluster with more
+// possibilities are skipped instead.
+const maxIUPACExpansions = 256
+
+// checkIUPACMode() returns an error unless mode is a value of -iupac.
+func checkIUPACMode(mode string) error {
+	if mode != "expand" && mode != "skip" {
+		return fmt.Errorf("-iupac must be expand or skip, not %q", mode)
+	}
+	return nil
+}
+
+// resolveIUPAC() returns the sequences rewritten, as refIUPACOption says, so
+// that the windows of k+1 bases of the result (a context of length k and the
+// base after it) are those of the original with no ambiguous bases, and,
+// with -iupac=expand, every way of reading those that have some. Some
+// windows may appear more than once, which does not matter when they seed the
+// model. The sequences are returned unchanged if they have no ambiguous
+// bases.
+func resolveIUPAC(seqs []string, k int) []string {
+	var out []string
+	skipped := 0
+	for i, s := range seqs {
+		amb := ambiguousPositions(s)
+		if len(amb) == 0 {
+			if out != nil {
+				out = append(out, s)
+			}
+			continue
+		}
+		if out == nil {
+			out = append(make([]string, 0, len(seqs)), seqs[:i]...)
+		}
+
+		// the pieces between the ambiguous bases have the other windows
+		start := 0
+		for _, p := range amb {
+			if p-start > k {
+				out = append(out, s[start:p])
+			}
+			start = p + 1
+		}
+		if len(s)-start > k {
+			out = append(out, s[start:])
+		}
+		if refIUPACOption != "expand" {
+			skipped += len(amb)
+			continue
+		}
+
+		// ambiguous bases less than k apart share windows, so each
+		// cluster of them is expanded together, with k bases either side
+		for c := 0; c < len(amb); {
+			e := c + 1
+			for e < len(amb) && amb[e]-amb[e-1] <= k {
+				e++
+			}
+			from, to := amb[c]-k, amb[e-1]+k+1
+			if from < 0 {
+				from = 0
+			}
+			if to > len(s) {
+				to = len(s)
+			}
+			pieces, ok := expandIUPAC(s[from:to])
+			if ok {
+				out = append(out, pieces...)
+			} else {
+				skipped += e - c
+			}
+			c = e
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped the windows of %d ambiguous bases in the reference.", skipped)
+	}
+	if out == nil {
+		return seqs
+	}
+	return out
+}
+
+// ambiguousPositions() returns the positions of the ambiguous IUPAC codes in
+// s, in order.
+func ambiguousPositions(s string) []int {
+	var amb []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'A', 'C', 'G', 'T', 'N':
+		default:
+			if _, ok := iupacBases[s[i]]; ok {
+				amb = append(amb, i)
+			}
+		}
+	}
+	return amb
+}
+
+// expandIUPAC() returns every sequence s could be, reading each ambiguous
+// base as each of the bases it stands for. It returns false if there would be
+// more than maxIUPACExpansions of them.
+func expandIUPAC(s string) ([]string, bool) {
+	out := []string{""}
+	for i := 0; i < len(s); i++ {
+		bases, ok := iupacBases[s[i]]
+		if !ok {
+			for j := range out {
+				out[j] += s[i : i+1]
+			}
+			continue
+		}
+		if len(out)*len(bases) > maxIUPACExpansions {
+			return nil, false
+		}
+		next := make([]string, 0, len(out)*len(bases))
+		for _, o := range out {
+			for j := 0; j < len(bases); j++ {
+				next = append(next, o+bases[j:j+1])
+			}
+		}
+		out = next
+	}
+	return out, true
+}
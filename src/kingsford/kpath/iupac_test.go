@@ -0,0 +1,142 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// modelTransitions() lists the transitions the model has seen, as
+// "context>next".
+func modelTransitions(km KmerModel, k int) []string {
+	var out []string
+	km.Iterate(func(c Kmer, dist [len(ALPHA)]KmerCount) {
+		for next, v := range dist {
+			if v > 0 {
+				out = append(out, kmerToString(c, k)+">"+string(ALPHA[next]))
+			}
+		}
+	})
+	sort.Strings(out)
+	return out
+}
+
+func TestIUPACReference(t *testing.T) {
+	setTestOptions(2)
+	ref := []string{"ACRGT"}
+	for _, c := range []struct {
+		mode string
+		want string
+	}{
+		// R is A or G, so ACR is ACA or ACG, and so on
+		{"expand", "AC>A AC>G AG>T CA>G CG>G GG>T"},
+		// every window covers the R
+		{"skip", ""},
+	} {
+		refIUPACOption = c.mode
+		got := strings.Join(modelTransitions(countKmersInReference(2, ref), 2), " ")
+		if got != c.want {
+			t.Fatalf("With -iupac=%s, the model has %q, not %q", c.mode, got, c.want)
+		}
+
+		// the flip set has the same contexts
+		ks := kmerSetFromReference(2, ref)
+		var contexts []string
+		for kmer := uint64(0); kmer < 16; kmer++ {
+			if ks.Contains(Kmer(kmer)) {
+				contexts = append(contexts, kmerToString(Kmer(kmer), 2))
+			}
+		}
+		if want := contextsOf(c.want); strings.Join(contexts, " ") != want {
+			t.Fatalf("With -iupac=%s, the flip set has %v, not %s", c.mode, contexts, want)
+		}
+	}
+
+	// windows away from the ambiguous bases are kept either way, and a
+	// cluster with too many possibilities is skipped even when expanding
+	for _, mode := range []string{"expand", "skip"} {
+		refIUPACOption = mode
+		got := strings.Join(modelTransitions(countKmersInReference(2, []string{"ACGT" + "BBBBBB" + "TTGC"}), 2), " ")
+		if want := "AC>G CG>T TG>C TT>G"; got != want {
+			t.Fatalf("With -iupac=%s, the model has %q, not %q", mode, got, want)
+		}
+	}
+
+	// without ambiguous bases the sequences are used as they are
+	seqs := []string{"ACGTN", "TTTT"}
+	if got := resolveIUPAC(seqs, 2); &got[0] != &seqs[0] {
+		t.Fatalf("Sequences without IUPAC codes were copied")
+	}
+}
+
+// contextsOf() returns the distinct contexts of the "context>next"
+// transitions, in order.
+func contextsOf(transitions string) string {
+	var out []string
+	for _, tr := range strings.Fields(transitions) {
+		c := tr[:strings.Index(tr, ">")]
+		if len(out) == 0 || out[len(out)-1] != c {
+			out = append(out, c)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func TestIUPACArchive(t *testing.T) {
+	td := newTestData(t, 47, 500, 40)
+	defer td.Close()
+
+	// put IUPAC codes through the reference
+	setTestOptions(8)
+	ref := readReferenceFile(td.refFile)
+	for i, s := range ref {
+		b := []byte(s)
+		for j := 50; j < len(b); j += 97 {
+			b[j] = "RYSWKMBDHV"[j%10]
+		}
+		ref[i] = string(b)
+	}
+	writeTestReference(t, td.refFile, ref)
+
+	for _, mode := range []string{"expand", "skip"} {
+		setTestOptions(8)
+		refIUPACOption = mode
+		out := td.path("out-" + mode)
+		encodeArchive(td.refFile, td.readFN, out)
+		meta := loadArchiveMeta(out + ".meta")
+		if iupacFor(meta) != mode {
+			t.Fatalf("Metadata records -iupac=%s, not %s", iupacFor(meta), mode)
+		}
+
+		// the decoder follows the archive, whatever -iupac says
+		setTestOptions(8)
+		refIUPACOption = "skip"
+		if mode == "skip" {
+			refIUPACOption = "expand"
+		}
+		decodeArchive(td.refFile, out, out+".seq")
+		if got := readDecodedSeqs(t, out+".seq"); !sameReads(got, td.reads) {
+			t.Fatalf("Decoded reads differ with -iupac=%s", mode)
+		}
+	}
+}
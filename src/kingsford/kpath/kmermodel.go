@@ -92,18 +92,24 @@ func (km *ArrayKmerModel) KmerExists(k Kmer) bool {
 }
 */
 
-// set the value of the given parameter
+// set the value of the given parameter; once the kmer has overflowed its
+// counts live in the overflow entry, and a count of 255 can only live there
 func (km *ArrayKmerModel) SetCount(k Kmer, c, v byte) {
-    km.dist[k][c] = uint8(v)
+    if idx, over := km.hasOverflow(k); over {
+        km.overflow[idx][c] = KmerCount(v)
+    } else if v == math.MaxUint8 {
+        idx := km.createOverflow(k)
+        km.overflow[idx][c] = KmerCount(v)
+    } else {
+        km.dist[k][c] = uint8(v)
+    }
 }
 
 
-// increment the value of the given count
+// increment the value of the given count; counts stop at MAX_OBSERVATION-1
 func (km *ArrayKmerModel) Increment(k Kmer, c, by byte) {
     if idx, over := km.hasOverflow(k); over {
-        if uint64(km.overflow[idx][c]) + uint64(by) < MAX_OBSERVATION {
-            km.overflow[idx][c] += KmerCount(by)
-        }
+        km.overflow[idx][c] = saturatingAdd(km.overflow[idx][c], by)
     } else if uint64(km.dist[k][c])+uint64(by) >= math.MaxUint8 {
         idx := km.createOverflow(k)
         km.overflow[idx][c] += KmerCount(by)
@@ -111,3 +117,12 @@ func (km *ArrayKmerModel) Increment(k Kmer, c, by byte) {
         km.dist[k][c] += by
     }
 }
+
+// call f for every kmer that exists in the model, in increasing kmer order
+func (km *ArrayKmerModel) Iterate(f func(k Kmer, dist [len(ALPHA)]KmerCount)) {
+    for i := range km.dist {
+        if exists, d := km.Distribution(Kmer(i)); exists {
+            f(Kmer(i), d)
+        }
+    }
+}
@@ -0,0 +1,169 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// checkNextCount() fails the test if NextCount() and Distribution() disagree
+// for kmer k in any of the models, or if the models disagree with each other.
+func checkNextCount(t *testing.T, names []string, models []KmerModel, k Kmer) {
+	_, want := models[0].Distribution(k)
+	for i, km := range models {
+		exists, dist := km.Distribution(k)
+		if !exists {
+			t.Fatalf("%s: kmer %v is missing", names[i], k)
+		}
+		if dist != want {
+			t.Fatalf("%s: distribution %v != %v (%s)", names[i], dist, want, names[0])
+		}
+		for c := range dist {
+			if n := km.NextCount(k, byte(c)); n != dist[c] {
+				t.Fatalf("%s: NextCount(%v, %d) = %d but Distribution() has %d",
+					names[i], k, c, n, dist[c])
+			}
+		}
+	}
+}
+
+func TestNextCountMatchesDistribution(t *testing.T) {
+	setTestOptions(6)
+	names := []string{"small", "array", "fullmap", "concurrent"}
+	models := []KmerModel{
+		NewSmallKmerModel(6),
+		NewArrayKmerModel(6),
+		NewFullMapKmerModel(6),
+		NewConcurrentKmerModel(6, 4),
+	}
+
+	rng := rand.New(rand.NewSource(13))
+	kmers := make([]Kmer, 50)
+	for i := range kmers {
+		kmers[i] = Kmer(rng.Intn(1 << 12))
+	}
+
+	// set the counts as counting the reference does
+	for _, k := range kmers {
+		for c := 0; c < len(ALPHA); c++ {
+			v := byte(1 + rng.Intn(200))
+			for _, km := range models {
+				km.SetCount(k, byte(c), v)
+			}
+		}
+		checkNextCount(t, names, models, k)
+	}
+
+	// increment them past the point where the small counts overflow, and on
+	// up to the largest count
+	for i := 0; i < 200000; i++ {
+		k := kmers[rng.Intn(len(kmers))]
+		c := byte(rng.Intn(len(ALPHA)))
+		by := byte(1 + rng.Intn(254))
+		for _, km := range models {
+			km.Increment(k, c, by)
+		}
+		checkNextCount(t, names, models, k)
+	}
+
+	overflowed, saturated := 0, 0
+	for _, k := range kmers {
+		if _, _, over := models[0].(*SmallKmerModel).hasOverflow(k); over {
+			overflowed++
+		}
+		_, dist := models[0].Distribution(k)
+		for _, v := range dist {
+			if int(v)+254 >= MAX_OBSERVATION {
+				saturated++
+			}
+		}
+	}
+	if overflowed != len(kmers) || saturated == 0 {
+		t.Fatalf("Only %d of %d kmers overflowed and %d counts saturated",
+			overflowed, len(kmers), saturated)
+	}
+}
+
+func TestIncrementNearBoundary(t *testing.T) {
+	setTestOptions(6)
+	names := []string{"small", "array", "fullmap", "concurrent"}
+	models := []KmerModel{
+		NewSmallKmerModel(6),
+		NewArrayKmerModel(6),
+		NewFullMapKmerModel(6),
+		NewConcurrentKmerModel(6, 4),
+	}
+	k := Kmer(77)
+	check := func(step string, want [len(ALPHA)]KmerCount) {
+		for i, km := range models {
+			if _, dist := km.Distribution(k); dist != want {
+				t.Fatalf("%s: after %s the counts are %v, not %v", names[i], step, dist, want)
+			}
+		}
+		checkNextCount(t, names, models, k)
+	}
+
+	for _, km := range models {
+		km.SetCount(k, 0, 50)
+		km.SetCount(k, 1, 254)
+		km.Increment(k, 0, 200)
+	}
+	check("50+200", [len(ALPHA)]KmerCount{250, 254, 0, 0})
+
+	// the small counts overflow, keeping the others
+	for _, km := range models {
+		km.Increment(k, 0, 200)
+	}
+	check("250+200", [len(ALPHA)]KmerCount{450, 254, 0, 0})
+	for _, km := range models {
+		km.Increment(k, 1, 200)
+	}
+	check("254+200", [len(ALPHA)]KmerCount{450, 454, 0, 0})
+
+	// setting a count of an overflowed kmer
+	for _, km := range models {
+		km.SetCount(k, 3, 7)
+		km.SetCount(k, 2, 255)
+	}
+	check("setting counts", [len(ALPHA)]KmerCount{450, 454, 255, 7})
+
+	// a count of 255 set directly
+	k = Kmer(78)
+	for _, km := range models {
+		km.SetCount(k, 0, 255)
+		km.SetCount(k, 1, 3)
+	}
+	check("setting 255", [len(ALPHA)]KmerCount{255, 3, 0, 0})
+
+	// near the largest count, an increment stops there
+	for _, km := range models {
+		for i := 0; i < (MAX_OBSERVATION-400)/250; i++ {
+			km.Increment(k, 0, 250)
+		}
+	}
+	near := KmerCount(255 + 250*((MAX_OBSERVATION-400)/250))
+	check("counting up", [len(ALPHA)]KmerCount{near, 3, 0, 0})
+	for _, km := range models {
+		km.Increment(k, 0, 200)
+		km.Increment(k, 0, 200)
+	}
+	check("passing the largest count", [len(ALPHA)]KmerCount{MAX_OBSERVATION - 1, 3, 0, 0})
+}
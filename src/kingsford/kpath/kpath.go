@@ -24,15 +24,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"crypto/md5"
+	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
     "runtime/debug"
@@ -55,12 +60,24 @@ type KmerCount uint16
 // KmerCount
 const MAX_OBSERVATION = math.MaxUint16
 
+// saturatingAdd() returns count + by, or MAX_OBSERVATION-1 if that is more.
+// All the models stop their counts there; an increment by more than 1 that
+// would pass it stops there too, rather than being dropped, so it ends where
+// the same number of increments by 1 would.
+func saturatingAdd(count KmerCount, by byte) KmerCount {
+	if uint64(count)+uint64(by) >= MAX_OBSERVATION {
+		return MAX_OBSERVATION - 1
+	}
+	return count + KmerCount(by)
+}
+
 // the interface for the model storage
 type KmerModel interface {
     NextCount(k Kmer, c byte) KmerCount
     Distribution(k Kmer) (bool, [len(ALPHA)]KmerCount)
     SetCount(k Kmer, c, v byte)
     Increment(k Kmer, c, by byte)
+    Iterate(f func(k Kmer, dist [len(ALPHA)]KmerCount))
 }
 
 
@@ -80,15 +97,71 @@ var (
 	refFile       string
 	readFile      string
 	globalK       int
+	bucketK       int // length of the bucket prefixes; 0 means globalK
 	shiftKmerMask Kmer
+	seedMask      Kmer // the bases of a context the model sees; see setSeed()
+
+	// the adaptive state of the current encode or decode
+	coding *codingState = newCodingState()
 
-	defaultInterval    [len(ALPHA)]uint32 = [...]uint32{2, 2, 2, 2}
-	defaultIntervalSum uint64             = 4 * 2
+	flipped int
 
-	contextExists int
-	flipped       int
+	// if entropyOption is set, the ideal code length of the tails encoded so
+	// far under the model, in bits, and the number of bases it covers
+	modelBits  float64
+	modelBases uint64
+
+	// how often the current encode or decode found the contexts it needed
+	contexts contextStats
 )
 
+// A codingState holds the adaptive state, beyond the kmer model itself, that
+// the encoder updates as it codes and the decoder must replay in the same
+// order: the default distribution used for contexts not in the model, and
+// with -backoff, the counts of the shorter contexts. Each stream being
+// decoded needs its own.
+type codingState struct {
+	defaultInterval    [len(ALPHA)]uint32
+	defaultIntervalSum uint64
+	backoff            *backoffModel // made when first needed; see backoffFor()
+}
+
+// A contextStats counts how often the model had the context of a base
+// (found), how often the default distribution was used instead (missed), and
+// how many of the missing contexts were added to the model by -update
+// (created). With -backoff, the bases coded in a shorter context instead are
+// counted apart (backedOff), and not as found or missed.
+type contextStats struct {
+	found     uint64
+	missed    uint64
+	created   uint64
+	backedOff uint64
+}
+
+func (s contextStats) String() string {
+	total := s.found + s.missed + s.backedOff
+	if total == 0 {
+		return "Contexts: no bases were coded"
+	}
+	pct := func(n uint64) float64 { return 100 * float64(n) / float64(total) }
+	str := fmt.Sprintf("Contexts: found for %d bases (%.2f%%), missed for %d (%.2f%%); "+
+		"%d (%.2f%%) were created by -update",
+		s.found, pct(s.found), s.missed, pct(s.missed), s.created, pct(s.created))
+	if s.backedOff > 0 {
+		str += fmt.Sprintf("; backed off to a shorter context for %d (%.2f%%)",
+			s.backedOff, pct(s.backedOff))
+	}
+	return str
+}
+
+// newCodingState() returns the state at the start of a stream.
+func newCodingState() *codingState {
+	return &codingState{
+		defaultInterval:    [...]uint32{2, 2, 2, 2},
+		defaultIntervalSum: 4 * 2,
+	}
+}
+
 const (
     SMALL_MODEL = 1
     ARRAY_MODEL = 2
@@ -101,17 +174,82 @@ var (
 	writeFlippedOption bool = true
 	updateReference    bool = true
 	maxThreads         int  = 10
+	readBufferSize     int  = 10000 // # of reads the reader can get ahead by
+	gcPercent          int  = 100 // passed to debug.SetGCPercent, unless 100
+	forceGCOption      bool = true // collect garbage between the stages of encoding
+	tempBufferSize     int  = 1 << 20 // # of bytes of reads buffered for the temp file
 	outputFastaOption  bool = true
+	lenReportOption    bool = false
+	validateOutOption  bool = false // check that the decoded reads are well formed
+	keepSortedOption   bool = false
+	lenientFastQOption bool = false
+	readFormatOption   string = "fastq" // the format of the reads: fastq or fasta
+	maxDecodeReads     int  = 0 // if > 0, decode only this many reads
+	indexBlockBuckets  int  = 0 // if > 0, restart the coder every this many buckets
+	memEncodeOption    bool = false
+	flipK              int  = 0 // kmer size for deciding which reads to flip; 0 means k
+	seedOption         string = "" // spaced seed for the model contexts; "" means contiguous
+	backoffOption      string = "" // shorter contexts to back off to, such as "10,6"
+	backoffMinOption   int    = 2  // the observations a context needs to code a base with -backoff
+	memEncodeThreshold int64 = 1 << 27 // bytes of reads below which to encode in memory
+	bucketRange        string = "" // if nonempty, decode only these buckets
+	dupRunsOption      bool = false // record runs of identical reads within buckets
+	readBitsOption     bool = false
+	rawStreamsOption   bool = false // write .counts, .flipped and .ns without gzip
+	worstReadsOption   int  = 0 // if > 0, log this many of the reads that took the most bits
+	entropyOption      bool = false
+	maxNOption         int  = -1 // if >= 0, drop reads with more Ns than this
+	minLenOption       int  = 0  // drop reads shorter than this
+	dropOddOption      bool = false // drop reads not of the most common length
+	gcOption           bool = false // record the GC count of each read, and add it to the decoded ids
+	positionsOption    bool = false // record where each bucket is in the reference, and decode in that order
+	keepOrderOption    bool = false // record the input order of the reads, and decode in that order
+	readRange          string = "" // if given as START:END, decode only the reads with these input indices
+	nsFormatOption     string = "text" // format of the .ns file: text or varint
+	keepDroppedOption  bool = false
+	exactCaseOption    bool = false // keep the case of the bases in the reads
+	partialOption      bool = false // decode even if .flipped or .ns are missing
+	prefixOnlyOption   bool = false // decode only the bucket prefixes
+	recordsOption      bool = false // decode to a binary record stream
+	lowComplexOption   bool = false // store homopolymer reads without coding them
+	eccOption          bool = false // correct likely errors, keeping the original bases in .ecc
+	jsonOption         bool = false // write reference-stats as JSON
+	dictionaryOption   string = "" // model to start from instead of an empty one
+	saveModelOption    string = "" // if nonempty, save the model here after encoding
+	coderStatsOption   bool = false // log the work done by the arithmetic coder
+	bucketStatsOption  bool = false // log the distribution of bucket sizes
+	noWriteOption      bool = false // decode without writing the reads anywhere
+	atomicOption       bool = true // decode to a temp file and rename it when done
+	mphfOption         bool = false // decode with a compact read-only model
+	refIUPACOption     string = "expand" // how ambiguous bases in the reference seed the model
+	sepOption          string = "\\n" // ends each read when -fasta=false
 
     useArrayModel      bool = false
+	bigmemOption       modelChoice = "false" // -bigmem: true, false or auto
+	arrayDensityOption int  = 15 // with -bigmem=auto, the % of contexts above which to use the array model
+	bvBitsOption       uint64 = 1 << 32 // most bits for the flip set before it is a Bloom filter
+	refFromReads       bool = false
+	embedRefOption     bool = false // store the model so decoding needs no -ref
+	maxBucketsOption   int  = 0     // if > 0, shorten the bucket prefixes to have at most this many buckets
+	sortBatchOption    int  = 0     // if > 0, sort the reads in batches of this many, merged from temp files
+	bucketOrderOption  string = "prefix" // the order to code the buckets in: prefix or walk
+	qualFlipOption     bool = false // weight the kmer matches by quality when flipping
+	flipWindowOption   int  = 0     // if > 0, score only this many bases at the start of each orientation when flipping
+	adaptivePseudoOption int = 0    // if > 0, add this / the observations of a context to the pseudocount
+	sweepKOption       string = "8:16" // the values of k for sweep to try
+	sweepSampleOption  int  = 100000 // the number of reads sweep encodes
+	genOptions         = genSpec{refBases: 1000000, reads: 100000, readLen: 100,
+		errRate: 0.01, nRate: 0.001, dupRate: 0.1, seed: 1} // what gen writes
 
 	cpuProfile      string = ""    // set to nonempty to write profile to this file
+	memProfile      string = ""    // set to nonempty to write heap profile to this file
 	writeQualOption bool   = false // NYI completely
 	observationWeight int = 10
 )
 
 const (
 	pseudoCount       uint64    = 1
+	maxAdaptivePseudo int       = 1 << 16 // keeps the weights of a context well within the coder's range
 	seenThreshold     KmerCount = 2 // before this threshold, increment 1 and treat as unseen
 )
 
@@ -167,11 +305,48 @@ func kmerToString(kmer Kmer, k int) string {
 }
 
 // setShiftKmerMask() initializes the kmer mask. This must be called anytime
-// globalK changes.
+// globalK changes. It also resets the seed to the contiguous one.
 func setShiftKmerMask() {
-	for i := 0; i < globalK; i++ {
-		shiftKmerMask = (shiftKmerMask << 2) | 3
+	shiftKmerMask = kmerMask(globalK)
+	seedMask = shiftKmerMask
+}
+
+// setSeed() sets the spaced seed used to form the contexts of the model. The
+// seed is a string of k 0s and 1s, one for each base of the context from the
+// oldest to the newest, and the model sees only the bases with a 1; the
+// others are taken to be As. The empty seed (or all 1s) is the usual
+// contiguous context.
+func setSeed(seed string) error {
+	if seed == "" {
+		seedMask = shiftKmerMask
+		return nil
+	}
+	if len(seed) != globalK || strings.Trim(seed, "01") != "" {
+		return fmt.Errorf("seed %q is not a string of %d 0s and 1s", seed, globalK)
+	}
+	seedMask = 0
+	for _, c := range seed {
+		seedMask <<= 2
+		if c == '1' {
+			seedMask |= 3
+		}
+	}
+	return nil
+}
+
+// seedContext() returns the context the model uses for the given kmer: the
+// kmer with the bases the seed leaves out set to A.
+func seedContext(kmer Kmer) Kmer {
+	return kmer & seedMask
+}
+
+// kmerMask() returns the mask that keeps the last k bases of a kmer.
+func kmerMask(k int) Kmer {
+	mask := Kmer(0)
+	for i := 0; i < k; i++ {
+		mask = (mask << 2) | 3
 	}
+	return mask
 }
 
 // shiftKmer() creates a new kmer by shifting the given one over one base to
@@ -215,11 +390,21 @@ func AbsInt(x int) int {
 	return x
 }
 
+// sumAbs() returns the sum of the absolute values of the given integers.
+func sumAbs(x []int) (sum int) {
+	for _, v := range x {
+		sum += AbsInt(v)
+	}
+	return
+}
+
 //===================================================================
 
 
 // readReferenceFile() reads the sequences in the gzipped multifasta file with
-// the given name and returns them as a slice of strings.
+// the given name and returns them as a slice of strings. Lines may be wrapped
+// at any width and in any case; records with no sequence are dropped.
+// Sequence lines must be ASCII.
 func readReferenceFile(fastaFile string) []string {
 	// open the .gz fasta file that is the references
 	log.Println("Reading Reference File...")
@@ -227,66 +412,277 @@ func readReferenceFile(fastaFile string) []string {
 	DIE_ON_ERR(err, "Couldn't open fasta file %s", fastaFile)
 	defer inFasta.Close()
 
-	// wrap the gzip reader around it
+	// wrap the gzip reader around it; a bgzf file is a series of gzip
+	// members, which the reader reads straight through
 	in, err := gzip.NewReader(inFasta)
 	DIE_ON_ERR(err, "Couldn't open gzipped file %s", fastaFile)
 	defer in.Close()
 
-	out := make([]string, 0, 10000000)
+	out, err := parseReference(in)
+	DIE_ON_ERR(err, "Couldn't finish reading reference %s", fastaFile)
+	return out
+}
+
+// utf8BOM is the byte order mark some editors put at the start of a file.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// parseReference() reads the sequences of the uncompressed multifasta r, as
+// readReferenceFile() does. A byte order mark at the start is skipped, and
+// any other non-ASCII byte in a sequence line is an error.
+func parseReference(r io.Reader) ([]string, error) {
+	out := make([]string, 0)
 	cur := make([]string, 0, 100)
 
-	scanner := bufio.NewScanner(in)
-	for scanner.Scan() {
-		line := strings.TrimSpace(strings.ToUpper(scanner.Text()))
-		if len(line) == 0 {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		b := scanner.Bytes()
+		if lineNo == 1 {
+			b = bytes.TrimPrefix(b, utf8BOM)
+		}
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
 			continue
 		}
 
-		if line[0] == byte('>') {
+		if b[0] == byte('>') {
 			if len(cur) > 0 {
 				out = append(out, strings.Join(cur, ""))
 				cur = make([]string, 0, 100)
 			}
 		} else {
+			line, err := sequenceLine(b)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
 			cur = append(cur, line)
 		}
 	}
-	DIE_ON_ERR(scanner.Err(), "Couldn't finish reading reference")
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cur) > 0 {
+		out = append(out, strings.Join(cur, ""))
+	}
+	return out, nil
+}
+
+// sequenceLine() returns the line of a sequence, uppercased, or an error if
+// it has a byte that is not ASCII.
+func sequenceLine(b []byte) (string, error) {
+	line := make([]byte, len(b))
+	for i, c := range b {
+		if c >= 0x80 {
+			return "", fmt.Errorf("non-ASCII byte 0x%02X in sequence", c)
+		}
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		line[i] = c
+	}
+	return string(line), nil
+}
+
+// readSequencesFromReads() reads the reads in the given fastq file and returns
+// their sequences (with Ns replaced by As) so they can stand in for a reference.
+func readSequencesFromReads(readFile string) []string {
+	log.Println("Reading reads to use as the reference...")
+	fq := make(chan *FastQ, readBufferSize)
+	go ReadFastQ(readFile, fq)
+	out := make([]string, 0, estimateReadCount(readFile))
+	for rec := range fq {
+		out = append(out, string(rec.Seq))
+	}
+	log.Printf("Using %d reads as the reference.", len(out))
 	return out
 }
 
 // countKmersInReference() reads the given reference file (gzipped multifasta)
 // and constructs a kmer hash for it that mapps kmers to distributions of next
-// characters.
+// characters. If there is a dictionary, the counts are added to a copy of it.
+// A large reference is counted in pieces by maxThreads workers.
 func countKmersInReference(k int, seqs []string) KmerModel {
+	return countReferenceKmers(k, seqs, nil)
+}
+
+// countReferenceKmers() builds the model as countKmersInReference() does. If
+// bv is not nil, it also sets the bit of each context kmer in bv in the same
+// pass over the sequences, so that bv is the set kmerSetFromReference() would
+// make with the same k.
+func countReferenceKmers(k int, seqs []string, bv BitSet) KmerModel {
+	seqs = resolveIUPAC(seqs, k)
+	if bigmemOption == "auto" {
+		// the contexts are marked first to choose the model, and then
+		// needn't be marked again while counting
+		if bv == nil {
+			bv = newKmerBits(k)
+		}
+		markReferenceKmers(k, seqs, bv)
+		useArrayModel = isDenseReference(bv, k)
+		bv = nil
+	}
     var km KmerModel
-    if useArrayModel {
-        km = NewArrayKmerModel(uint(k))
-    } else {
-        km = NewSmallKmerModel(uint(k))
-    }
+	if dictionaryModel != nil {
+		km = cloneKmerModel(dictionaryModel, uint(k))
+	} else {
+		km = newKmerModel(uint(k))
+	}
+	keepHigher := dictionaryModel != nil
 
 	log.Printf("Counting %v-mer transitions in reference file...\n", k)
+	total := 0
+	for _, s := range seqs {
+		total += len(s)
+	}
+	if maxThreads <= 1 || total < parallelCountMin {
+		countKmersInto(km, k, seqs, keepHigher, bv)
+		return km
+	}
+
+	// count pieces of the reference into separate models on up to
+	// maxThreads workers, and merge each model into km as its worker
+	// finishes
+	pieces := referenceChunks(seqs, k, total/maxThreads+1)
+	workers := maxThreads
+	if workers > len(pieces) {
+		workers = len(pieces)
+	}
+	chunks := make(chan string, len(pieces))
+	for _, c := range pieces {
+		chunks <- c
+	}
+	close(chunks)
+	parts := make(chan KmerModel)
+	for i := 0; i < workers; i++ {
+		go func() {
+			part := NewSmallKmerModel(uint(k))
+			for c := range chunks {
+				countKmersInto(part, k, []string{c}, false, bv)
+			}
+			parts <- part
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		mergeReferenceCounts(km, <-parts, keepHigher)
+	}
+	return km
+}
+
+// parallelCountMin is the size of reference, in bases, below which
+// countKmersInReference() counts on one thread, as merging the counts would
+// take longer than it saves.
+var parallelCountMin = 1 << 22
+
+// countKmersInto() sets the count of each transition in the sequences to
+// seenThreshold in km, unless keepHigher is set and km already has a count
+// at least that high (as a dictionary may). If bv is not nil, the bit of each
+// context kmer is set in it; the workers of countReferenceKmers() share it,
+// so the bits are set atomically.
+func countKmersInto(km KmerModel, k int, seqs []string, keepHigher bool, bv BitSet) {
 	for _, s := range seqs {
 		if len(s) <= k {
 			continue
 		}
 		contextMer := stringToKmer(s[:k])
 		for i := 0; i < len(s)-k; i++ {
+			if bv != nil {
+				bv.SetOnAtomic(uint64(contextMer))
+			}
 			next := acgt(s[i+k])
-			// seeing something in the reference gives us a count of seenThreshold
-            km.SetCount(contextMer, next, byte(seenThreshold))
+			// seeing something in the reference gives us a count of
+			// seenThreshold, unless the dictionary already has more
+			context := seedContext(contextMer)
+			if !keepHigher || !hasCount(km, context, next, seenThreshold) {
+				km.SetCount(context, next, byte(seenThreshold))
+			}
 
 			contextMer = shiftKmer(contextMer, next)
 		}
 	}
-	return km
 }
 
-func createKmerBitVectorFromReference(k int, seqs []string) *BitVec {
+// referenceChunks() splits the sequences into pieces of about size bases
+// whose transitions are together those of the sequences: each piece but the
+// last of a sequence overlaps the next by k bases, so the transition from
+// every context is in exactly one piece.
+func referenceChunks(seqs []string, k, size int) []string {
+	if size < 1 {
+		size = 1
+	}
+	chunks := make([]string, 0)
+	for _, s := range seqs {
+		for start := 0; start < len(s)-k; start += size {
+			end := start + size + k
+			if end > len(s) {
+				end = len(s)
+			}
+			chunks = append(chunks, s[start:end])
+		}
+	}
+	return chunks
+}
+
+// mergeReferenceCounts() sets the counts of km for every transition counted
+// in part, as countKmersInto() would have if it had counted part's
+// sequences into km.
+func mergeReferenceCounts(km, part KmerModel, keepHigher bool) {
+	part.Iterate(func(context Kmer, dist [len(ALPHA)]KmerCount) {
+		for next, v := range dist {
+			if v == 0 {
+				continue
+			}
+			if !keepHigher || !hasCount(km, context, byte(next), seenThreshold) {
+				km.SetCount(context, byte(next), byte(seenThreshold))
+			}
+		}
+	})
+}
+
+// hasCount() returns true if the model has a count of at least n for the
+// given character following the given context.
+func hasCount(km KmerModel, context Kmer, next byte, n KmerCount) bool {
+	exists, dist := km.Distribution(context)
+	return exists && dist[next] >= n
+}
+
+// A kmerSet is a bit vector with the bits set for the kmers of length k in
+// the reference (or a Bloom filter of them, see newKmerBits()). It is used to
+// decide which reads to flip, and its k need not be the k of the model.
+type kmerSet struct {
+	bv   BitSet
+	k    int
+	mask Kmer
+}
+
+// Contains() returns true if the reference has the kmer k (of length ks.k),
+// followed by a base. A Bloom filter may wrongly say it does.
+func (ks *kmerSet) Contains(k Kmer) bool {
+	return ks.bv.Get(uint64(k & ks.mask))
+}
+
+// kmerSetFromModel() returns the set of kmers in the model; for a model made
+// by countKmersInReference() this is the same set kmerSetFromReference()
+// makes with the same k.
+func kmerSetFromModel(km KmerModel) *kmerSet {
+	bv := newKmerBits(globalK)
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		bv.SetOn(uint64(k))
+	})
+	return &kmerSet{bv, globalK, kmerMask(globalK)}
+}
+
+func kmerSetFromReference(k int, seqs []string) *kmerSet {
+	seqs = resolveIUPAC(seqs, k)
 
-    bv := NewBitVec(1 << (2*uint(k)))
+    bv := newKmerBits(k)
+	markReferenceKmers(k, seqs, bv)
+	return &kmerSet{bv, k, kmerMask(k)}
+}
 
+// markReferenceKmers() sets the bit of each kmer of length k that is followed
+// by a base in the sequences, which must already have been through
+// resolveIUPAC().
+func markReferenceKmers(k int, seqs []string, bv BitSet) {
+	mask := kmerMask(k)
     for _, s := range seqs {
 		if len(s) <= k {
 			continue
@@ -296,10 +692,9 @@ func createKmerBitVectorFromReference(k int, seqs []string) *BitVec {
             bv.SetOn(uint64(contextMer))
             DIE_IF(bv.Get(uint64(contextMer)) != true, "Bad bit vector!")
 			next := acgt(s[i+k])
-			contextMer = shiftKmer(contextMer, next)
+			contextMer = ((contextMer << 2) | Kmer(next)) & mask
 		}
 	}
-	return bv
 }
 
 
@@ -309,14 +704,69 @@ func createKmerBitVectorFromReference(k int, seqs []string) *BitVec {
 
 // contextWeight() is a weight transformation function that will change the
 // distribution weights according to the function for real contexts. If the
-// count is too small, it returns the pseudocount; if the count is big enough
-// it returns observationWeight * the distribution value.
+// count is too small, it returns the pseudocount (see unseenWeight()); if the
+// count is big enough it returns observationWeight * the distribution value.
 func contextWeight(charIdx int, dist [len(ALPHA)]KmerCount) uint64 {
 	if dist[charIdx] >= seenThreshold {
 		return uint64(observationWeight) * uint64(dist[charIdx])
 	} else {
+		return unseenWeight(dist)
+	}
+}
+
+// unseenWeight() returns the pseudocount of a base not yet seen after a
+// context with the given distribution. It is pseudoCount, plus, with
+// -adaptivepseudo=N, N divided by the number of observations of the context,
+// so that an unseen base is likelier after a sparsely seen context than
+// after a well seen one. It only depends on the distribution, so the encoder
+// and the decoder agree on it.
+func unseenWeight(dist [len(ALPHA)]KmerCount) uint64 {
+	if adaptivePseudoOption <= 0 {
+		return pseudoCount
+	}
+	seen := uint64(0)
+	for _, c := range dist {
+		if c >= seenThreshold {
+			seen += uint64(c)
+		}
+	}
+	if seen == 0 {
 		return pseudoCount
 	}
+	return pseudoCount + uint64(adaptivePseudoOption)/seen
+}
+
+// maxCodingTotal is the largest total a context may have: the coder takes up
+// to arithc.MaxTotal, but dart() finds the decoded base with 32 bit sums.
+const maxCodingTotal uint64 = math.MaxUint32
+
+// worstCaseTotal() returns the largest total contextWeight() can give a
+// context with the current options, when every base has the largest count or
+// the largest pseudocount.
+func worstCaseTotal() uint64 {
+	w := uint64(observationWeight) * uint64(MAX_OBSERVATION-1)
+	if unseen := pseudoCount + uint64(adaptivePseudoOption); unseen > w {
+		w = unseen
+	}
+	return uint64(len(ALPHA)) * w
+}
+
+// checkCodingPrecision() returns an error if -mul is so large that a
+// context's total could be more than the coder handles, which would only
+// show up part way through coding.
+func checkCodingPrecision() error {
+	if observationWeight < 1 {
+		return fmt.Errorf("-mul must be at least 1")
+	}
+	limit := maxCodingTotal
+	if arithc.MaxTotal < limit {
+		limit = arithc.MaxTotal
+	}
+	if t := worstCaseTotal(); t > limit {
+		return fmt.Errorf("with -mul=%d a context's total can reach %d, more than the coder's %d; -mul can be at most %d",
+			observationWeight, t, limit, limit/(uint64(len(ALPHA))*uint64(MAX_OBSERVATION-1)))
+	}
+	return nil
 }
 
 // defaultWeight() is a weight transformation function for the default
@@ -350,10 +800,10 @@ func intervalFor(
 
 // intervalForDefault() computes the interval for the given character using the
 // default interval
-func intervalForDefault(letter byte) (a uint64, b uint64, total uint64) {
+func intervalForDefault(st *codingState, letter byte) (a uint64, b uint64, total uint64) {
 	letterIdx := int(letter)
-	for i := 0; i < len(defaultInterval); i++ {
-		w := uint64(defaultInterval[i])
+	for i := 0; i < len(st.defaultInterval); i++ {
+		w := uint64(st.defaultInterval[i])
 		total += w
 		if i <= letterIdx {
 			b += w
@@ -368,14 +818,39 @@ func intervalForDefault(letter byte) (a uint64, b uint64, total uint64) {
 // nextInterval() computes the interval for the given context and updates the
 // default distribution and context distributions as required.
 func nextInterval(
+	st *codingState,
 	km KmerModel,
 	contextMer Kmer,
 	kidx byte,
 	computeInterval bool,
 ) (a uint64, b uint64, total uint64) {
+	contextMer = seedContext(contextMer)
+	exists, dist := km.Distribution(contextMer)
+
+	// with -backoff, a context seen too rarely gives way to a shorter one
+	if len(backoffOrders) > 0 {
+		bdist, ok := backoffFor(st, km, contextMer, exists, dist)
+		if updateReference {
+			st.backoffModel(km).update(contextMer, kidx)
+		}
+		if ok {
+			contexts.backedOff++
+			if computeInterval {
+				a, b, total = intervalFor(kidx, bdist)
+			}
+			if updateReference {
+				km.Increment(contextMer, kidx, 1)
+				if !exists {
+					contexts.created++
+				}
+			}
+			return
+		}
+	}
+
 	// if the context exists, use that distribution
-    if exists, dist := km.Distribution(contextMer); exists {
-		contextExists++
+    if exists {
+		contexts.found++
 		if computeInterval {
 			a, b, total = intervalFor(kidx, dist)
 		}
@@ -385,14 +860,16 @@ func nextInterval(
 	} else {
 		// if the context doesnt exist, use a simple default interval
 		if computeInterval {
-			a, b, total = intervalForDefault(kidx)
+			a, b, total = intervalForDefault(st, kidx)
 		}
-		defaultInterval[kidx]++
-		defaultIntervalSum++
+		st.defaultInterval[kidx]++
+		st.defaultIntervalSum++
+		contexts.missed++
 
 		if updateReference {
 			// add this to the context now
             km.Increment(contextMer, kidx, 1)
+			contexts.created++
 		}
 	}
 	return
@@ -400,12 +877,12 @@ func nextInterval(
 
 // countMatchingObservations() counts the number of observaions of kmers in the
 // read.
-func countMatchingObservations(bv *BitVec, r string) (n KmerCount) {
-	contextMer := stringToKmer(r[:globalK])
-	for i := globalK; i < len(r); i++ {
+func countMatchingObservations(ks *kmerSet, r string) (n KmerCount) {
+	contextMer := stringToKmer(r[:ks.k])
+	for i := ks.k; i < len(r); i++ {
 		symb := acgt(r[i])
-        nextMer := shiftKmer(contextMer, symb)
-        if bv.Get(uint64(contextMer)) && bv.Get(uint64(nextMer)) {
+        nextMer := ((contextMer << 2) | Kmer(symb)) & ks.mask
+        if ks.Contains(contextMer) && ks.Contains(nextMer) {
 			n += seenThreshold
 		}
         contextMer = nextMer
@@ -413,7 +890,46 @@ func countMatchingObservations(bv *BitVec, r string) (n KmerCount) {
 	return
 }
 
-// support sorting the fastq list lexicographically
+// phredOffset is the quality byte of a base with Phred quality 0.
+const phredOffset = 33
+
+// countQualityWeightedObservations() counts the observations of kmers in the
+// read as countMatchingObservations() does, but weights each one by the
+// lowest Phred quality of the bases it covers, so matches in low quality
+// parts of the read count for little. qual gives the qualities of r, in the
+// same orientation.
+func countQualityWeightedObservations(ks *kmerSet, r string, qual []byte) (n uint64) {
+	contextMer := stringToKmer(r[:ks.k])
+	for i := ks.k; i < len(r); i++ {
+		symb := acgt(r[i])
+		nextMer := ((contextMer << 2) | Kmer(symb)) & ks.mask
+		if ks.Contains(contextMer) && ks.Contains(nextMer) {
+			low := qual[i]
+			for _, q := range qual[i-ks.k : i] {
+				if q < low {
+					low = q
+				}
+			}
+			if low > phredOffset {
+				n += uint64(seenThreshold) * uint64(low-phredOffset)
+			}
+		}
+		contextMer = nextMer
+	}
+	return
+}
+
+// reversed() returns a reversed copy of b.
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
+
+// support sorting the fastq list lexicographically by the whole sequence, so
+// that identical reads end up next to each other
 type Lexicographically []*FastQ
 
 func (a Lexicographically) Len() int { return len(a) }
@@ -421,26 +937,34 @@ func (a Lexicographically) Len() int { return len(a) }
 func (a Lexicographically) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
 func (a Lexicographically) Less(i, j int) bool {
-	for i, c := range a[i].Seq[:globalK] {
-		d := a[j].Seq[i]
-		if c < d {
-			return true
-		}
-		if c > d {
-			return false
-		}
-	}
-	return false
+	return bytes.Compare(a[i].Seq, a[j].Seq) < 0
 }
 
 // flipRange() flips the reads in the given slice if the reverse complement
-// matches the reference better.
-func flipRange(block []*FastQ, bv *BitVec) int {
+// matches the reference better. If qualFlipOption is set, the matches of
+// reads with qualities are weighted by quality, and the qualities are then
+// dropped, as nothing else needs them. If flipWindowOption is set, only the
+// matches in the first flipWindowOption bases of the read and of its reverse
+// complement are counted.
+func flipRange(block []*FastQ, ks *kmerSet) int {
 	flip := 0
 	for _, fq := range block {
-		n1 := countMatchingObservations(bv, string(fq.Seq))
 		rcr := reverseComplement(string(fq.Seq))
-		n2 := countMatchingObservations(bv, rcr)
+		w := len(rcr)
+		if flipWindowOption > 0 && flipWindowOption < w {
+			w = flipWindowOption
+		}
+		var n1, n2 uint64
+		if qualFlipOption && fq.Quals != nil {
+			n1 = countQualityWeightedObservations(ks, string(fq.Seq[:w]), fq.Quals[:w])
+			n2 = countQualityWeightedObservations(ks, rcr[:w], reversed(fq.Quals)[:w])
+			if !writeQualOption {
+				fq.Quals = nil
+			}
+		} else {
+			n1 = uint64(countMatchingObservations(ks, string(fq.Seq[:w])))
+			n2 = uint64(countMatchingObservations(ks, rcr[:w]))
+		}
 
 		// if they are tied, take the lexigographically smaller one
 		if n2 > n1 || (n2 == n1 && string(rcr) < string(fq.Seq)) {
@@ -451,350 +975,1209 @@ func flipRange(block []*FastQ, bv *BitVec) int {
 	return flip
 }
 
+// flipReads() reverse complements each read whose reverse complement
+// matches ks better, splitting the reads among maxThreads-1 workers. It
+// returns the number of reads it flipped.
+func flipReads(reads []*FastQ, ks *kmerSet) int {
+	// start maxThreads-1 workers to flip the read ranges
+	wait := make([]chan int, maxThreads-1)
+	for i := range wait {
+		wait[i] = make(chan int)
+	}
+	blockSize := 1 + len(reads)/len(wait)
+	log.Printf("Have %v read flippers, each working on %v reads",
+		len(wait), blockSize)
+	for i, c := range wait {
+		go func(i int, c chan int) {
+			start, end := i*blockSize, (i+1)*blockSize
+			if end > len(reads) {
+				end = len(reads)
+			}
+			if start > end {
+				start = end
+			}
+			log.Printf("Worker %v flipping [%d, %d)...", i, start, end)
+			count := flipRange(reads[start:end], ks)
+			c <- count
+			close(c)
+		}(i, c)
+	}
+
+	// wait for all the workers to finish and sum up their counts
+	n := 0
+	for _, c := range wait {
+		for f := range c {
+			n += f
+		}
+	}
+	return n
+}
+
+// modalReadLength() returns the most common of the read lengths counted in
+// lengths, the longest if several are equally common, or 0 if there are none.
+// It, and not the length of whichever read comes first, is the length of the
+// archive, since an odd read (such as an adapter dimer) may come first.
+func modalReadLength(lengths map[int]int) int {
+	best := 0
+	for l, n := range lengths {
+		if n > lengths[best] || (n == lengths[best] && l > best) {
+			best = l
+		}
+	}
+	return best
+}
+
+// checkReadLengths() returns an error unless the reads all have length
+// readLen, which the archive assumes. The reads are numbered from first+1 in
+// the error.
+func checkReadLengths(reads []*FastQ, readLen, first int) error {
+	for i, r := range reads {
+		if len(r.Seq) != readLen {
+			return fmt.Errorf("read %d has length %d, but most reads have length %d "+
+				"(use -minlen or -dropodd to drop the others)", first+i+1, len(r.Seq), readLen)
+		}
+	}
+	return nil
+}
+
+// A readFilter decides which reads are encoded: those shorter than
+// minLenOption, with more than maxNOption Ns (if it is >= 0), or, if
+// dropOddOption is set, not of the most common length readLen of the others,
+// are dropped. It counts the reads dropped for each reason.
+type readFilter struct {
+	readLen            int
+	short, manyNs, odd int
+}
+
+// countReadLength() counts the length of the read in lengths, unless it is
+// dropped whatever its length, for newReadFilter().
+func countReadLength(lengths map[int]int, rec *FastQ) {
+	if !isShortRead(rec) && !hasManyNs(rec) {
+		lengths[len(rec.Seq)]++
+	}
+}
+
+func isShortRead(rec *FastQ) bool { return len(rec.Seq) < minLenOption }
+
+func hasManyNs(rec *FastQ) bool { return maxNOption >= 0 && len(rec.NLocations) > maxNOption }
+
+// newReadFilter() returns the filter for reads whose lengths were counted
+// by countReadLength().
+func newReadFilter(lengths map[int]int) *readFilter {
+	return &readFilter{readLen: modalReadLength(lengths)}
+}
+
+// keep() returns true if the read is encoded, and otherwise counts it as
+// dropped.
+func (f *readFilter) keep(rec *FastQ) bool {
+	switch {
+	case isShortRead(rec):
+		f.short++
+	case hasManyNs(rec):
+		f.manyNs++
+	case dropOddOption && len(rec.Seq) != f.readLen:
+		f.odd++
+	default:
+		return true
+	}
+	return false
+}
+
+// report() logs the number of reads dropped for each reason asked for.
+func (f *readFilter) report() {
+	if minLenOption > 0 {
+		log.Printf("Dropped %v reads shorter than %v bases.", f.short, minLenOption)
+	}
+	if maxNOption >= 0 {
+		log.Printf("Dropped %v reads with more than %v Ns.", f.manyNs, maxNOption)
+	}
+	if dropOddOption {
+		log.Printf("Dropped %v reads not of the most common length, %v.", f.odd, f.readLen)
+	}
+}
+
 // readAndFlipReads() reads the reads and reverse complements them if the
 // reverse complement matches the hash better (according to a countMatching*
 // function above). It returns a slice of the reads. "N"s are treated as "A"s.
 // No other characters are transformed and will eventually lead to a panic.
+// The reads a readFilter drops are left out of the slice and returned,
+// unflipped and in the order they were read, in a second slice. The others
+// are processed by prepareReads().
 func readAndFlipReads(
 	readFile string,
-	bv *BitVec,
+	ks *kmerSet,
+	eccModel KmerModel,
 	flipReadsOption bool,
-) []*FastQ {
+) ([]*FastQ, []*FastQ) {
 	// read the reads from the file into memory
 	log.Printf("Reading reads...")
 	readStart := time.Now()
-	fq := make(chan *FastQ, 10000000)
+	fq := make(chan *FastQ, readBufferSize)
 	go ReadFastQ(readFile, fq)
-	reads := make([]*FastQ, 0, 10000000)
+	all := make([]*FastQ, 0, estimateReadCount(readFile))
+	lengths := make(map[int]int)
 	for rec := range fq {
-		reads = append(reads, rec)
+		all = append(all, rec)
+		countReadLength(lengths, rec)
+	}
+	filter := newReadFilter(lengths)
+
+	// the reads kept are moved to the front of all
+	reads := all[:0]
+	dropped := make([]*FastQ, 0)
+	for _, rec := range all {
+		if filter.keep(rec) {
+			rec.Index = len(reads)
+			reads = append(reads, rec)
+		} else {
+			dropped = append(dropped, rec)
+		}
 	}
 	readEnd := time.Now()
 	log.Printf("Time: read %v reads; spent %v seconds.",
-		len(reads), readEnd.Sub(readStart).Seconds())
+		len(reads)+len(dropped), readEnd.Sub(readStart).Seconds())
+	filter.report()
+	DIE_IF(len(reads) == 0, "No reads to encode.")
+	DIE_ON_ERR(checkReadLengths(reads, filter.readLen, 0), "Can't encode reads of different lengths")
+	prepareReads(reads, ks, eccModel, flipReadsOption)
 
-	// if enabled, start several threads to flip the reads
-	if flipReadsOption {
-		// start maxThreads-1 workers to flip the read ranges
-		wait := make([]chan int, maxThreads-1)
-		for i := range wait {
-			wait[i] = make(chan int)
-		}
-		blockSize := 1 + len(reads)/len(wait)
-		log.Printf("Have %v read flippers, each working on %v reads",
-			len(wait), blockSize)
-		for i, c := range wait {
-			go func(i int, c chan int) {
-				end := (i + 1) * blockSize
-				if end > len(reads) {
-					end = len(reads)
-				}
-				log.Printf("Worker %v flipping [%d, %d)...", i, i*blockSize, end)
-				count := flipRange(reads[i*blockSize:end], bv)
-				c <- count
-				close(c)
-				runtime.Goexit()
-				return
-			}(i, c)
-		}
+	log.Printf("Read %v reads; flipped %v of them.", len(reads), flipped)
+	return reads, dropped
 
-		// wait for all the workers to finish and sum up their
-		for _, c := range wait {
-			for f := range c {
-				flipped += f
-			}
-		}
+}
+
+// prepareReads() gets the reads kept for encoding ready to be bucketed: if
+// lowComplexOption is set, the Ns of reads that are otherwise a single base
+// become that base instead of "A"; if flipReadsOption is set, the reads are
+// flipped as needed; if eccModel is not nil, their likely errors are
+// corrected against it (see correctErrors()); and they are sorted.
+func prepareReads(reads []*FastQ, ks *kmerSet, eccModel KmerModel, flipReadsOption bool) {
+	start := time.Now()
+	if lowComplexOption {
+		log.Printf("%v reads are a single base (apart from Ns).", fillHomopolymerNs(reads))
+	}
+
+	// if enabled, flip the reads
+	if flipReadsOption {
+		flipped += flipReads(reads, ks)
 	}
 	flipEnd := time.Now()
-	log.Printf("Time: flipping: %v seconds.", flipEnd.Sub(readEnd).Seconds())
+	log.Printf("Time: flipping: %v seconds.", flipEnd.Sub(start).Seconds())
+
+	// the corrections change the reads, so they come before the sort
+	if eccModel != nil {
+		log.Printf("Corrected %v likely errors.", correctErrors(reads, eccModel))
+	}
 
-	// sort the records by sequence
-	sort.Sort(Lexicographically(reads))
+	// sort the records by sequence; identical reads (which may differ in
+	// their Ns or orientation) are kept in the order they were read, so the
+	// archive depends only on the input
+	sort.Stable(Lexicographically(reads))
 	readSort := time.Now()
 	log.Printf("Time: sorting reads: %v seconds.", readSort.Sub(flipEnd).Seconds())
-
-	log.Printf("Read %v reads; flipped %v of them.", len(reads), flipped)
-	return reads
-
 }
 
 // listBuckets() processes the reads and creates the bucket list and the list
-// of the bucket sizes and returns them.
-func listBuckets(reads []*FastQ) ([]string, []int) {
+// of the bucket sizes and returns them. If dupRunsOption is set, it also
+// returns, for each bucket that has a run of identical reads but is not
+// uniform, the lengths of the runs of identical reads in the bucket, in order
+// (reads that are not repeated are runs of length 1, and those after the last
+// longer run are left off).
+func listBuckets(reads readStream) ([]string, []int, map[int][]int) {
 	curBucket := ""
 	prevRead := ""
-	allSame := false
-	buckets := make([]string, 0, 1000000)
-	counts := make([]int, 0, 1000000)
-
-	for _, rec := range reads {
-		r := string(rec.Seq)
-		if r[:globalK] != curBucket {
+	nbuckets := countBuckets(reads)
+	buckets := make([]string, 0, nbuckets)
+	counts := make([]int, 0, nbuckets)
+	runs := make(map[int][]int)
+
+	// the lengths of the runs of identical reads in the current bucket; as
+	// the reads are sorted, identical reads are adjacent, so the bucket is
+	// uniform exactly when it is a single run
+	var bucketRuns []int
+
+	// finish the current bucket, recording it as uniform or as runs
+	endBucket := func() {
+		if len(counts) == 0 {
+			return
+		}
+		b := len(counts) - 1
+		if dupsOption && len(bucketRuns) == 1 && counts[b] > 1 {
 			// if all the reads in a bucket are the same, record this
 			// by negating the bucket count
-			if dupsOption && allSame && counts[len(counts)-1] > 1 {
-				counts[len(counts)-1] = -counts[len(counts)-1]
+			counts[b] = -counts[b]
+		} else if dupRunsOption {
+			last := len(bucketRuns)
+			for last > 0 && bucketRuns[last-1] == 1 {
+				last--
 			}
+			if last > 0 {
+				runs[b] = append([]int(nil), bucketRuns[:last]...)
+			}
+		}
+	}
 
-			curBucket = r[:globalK]
-			prevRead = r
+	DIE_ON_ERR(reads.each(func(rec *FastQ) error {
+		r := string(rec.Seq)
+		if r[:bucketK] != curBucket {
+			endBucket()
+			// a copy of just the prefix, which would otherwise keep the
+			// whole read
+			curBucket = string(rec.Seq[:bucketK])
 			buckets = append(buckets, curBucket)
 			counts = append(counts, 1)
-			allSame = true
+			bucketRuns = append(bucketRuns[:0], 1)
 		} else {
-			allSame = allSame && (r == prevRead)
-			prevRead = r
+			if r == prevRead {
+				bucketRuns[len(bucketRuns)-1]++
+			} else {
+				bucketRuns = append(bucketRuns, 1)
+			}
 			counts[len(counts)-1]++
 		}
+		prevRead = r
+		return nil
+	}), "Couldn't read the sorted reads")
+	endBucket()
+	return buckets, counts, runs
+}
+
+// countBuckets() returns the number of buckets listBuckets() finds in the
+// sorted reads, so that its lists can be made the right size.
+func countBuckets(reads readStream) int {
+	n := 0
+	var prev []byte
+	DIE_ON_ERR(reads.each(func(rec *FastQ) error {
+		if n == 0 || !bytes.Equal(rec.Seq[:bucketK], prev) {
+			n++
+			prev = rec.Seq[:bucketK]
+		}
+		return nil
+	}), "Couldn't read the sorted reads")
+	return n
+}
+
+// maxExactBucketSize is the largest bucket size bucketSizeReport() counts on
+// its own; larger buckets are counted in ranges that double in size.
+const maxExactBucketSize = 16
+
+// bucketSizeReport() describes the distribution of the sizes of the buckets
+// with the given counts, as listBuckets() returns them: the number of buckets
+// of each size, the number that are uniform (negated counts) and the largest.
+// Many buckets of size 1 mean -k is too long to group the reads; a few huge
+// buckets mean it is too short.
+func bucketSizeReport(counts []int) string {
+	hist := make(map[int]int) // least size in the range -> # of buckets
+	uniform, largest, reads := 0, 0, 0
+	for _, c := range counts {
+		if c < 0 {
+			uniform++
+		}
+		c = AbsInt(c)
+		reads += c
+		if c > largest {
+			largest = c
+		}
+		lo := c
+		if c > maxExactBucketSize {
+			lo = maxExactBucketSize + 1
+			for hi := 2 * maxExactBucketSize; c > hi; hi *= 2 {
+				lo = hi + 1
+			}
+		}
+		hist[lo]++
+	}
+
+	sizes := make([]int, 0, len(hist))
+	for lo := range hist {
+		sizes = append(sizes, lo)
+	}
+	sort.Ints(sizes)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Bucket sizes: %d buckets of %d reads; %d uniform; largest %d\n",
+		len(counts), reads, uniform, largest)
+	for _, lo := range sizes {
+		if lo <= maxExactBucketSize {
+			fmt.Fprintf(&b, "  %d: %d\n", lo, hist[lo])
+		} else {
+			fmt.Fprintf(&b, "  %d-%d: %d\n", lo, 2*(lo-1), hist[lo])
+		}
 	}
-	if dupsOption && allSame && counts[len(counts)-1] > 1 {
-		counts[len(counts)-1] = -counts[len(counts)-1]
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// bucketKForLimit() returns the longest prefix length, at most k, at which
+// the sorted reads have no more than limit distinct prefixes (or 1, if even
+// single bases give too many). Two adjacent reads are in different buckets
+// at length L exactly when their common prefix is shorter than L, so one pass
+// over the reads gives the number of buckets at every length.
+func bucketKForLimit(reads readStream, k, limit int) int {
+	// diverge[L] is the number of adjacent pairs whose common prefix is L
+	diverge := make([]int, k)
+	var a []byte
+	DIE_ON_ERR(reads.each(func(fq *FastQ) error {
+		b := fq.Seq
+		if a != nil {
+			l := 0
+			for l < k && a[l] == b[l] {
+				l++
+			}
+			if l < k {
+				diverge[l]++
+			}
+		}
+		a = b
+		return nil
+	}), "Couldn't read the sorted reads")
+	// the number of buckets at length L is 1 plus the pairs that differ
+	// in their first L bases
+	best, nbuckets := 1, 1
+	for l := 1; l <= k; l++ {
+		nbuckets += diverge[l-1]
+		if nbuckets > limit {
+			break
+		}
+		best = l
 	}
-	return buckets, counts
+	return best
 }
 
 // writeCounts() writes the counts list out to the given writer.
-func writeCounts(f io.Writer, readlen int, counts []int) {
+func writeCounts(f io.Writer, readlen int, counts []int) error {
 	log.Printf("Writing counts...")
-	fmt.Fprintf(f, "%d ", readlen)
+	if _, err := fmt.Fprintf(f, "%d ", readlen); err != nil {
+		return err
+	}
 	for _, c := range counts {
-		fmt.Fprintf(f, "%d ", c)
+		if _, err := fmt.Fprintf(f, "%d ", c); err != nil {
+			return err
+		}
 	}
 	log.Printf("Done; wrote %d counts.", len(counts))
+	return nil
 }
 
-// writeNLocations() writes out the locations of the translated Ns in the file.
-func writeNLocations(f io.Writer, reads []*FastQ) {
-	log.Printf("Writing location of Ns...")
-	// every read's locations are written as a space separated list of ascii
-	// integers
-	c := 0
-	for _, fq := range reads {
-		for i, p := range fq.NLocations {
-			fmt.Fprintf(f, "%d", p)
-			c++
-			if i != len(fq.NLocations)-1 {
-				fmt.Fprintf(f, " ")
+// writeRuns() writes out the runs of identical reads found by listBuckets(),
+// one bucket per line: the difference between the index of the bucket and
+// that of the previous line's bucket, followed by a pair of numbers for each
+// run longer than 1: the number of reads that are not repeated before it, and
+// its length.
+func writeRuns(f io.Writer, runs map[int][]int) error {
+	log.Printf("Writing runs of identical reads...")
+	bs := make([]int, 0, len(runs))
+	for b := range runs {
+		bs = append(bs, b)
+	}
+	sort.Ints(bs)
+
+	w := bufio.NewWriter(f)
+	dups := 0
+	prev := 0
+	for _, b := range bs {
+		fmt.Fprintf(w, "%d", b-prev)
+		prev = b
+		singles := 0
+		for _, r := range runs[b] {
+			if r == 1 {
+				singles++
+				continue
 			}
+			fmt.Fprintf(w, " %d %d", singles, r)
+			singles = 0
+			dups += r - 1
 		}
-		fmt.Fprintf(f, "\n")
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
 	}
-	log.Printf("Done; wrote %d Ns.", c)
+	log.Printf("Done; %d buckets have runs, which skip %d reads.", len(bs), dups)
+	return nil
 }
 
-// writeFlipped() writes out a stream of bits that says whether or not the
-// reads were flipped.
-func writeFlipped(out *bitio.Writer, reads []*FastQ) {
-	for _, fq := range reads {
-		if fq.IsFlipped {
-			out.WriteBit(1)
-		} else {
-			out.WriteBit(0)
-		}
+// nsVarintVersion is the first byte of an N location file in the varint
+// format; a file in the text format starts with a digit or a newline.
+// Versions before nsRunsVersion have no end runs.
+const (
+	nsVarintVersion byte = 1
+	nsRunsVersion   byte = 2
+)
+
+// An nRun is a run of Ns: its start and length.
+type nRun [2]int
+
+// splitNEndRuns() sorts the positions of the Ns of a read of length readLen
+// and splits off the runs of at least 2 Ns at either end of the read, which
+// are common where low quality bases have been masked. It returns the
+// positions of the other Ns and the end runs. A flipped read has its
+// trailing Ns at the start.
+func splitNEndRuns(posns []int, readLen int) ([]int, []nRun) {
+	sort.Ints(posns)
+	var runs []nRun
+	lead := 0
+	for lead < len(posns) && posns[lead] == lead {
+		lead++
+	}
+	if lead < 2 {
+		lead = 0
+	} else {
+		runs = append(runs, nRun{0, lead})
+	}
+	trail := 0
+	for n := len(posns) - 1 - trail; n >= lead && posns[n] == readLen-1-trail; n-- {
+		trail++
+	}
+	if trail >= 2 {
+		runs = append(runs, nRun{readLen - trail, trail})
+	} else {
+		trail = 0
 	}
+	return posns[lead : len(posns)-trail], runs
 }
 
+// appendNRun() adds the positions of the run to posns, keeping them in
+// increasing order if they were.
+func appendNRun(posns []byte, start, length uint64) ([]byte, error) {
+	if start+length > 256 || length == 0 {
+		return nil, fmt.Errorf("bad run of Ns %d+%d", start, length)
+	}
+	for p := start; p < start+length; p++ {
+		posns = append(posns, byte(p))
+	}
+	sort.Slice(posns, func(i, j int) bool { return posns[i] < posns[j] })
+	return posns, nil
+}
 
-// encodeWithBuckets() reads the reads, creates the buckets, saves the buckets
-// and their counts, and then encodes each read.
-func preprocessWithBuckets(
-	readFile string,
-	outBaseName string,
-	bv *BitVec,
-) (*os.File, []string, []int) {
-	// read the reads and flip as needed
-	reads := readAndFlipReads(readFile, bv, flipReadsOption)
+// An nLocationWriter writes out the locations of the translated Ns of reads
+// one read at a time, in the format given by nsFormatOption, so that the
+// reads needn't all be at hand at once. Flush() must be called after the
+// last read.
+type nLocationWriter struct {
+	buf    *bufio.Writer
+	varint bool
+	posns  []int
+	v      [binary.MaxVarintLen64]byte
+	n      int // # of Ns written
+}
 
-	readLength := len(reads[0].Seq)
+// newNLocationWriter() returns an nLocationWriter writing to f; the varint
+// format starts with its version byte.
+func newNLocationWriter(f io.Writer) *nLocationWriter {
+	w := &nLocationWriter{
+		buf:    bufio.NewWriter(f),
+		varint: nsFormatOption == "varint",
+		posns:  make([]int, 0, 256),
+	}
+	if w.varint {
+		log.Printf("Writing location of Ns as varints...")
+		w.buf.WriteByte(nsRunsVersion)
+	} else {
+		log.Printf("Writing location of Ns...")
+	}
+	return w
+}
 
-	log.Printf("Estimated 2-bit encoding size: %d",
-		uint64(math.Ceil(float64(2*len(reads)*readLength)/8.0)))
+// Write() writes out the locations of the Ns of the next read. In the varint
+// format they are 4 times the number of interior Ns plus the number of end
+// runs (see splitNEndRuns()), then the positions of the interior Ns in
+// increasing order, each as the gap from the previous one (or from 0), then
+// the start and length of each end run, all as unsigned varints. In the text
+// format they are a line with the interior positions as a space separated
+// list of ascii integers, followed by the end runs as START+LENGTH.
+func (w *nLocationWriter) Write(fq *FastQ) {
+	w.posns = w.posns[:0]
+	for _, p := range fq.NLocations {
+		w.posns = append(w.posns, int(p))
+	}
+	interior, runs := splitNEndRuns(w.posns, len(fq.Seq))
+	w.n += len(w.posns)
+	if w.varint {
+		put := func(x int) {
+			w.buf.Write(w.v[:binary.PutUvarint(w.v[:], uint64(x))])
+		}
+		put(4*len(interior) + len(runs))
+		prev := 0
+		for _, p := range interior {
+			put(p - prev)
+			prev = p
+		}
+		for _, r := range runs {
+			put(r[0])
+			put(r[1])
+		}
+		return
+	}
+	sep := ""
+	for _, p := range interior {
+		fmt.Fprintf(w.buf, "%s%d", sep, p)
+		sep = " "
+	}
+	for _, r := range runs {
+		fmt.Fprintf(w.buf, "%s%d+%d", sep, r[0], r[1])
+		sep = " "
+	}
+	w.buf.WriteByte('\n')
+}
 
-	// if the user wants the qualities written out
-	waitForFlipped := make(chan struct{})
-	if writeFlippedOption {
-		outFlipped, err := os.Create(outBaseName + ".flipped")
-		DIE_ON_ERR(err, "Couldn't create flipped file: %s", outBaseName+".flipped")
-		defer outFlipped.Close()
+// Flush() writes out anything still buffered.
+func (w *nLocationWriter) Flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Done; wrote %d Ns.", w.n)
+	return nil
+}
+
+// writeExceptions() writes out the exceptions of each read, one read per
+// line, as a space separated list of position:byte pairs (both in decimal).
+func writeExceptions(f io.Writer, reads readStream) error {
+	w := bufio.NewWriter(f)
+	c := 0
+	err := reads.each(func(fq *FastQ) error {
+		for i := 0; i < len(fq.Exceptions); i += 2 {
+			if i > 0 {
+				fmt.Fprintf(w, " ")
+			}
+			fmt.Fprintf(w, "%d:%d", fq.Exceptions[i], fq.Exceptions[i+1])
+			c++
+		}
+		_, err := fmt.Fprintf(w, "\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Done; wrote %d exceptions.", c)
+	return nil
+}
 
-		outFlippedZ, err := gzip.NewWriterLevel(outFlipped, gzip.BestCompression)
-		DIE_ON_ERR(err, "Couldn't create gzipper for flipped file.")
-		defer outFlippedZ.Close()
+// hasExceptions() returns true if any of the reads has an exception.
+func hasExceptions(reads readStream) bool {
+	return anyRead(reads, func(fq *FastQ) bool { return len(fq.Exceptions) > 0 })
+}
 
-		flippedBits := bitio.NewWriter(outFlippedZ)
-		defer flippedBits.Close()
+// errFound stops anyRead() at the first read it is looking for.
+var errFound = errors.New("found")
 
-		go func() {
-			writeFlipped(flippedBits, reads)
-			close(waitForFlipped)
-			runtime.Goexit()
-			return
-		}()
+// anyRead() returns true if is() is true of any of the reads.
+func anyRead(reads readStream, is func(fq *FastQ) bool) bool {
+	err := reads.each(func(fq *FastQ) error {
+		if is(fq) {
+			return errFound
+		}
+		return nil
+	})
+	if err != errFound {
+		DIE_ON_ERR(err, "Couldn't read the sorted reads")
+	}
+	return err == errFound
+}
+
+// writeDroppedReads() writes the sequences of the reads, as they were read,
+// one per line to the gzipped file filename.
+func writeDroppedReads(filename string, reads []*FastQ) {
+	f, err := os.Create(filename)
+	DIE_ON_ERR(err, "Couldn't create dropped reads file: %s", filename)
+	z, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	DIE_ON_ERR(err, "Couldn't create gzipper for dropped reads file.")
+	w := newRawWriter(z)
+	for _, fq := range reads {
+		w.Write("", fq.Original(), nil)
+	}
+	DIE_ON_ERR(w.Flush(), "Couldn't write dropped reads file: %s", filename)
+	DIE_ON_ERR(z.Close(), "Couldn't write dropped reads file: %s", filename)
+	DIE_ON_ERR(f.Close(), "Couldn't write dropped reads file: %s", filename)
+}
+
+// writeFlipped() writes out a stream of bits that says whether or not the
+// reads were flipped.
+func writeFlipped(out *bitio.Writer, reads readStream) error {
+	err := reads.each(func(fq *FastQ) error {
+		var b byte
+		if fq.IsFlipped {
+			b = 1
+		}
+		return out.WriteBit(b)
+	})
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+
+/*
+The processed reads are passed from preprocessWithBuckets() to
+encodeReadsFromTempFile(), through memory, a temp file or OUT.sorted, as
+processedMagic followed by each read as a uvarint length and then its bases.
+Unlike one read per line, this can't be thrown off by a stray newline, and
+reading a read back needs no scan for its end. .sorted files written before
+the magic was added have one read per line, and are still read.
+*/
+
+// processedMagic starts a stream of processed reads.
+const processedMagic = "KPS\x01"
+
+// maxProcessedRead is the longest read a stream of processed reads may hold;
+// anything longer means the stream is corrupt.
+const maxProcessedRead = 1 << 16
+
+// appendProcessedRead() appends the record for seq to buf.
+func appendProcessedRead(buf []byte, seq []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(seq)))]...)
+	return append(buf, seq...)
+}
+
+// A processedReader reads the reads back from a stream of processed reads.
+type processedReader struct {
+	in    *bufio.Reader
+	lines bool // an old stream of one read per line
+}
+
+func newProcessedReader(r io.Reader) *processedReader {
+	in := bufio.NewReader(r)
+	if b, err := in.Peek(len(processedMagic)); err == nil && string(b) == processedMagic {
+		in.Discard(len(processedMagic))
+		return &processedReader{in: in}
+	}
+	return &processedReader{in: in, lines: true}
+}
+
+// Next() returns the next read, or io.EOF after the last one.
+func (r *processedReader) Next() (string, error) {
+	if r.lines {
+		s, err := r.in.ReadString('\n')
+		if err == io.EOF && s != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		return s[:len(s)-1], nil
+	}
+	n, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return "", err
+	}
+	if n > maxProcessedRead {
+		return "", fmt.Errorf("processed read of %d bases is too long", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.in, b); err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(b), nil
+}
+
+// A seqReader reads a list of sequences as a stream of processed reads.
+type seqReader struct {
+	seqs    [][]byte
+	started bool   // the magic has been queued
+	buf     []byte // the record of the current sequence
+	pending []byte // the bytes of buf not yet read
+}
+
+func (r *seqReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(r.pending) == 0 {
+			if !r.started {
+				r.started = true
+				r.buf = append(r.buf[:0], processedMagic...)
+			} else if len(r.seqs) > 0 {
+				r.buf = appendProcessedRead(r.buf[:0], r.seqs[0])
+				r.seqs = r.seqs[1:]
+			} else {
+				break
+			}
+			r.pending = r.buf
+		}
+		c := copy(p[n:], r.pending)
+		n += c
+		r.pending = r.pending[c:]
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (r *seqReader) Close() error {
+	r.seqs = nil
+	r.pending = nil
+	return nil
+}
+
+// A tempFile is a temporary file that is deleted when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// A bucketedReads holds the reads of a segment, processed and ready to
+// encode: the reads themselves, as a stream of processed reads in the order
+// they are encoded,
+// and their buckets, counts, runs of identical reads, homopolymer tails, and
+// archive id. sidecars lists the extensions of the optional files written for
+// the segment.
+type bucketedReads struct {
+	reads        io.ReadCloser
+	buckets      []string
+	counts       []int
+	runs         map[int][]int
+	homopolymers map[int]homopolymerTails
+	id           archiveID
+	sidecars     []string
+}
+
+// preprocessWithBuckets() reads the reads, creates the buckets, saves the
+// buckets and their counts, and returns the processed reads for
+// encodeReadsFromTempFile(). refMD5 is the md5 hash of the reference, which
+// goes into the archive id. If maxBuckets > 0 and the reads have more than
+// that many distinct prefixes, bucketK is shortened until they don't (see
+// bucketKForLimit()). With -bucketorder=walk, the buckets are put in the
+// order of walkBucketOrder() along km, the model the tails are coded with,
+// as it is before any reads are coded. With -sortbatch=N, the reads are
+// sorted in batches of N and merged each time they are gone through (see
+// sortReadsExternally()), so that they are never all in memory. The
+// processed reads are kept in memory if
+// memEncodeOption is set or they take at most memEncodeThreshold bytes, and
+// are otherwise written to a temp file that is deleted when closed, or kept
+// in memory after all if no temp file can be created.
+//
+// Once sorted, the reads are written to the sidecar files and the temp file
+// by several goroutines at once. They all only read the reads, and this
+// function waits for all of them before it returns, so nothing changes the
+// reads while they are being written.
+func preprocessWithBuckets(
+	readFile string,
+	outBaseName string,
+	refMD5 string,
+	ks *kmerSet,
+	km KmerModel,
+	eccModel KmerModel,
+	maxBuckets int,
+) *bucketedReads {
+	// read the reads and flip as needed
+	DIE_ON_ERR(checkSortBatch(sortBatchOption), "Can't encode with these options")
+	var reads readStream
+	var dropped []*FastQ
+	var batches *sortedRuns
+	if sortBatchOption > 0 {
+		batches, dropped = sortReadsExternally(readFile, ks, eccModel, flipReadsOption, sortBatchOption)
+		defer batches.Close()
+		reads = batches
 	} else {
-		close(waitForFlipped)
+		var inMemory []*FastQ
+		inMemory, dropped = readAndFlipReads(readFile, ks, eccModel, flipReadsOption)
+		reads = readSlice(inMemory)
 	}
 
-	// if the user wants to write out the N positions, write them out
-	waitForNs := make(chan struct{})
-	if writeNsOption {
-		outNs, err := os.Create(outBaseName + ".ns")
-		DIE_ON_ERR(err, "Couldn't create N location file: %s", outBaseName+".ns")
-		defer outNs.Close()
+	// merge buckets if there are too many; this is done before the archive
+	// id is computed, as the id covers the prefix length
+	if maxBuckets > 0 {
+		if k := bucketKForLimit(reads, bucketK, maxBuckets); k < bucketK {
+			log.Printf("Shortening the bucket prefixes from %d to %d bases to have at most %d buckets",
+				bucketK, k, maxBuckets)
+			bucketK = k
+		}
+	}
 
-		outNsZ, err := gzip.NewWriterLevel(outNs, gzip.BestCompression)
-		DIE_ON_ERR(err, "Couldn't create gzipper for N location file.")
-		defer outNsZ.Close()
+	// the reads all have the length checked by readAndFlipReads()
+	readLength := reads.readLen()
 
-		go func() {
-			writeNLocations(outNsZ, reads)
-			close(waitForNs)
-			runtime.Goexit()
-			return
-		}()
+	// reorder the buckets before anything is written, so that every file
+	// but the bittree and counts follows the coding order; the reads are in
+	// memory, as checkSortBatch() allows no other way
+	if bucketOrderOption == "walk" {
+		reads = readSlice(orderReadsByBuckets(reads.(readSlice), km, readLength-bucketK))
+	}
+	id := newArchiveID(reads, refMD5)
+	log.Printf("Archive id = %v", id)
+
+	// the dropped reads are not part of the archive, so don't leave a stale
+	// file around that might be taken for them
+	if keepDroppedOption {
+		writeDroppedReads(outBaseName+".dropped", dropped)
 	} else {
-		close(waitForNs)
+		os.Remove(outBaseName + ".dropped")
 	}
 
+	log.Printf("Estimated 2-bit encoding size: %d",
+		uint64(math.Ceil(float64(2*reads.count()*readLength)/8.0)))
+
 	// create the buckets and counts
-	buckets, counts := listBuckets(reads)
+	buckets, counts, runs := listBuckets(reads)
+	if bucketStatsOption {
+		log.Println(bucketSizeReport(counts))
+	}
+	var homopolymers map[int]homopolymerTails
+	if lowComplexOption {
+		homopolymers = listHomopolymers(reads, counts, runs)
+	}
+
+	// Every file is created before any is written, so that if one can't be
+	// created, those created before it are removed with nothing running
+	// that still writes to them.
+	var created []*sidecarFile
+	create := func(ext string, wrap func(io.Writer) (io.WriteCloser, error)) *sidecarFile {
+		f, err := createSidecar(outBaseName+ext, wrap)
+		if err != nil {
+			for _, c := range created {
+				c.close(err)
+			}
+			DIE_ON_ERR(err, "Couldn't create %s", outBaseName+ext)
+		}
+		created = append(created, f)
+		return f
+	}
+
+	// if the user wants the flipped bits or the N positions written out; the
+	// N positions are written read by read as the processed reads are
+	sidecars := make([]string, 0, 4)
+	var flippedFile, nsFile *sidecarFile
+	var nsWriter *nLocationWriter
+	if writeFlippedOption {
+		sidecars = append(sidecars, ".flipped")
+		flippedFile = create(".flipped", sidecarWrapper(id))
+	}
+	if writeNsOption {
+		sidecars = append(sidecars, ".ns")
+		nsFile = create(".ns", sidecarWrapper(id))
+		nsWriter = newNLocationWriter(nsFile.w)
+	}
 
-	// write the bittree for the bucket out to a file
-	outBT, err := os.Create(outBaseName + ".bittree")
-	DIE_ON_ERR(err, "Couldn't create bucket file: %s", outBaseName+".bittree")
-	defer outBT.Close()
+	// The exceptions are needed to decode exactly, so they are written if
+	// there are any, and a stale file is removed otherwise; likewise the
+	// original bases of the corrected reads, the runs of identical reads and
+	// the homopolymer tails, which are not coded. The GC counts and the input
+	// order of the reads aren't needed to decode, so they are only written if
+	// asked.
+	extras := []struct {
+		ext     string
+		write   bool
+		wrap    func(io.Writer) (io.WriteCloser, error)
+		produce func(w io.Writer) error
+		file    *sidecarFile
+	}{
+		{ext: ".exc", write: hasExceptions(reads), wrap: gzipWrapper(id, gzip.BestCompression),
+			produce: func(w io.Writer) error { return writeExceptions(w, reads) }},
+		{ext: ".ecc", write: hasCorrections(reads), wrap: gzipWrapper(id, gzip.BestCompression),
+			produce: func(w io.Writer) error { return writeCorrections(w, reads) }},
+		{ext: ".gc", write: gcOption, wrap: sidecarWrapper(id),
+			produce: func(w io.Writer) error { return writeGC(w, reads) }},
+		{ext: ".order", write: keepOrderOption, wrap: gzipWrapper(id, gzip.BestCompression),
+			produce: func(w io.Writer) error { return writeOrder(w, reads) }},
+		{ext: ".runs", write: dupRunsOption, wrap: gzipWrapper(id, gzip.BestCompression),
+			produce: func(w io.Writer) error { return writeRuns(w, runs) }},
+		{ext: ".homo", write: len(homopolymers) > 0, wrap: gzipWrapper(id, gzip.BestCompression),
+			produce: func(w io.Writer) error { return writeHomopolymers(w, homopolymers) }},
+	}
+	for i := range extras {
+		if extras[i].write {
+			sidecars = append(sidecars, extras[i].ext)
+			extras[i].file = create(extras[i].ext, extras[i].wrap)
+		} else {
+			os.Remove(outBaseName + extras[i].ext)
+		}
+	}
 
-	// compress the file with gzip as we are writing it
-	outBZ, err := gzip.NewWriterLevel(outBT, gzip.BestCompression)
-	DIE_ON_ERR(err, "Couldn't create gzipper for bucket file")
-	defer outBZ.Close()
+	// the bittree for the buckets and their counts, compressed as they are
+	// written (the counts unless asked not to)
+	bittreeFile := create(".bittree", gzipWrapper(id, gzip.BestCompression))
+	countsFile := create(".counts", sidecarWrapper(id))
 
-	// create a writer that lets us write bits
-	writer := bitio.NewWriter(outBZ)
-	defer writer.Close()
+	// if asked, keep a copy of the processed reads so the tails can be
+	// re-encoded later without flipping and sorting again
+	var sortedFile *sidecarFile
+	if keepSortedOption {
+		sortedFile = create(".sorted", gzipWrapper(id, gzip.BestSpeed))
+	}
 
-	/*** The main work to encode the bucket names ***/
-	waitForBuckets := make(chan struct{})
-	go func() {
-		encodeKmersToFile(buckets, writer)
-		close(waitForBuckets)
-		runtime.Goexit()
-		return
-	}()
+	// each file but the N locations and the sorted reads is written by a
+	// producer of its own
+	if flippedFile != nil {
+		flippedFile.start(func(w io.Writer) error {
+			return writeFlipped(bitio.NewWriter(w), reads)
+		})
+	}
+	for _, x := range extras {
+		if x.file != nil {
+			x.file.start(x.produce)
+		}
+	}
 
-	// write out the counts
-	countF, err := os.Create(outBaseName + ".counts")
-	DIE_ON_ERR(err, "Couldn't create counts file: %s", outBaseName+".counts")
-	defer countF.Close()
+	// the bittree and counts are kept in the sorted order of the buckets
+	// whatever order they are coded in
+	sorted, sortedCounts := buckets, counts
+	if bucketOrderOption == "walk" {
+		sorted, sortedCounts = sortedBuckets(buckets, counts)
+	}
 
-	// compress it as we are writing it
-	countZ, err := gzip.NewWriterLevel(countF, gzip.BestCompression)
-	DIE_ON_ERR(err, "Couldn't create gzipper for count file")
-	defer countZ.Close()
+	/*** The main work to encode the bucket names ***/
+	bittreeFile.start(func(w io.Writer) error {
+		// create a writer that lets us write bits
+		writer := bitio.NewWriter(w)
+		encodeKmersToFile(sorted, writer)
+		return writer.Close()
+	})
 
 	/*** The main work to encode the bucket counts ***/
-	waitForCounts := make(chan struct{})
-	go func() {
-		writeCounts(countZ, readLength, counts)
-		close(waitForCounts)
-		runtime.Goexit()
-		return
-	}()
-
-	// create a temp file containing the processed reads
-	processedFile, err := ioutil.TempFile("", "kpath-encode-")
-	DIE_ON_ERR(err, "Couldn't create temporary file in %s", os.TempDir())
+	countsFile.start(func(w io.Writer) error {
+		return writeCounts(w, readLength, sortedCounts)
+	})
+
+	// keep the processed reads in memory if asked to or if they are small;
+	// otherwise spill them to a temp file, as always with -sortbatch
+	var processed io.ReadCloser
+	var processedFile *os.File
+	outs := make([]io.Writer, 0, 2)
+	inMemory := batches == nil &&
+		(memEncodeOption || int64(reads.count())*int64(readLength+1) <= memEncodeThreshold)
+	if !inMemory {
+		// with no writable temp dir (as in some containers), memory is
+		// the only place left for them
+		var err error
+		processedFile, err = ioutil.TempFile("", "kpath-encode-")
+		if err != nil {
+			log.Printf("Couldn't create temporary file in %s (%v); keeping the processed reads in memory instead",
+				os.TempDir(), err)
+			inMemory = true
+		} else {
+			processed = &tempFile{processedFile}
+			outs = append(outs, processedFile)
+		}
+	}
+	if inMemory {
+		log.Printf("Keeping the processed reads in memory")
+		seqs := make([][]byte, 0, reads.count())
+		DIE_ON_ERR(reads.each(func(fq *FastQ) error {
+			seqs = append(seqs, fq.Seq)
+			return nil
+		}), "Couldn't read the sorted reads")
+		processed = &seqReader{seqs: seqs}
+	}
 	md5Hash := md5.New()
-	waitForTemp := make(chan struct{})
+	if sortedFile != nil {
+		outs = append(outs, sortedFile.w)
+	}
+
+	// the N locations and the sorted reads are written along with the
+	// processed reads
+	waitForTemp := make(chan error, 1)
 	go func() {
-		for i := range reads {
-			md5Hash.Write(reads[i].Seq)
-			processedFile.Write(reads[i].Seq)
-			processedFile.Write([]byte{'\n'})
-		}
-		processedFile.Seek(0, 0)
-		close(waitForTemp)
+		waitForTemp <- runProducer(func() error {
+			if err := writeProcessedReads(reads, md5Hash, nsWriter, outs...); err != nil {
+				return err
+			}
+			if processedFile != nil {
+				_, err := processedFile.Seek(0, 0)
+				return err
+			}
+			return nil
+		})
 	}()
 
-
-	// Wait for each of the coders to finish
-	<-waitForBuckets
-	<-waitForCounts
-	<-waitForNs
-	<-waitForFlipped
-	<-waitForTemp
+	// Wait for each of the coders to finish before closing its file. If any
+	// of them failed, remove every file written so far, so that no part of
+	// the archive is left looking usable.
+	errs := []error{bittreeFile.finish(), countsFile.finish()}
+	if flippedFile != nil {
+		errs = append(errs, flippedFile.finish())
+	}
+	for _, x := range extras {
+		if x.file != nil {
+			errs = append(errs, x.file.finish())
+		}
+	}
+	tempErr := <-waitForTemp
+	if nsFile != nil {
+		errs = append(errs, nsFile.close(tempErr))
+	}
+	if sortedFile != nil {
+		errs = append(errs, sortedFile.close(tempErr))
+	}
+	errs = append(errs, tempErr)
+	for _, err := range errs {
+		if err != nil {
+			processed.Close()
+			removeSidecars(outBaseName, append(sidecars, ".bittree", ".counts", ".sorted"))
+			DIE_ON_ERR(err, "Couldn't write the files of %s", outBaseName)
+		}
+	}
 	log.Printf("MD5 hash of reads = %x", md5Hash.Sum(nil))
 
 	log.Printf("Done processing; reads are of length %d ...", readLength)
-	return processedFile, buckets, counts
+	return &bucketedReads{processed, buckets, counts, runs, homopolymers, id, sidecars}
+}
+
+// writeProcessedReads() writes the sequences of the reads, as a stream of
+// processed reads, to each of the outputs, and adds them to md5Hash. At
+// most tempBufferSize bytes are buffered for each output, so a slow output
+// holds up the writer instead of letting memory grow. If ns is not nil, the
+// N locations of each read are written to it as the read is. The reads are
+// only read.
+func writeProcessedReads(reads readStream, md5Hash hash.Hash, ns *nLocationWriter, outs ...io.Writer) error {
+	bufs := make([]*bufio.Writer, len(outs))
+	for i, out := range outs {
+		bufs[i] = bufio.NewWriterSize(out, tempBufferSize)
+		bufs[i].WriteString(processedMagic)
+	}
+	var rec []byte
+	err := reads.each(func(fq *FastQ) error {
+		md5Hash.Write(fq.Seq)
+		rec = appendProcessedRead(rec[:0], fq.Seq)
+		for _, buf := range bufs {
+			buf.Write(rec)
+		}
+		if ns != nil {
+			ns.Write(fq)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+	}
+	if ns != nil {
+		return ns.Flush()
+	}
+	return nil
 }
 
 // encodeSingleReadWithBucket() encodes a single read: uses a bucketing scheme
-// for initial part, and arithmetic encoding for the rest.
-func encodeSingleReadWithBucket(contextMer Kmer, r string, km KmerModel, coder *arithc.Encoder) {
+// for initial part, and arithmetic encoding for the rest. If the buckets are
+// shorter than k, the first contexts are the bucket padded on the left by As.
+func encodeSingleReadWithBucket(st *codingState, contextMer Kmer, r string, km KmerModel, coder *arithc.Encoder) {
 	// encode rest using the reference probs
-	for i := globalK; i < len(r); i++ {
+	for i := bucketK; i < len(r); i++ {
 		char := acgt(r[i])
-		a, b, total := nextInterval(km, contextMer, char, true)
+		a, b, total := nextInterval(st, km, contextMer, char, true)
 		coder.Encode(a, b, total)
+		if entropyOption {
+			modelBits += math.Log2(float64(total) / float64(b-a))
+			modelBases++
+		}
 		contextMer = shiftKmer(contextMer, char)
 	}
 }
 
-// encodeReadsFromTempFile() reads the newline seperated reads from tempFile
-// and encodes them using the information in buckets, counts, hash. It writes
-// to the given arithmetic coder.  buckets, counts and tempFile are obtained
-// with preprocessWithBuckets().
+// encodeReadsFromTempFile() reads the stream of processed reads in tempFile
+// and encodes them using the information in buckets, counts, runs, hash. It
+// writes to the given arithmetic coder.  buckets, counts, runs and tempFile
+// are obtained with preprocessWithBuckets() (or, when re-encoding, from the
+// .sorted, .bittree, .counts and .runs files of an archive). Only the first
+// read of each run of identical reads is encoded, unless homopolymers lists
+// it as a homopolymer, whose tail is not coded at all. If readBits is not nil, it
+// is called with the index in the stream, the sequence and the number of bits
+// of each encoded read (0 for a homopolymer), in order. If
+// startBucket is not nil, it is called before each bucket is encoded with the
+// index of the bucket and the number of reads in the buckets before it.
 func encodeReadsFromTempFile(
-	tempFile *os.File,
+	tempFile io.Reader,
 	buckets []string,
 	counts []int,
+	runs map[int][]int,
+	homopolymers map[int]homopolymerTails,
 	km KmerModel,
 	coder *arithc.Encoder,
+	readBits func(index int, r string, bits uint64),
+	startBucket func(bucket, readsBefore int),
 ) (n int) {
 	/*** The main work to encode the read tails ***/
 	log.Printf("Currently have %v Go routines...", runtime.NumGoroutine())
-	runtime.GC()
+	if forceGCOption {
+		runtime.GC()
+	}
+	// The encode is serial, so keep it on one OS thread rather than letting
+	// it migrate as the scheduler moves goroutines about. Locking only pins
+	// this goroutine: the goroutines writing the other streams run on the
+	// remaining GOMAXPROCS threads and signal their wait channels as usual.
 	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 
-	buf := bufio.NewReader(tempFile)
+	buf := newProcessedReader(tempFile)
 
 	encodeStart := time.Now()
 	log.Printf("Encoding reads...")
 
-	for i, c := range counts {
-		bucketMer := stringToKmer(buckets[i])
-		if c > 0 {
-			// write out the given number of reads
-			for j := 0; j < c; j++ {
-				r, err := buf.ReadString('\n')
-				DIE_ON_ERR(err, "Couldn't read from temp file %s", tempFile.Name())
-				encodeSingleReadWithBucket(bucketMer, r[:len(r)-1], km, coder)
-				n++
+	// encode a read, recording its size if asked to
+	index := 0 // of the next read in the stream
+	encodeRead := func(bucketMer Kmer, r string) {
+		before := coder.BitPosition()
+		encodeSingleReadWithBucket(coding, bucketMer, r, km, coder)
+		if readBits != nil {
+			readBits(index, r, coder.BitPosition()-before)
+		}
+	}
+
+	// encode the next of a run of identical reads, and skip the rest; the
+	// tail of a homopolymer is left out of the stream
+	bucket, tail := 0, 0
+	encodeRun := func(bucketMer Kmer, length int) {
+		r, err := buf.Next()
+		DIE_ON_ERR(err, "Couldn't read from processed reads")
+		if h, ok := homopolymers[bucket]; ok && h.contains(tail) {
+			if readBits != nil {
+				readBits(index, r, 0)
 			}
 		} else {
+			encodeRead(bucketMer, r)
+			n++
+		}
+		tail++
+
+		// skip past length-1 reads that should be identical
+		for j := 1; j < length; j++ {
+			_, err := buf.Next()
+			DIE_ON_ERR(err, "Couldn't read from processed reads")
+		}
+		index += length
+	}
+
+	readsBefore := 0
+	for i, c := range counts {
+		if startBucket != nil {
+			startBucket(i, readsBefore)
+		}
+		readsBefore += AbsInt(c)
+		bucket, tail = i, 0
+
+		if c == 0 {
+			// an empty bucket has nothing in the stream; the decoder
+			// skips it the same way
+			continue
+		}
+		bucketMer := stringToKmer(buckets[i])
+		if c < 0 {
 			// all the reads in this bucket are the same, so just write one
-			// and skip past the rest.
-			r, err := buf.ReadString('\n')
-			DIE_ON_ERR(err, "Couldn't read from temp file %s", tempFile.Name())
-			encodeSingleReadWithBucket(bucketMer, r[:len(r)-1], km, coder)
-
-			// skip past c-1 reads that should be identical
-			for j := 1; j < AbsInt(c); j++ {
-				buf.ReadString('\n')
-				DIE_ON_ERR(err, "Couldn't read from temp file %s", tempFile.Name())
+			encodeRun(bucketMer, -c)
+		} else {
+			// write out the runs, then the rest of the reads one by one
+			for _, length := range runs[i] {
+				encodeRun(bucketMer, length)
+				c -= length
+			}
+			for j := 0; j < c; j++ {
+				encodeRun(bucketMer, 1)
 			}
-			n++
 		}
 	}
 
 	log.Printf("done. Took %v seconds to encode the tails.",
 		time.Now().Sub(encodeStart).Seconds())
-	runtime.UnlockOSThread()
-
-	tempFile.Close()
-	err := os.Remove(tempFile.Name())
-	DIE_ON_ERR(err, "Couldn't delete temp file %s", tempFile.Name())
-
 	return
 }
 
@@ -814,27 +2197,20 @@ func readBucketCounts(countsFN string) ([]int, int) {
 	DIE_ON_ERR(err, "Couldn't open count file: %s", countsFN)
 	defer c1.Close()
 
-	// the count file is compressed with gzip; uncompress it as we read it
-	c, err := gzip.NewReader(c1)
+	// the count file is compressed with gzip (unless written with
+	// -rawstreams); uncompress it as we read it
+	c, err := openSidecar(c1)
 	DIE_ON_ERR(err, "Couldn't create gzip reader: %v")
 	defer c.Close()
 
-	var n, readlen int
-	_, err = fmt.Fscanf(c, "%d", &readlen)
-	DIE_ON_ERR(err, "Couldn't read read length from counts file")
-
-	counts := make([]int, 0)
-	err = nil
+	counts, readlen, err := parseBucketCounts(c)
+	DIE_ON_ERR(err, "Couldn't read the counts in %s", countsFN)
 	sum := 0
 	dupBucketCount := 0
-	for x := 1; err == nil && x > 0; {
-		x, err = fmt.Fscanf(c, "%d", &n)
-		if x > 0 && err == nil {
-			sum += AbsInt(n)
-			if n < 0 {
-				dupBucketCount++
-			}
-			counts = append(counts, n)
+	for _, n := range counts {
+		sum += AbsInt(n)
+		if n < 0 {
+			dupBucketCount++
 		}
 	}
 	log.Printf("Number of uniform buckets = %d\n", dupBucketCount)
@@ -843,23 +2219,92 @@ func readBucketCounts(countsFN string) ([]int, int) {
 	return counts, readlen
 }
 
+// parseBucketCounts() parses the read length and the bucket counts written
+// by writeCounts(). A count that doesn't fit in an int (as may happen with a
+// 32-bit build and over 2^31 copies of a read) is an error, not the end of
+// the counts.
+func parseBucketCounts(r io.Reader) ([]int, int, error) {
+	// a RuneScanner, so that Fscan reads no further than each number
+	in := bufio.NewReader(r)
+	var n, readlen int
+	if _, err := fmt.Fscan(in, &readlen); err != nil {
+		return nil, 0, fmt.Errorf("no read length: %v", err)
+	}
+	counts := make([]int, 0)
+	for {
+		_, err := fmt.Fscan(in, &n)
+		if err == io.EOF {
+			return counts, readlen, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("bad count after %d counts: %v", len(counts), err)
+		}
+		counts = append(counts, n)
+	}
+}
+
+// readRuns() reads the runs of identical reads written by writeRuns(). If
+// the file does not exist, returns nil.
+func readRuns(runsFN string) map[int][]int {
+	runsIn, err := os.Open(runsFN)
+	if err != nil {
+		return nil
+	}
+	defer runsIn.Close()
+	log.Printf("Reading runs of identical reads from %v", runsFN)
+
+	runsZ, err := gzip.NewReader(runsIn)
+	DIE_ON_ERR(err, "Couldn't create gzip reader for %s", runsFN)
+	defer runsZ.Close()
+
+	runs := make(map[int][]int)
+	b := 0
+	scanner := bufio.NewScanner(runsZ)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		delta, err := strconv.Atoi(fields[0])
+		DIE_ON_ERR(err, "Bad bucket in %s: %q", runsFN, scanner.Text())
+		b += delta
+		DIE_IF(len(fields)%2 != 1, "Bad line in %s: %q", runsFN, scanner.Text())
+		r := make([]int, 0, len(fields)-1)
+		for i := 1; i < len(fields); i += 2 {
+			singles, err1 := strconv.Atoi(fields[i])
+			length, err2 := strconv.Atoi(fields[i+1])
+			DIE_IF(err1 != nil || err2 != nil || singles < 0 || length < 2,
+				"Bad run in %s: %q", runsFN, scanner.Text())
+			for ; singles > 0; singles-- {
+				r = append(r, 1)
+			}
+			r = append(r, length)
+		}
+		runs[b] = r
+	}
+	DIE_ON_ERR(scanner.Err(), "Couldn't read %s", runsFN)
+	log.Printf("done; read runs for %d buckets", len(runs))
+	return runs
+}
+
 // readFlipped() reads the compressed bitstream that indicates whether a read
-// was flipped or not. If the file does not exist, returns nil.
-func readFlipped(flippedFN string) []bool {
+// was flipped or not, for about nreads reads (0 if the number isn't known).
+// If the file does not exist, returns nil.
+func readFlipped(flippedFN string, nreads int) []bool {
 	// open the file; return empty if nothing there
 	flippedIn, err := os.Open(flippedFN)
 	if err == nil {
 		log.Printf("Reading flipped bits from %s", flippedFN)
 		defer flippedIn.Close()
 
-		flippedZ, err := gzip.NewReader(flippedIn)
+		flippedZ, err := openSidecar(flippedIn)
 		DIE_ON_ERR(err, "Couldn't create unzipper for flipped file")
 		defer flippedZ.Close()
 
 		flippedBits := bitio.NewReader(bufio.NewReader(flippedZ))
 		defer flippedBits.Close()
 
-		flipped := make([]bool, 0, 1000000)
+		flipped := make([]bool, 0, nreads)
 		for {
 			b, err := flippedBits.ReadBit()
 			if err != nil {
@@ -879,25 +2324,32 @@ func readFlipped(flippedFN string) []bool {
 	}
 }
 
-// readNLocations() reads the compressed N location file and returns a slice of
-// slices that contain the positions of the Ns. An optimization is made that if
-// there are no Ns in a read, then out[r] will be nil rather than an empty
-// list.  If the file is not found, will return nil
+// readNLocations() reads the compressed N location file (in either format) and
+// returns a slice of slices that contain the positions of the Ns. An
+// optimization is made that if there are no Ns in a read, then out[r] will be
+// nil rather than an empty list.  If the file is not found, will return nil
 func readNLocations(nLocFN string) [][]byte {
 	// open the file; return empty if nothing there
 	inNs, err := os.Open(nLocFN)
 	if err == nil {
 		log.Printf("Reading locations of Ns from %s", nLocFN)
 		defer inNs.Close()
-		inZ, err := gzip.NewReader(inNs)
+		inZ, err := openSidecar(inNs)
 		DIE_ON_ERR(err, "Couldn't create gzipper for N locations")
 		defer inZ.Close()
 
-		locs := make([][]byte, 0, 10000000)
+		in := bufio.NewReader(inZ)
+		if b, err := in.Peek(1); err == nil && (b[0] == nsVarintVersion || b[0] == nsRunsVersion) {
+			locs, err := readNLocationsVarint(in)
+			DIE_ON_ERR(err, "Badly formatted N location file %s", nLocFN)
+			return locs
+		}
+
+		locs := make([][]byte, 0)
 		ncount := 0
 
 		// for every line in the input file
-		scanner := bufio.NewScanner(inZ)
+		scanner := bufio.NewScanner(in)
 		for scanner.Scan() {
 			// split into the list of integers (as strings)
 			posns := strings.Split(strings.TrimSpace(scanner.Text()), " ")
@@ -905,13 +2357,24 @@ func readNLocations(nLocFN string) [][]byte {
 			// if there are any Ns in this read
 			if len(posns) > 0 && posns[0] != "" {
 				// create a new slice to hold them, and convert them to integers
+				// an end run is START+LENGTH
 				locs = append(locs, make([]byte, 0))
 				for _, v := range posns {
-					p, err := strconv.Atoi(v)
-					DIE_ON_ERR(err, "Badly formatted N location file!")
-					locs[len(locs)-1] = append(locs[len(locs)-1], byte(p))
+					l := locs[len(locs)-1]
+					if i := strings.IndexByte(v, '+'); i >= 0 {
+						start, err1 := strconv.ParseUint(v[:i], 10, 8)
+						length, err2 := strconv.ParseUint(v[i+1:], 10, 16)
+						DIE_IF(err1 != nil || err2 != nil, "Badly formatted N location file!")
+						l, err = appendNRun(l, start, length)
+						DIE_ON_ERR(err, "Badly formatted N location file!")
+					} else {
+						p, err := strconv.Atoi(v)
+						DIE_ON_ERR(err, "Badly formatted N location file!")
+						l = append(l, byte(p))
+					}
+					locs[len(locs)-1] = l
 				}
-				ncount += len(posns)
+				ncount += len(locs[len(locs)-1])
 			} else {
 				// otherwise, for reads with no Ns, the slice is just nil
 				locs = append(locs, nil)
@@ -926,6 +2389,119 @@ func readNLocations(nLocFN string) [][]byte {
 	}
 }
 
+// readExceptions() reads the compressed exceptions file written by
+// writeExceptions() and returns, for each of the nreads reads (0 if the
+// number isn't known), its (position, byte) pairs (nil if it has none). If
+// the file is not found, it returns nil.
+func readExceptions(excFN string, nreads int) [][]byte {
+	return readBytePairs(excFN, "exceptions", nreads)
+}
+
+// readBytePairs() reads a compressed file of (position, byte) pairs, one
+// line for each of about nreads reads, as written by writeExceptions(); what
+// names its contents in messages.
+func readBytePairs(fn string, what string, nreads int) [][]byte {
+	in, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	log.Printf("Reading %s from %s", what, fn)
+	defer in.Close()
+	inZ, err := gzip.NewReader(in)
+	DIE_ON_ERR(err, "Couldn't create gzipper for %s", what)
+	defer inZ.Close()
+
+	pairs := make([][]byte, 0, nreads)
+	scanner := bufio.NewScanner(inZ)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			pairs = append(pairs, nil)
+			continue
+		}
+		e := make([]byte, 0, 2*len(fields))
+		for _, f := range fields {
+			var p, c int
+			_, err := fmt.Sscanf(f, "%d:%d", &p, &c)
+			DIE_IF(err != nil || p < 0 || p > 255 || c < 0 || c > 255,
+				"Bad entry in %s: %q", fn, f)
+			e = append(e, byte(p), byte(c))
+		}
+		pairs = append(pairs, e)
+	}
+	DIE_ON_ERR(scanner.Err(), "Couldn't finish reading %s", what)
+	return pairs
+}
+
+// putbackExceptions() puts the original bytes back at the positions of the
+// given (position, byte) pairs.
+func putbackExceptions(s string, exc []byte) string {
+	if len(exc) == 0 {
+		return s
+	}
+	b := []byte(s)
+	for i := 0; i < len(exc); i += 2 {
+		b[exc[i]] = exc[i+1]
+	}
+	return string(b)
+}
+
+// readNLocationsVarint() reads N locations written by an nLocationWriter in
+// the varint format, including the version byte, and returns them as
+// readNLocations() does.
+func readNLocationsVarint(in *bufio.Reader) ([][]byte, error) {
+	version, err := in.ReadByte()
+	if err != nil || (version != nsVarintVersion && version != nsRunsVersion) {
+		return nil, fmt.Errorf("unknown N location format %d", version)
+	}
+	locs := make([][]byte, 0)
+	ncount := 0
+	for {
+		n, err := binary.ReadUvarint(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			locs = append(locs, nil)
+			continue
+		}
+		nruns := uint64(0)
+		if version == nsRunsVersion {
+			n, nruns = n/4, n%4
+		}
+		posns := make([]byte, n)
+		p := uint64(0)
+		for i := range posns {
+			gap, err := binary.ReadUvarint(in)
+			if err != nil {
+				return nil, fmt.Errorf("read %d: %v", len(locs), err)
+			}
+			p += gap
+			if p > 255 {
+				return nil, fmt.Errorf("read %d: N at position %d", len(locs), p)
+			}
+			posns[i] = byte(p)
+		}
+		for ; nruns > 0; nruns-- {
+			start, err1 := binary.ReadUvarint(in)
+			length, err2 := binary.ReadUvarint(in)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("read %d: truncated run of Ns", len(locs))
+			}
+			if posns, err = appendNRun(posns, start, length); err != nil {
+				return nil, fmt.Errorf("read %d: %v", len(locs), err)
+			}
+		}
+		locs = append(locs, posns)
+		ncount += len(posns)
+	}
+	log.Printf("Read locations for %d Ns.", ncount)
+	return locs, nil
+}
+
 // dart() finds the interval in the given distribution that contains the given
 // target, after transformming the distribution using the given weightOf
 // function. This is called by lookup() during decode.
@@ -946,9 +2522,9 @@ func dart(
 
 // dartDefault() finds the range in the default distribution that contains
 // target
-func dartDefault(target uint32) (uint64, uint64, uint64) {
+func dartDefault(st *codingState, target uint32) (uint64, uint64, uint64) {
 	sum := uint32(0)
-	for i, w := range defaultInterval {
+	for i, w := range st.defaultInterval {
 		sum += uint32(w)
 		if target < sum {
 			return uint64(sum - w), uint64(sum), uint64(i)
@@ -960,11 +2536,16 @@ func dartDefault(target uint32) (uint64, uint64, uint64) {
 
 // lookup() is called by arithc.Decoder to find an interval that contains the
 // given value t.
-func lookup(km KmerModel, context Kmer, t uint64) (uint64, uint64, uint64) {
-    if exists, dist := km.Distribution(context); exists {
+func lookup(st *codingState, km KmerModel, context Kmer, t uint64) (uint64, uint64, uint64) {
+	context = seedContext(context)
+	exists, dist := km.Distribution(context)
+	if bdist, ok := backoffFor(st, km, context, exists, dist); ok {
+		return dart(bdist, uint32(t))
+	}
+    if exists {
 		return dart(dist, uint32(t))
 	} else {
-		return dartDefault(uint32(t))
+		return dartDefault(st, uint32(t))
 	}
 }
 
@@ -982,19 +2563,25 @@ func sumDist(d [len(ALPHA)]KmerCount, weightOf WeightXformFcn) (total uint64) {
 // contextTotal() returns the total sum of the appropriate distribution: the
 // distribution of the given context (if found) or the default distribution
 // (otherwise).
-func contextTotal(km KmerModel, context Kmer) (total uint64) {
-    if exists, dist := km.Distribution(context); exists {
+func contextTotal(st *codingState, km KmerModel, context Kmer) (total uint64) {
+	context = seedContext(context)
+	exists, dist := km.Distribution(context)
+	if bdist, ok := backoffFor(st, km, context, exists, dist); ok {
+		dist, exists = bdist, true
+	}
+    if exists {
         for i := range dist {
             total += uint64(contextWeight(i, dist))
         }
 		return total
 	} else {
-		return defaultIntervalSum
+		return st.defaultIntervalSum
 	}
 }
 
 // decodeSingleRead() does the work of decoding a single read.
 func decodeSingleRead(
+	st *codingState,
 	contextMer Kmer,
 	km KmerModel,
 	tailLen int,
@@ -1003,13 +2590,13 @@ func decodeSingleRead(
 ) {
 	// function called by Decode
 	lu := func(t uint64) (uint64, uint64, uint64) {
-		a, b, c := lookup(km, contextMer, t)
+		a, b, c := lookup(st, km, contextMer, t)
 		return a, b, c
 	}
 
 	for i := 0; i < tailLen; i++ {
 		// decode next symbol
-		symb, err := decoder.Decode(contextTotal(km, contextMer), lu)
+		symb, err := decoder.Decode(contextTotal(st, km, contextMer), lu)
 		DIE_ON_ERR(err, "Fatal error decoding!")
 		b := byte(symb)
 
@@ -1018,7 +2605,7 @@ func decodeSingleRead(
 
 		// update hash counts (throws away the computed interval; just
 		// called for side effects.)
-		nextInterval(km, contextMer, b, false)
+		nextInterval(st, km, contextMer, b, false)
 
 		// update the new context
 		contextMer = shiftKmer(contextMer, b)
@@ -1034,82 +2621,391 @@ func putbackNs(s string, p []byte) string {
 	return string(b)
 }
 
-// decodeReads() decodes the file wrapped by the given Decoder, using the
-// kmers, counts, and hash table provided. It writes its output to the given
-// io.Writer.
-func decodeReads(
+// An archiveSegment holds what is needed to decode one segment of an archive:
+// the buckets and their counts, the runs of identical reads and the
+// homopolymer tails (nil if there are none), the flipped bits, N locations,
+// exceptions, GC counts, bucket positions and input indices (any of which
+// may be nil), and a decoder for the encoded tails.
+type archiveSegment struct {
+	kmers        []string
+	counts       []int
+	runs         map[int][]int
+	homopolymers map[int]homopolymerTails
+	isFlipped  []bool
+	nLocations [][]byte
+	exceptions [][]byte
+	corrections [][]byte
+	gc         []int
+	positions  []int
+	order      []int
+	readLen    int
+	decoder    *arithc.Decoder
+	ntails     int
+
+	// the blocks at which the coder restarts (nil if it never does), and a
+	// function that returns a decoder for the block at the given offset
+	blocks    []blockIndexEntry
+	openBlock func(offset int64) *arithc.Decoder
+}
+
+// A ReadIterator decodes the reads of an archive one at a time, in the order
+// they were encoded.
+type ReadIterator struct {
+	segs     []*archiveSegment // the segments still to come
+	seg      *archiveSegment   // the current segment
+	km       KmerModel
+	newModel func() KmerModel // returns the model to start a segment with
+	st       *codingState
+
+	tailBuf     []byte // the most recently decoded tail
+	bucket      int    // the current bucket
+	left        int    // # of reads still to come from the current bucket
+	runs        []int  // the lengths of the runs still to come in the bucket
+	repeat      int    // # of reads still to come that are tailBuf
+	bucketTails int    // # of tails of the current bucket so far
+	block       int    // the next block of the current segment to start
+	tails       int    // # of tails decoded from the current segment
+	segN        int    // # of reads returned from the current segment
+	n           int    // # of reads returned
+	ncount      int    // # of Ns put back
+	flipped     int    // # of reads unflipped
+	md5Hash     hash.Hash
+
+	// if not nil, the start and end of the input indices of the reads
+	// wanted (see ReadRange())
+	indexRange []int
+}
+
+// newReadIterator() creates an iterator over the reads encoded in the stream
+// wrapped by decoder, using the kmers, counts and model provided. The
+// iterator stops after ntails tails have been decoded, even if the counts
+// call for more (ntails < 0 means no limit). isFlipped and nLocations may be
+// nil, in which case the reads are not unflipped or given back their Ns.
+func newReadIterator(
+	st *codingState,
 	kmers []string,
 	counts []int,
 	isFlipped []bool,
 	nLocations [][]byte,
 	km KmerModel,
 	readLen int,
-	out io.Writer,
 	decoder *arithc.Decoder,
-) {
-	log.Printf("Decoding reads...")
+	ntails int,
+) *ReadIterator {
+	seg := &archiveSegment{
+		kmers:      kmers,
+		counts:     counts,
+		isFlipped:  isFlipped,
+		nLocations: nLocations,
+		readLen:    readLen,
+		decoder:    decoder,
+		ntails:     ntails,
+	}
+	return newSegmentIterator(st, []*archiveSegment{seg}, func() KmerModel { return km })
+}
 
+// newSegmentIterator() creates an iterator over the reads of the given
+// segments in turn. Each segment is decoded with a fresh coding state and
+// the model returned by newModel.
+func newSegmentIterator(st *codingState, segs []*archiveSegment, newModel func() KmerModel) *ReadIterator {
+	return &ReadIterator{
+		segs:     segs,
+		newModel: newModel,
+		st:       st,
+		md5Hash:  md5.New(),
+	}
+}
+
+// expected() returns the number of reads the counts of the segments list,
+// including those of the current segment already returned.
+func (it *ReadIterator) expected() int {
 	n := 0
-	ncount := 0
-	buf := bufio.NewWriter(out)
+	if it.seg != nil {
+		n += sumAbs(it.seg.counts)
+	}
+	for _, seg := range it.segs {
+		n += sumAbs(seg.counts)
+	}
+	return n
+}
 
-	md5Hash := md5.New()
+// nextSegment() moves on to the next segment, returning false if there are
+// no more.
+func (it *ReadIterator) nextSegment() bool {
+	if len(it.segs) == 0 {
+		it.seg = nil
+		return false
+	}
+	if it.seg != nil {
+		*it.st = *newCodingState()
+	}
+	it.seg, it.segs = it.segs[0], it.segs[1:]
+	it.km = it.newModel()
+	it.tailBuf = make([]byte, it.seg.readLen-len(it.seg.kmers[0]))
+	it.bucket = -1
+	it.left = 0
+	it.block = 0
+	it.tails = 0
+	it.segN = 0
+	return true
+}
 
-	patchAndWriteRead := func(head, tail string) {
-		// put the head & tail together
-		s := fmt.Sprintf("%s%s", head, tail)
-		md5Hash.Write([]byte(s))
+// decodeTail() decodes the next tail into tailBuf; it returns false if the
+// segment has no more tails. A homopolymer tail is filled in without
+// decoding.
+func (it *ReadIterator) decodeTail() bool {
+	t := it.bucketTails
+	it.bucketTails++
+	if h, ok := it.seg.homopolymers[it.bucket]; ok && h.contains(t) {
+		base := it.seg.kmers[it.bucket][0]
+		for i := range it.tailBuf {
+			it.tailBuf[i] = base
+		}
+		return true
+	}
+	if it.tails == it.seg.ntails {
+		return false
+	}
+	contextMer := stringToKmer(it.seg.kmers[it.bucket])
+	decodeSingleRead(it.st, contextMer, it.km, len(it.tailBuf), it.seg.decoder, it.tailBuf)
+	it.tails++
+	return true
+}
+
+// startBlock() restarts the decoder and the coding state if the current
+// bucket is the first of a block (other than the first block).
+func (it *ReadIterator) startBlock() {
+	blocks := it.seg.blocks
+	if it.block >= len(blocks) || blocks[it.block].bucket != it.bucket {
+		return
+	}
+	if it.bucket > 0 {
+		it.seg.decoder = it.seg.openBlock(blocks[it.block].offset)
+		*it.st = *newCodingState()
+	}
+	it.block++
+}
 
-		// put back the ns if we have them
-		if nLocations != nil {
-			s = putbackNs(s, nLocations[n])
-			ncount += len(nLocations[n])
+// skipSegment() skips the rest of the current segment; it is called when the
+// stream ends before the counts do.
+func (it *ReadIterator) skipSegment() {
+	it.bucket = len(it.seg.counts) - 1
+	it.left = 0
+	it.repeat = 0
+}
+
+// Next() returns the next read, or false if there are no more.
+func (it *ReadIterator) Next() (string, bool) {
+	for {
+		// move on to the next bucket with reads in it, passing over any
+		// with a count of 0; a uniform bucket is one run of identical reads,
+		// and a bucket without runs is all runs of length 1
+		for it.left == 0 {
+			if it.seg == nil || it.bucket+1 >= len(it.seg.counts) {
+				if !it.nextSegment() {
+					return "", false
+				}
+			}
+			it.bucket++
+			it.startBlock()
+			c := it.seg.counts[it.bucket]
+			it.left = AbsInt(c)
+			it.repeat = 0
+			it.bucketTails = 0
+			it.runs = it.seg.runs[it.bucket]
+			if c < 0 {
+				it.runs = []int{it.left}
+			}
 		}
-		// unflip the reads if we have them
-		if isFlipped != nil && isFlipped[n] {
-			s = reverseComplement(s)
-			flipped++
+		if it.repeat > 0 {
+			break
 		}
-		// write it out
-		if outputFastaOption {
-			fmt.Fprintf(buf, ">R%d\n", n)
+		// the first read of each run has its tail decoded
+		if it.decodeTail() {
+			it.repeat = 1
+			if len(it.runs) > 0 {
+				it.repeat, it.runs = it.runs[0], it.runs[1:]
+			}
+			break
+		}
+		it.skipSegment()
+	}
+	it.left--
+	it.repeat--
+
+	// put the head & tail together
+	s := it.seg.kmers[it.bucket] + string(it.tailBuf)
+	it.md5Hash.Write([]byte(s))
+
+	// undo the corrections, which are in the orientation of the tail
+	if it.seg.corrections != nil {
+		s = putbackExceptions(s, it.seg.corrections[it.segN])
+	}
+	// put back the ns if we have them
+	if it.seg.nLocations != nil {
+		s = putbackNs(s, it.seg.nLocations[it.segN])
+		it.ncount += len(it.seg.nLocations[it.segN])
+	}
+	// unflip the reads if we have them
+	if it.seg.isFlipped != nil && it.seg.isFlipped[it.segN] {
+		s = reverseComplement(s)
+		it.flipped++
+	}
+	// the exceptions are in the original orientation
+	if it.seg.exceptions != nil {
+		s = putbackExceptions(s, it.seg.exceptions[it.segN])
+	}
+	it.segN++
+	it.n++
+	return s, true
+}
+
+// decodeReads() decodes the file wrapped by the given Decoder, using the
+// kmers, counts, and hash table provided. It writes its output to the given
+// io.Writer. Decoding stops after ntails tails have been decoded, even if the
+// counts call for more (ntails < 0 means no limit), or once maxDecodeReads
+// reads have been written (if it is > 0). If lenReportOption is set,
+// it returns the number of reads of each length it wrote.
+func decodeReads(
+	kmers []string,
+	counts []int,
+	isFlipped []bool,
+	nLocations [][]byte,
+	km KmerModel,
+	readLen int,
+	out io.Writer,
+	decoder *arithc.Decoder,
+	ntails int,
+) map[int]int {
+	it := newReadIterator(coding, kmers, counts, isFlipped, nLocations, km, readLen, decoder, ntails)
+	return writeReads(it, newOutputWriter(out, ""))
+}
+
+// newOutputWriter() returns a writer for decoded reads in the given format
+// (see outputFormats), or if it is "", in the format given by recordsOption
+// and outputFastaOption.
+func newOutputWriter(out io.Writer, format string) SeqWriter {
+	if format == "" {
+		switch {
+		case recordsOption:
+			format = "records"
+		case outputFastaOption:
+			format = "fasta"
+		default:
+			format = "raw"
 		}
-		buf.Write([]byte(s))
-		buf.WriteByte('\n')
-		return
 	}
+	switch format {
+	case "records":
+		return newRecordWriter(out)
+	case "fasta":
+		return newFastaWriter(out)
+	case "fastq":
+		return newFastqWriter(out)
+	}
+	sep, err := parseSeparator(sepOption)
+	DIE_ON_ERR(err, "Bad value for -sep")
+	return newSeparatedWriter(out, sep)
+}
 
-	// tailBuf is a buffer for read tails returned by decodeSingleRead
-	tailLen := readLen - len(kmers[0])
-	tailBuf := make([]byte, tailLen)
+// writeReads() writes the reads from the iterator to w, stopping once
+// maxDecodeReads reads have been written (if it is > 0). If lenReportOption
+// is set, it returns the number of reads of each length it wrote.
+func writeReads(it *ReadIterator, w SeqWriter) map[int]int {
+	log.Printf("Decoding reads...")
 
+	lengths := make(map[int]int)
 	log.Printf("Currently have %v Go routines...", runtime.NumGoroutine())
 
-	// for every bucket
-	for curBucket, c := range counts {
-		contextMer := stringToKmer(kmers[curBucket])
+	// with -positions or -keeporder the reads are held until they can be
+	// sorted
+	var placed []placedRead
+	var ordered []orderedRead
+	keepOrder := keepOrderOption || it.indexRange != nil
+
+	// the iterator may have skipped some reads already
+	expected := it.expected()
+	first := it.n
+	limited := false
+	left := 0 // # of reads outside -readrange
+	for {
+		if maxDecodeReads > 0 && it.n-first >= maxDecodeReads {
+			limited = true
+			break
+		}
+		s, ok := it.Next()
+		if !ok {
+			break
+		}
+		if lenReportOption {
+			lengths[len(s)]++
+		}
 
-		// if bucket is a uniform bucket, write out |c| copies of the decoded
-		// string
-		if c < 0 {
-			decodeSingleRead(contextMer, km, tailLen, decoder, tailBuf)
-			for j := 0; j < AbsInt(c); j++ {
-				patchAndWriteRead(kmers[curBucket], string(tailBuf))
-				n++
-			}
-		} else {
-			// otherwise, decode a read for each string in the bucket
-			for j := 0; j < c; j++ {
-				decodeSingleRead(contextMer, km, tailLen, decoder, tailBuf)
-				patchAndWriteRead(kmers[curBucket], string(tailBuf))
-				n++
+		// write it out; in input order, a read is named for its input
+		// index, and those outside the range asked for are dropped
+		id := "R" + strconv.Itoa(it.n-1)
+		index := 0
+		if keepOrder {
+			index = it.inputIndex()
+			if !it.wantIndex(index) {
+				left++
+				continue
 			}
+			id = "R" + strconv.Itoa(index)
+		}
+		if gcOption {
+			id = it.gcName(id)
 		}
+		if positionsOption {
+			placed = append(placed, placedRead{it.position(), id, s})
+			continue
+		}
+		if keepOrder {
+			ordered = append(ordered, orderedRead{index, id, s})
+			continue
+		}
+		w.Write(id, s, nil)
 	}
-	buf.Flush()
-	log.Printf("Added back %d Ns to the reads.", ncount)
-	log.Printf("MD5 hash of reads = %x", md5Hash.Sum(nil))
-	log.Printf("done. Wrote %v reads; %d were flipped", n, flipped)
+	if positionsOption {
+		writeByPosition(w, placed)
+	}
+	if keepOrder {
+		writeByInputIndex(w, ordered)
+	}
+	DIE_ON_ERR(w.Flush(), "Couldn't write the decoded reads")
+	flipped += it.flipped
+
+	if it.n < expected && !limited {
+		log.Printf("Warning: the encoded stream ended after %d reads, "+
+			"but the counts list %d reads", it.n, expected)
+	}
+	log.Printf("Added back %d Ns to the reads.", it.ncount)
+	log.Printf("MD5 hash of reads = %x", it.md5Hash.Sum(nil))
+	log.Printf("done. Wrote %v reads; %d were flipped", it.n-first-left, flipped)
+	return lengths
+}
+
+// lengthReport() describes the distribution of decoded read lengths and
+// returns an error if any read is not of the length recorded by the encoder.
+func lengthReport(lengths map[int]int, readLen int) (string, error) {
+	lens := make([]int, 0, len(lengths))
+	for l := range lengths {
+		lens = append(lens, l)
+	}
+	sort.Ints(lens)
+
+	report := fmt.Sprintf("Decoded read lengths (expected %d):", readLen)
+	bad := 0
+	for _, l := range lens {
+		report += fmt.Sprintf(" %d:%d", l, lengths[l])
+		if l != readLen {
+			bad += lengths[l]
+		}
+	}
+	if bad > 0 {
+		return report, fmt.Errorf("%d decoded reads are not of length %d", bad, readLen)
+	}
+	return report, nil
 }
 
 //===================================================================
@@ -1122,18 +3018,86 @@ func init() {
 	encodeFlags = flag.NewFlagSet("encode", flag.ContinueOnError)
 	encodeFlags.StringVar(&refFile, "ref", "", "reference fasta filename")
 	encodeFlags.StringVar(&outFile, "out", "", "output filename")
-	encodeFlags.StringVar(&readFile, "reads", "", "reads filename")
+	encodeFlags.StringVar(&readFile, "reads", "", "reads filename (when encoding, may be a comma-separated list)")
 	encodeFlags.IntVar(&globalK, "k", 16, "length of k")
+	encodeFlags.IntVar(&bucketK, "bucketk", 0, "length of the bucket prefixes (<= k); 0 means k")
+	encodeFlags.StringVar(&sweepKOption, "krange", "8:16", "for sweep, the values of k to try, as MIN:MAX or a comma-separated list")
+	encodeFlags.IntVar(&sweepSampleOption, "sample", 100000, "for sweep, the number of reads to encode (0 means all)")
+	encodeFlags.IntVar(&genOptions.refBases, "genbases", genOptions.refBases, "for gen, the number of bases of the reference")
+	encodeFlags.IntVar(&genOptions.reads, "genreads", genOptions.reads, "for gen, the number of reads")
+	encodeFlags.IntVar(&genOptions.readLen, "genlen", genOptions.readLen, "for gen, the length of the reads")
+	encodeFlags.Float64Var(&genOptions.errRate, "generr", genOptions.errRate, "for gen, the chance that a base of a read is changed")
+	encodeFlags.Float64Var(&genOptions.nRate, "genn", genOptions.nRate, "for gen, the chance that a base of a read is an N")
+	encodeFlags.Float64Var(&genOptions.dupRate, "gendup", genOptions.dupRate, "for gen, the chance that a read repeats the one before it")
+	encodeFlags.Int64Var(&genOptions.seed, "genseed", genOptions.seed, "for gen, the seed of the random numbers")
+	encodeFlags.BoolVar(&qualFlipOption, "qualflip", false, "if true, weight each kmer match by the lowest quality of its bases when deciding which reads to flip")
+	encodeFlags.IntVar(&flipWindowOption, "flipwindow", 0, "if > 0, decide which reads to flip from only the first this many bases of the read and of its reverse complement")
+	encodeFlags.IntVar(&maxBucketsOption, "maxbuckets", 0, "if > 0, shorten the bucket prefixes until there are at most this many buckets")
+	encodeFlags.IntVar(&sortBatchOption, "sortbatch", 0, "if > 0, hold at most this many reads in memory when encoding, sorting them in batches in a temporary file")
+	encodeFlags.StringVar(&bucketOrderOption, "bucketorder", "prefix", "the order to code the buckets in: prefix (sorted) or walk (following the model, so consecutive buckets share contexts)")
+	encodeFlags.StringVar(&seedOption, "seed", "", "spaced seed for the contexts of the model, as k 0s and 1s (1 for each base used)")
+	encodeFlags.StringVar(&backoffOption, "backoff", "", "shorter contexts, longest first (such as 10,6), to code a base in when its k-mer context has been seen less than -backoffmin times")
+	encodeFlags.IntVar(&backoffMinOption, "backoffmin", 2, "with -backoff, the observations a context needs to code a base")
+	encodeFlags.IntVar(&flipK, "flipk", 0, "length of the kmers used to decide which reads to flip; 0 means k")
 	encodeFlags.BoolVar(&flipReadsOption, "flip", true, "if true, reverse complement reads as needed")
 	encodeFlags.BoolVar(&dupsOption, "dups", true, "if true, record dups specially")
+	encodeFlags.BoolVar(&dupRunsOption, "runs", false, "if true, record runs of identical reads within a bucket specially")
 	encodeFlags.BoolVar(&updateReference, "update", true, "if true, update the reference dynamically")
 	encodeFlags.IntVar(&maxThreads, "p", 10, "The maximum number of threads to use")
-
+	encodeFlags.IntVar(&readBufferSize, "readbuf", readBufferSize, "number of reads to buffer between the fastq parser and the encoder")
+	encodeFlags.IntVar(&gcPercent, "gcpercent", 100, "garbage collection target percentage (as for $GOGC); < 0 turns off the collector")
+	encodeFlags.BoolVar(&forceGCOption, "forcegc", true, "if true, force garbage collections between the stages of encoding")
+	encodeFlags.IntVar(&tempBufferSize, "tempbuf", tempBufferSize, "number of bytes of processed reads to buffer for the temp file")
+
+	encodeFlags.IntVar(&indexBlockBuckets, "index", 0, "if > 0, write OUT.idx so blocks of this many buckets can be decoded on their own (needs -update=false)")
+	encodeFlags.StringVar(&bucketRange, "buckets", "", "if given as START:END, decode only buckets START to END-1 (needs OUT.idx)")
+	encodeFlags.IntVar(&maxDecodeReads, "n", 0, "if > 0, decode only the first n reads")
+	encodeFlags.BoolVar(&prefixOnlyOption, "prefixonly", false, "if true, decode only the bucket prefix of each read")
+	encodeFlags.BoolVar(&partialOption, "partial", false, "if true, decode even if the .flipped or .ns files listed in OUT.meta are missing")
+	encodeFlags.BoolVar(&coderStatsOption, "coderstats", false, "if true, report the renormalizations and held back bits of the arithmetic coder")
+	encodeFlags.BoolVar(&bucketStatsOption, "bucketstats", false, "if true, report the distribution of bucket sizes")
+	encodeFlags.StringVar(&dictionaryOption, "dictionary", "", "model saved with -savemodel to start from; must be given again to decode")
+	encodeFlags.StringVar(&saveModelOption, "savemodel", "", "if given, save the model as it is after encoding to this file, for use with -dictionary")
+	encodeFlags.BoolVar(&jsonOption, "json", false, "if true, reference-stats writes JSON instead of a report")
+	encodeFlags.BoolVar(&lowComplexOption, "lowcomplex", false, "if true, store reads that are a single base without coding them")
+	encodeFlags.BoolVar(&eccOption, "ecc", false, "if true, correct likely sequencing errors against the model before encoding, keeping the original bases in OUT.ecc")
+	encodeFlags.BoolVar(&recordsOption, "records", false, "if true, write the decoded reads as a binary record stream")
+	encodeFlags.BoolVar(&noWriteOption, "nowrite", false, "if true, decode the reads but throw them away, for benchmarking")
+	encodeFlags.StringVar(&refIUPACOption, "iupac", "expand", "how IUPAC codes in the reference seed the model: expand (every base they could be) or skip")
+	encodeFlags.BoolVar(&mphfOption, "mphf", false, "if true, decode with a compact read-only model (needs -update=false)")
+	encodeFlags.BoolVar(&atomicOption, "atomic", true, "if true, decode to a temporary file that replaces the output only once decoding succeeds")
 	encodeFlags.BoolVar(&outputFastaOption, "fasta", true, "If false, output seqs, one per line")
+	encodeFlags.StringVar(&sepOption, "sep", "\\n", "with -fasta=false, the separator written after each read (escapes such as \\t and \\x00 are allowed)")
+	encodeFlags.BoolVar(&entropyOption, "entropy", false, "if true, compare the size of the encoded tails to the entropy under the model")
+	encodeFlags.BoolVar(&rawStreamsOption, "rawstreams", false, "debugging: write OUT.counts, OUT.flipped and OUT.ns uncompressed")
+	encodeFlags.BoolVar(&readBitsOption, "readbits", false, "if true, write the number of bits used by each read to OUT.readbits")
+	encodeFlags.IntVar(&worstReadsOption, "worst", 0, "if > 0, log this many of the reads that took the most bits to encode")
+	encodeFlags.IntVar(&maxNOption, "maxn", -1, "if >= 0, drop reads with more than this many Ns")
+	encodeFlags.StringVar(&nsFormatOption, "nsformat", "text", "format of OUT.ns: text (positions as decimal) or varint (gaps as varints)")
+	encodeFlags.IntVar(&minLenOption, "minlen", 0, "drop reads shorter than this")
+	encodeFlags.BoolVar(&keepOrderOption, "keeporder", false, "if true, record the input order of the reads in OUT.order when encoding, and write the reads in that order when decoding")
+	encodeFlags.StringVar(&readRange, "readrange", "", "if given as START:END, decode only the reads that were START to END-1 in the input, in that order (needs OUT.order)")
+	encodeFlags.BoolVar(&positionsOption, "positions", false, "if true, record where each bucket prefix first occurs in the reference in OUT.pos when encoding, and write the reads in that order when decoding")
+	encodeFlags.BoolVar(&gcOption, "gc", false, "if true, record the GC count of each read in OUT.gc when encoding, and add it to the read ids when decoding")
+	encodeFlags.BoolVar(&dropOddOption, "dropodd", false, "if true, drop reads whose length is not the most common one")
+	encodeFlags.BoolVar(&keepDroppedOption, "keepdropped", false, "if true, write the reads dropped by -maxn, -minlen or -dropodd to OUT.dropped")
+	encodeFlags.BoolVar(&exactCaseOption, "exact", false, "if true, keep lowercase bases so decoding restores them")
+	encodeFlags.BoolVar(&lenientFastQOption, "lenient", false, "if true, skip malformed fastq records instead of stopping")
+	encodeFlags.StringVar(&readFormatOption, "readformat", "fastq", "the format of the reads to encode: fastq or fasta")
+	encodeFlags.BoolVar(&memEncodeOption, "memencode", false, "if true, keep the processed reads in memory instead of a temp file")
+	encodeFlags.BoolVar(&keepSortedOption, "keepsorted", false, "if true, save the sorted reads to OUT.sorted so the tails can be re-encoded")
+	encodeFlags.BoolVar(&lenReportOption, "lenreport", false, "if true, report the lengths of the decoded reads")
+	encodeFlags.BoolVar(&validateOutOption, "validateout", false, "if true, check that the decoded reads are well formed before the output is kept")
 
 	encodeFlags.StringVar(&cpuProfile, "cpuProfile", "", "if nonempty, write pprof profile to given file.")
+	encodeFlags.StringVar(&memProfile, "memProfile", "", "if nonempty, write pprof heap profile to given file.")
     encodeFlags.IntVar(&observationWeight, "mul", observationWeight, "debugging: change weight of an observation")
-    encodeFlags.BoolVar(&useArrayModel, "bigmem", false, "if true, use more memory for faster speed")
+	encodeFlags.IntVar(&adaptivePseudoOption, "adaptivepseudo", 0, "if > 0, add this divided by the number of observations of a context to the pseudocount of its unseen bases")
+    encodeFlags.Var(&bigmemOption, "bigmem", "if true, use more memory for faster speed; if auto, only when the reference is dense (see -arraydensity)")
+	encodeFlags.IntVar(&arrayDensityOption, "arraydensity", 15, "with -bigmem=auto, the percentage of the contexts the reference must have for the array model to be used")
+	encodeFlags.Uint64Var(&bvBitsOption, "bvbits", 1<<32, "the most bits the set of reference kmers used to flip reads may take before it is a Bloom filter")
+	encodeFlags.BoolVar(&refFromReads, "reference-from-reads", false, "if true, build the model from the reads instead of -ref")
+	encodeFlags.BoolVar(&embedRefOption, "embedref", false, "if true, store the model counted from -ref in OUT.model so -ref isn't needed to decode")
 }
 
 // writeGlobalOptions() writes out the global variables that can affect the
@@ -1142,68 +3106,938 @@ func init() {
 func writeGlobalOptions() {
 	log.Printf("Option: psudeoCount = %d", pseudoCount)
 	log.Printf("Option: observationWeight = %d", observationWeight)
+	log.Printf("Option: adaptivePseudo = %d", adaptivePseudoOption)
 	log.Printf("Option: seenThreshold = %d", seenThreshold)
 	//log.Printf("Option: MAX_OBSERVATION = %d", MAX_OBSERVATION)
 	log.Printf("Option: flipReadsOption = %v", flipReadsOption)
 	log.Printf("Option: dupsOption = %v", dupsOption)
+	log.Printf("Option: dupRunsOption = %v", dupRunsOption)
 	log.Printf("Option: updateReference = %v", updateReference)
 }
 
+// setThreads() sets the number of OS threads Go may use to maxThreads, after
+// raising maxThreads to its minimum of 2: the reader and the flippers run
+// concurrently, and readAndFlipReads() uses maxThreads-1 flippers.
+func setThreads() {
+	if maxThreads < 2 {
+		maxThreads = 2
+	}
+	log.Printf("Maximum threads = %v", maxThreads)
+	runtime.GOMAXPROCS(maxThreads)
+}
+
+// setGC() sets the garbage collection target percentage to gcPercent, unless
+// it is the default, in which case $GOGC is left to decide.
+func setGC() {
+	if gcPercent != 100 {
+		log.Printf("Setting the GC percentage to %d", gcPercent)
+		debug.SetGCPercent(gcPercent)
+	}
+}
+
+// freeMemory() collects garbage and returns as much memory as it can to the
+// OS, unless forceGCOption is off. It is called between the stages of an
+// encode, when the large allocations of one stage have just become garbage.
+func freeMemory() {
+	if forceGCOption {
+		debug.FreeOSMemory()
+	}
+}
+
+// writeHeapProfile() writes a pprof heap profile to the given file.
+func writeHeapProfile(filename string) {
+	log.Printf("Writing heap profile to %s", filename)
+	runtime.GC()
+	memF, err := os.Create(filename)
+	DIE_ON_ERR(err, "Couldn't create heap profile file %s", filename)
+	defer memF.Close()
+	DIE_ON_ERR(pprof.WriteHeapProfile(memF), "Couldn't write heap profile")
+}
+
+// resetModelState() resets the adaptive state that is shared by the encoder
+// and the decoder. It must be called before encoding or decoding an archive.
+func resetModelState() {
+	coding = newCodingState()
+	flipped = 0
+	modelBits = 0
+	modelBases = 0
+	contexts = contextStats{}
+	dictionaryModel = nil
+}
+
+// fileExists() returns true if the given file can be stat'ed.
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// encodeTails() encodes the processed reads as a new segment at the end of outF using the model
+// km. If readBitsOption is set, the read sizes are written to
+// sideBase.readbits. If worstReadsOption > 0, the reads that took the most
+// bits are logged.
+func encodeTails(
+	outF *os.File,
+	sideBase string,
+	br *bucketedReads,
+	km KmerModel,
+) {
+	//outBuf := bufio.NewWriterSize(outF, 200000000)
+	//defer outBuf.Flush()
+
+	// the stream is preceded by a header that is filled in at the end
+	segStart := beginSegment(outF)
+	writer := bitio.NewWriter(outF)
+
+	// create encoder
+	encoder := arithc.NewEncoder(writer)
+
+	// if asked, record the size of every encoded read, and keep the
+	// largest
+	var bitsFile *sidecarFile
+	var bitsErr error
+	if readBitsOption {
+		var err error
+		bitsFile, err = createSidecar(sideBase+".readbits", gzipWrapper(br.id, gzip.BestCompression))
+		DIE_ON_ERR(err, "Couldn't create read size file: %s", sideBase+".readbits")
+	}
+	var worst *worstReads
+	if worstReadsOption > 0 {
+		worst = newWorstReads(worstReadsOption)
+	}
+	var readBits func(index int, r string, bits uint64)
+	if bitsFile != nil || worst != nil {
+		readBits = func(index int, r string, bits uint64) {
+			if bitsFile != nil && bitsErr == nil {
+				_, bitsErr = fmt.Fprintf(bitsFile.w, "%d\n", bits)
+			}
+			if worst != nil {
+				worst.Add(index, r, bits)
+			}
+		}
+	}
+
+	// if asked, restart the coder every indexBlockBuckets buckets so that
+	// the blocks can be decoded on their own
+	var startBucket func(bucket, readsBefore int)
+	if indexBlockBuckets > 0 {
+		DIE_IF(updateReference, "-index requires -update=false")
+		idx := createBlockIndex(sideBase+".idx", br.id)
+		defer idx.Close()
+		startBucket = func(bucket, readsBefore int) {
+			if bucket%indexBlockBuckets != 0 {
+				return
+			}
+			if bucket > 0 {
+				encoder.Finish()
+				DIE_ON_ERR(writer.Close(), "Couldn't write to %s", outF.Name())
+				writer = bitio.NewWriter(outF)
+				encoder.Reset(writer)
+				*coding = *newCodingState()
+			}
+			pos, err := outF.Seek(0, os.SEEK_CUR)
+			DIE_ON_ERR(err, "Couldn't seek in %s", outF.Name())
+			idx.Add(blockIndexEntry{bucket, pos - segStart - segmentHeaderLen, readsBefore})
+		}
+	}
+
+	// encode the reads
+	n := encodeReadsFromTempFile(br.reads, br.buckets, br.counts, br.runs, br.homopolymers, km, encoder, readBits, startBucket)
+	log.Printf("Reads Flipped: %v", flipped)
+	log.Printf("Encoded %v reads (may be < # of input reads due to duplicates).", n)
+
+	encoder.Finish()
+	DIE_ON_ERR(writer.Close(), "Couldn't write to %s", outF.Name())
+	endSegment(outF, segStart, uint64(n), br.id)
+
+	// the read sizes are complete once every read is encoded; if they
+	// couldn't all be written, don't leave a partial file behind
+	if bitsFile != nil {
+		DIE_ON_ERR(bitsFile.close(bitsErr), "Couldn't write read size file")
+	}
+	if coderStatsOption {
+		log.Println(coderStatsReport(encoder.Stats()))
+	}
+	if worst != nil {
+		log.Println(worst)
+	}
+
+	if entropyOption {
+		end, err := outF.Seek(0, os.SEEK_CUR)
+		DIE_ON_ERR(err, "Couldn't seek in %s", outF.Name())
+		codedBits := uint64(end-segStart-segmentHeaderLen) * 8
+		log.Println(entropyReport(modelBits, modelBases, codedBits))
+	}
+}
+
+// coderStatsReport() describes the work done by the arithmetic coder. Each
+// renormalization writes or holds back one bit, so many per symbol means the
+// coder is spending many bits; many held back at once means the interval kept
+// straddling the midpoint.
+func coderStatsReport(s arithc.Stats) string {
+	if s.Symbols == 0 {
+		return "Coder: no symbols were encoded"
+	}
+	return fmt.Sprintf("Coder: %d symbols, %d renormalizations (%.4f per symbol); "+
+		"%d bits held back, at most %d at once",
+		s.Symbols, s.Renormalizations, float64(s.Renormalizations)/float64(s.Symbols),
+		s.PendingBits, s.MaxPending)
+}
+
+// entropyReport() compares the number of bits the coder wrote for the tails
+// to their ideal code length under the model, the sum of -log2 p over the
+// encoded bases, where p is the probability the model gave each base.
+func entropyReport(modelBits float64, bases uint64, codedBits uint64) string {
+	if bases == 0 {
+		return "Entropy: no bases were encoded"
+	}
+	return fmt.Sprintf("Entropy: the model predicts %.0f bits (%.4f bits/base); "+
+		"the coder wrote %d bits (%.4f bits/base), %.2f%% more",
+		modelBits, modelBits/float64(bases),
+		codedBits, float64(codedBits)/float64(bases),
+		100*(float64(codedBits)-modelBits)/modelBits)
+}
+
+// kpathVersion is the version of kpath, which is recorded in the metadata of
+// the archives it writes.
+const kpathVersion = "0.6.3 (1-6-15)"
+
+// encodeArchive() encodes the reads in readFile against the reference in
+// refFile and writes them to outFile.{enc,bittree,counts,flipped,ns}. If
+// refFromReads is set, the reads themselves are used as the reference and the
+// resulting model is saved to outFile.model; so is the model counted from the
+// reference if embedRefOption is set.
+func encodeArchive(refFile, readFile, outFile string) {
+	/* encode -k -ref -reads=FOO.seq -out=OUT
+	   will encode into OUT.{enc,bittree,counts} */
+	resetModelState()
+	log.Printf("Reading from %s", readFile)
+	log.Printf("Writing to %s, %s, %s",
+		outFile+".enc", outFile+".bittree", outFile+".counts")
+
+	if bucketK <= 0 {
+		bucketK = globalK
+	}
+
+	// pre-Process reads
+	var refSeqs []string
+	var meta *ArchiveMeta
+	if refFromReads {
+		refSeqs = readSequencesFromReads(readFile)
+		meta = newArchiveMeta(nil, globalK)
+	} else {
+		refSeqs = readReferenceFile(refFile)
+		meta = newArchiveMeta(refSeqs, globalK)
+	}
+	if flipK > 0 && flipK != globalK {
+		meta.FlipK = flipK
+	}
+	if strings.Contains(seedOption, "0") {
+		meta.Seed = seedOption
+	}
+	DIE_ON_ERR(setSeed(meta.Seed), "Bad value for -seed")
+	DIE_ON_ERR(setBackoff(backoffOption), "Bad value for -backoff")
+	if backoffOption != "" {
+		meta.Backoff, meta.BackoffMin = backoffOption, backoffMinOption
+	}
+	if refIUPACOption != "expand" {
+		meta.RefIUPAC = refIUPACOption
+	}
+	meta.AdaptivePseudo = adaptivePseudoOption
+	meta.DictMD5 = loadDictionary(dictionaryOption)
+	// the flip set and the model are built in one pass over the reference
+	idx := referenceIndexFor(meta, refSeqs)
+	// the reference is only kept to find the buckets in with -positions
+	var posSeqs []string
+	if positionsOption {
+		posSeqs = refSeqs
+	}
+	var eccModel KmerModel
+	if eccOption {
+		eccModel = idx.Model
+	}
+	br := preprocessWithBuckets(readFile, outFile, meta.RefMD5, idx.Flip, idx.Model, eccModel, maxBucketsOption)
+	km := idx.Model
+	idx = nil
+	// the positions aren't needed to decode, so they are only written if asked
+	if positionsOption {
+		br.sidecars = append(br.sidecars, ".pos")
+		DIE_ON_ERR(writeBucketPositions(outFile+".pos", br, posSeqs), "Couldn't write the bucket positions")
+	} else {
+		os.Remove(outFile + ".pos")
+	}
+	meta.BucketK = bucketK
+	if bucketOrderOption != "prefix" {
+		meta.BucketOrder = bucketOrderOption
+	}
+	meta.Sidecars = map[int][]string{0: br.sidecars}
+	meta.Reads = map[int]int{0: sumAbs(br.counts)}
+	recordProvenance(meta, os.Args, encodeFlags)
+	saveArchiveMeta(outFile+".meta", meta)
+	freeMemory()
+
+	// the model, buckets and counts are all resident now
+	if memProfile != "" {
+		writeHeapProfile(memProfile + ".peak")
+	}
+
+	// without a reference the decoder needs the model itself, and with
+	// -embedref it gets it so that it doesn't need the reference
+	if refFromReads || embedRefOption {
+		saveKmerModel(outFile+".model", km, globalK)
+	}
+
+	outF, err := os.Create(outFile + ".enc")
+	DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+	defer outF.Close()
+	encodeTails(outF, outFile, br, km)
+
+	DIE_ON_ERR(br.reads.Close(), "Couldn't delete temp file")
+
+	// the model has learned from the reads, so it can start the next encode
+	// of a similar sample
+	if saveModelOption != "" {
+		saveKmerModel(saveModelOption, km, globalK)
+	}
+}
+
+// appendArchive() encodes the reads in readFile and adds them to the existing
+// archive with basename archive as a new segment. The tails are appended to
+// archive.enc and the other files of the segment are written with the
+// basename segmentBase(). Each segment starts coding from a fresh copy of the
+// model (from refFile, or from archive.model if it exists), so appending does
+// not need to decode what is already in the archive.
+func appendArchive(refFile, readFile, archive string) {
+	resetModelState()
+	meta := loadArchiveMeta(archive + ".meta")
+	DIE_IF(meta == nil, "Can't append to %s: it has no metadata file", archive)
+
+	modelFN := archive + ".model"
+	haveModel := fileExists(modelFN)
+	DIE_IF(!haveModel && refFile == "",
+		"Must specify gzipped fasta as reference with -ref (no %s found)", modelFN)
+	checkRef := refFile
+	if haveModel {
+		checkRef = ""
+	}
+	DIE_ON_ERR(checkArchiveReference(meta, checkRef, globalK),
+		"Can't append to %s with these options", archive)
+	DIE_ON_ERR(checkArchiveMul(meta, observationWeight),
+		"Can't append to %s with these options", archive)
+	DIE_ON_ERR(checkArchiveUpdate(meta, updateReference),
+		"Can't append to %s with these options", archive)
+	DIE_ON_ERR(setSeed(meta.Seed), "Bad seed in %s", archive+".meta")
+	DIE_ON_ERR(setArchiveBackoff(meta), "Bad backoff in %s", archive+".meta")
+	refIUPACOption = iupacFor(meta)
+	adaptivePseudoOption = meta.AdaptivePseudo
+	bucketK = meta.BucketK
+	if bucketK <= 0 {
+		bucketK = globalK
+	}
+	bucketOrderOption = bucketOrderFor(meta)
+
+	// the reads are flipped against the same kmers as the first segment,
+	// except that only the model's kmers are at hand if there is no reference
+	var km KmerModel
+	var ks *kmerSet
+	var posSeqs []string // the reference, kept only for -positions
+	if haveModel {
+		DIE_IF(positionsOption, "-positions needs the reference, but %s is appended to with %s", archive, modelFN)
+		km, _ = loadKmerModel(modelFN)
+		ks = kmerSetFromModel(km)
+	} else {
+		DIE_ON_ERR(archiveDictionary(meta, dictionaryOption), "Can't append to %s", archive)
+		refSeqs := readReferenceFile(refFile)
+		idx := referenceIndexFor(meta, refSeqs)
+		km, ks = idx.Model, idx.Flip
+		if positionsOption {
+			posSeqs = refSeqs
+		}
+	}
+
+	if meta.Segments <= 0 {
+		meta.Segments = 1
+	}
+	seg := meta.Segments
+	sideBase := segmentBase(archive, seg)
+	log.Printf("Appending %s to %s as segment %d", readFile, archive, seg)
+
+	var eccModel KmerModel
+	if eccOption {
+		eccModel = km
+	}
+	br := preprocessWithBuckets(readFile, sideBase, meta.RefMD5, ks, km, eccModel, 0)
+	if positionsOption {
+		br.sidecars = append(br.sidecars, ".pos")
+		DIE_ON_ERR(writeBucketPositions(sideBase+".pos", br, posSeqs), "Couldn't write the bucket positions")
+	} else {
+		os.Remove(sideBase + ".pos")
+	}
+
+	outF, err := os.OpenFile(archive+".enc", os.O_RDWR, 0)
+	DIE_ON_ERR(err, "Couldn't open %s", archive+".enc")
+	defer outF.Close()
+	encodeTails(outF, sideBase, br, km)
+
+	DIE_ON_ERR(br.reads.Close(), "Couldn't delete temp file")
+
+	// only count the segment once it is completely written
+	if meta.Sidecars == nil {
+		meta.Sidecars = make(map[int][]string)
+	}
+	meta.Sidecars[seg] = br.sidecars
+	if meta.Reads == nil {
+		meta.Reads = make(map[int]int)
+	}
+	meta.Reads[seg] = sumAbs(br.counts)
+	meta.Segments++
+	saveArchiveMeta(archive+".meta", meta)
+}
+
+// copyFile() copies the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// reencodeArchive() re-encodes the read tails of the archive with basename
+// archive, which must have been encoded with -keepsorted, and writes a new
+// archive with basename outFile. The reads are not read, flipped or sorted
+// again: the buckets and counts come from the archive and the sorted reads
+// from archive.sorted, so only the options that affect the tail coding (such
+// as -mul and -update) can differ from the original encode.
+func reencodeArchive(refFile, archive, outFile string) {
+	resetModelState()
+	sortedFN := archive + ".sorted"
+	DIE_IF(!fileExists(sortedFN),
+		"No sorted reads (%s) found; encode with -keepsorted to re-encode later", sortedFN)
+	bucketOrder := "prefix"
+
+	// use the model or the reference the archive was encoded with
+	modelFN := archive + ".model"
+	haveModel := fileExists(modelFN)
+	DIE_IF(!haveModel && refFile == "",
+		"Must specify gzipped fasta as reference with -ref (no %s found)", modelFN)
+	if meta := loadArchiveMeta(archive + ".meta"); meta != nil {
+		checkRef := refFile
+		if haveModel {
+			checkRef = ""
+		}
+		DIE_ON_ERR(checkArchiveReference(meta, checkRef, globalK),
+			"Can't re-encode %s with these options", archive)
+		DIE_IF(meta.Segments > 1, "Can't re-encode %s: reads have been appended to it", archive)
+		if meta.BucketK > 0 {
+			bucketK = meta.BucketK
+		}
+		bucketOrder = bucketOrderFor(meta)
+		DIE_ON_ERR(setSeed(meta.Seed), "Bad seed in %s", archive+".meta")
+		DIE_ON_ERR(setArchiveBackoff(meta), "Bad backoff in %s", archive+".meta")
+		refIUPACOption = iupacFor(meta)
+		adaptivePseudoOption = meta.AdaptivePseudo
+		if !haveModel {
+			DIE_ON_ERR(archiveDictionary(meta, dictionaryOption), "Can't re-encode %s", archive)
+		}
+	} else if !haveModel {
+		DIE_ON_ERR(checkArchiveFormat(nil), "Can't re-encode %s with -ref", archive)
+	}
+	if bucketK <= 0 {
+		bucketK = globalK
+	}
+
+	var km KmerModel
+	if haveModel {
+		km, _ = loadKmerModel(modelFN)
+	} else {
+		km = countKmersInReference(globalK, readReferenceFile(refFile))
+	}
+
+	buckets := decodeKmersFromFile(archive+".bittree", bucketK)
+	sort.Strings(buckets)
+	counts, readLen := readBucketCounts(archive + ".counts")
+	DIE_ON_ERR(checkBucketCounts(buckets, counts),
+		"%s and %s don't match", archive+".bittree", archive+".counts")
+	buckets, counts = codingOrder(bucketOrder, buckets, counts, km, readLen-bucketK)
+	runs := readRuns(archive + ".runs")
+	homopolymers := readHomopolymers(archive + ".homo")
+
+	// everything but the tails is the same as in the original archive
+	if outFile != archive {
+		for _, ext := range []string{".bittree", ".counts", ".flipped", ".ns", ".exc", ".ecc", ".gc", ".order", ".pos", ".homo", ".meta", ".model", ".runs", ".sorted"} {
+			if fileExists(archive + ext) {
+				DIE_ON_ERR(copyFile(archive+ext, outFile+ext), "Couldn't copy %s", archive+ext)
+			}
+		}
+	}
+
+	sortedF, err := os.Open(sortedFN)
+	DIE_ON_ERR(err, "Couldn't open sorted reads %s", sortedFN)
+	defer sortedF.Close()
+	sortedZ, err := gzip.NewReader(sortedF)
+	DIE_ON_ERR(err, "Couldn't create unzipper for sorted reads")
+	defer sortedZ.Close()
+	id, err := sidecarID(sortedZ)
+	DIE_ON_ERR(err, "Couldn't read the archive id of %s", sortedFN)
+
+	outF, err := os.Create(outFile + ".enc")
+	DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+	defer outF.Close()
+	// the new tails belong with the copied files, and may have been coded
+	// with another -mul
+	if meta := loadArchiveMeta(outFile + ".meta"); meta != nil {
+		recordProvenance(meta, os.Args, encodeFlags)
+		saveArchiveMeta(outFile+".meta", meta)
+	}
+	br := &bucketedReads{sortedZ, buckets, counts, runs, homopolymers, id, nil}
+	encodeTails(outF, outFile, br, km)
+}
+
+// decodeArchive() decodes the archive with basename readFile using the
+// reference in refFile and writes the reads to outFile. If readFile.model
+// exists, the model is read from it and refFile is not needed. outFile may
+// list several files, separated by commas, each with its own format (see
+// parseDecodeTargets()); the reads are decoded once and written to all of
+// them.
+func decodeArchive(refFile, readFile, outFile string) {
+	decodeArchiveWith(refFile, readFile, outFile, nil)
+}
+
+// decodeArchiveWith() decodes the archive as decodeArchive() does, taking the
+// model built from the reference from models if it is not nil (see
+// openArchiveWith()).
+func decodeArchiveWith(refFile, readFile, outFile string, models *modelCache) {
+	/* decode -k -ref -reads=FOO -out=OUT.seq
+	   will look for FOO.enc, FOO.bittree, FOO.counts and decode into OUT.seq */
+	resetModelState()
+	targets, err := parseDecodeTargets(outFile)
+	DIE_ON_ERR(err, "Bad value for -out")
+
+	// create the output files
+	outFs := make([]io.WriteCloser, len(targets))
+	w := make(multiSeqWriter, len(targets))
+	for i, t := range targets {
+		outFs[i] = createDecodeOutput(t.file)
+		defer outFs[i].Close()
+		w[i] = newOutputWriter(outFs[i], t.format)
+	}
+
+	if prefixOnlyOption {
+		n := writePrefixes(refFile, readFile, w)
+		for i, t := range targets {
+			commitDecodeOutput(outFs[i], t.file)
+		}
+		log.Printf("done. Wrote the prefixes of %v reads", n)
+		return
+	}
+
+	ar := openArchiveWith(refFile, readFile, models)
+	defer ar.Close()
+	var reads *ReadIterator
+	if bucketRange != "" {
+		start, end, err := parseRange(bucketRange)
+		DIE_ON_ERR(err, "Bad value for -buckets")
+		reads = ar.BucketRange(readFile, start, end, coding)
+	} else if readRange != "" {
+		start, end, err := parseRange(readRange)
+		DIE_ON_ERR(err, "Bad value for -readrange")
+		reads = ar.ReadRange(readFile, start, end, coding)
+	} else {
+		reads = ar.Reads(coding)
+	}
+
+	lengths := writeReads(reads, w)
+	if bucketRange == "" && readRange == "" && maxDecodeReads <= 0 {
+		DIE_ON_ERR(ar.checkReadCount(reads.n), "Decoded reads look corrupted")
+	}
+	if lenReportOption {
+		report, err := lengthReport(lengths, ar.readLen)
+		log.Println(report)
+		DIE_ON_ERR(err, "Decoded reads look corrupted")
+	}
+	for i, t := range targets {
+		if validateOutOption {
+			DIE_ON_ERR(validateDecodeOutput(outFs[i], t, ar.segs), "Decoded reads look corrupted")
+		}
+		commitDecodeOutput(outFs[i], t.file)
+	}
+}
+
+// A decodeTarget is a file decoded reads are written to, and the format to
+// write them in ("" for the one given by the options).
+type decodeTarget struct {
+	file   string
+	format string
+}
+
+// outputFormats are the formats a decodeTarget can name: "raw" is one read
+// per -sep.
+var outputFormats = map[string]bool{"fasta": true, "fastq": true, "raw": true, "records": true}
+
+// parseDecodeTargets() splits the comma separated list of files given to
+// -out into decodeTargets. A file may be given as FORMAT:FILE, where FORMAT
+// is one of outputFormats, to write it in that format; otherwise it is in
+// the format given by the options. With -nowrite, -out may be left out, and
+// the reads go to os.DevNull, which createDecodeOutput() throws away.
+func parseDecodeTargets(out string) ([]decodeTarget, error) {
+	if out == "" && noWriteOption {
+		return []decodeTarget{{file: os.DevNull}}, nil
+	}
+	targets := make([]decodeTarget, 0, 1)
+	seen := make(map[string]bool)
+	for _, fn := range strings.Split(out, ",") {
+		var t decodeTarget
+		if i := strings.Index(fn, ":"); i >= 0 && outputFormats[fn[:i]] {
+			t.format, fn = fn[:i], fn[i+1:]
+		}
+		t.file = fn
+		if fn == "" {
+			return nil, fmt.Errorf("missing output file in %q", out)
+		}
+		if seen[fn] && fn != os.DevNull {
+			return nil, fmt.Errorf("%s is given more than once", fn)
+		}
+		seen[fn] = true
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// batchDecode() decodes each of the archives with the given basenames into
+// outDir, naming each output after its archive with the extension of the
+// output format (see decodedExt()). The model built from the reference is
+// built once and used for every archive it fits.
+func batchDecode(refFile string, archives []string, outDir string) {
+	models := newModelCache()
+	for _, archive := range archives {
+		out := filepath.Join(outDir, filepath.Base(archive)+decodedExt())
+		log.Printf("Decoding %s into %s", archive, out)
+		decodeArchiveWith(refFile, archive, out, models)
+	}
+	log.Printf("Decoded %d archives, building %d models", len(archives), models.built)
+}
+
+// decodedExt() returns the extension for reads decoded with the current
+// options: .kpr for a record stream, .fa for fasta and .seq otherwise.
+func decodedExt() string {
+	switch {
+	case recordsOption:
+		return ".kpr"
+	case outputFastaOption:
+		return ".fa"
+	}
+	return ".seq"
+}
+
+// nopCloser is a WriteCloser that discards everything written to it.
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// createDecodeOutput() creates the file the decoded reads are written to.
+// With -nowrite, or if the file is /dev/null, the reads are thrown away
+// without a system call for each block, so a decode can be timed without
+// the cost of writing its output; the MD5 hash is still computed.
+func createDecodeOutput(outFile string) io.WriteCloser {
+	if noWriteOption || outFile == os.DevNull {
+		log.Printf("Not writing the decoded reads")
+		return nopCloser{ioutil.Discard}
+	}
+	log.Printf("Writing to %s", outFile)
+	if atomicOption && canReplace(outFile) {
+		outF, err := createAtomic(outFile)
+		DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+		return outF
+	}
+	outF, err := os.Create(outFile)
+	DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+	return outF
+}
+
+// commitDecodeOutput() makes the decoded reads written to outF, as returned
+// by createDecodeOutput(), appear at outFile.
+func commitDecodeOutput(outF io.WriteCloser, outFile string) {
+	if a, ok := outF.(*atomicFile); ok {
+		DIE_ON_ERR(a.Commit(), "Couldn't write output file %s", outFile)
+	}
+}
+
+// canReplace() returns true if the file doesn't exist yet or is a regular
+// file, so that a file renamed over it takes its place. Renaming over
+// /dev/stdout or a named pipe would replace the device rather than write to
+// it.
+func canReplace(filename string) bool {
+	fi, err := os.Stat(filename)
+	return os.IsNotExist(err) || (err == nil && fi.Mode().IsRegular())
+}
+
+// An atomicFile is written under a temporary name in the same directory as
+// its target, and renamed to the target by Commit(). Until then the target
+// is untouched, so if the program dies partway through writing, there is no
+// truncated file that looks like a complete one; the temporary file is
+// removed by DIE_IF() and DIE_ON_ERR() (see removeOnDie()). Closing an
+// atomicFile that hasn't been committed removes the temporary file.
+type atomicFile struct {
+	*os.File
+	target string
+	done   bool
+}
+
+// createAtomic() creates an atomicFile that will replace target.
+func createAtomic(target string) (*atomicFile, error) {
+	dir, base := filepath.Split(target)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	removeOnDie(f.Name())
+	return &atomicFile{File: f, target: target}, nil
+}
+
+// Commit() closes the file and renames it to the target.
+func (f *atomicFile) Commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	defer keepOnDie(f.Name())
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// TempFile() creates the file readable only by its owner
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.target); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Close() throws away what was written, unless Commit() has been called.
+func (f *atomicFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	f.File.Close()
+	defer keepOnDie(f.Name())
+	return os.Remove(f.Name())
+}
+
+// indexCounts() writes the bucket prefixes of the archive with basename
+// archive and the number of reads with each to outFile, as a sorted TSV.
+func indexCounts(archive, outFile string) {
+	DIE_IF(outFile == "", "Must give the file to write the counts to with -out")
+	prefixes, counts := bucketCounts(archive)
+	outF, err := os.Create(outFile)
+	DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+	DIE_ON_ERR(writeBucketCounts(outF, prefixes, counts), "Couldn't write %s", outFile)
+	DIE_ON_ERR(outF.Close(), "Couldn't write %s", outFile)
+	log.Printf("Wrote the counts of %d prefixes to %s", len(prefixes), outFile)
+}
+
 // main() encodes or decodes a set of reads based on the first command line
 // argument (which is either encode or decode).
 func main() {
-	fmt.Println("kpath  Copyright (C) 2014  Carl Kingsford & Rob Patro\n")
+	fmt.Println("kpath  Copyright (C) 2014  Carl Kingsford & Rob Patro")
+	fmt.Println()
 
 	fmt.Println("This program comes with ABSOLUTELY NO WARRANTY; This is free software, and")
 	fmt.Println("you are welcome to redistribute it under certain conditions; see")
-	fmt.Println("accompanying LICENSE.txt file.\n")
+	fmt.Println("accompanying LICENSE.txt file.")
+	fmt.Println()
 
-	log.Println("Starting kpath version 0.6.3 (1-6-15)")
+	log.Printf("Starting kpath version %s", kpathVersion)
 	startTime := time.Now()
 
-	log.Printf("Maximum threads = %v", maxThreads)
-	runtime.GOMAXPROCS(maxThreads)
-
-    // "GOMAXPROCS" sets the actual OS threads; our minimum number of "threads" is 2
-    // even though both these Go threads may run in the same OS thread.
-    if maxThreads < 2 {
-        maxThreads = 2
-    }
-
 	// parse the command line
 	const (
-		ENCODE int = 1
-		DECODE int = 2
+		ENCODE   int = 1
+		DECODE   int = 2
+		REENCODE int = 3
+		COMPARE  int = 4
+		APPEND   int = 5
+		COUNTS   int = 6
+		REFSTATS int = 7
+		ORIENT   int = 8
+		TRACE    int = 9
+		SWEEP    int = 10
+		EXPORT   int = 11
+		BATCH    int = 12
+		GEN      int = 13
 	)
 	if len(os.Args) < 2 {
 		encodeFlags.PrintDefaults()
 		os.Exit(1)
 	}
 	var mode int
-	if os.Args[1][0] == 'e' {
+	switch {
+	case os.Args[1] == "reencode":
+		mode = REENCODE
+		log.SetPrefix("kpath (reencode): ")
+	case os.Args[1] == "append":
+		mode = APPEND
+		log.SetPrefix("kpath (append): ")
+	case os.Args[1] == "compare":
+		mode = COMPARE
+		log.SetPrefix("kpath (compare): ")
+	case os.Args[1] == "index-counts":
+		mode = COUNTS
+		log.SetPrefix("kpath (index-counts): ")
+	case os.Args[1] == "reference-stats":
+		mode = REFSTATS
+		log.SetPrefix("kpath (reference-stats): ")
+	case os.Args[1] == "orient":
+		mode = ORIENT
+		log.SetPrefix("kpath (orient): ")
+	case os.Args[1] == "dump-intervals":
+		mode = TRACE
+		log.SetPrefix("kpath (dump-intervals): ")
+	case os.Args[1] == "sweep":
+		mode = SWEEP
+		log.SetPrefix("kpath (sweep): ")
+	case os.Args[1] == "export-counts":
+		mode = EXPORT
+		log.SetPrefix("kpath (export-counts): ")
+	case os.Args[1] == "batch-decode":
+		mode = BATCH
+		log.SetPrefix("kpath (batch-decode): ")
+	case os.Args[1] == "gen":
+		mode = GEN
+		log.SetPrefix("kpath (gen): ")
+	case os.Args[1][0] == 'e':
 		mode = ENCODE
 		log.SetPrefix("kpath (encode): ")
-	} else {
+	default:
 		mode = DECODE
 		log.SetPrefix("kpath (decode): ")
 	}
 	encodeFlags.Parse(os.Args[2:])
+	setThreads()
+	setGC()
+	if mode == GEN {
+		// nothing is encoded, so k isn't needed
+		if refFile == "" || readFile == "" {
+			log.Fatalln("Must give the files to write with -ref and -reads")
+		}
+		if err := genOptions.check(); err != nil {
+			log.Fatalf("Bad options for gen: %v", err)
+		}
+		generateData(genOptions, refFile, readFile)
+		return
+	}
 	if globalK <= 0 || globalK > 16 {
 		log.Fatalf("K must be specified as a small positive integer with -k")
 	}
 	log.Printf("Using kmer size = %d", globalK)
+	if bucketK < 0 || bucketK > globalK {
+		log.Fatalf("The bucket prefix length -bucketk must be between 1 and k")
+	}
+	if flipK < 0 || flipK > 16 {
+		log.Fatalf("The flip kmer size -flipk must be between 1 and 16")
+	}
+	if flipWindowOption < 0 || (flipWindowOption > 0 && (flipWindowOption <= globalK || flipWindowOption <= flipK)) {
+		log.Fatalf("The flip window -flipwindow must be longer than the kmers used to flip")
+	}
+	if _, err := parseBackoffOrders(backoffOption, globalK); err != nil {
+		log.Fatalf("Bad value for -backoff: %v", err)
+	}
+	if backoffMinOption < 1 {
+		log.Fatalf("The observations -backoffmin must be at least 1")
+	}
+	if adaptivePseudoOption < 0 || adaptivePseudoOption > maxAdaptivePseudo {
+		log.Fatalf("The pseudocount scale -adaptivepseudo must be between 0 and %d", maxAdaptivePseudo)
+	}
+	if err := checkCodingPrecision(); err != nil {
+		log.Fatalf("Bad value for -mul: %v", err)
+	}
+	if readFormatOption != "fastq" && readFormatOption != "fasta" {
+		log.Fatalf("The read format -readformat must be fastq or fasta")
+	}
+	if readFormatOption == "fasta" && qualFlipOption {
+		log.Fatalf("-qualflip needs the qualities of fastq reads")
+	}
+	if arrayDensityOption < 0 || arrayDensityOption > 100 {
+		log.Fatalf("The density -arraydensity must be a percentage between 0 and 100")
+	}
+	if readBufferSize < 0 {
+		log.Fatalf("The number of reads to buffer -readbuf must not be negative")
+	}
+	if worstReadsOption < 0 {
+		log.Fatalf("The number of reads -worst must not be negative")
+	}
+	if bvBitsOption < 64 {
+		log.Fatalf("The budget -bvbits must be at least 64 bits")
+	}
+	if mphfOption && updateReference {
+		log.Fatalf("The read-only model of -mphf needs -update=false")
+	}
+	if err := checkIUPACMode(refIUPACOption); err != nil {
+		log.Fatalf("Bad value for -iupac: %v", err)
+	}
+	if err := checkBucketOrder(bucketOrderOption); err != nil {
+		log.Fatalf("Bad value for -bucketorder: %v", err)
+	}
+	if nsFormatOption != "text" && nsFormatOption != "varint" {
+		log.Fatalf("The N location format -nsformat must be text or varint")
+	}
+	if _, err := parseSeparator(sepOption); err != nil {
+		log.Fatalf("Bad value for -sep: %v", err)
+	}
 	setShiftKmerMask()
 
-	if refFile == "" {
-		log.Fatalf("Must specify gzipped fasta as reference with -ref")
+	if positionsOption && refFromReads && (mode == ENCODE || mode == APPEND) {
+		log.Fatalf("-positions needs a reference to find the buckets in, not -reference-from-reads")
+	}
+	if keepOrderOption && mode == APPEND {
+		log.Fatalf("-keeporder can't number the reads appended after those already in the archive")
+	}
+	if (keepOrderOption || readRange != "") && positionsOption && mode == DECODE {
+		log.Fatalf("The reads can be written in input order (-keeporder, -readrange) or position order (-positions), not both")
+	}
+	if readRange != "" && bucketRange != "" {
+		log.Fatalf("Give -readrange or -buckets, not both")
 	}
 
-	if readFile == "" {
+	if refFile == "" && mode == ENCODE && !refFromReads {
+		log.Println("Must specify gzipped fasta as reference with -ref")
+		log.Fatalln("To use the reads as the reference, give -reference-from-reads.")
+	}
+
+	if mode == COMPARE && encodeFlags.NArg() != 2 {
+		log.Fatalln("Must give the basenames of the two archives to compare")
+	}
+
+	if mode == TRACE && encodeFlags.NArg() != 1 {
+		log.Fatalln("Must give the read to trace")
+	}
+
+	if mode == BATCH && encodeFlags.NArg() == 0 {
+		log.Fatalln("Must give the basenames of the archives to decode")
+	}
+
+	if readFile == "" && mode != COMPARE && mode != REFSTATS && mode != TRACE && mode != EXPORT && mode != BATCH {
 		log.Println("Must specify input file with -reads")
-		log.Fatalln("If decoding, just give basename of encoded files.")
+		log.Fatalln("If decoding or re-encoding, just give basename of encoded files.")
 	}
 
-	if outFile == "" {
+	if outFile == "" && mode != COMPARE && mode != REFSTATS && mode != TRACE && mode != SWEEP && mode != EXPORT && mode != BATCH && !(mode == DECODE && noWriteOption) {
 		log.Println("Must specify output location with -out")
 		log.Println("If encoding, omit extension.")
 	}
@@ -1218,144 +4052,41 @@ func main() {
 
 	writeGlobalOptions()
 
-	if mode == ENCODE {
-		/* encode -k -ref -reads=FOO.seq -out=OUT
-		   will encode into OUT.{enc,bittree,counts} */
-		log.Printf("Reading from %s", readFile)
-		log.Printf("Writing to %s, %s, %s",
-			outFile+".enc", outFile+".bittree", outFile+".counts")
-
-		// create the output file
-		outF, err := os.Create(outFile + ".enc")
-		DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
-		defer outF.Close()
-
-		//outBuf := bufio.NewWriterSize(outF, 200000000)
-		//defer outBuf.Flush()
-
-		writer := bitio.NewWriter(outF)
-		defer writer.Close()
-
-		// create encoder
-		encoder := arithc.NewEncoder(writer)
-		defer encoder.Finish()
-
-		// pre-Process reads
-        refSeqs := readReferenceFile(refFile)
-        bv := createKmerBitVectorFromReference(globalK, refSeqs)
-        tempReadFile, buckets, counts := preprocessWithBuckets(readFile, outFile, bv)
-        bv = nil
-        runtime.GC()
-        debug.FreeOSMemory()
-
-        // build the full model
-        km := countKmersInReference(globalK, refSeqs)
-        debug.FreeOSMemory()
-
-        // encode the reads
-		n := encodeReadsFromTempFile(tempReadFile, buckets, counts, km, encoder)
-		log.Printf("Reads Flipped: %v", flipped)
-		log.Printf("Encoded %v reads (may be < # of input reads due to duplicates).", n)
-
-	} else {
-		/* decode -k -ref -reads=FOO -out=OUT.seq
-		   will look for FOO.enc, FOO.bittree, FOO.counts and decode into OUT.seq */
-
-        // count the kmers in the reference
-        var km KmerModel
-        waitForReference := make(chan struct{})
-        go func() {
-            refStart := time.Now()
-            km = countKmersInReference(globalK, readReferenceFile(refFile))
-            log.Printf("Time: Took %v seconds to read reference.",
-                time.Now().Sub(refStart).Seconds())
-            close(waitForReference)
-            return
-        }()
-
-		tailsFN := readFile + ".enc"
-		headsFN := readFile + ".bittree"
-		countsFN := readFile + ".counts"
-
-		log.Printf("Reading from %s, %s, and %s", tailsFN, headsFN, countsFN)
-
-		// read the bucket names
-		var kmers []string
-		waitForBuckets := make(chan struct{})
-		go func() {
-			kmers = decodeKmersFromFile(headsFN, globalK)
-			sort.Strings(kmers)
-			close(waitForBuckets)
-			runtime.Goexit()
-			return
-		}()
-
-		// read the bucket counts
-		var counts []int
-		var readlen int
-		waitForCounts := make(chan struct{})
-		go func() {
-			counts, readlen = readBucketCounts(countsFN)
-			close(waitForCounts)
-			runtime.Goexit()
-			return
-		}()
-
-		// read the flipped bits --- flipped by be 0-length if no file could be
-		// found; this indicates that either nothing was flipped or we don't
-		// care about orientation
-		var flipped []bool
-		waitForFlipped := make(chan struct{})
-		go func() {
-			flipped = readFlipped(readFile + ".flipped")
-			close(waitForFlipped)
-			runtime.Goexit()
-			return
-		}()
-
-		// read the NLocations, which might be 0-length if no file could be
-		// found; this indicates that the Ns were recorded some other way.
-		var NLocations [][]byte
-		waitForNLocations := make(chan struct{})
-		go func() {
-			NLocations = readNLocations(readFile + ".ns")
-			close(waitForNLocations)
-			runtime.Goexit()
-			return
-		}()
-
-		// open encoded read file
-		encIn, err := os.Open(tailsFN)
-		DIE_ON_ERR(err, "Can't open encoded read file %s", tailsFN)
-		defer encIn.Close()
-
-		readerBuf := bufio.NewReader(encIn)
-
-		// create a bit reader wrapper around it
-		reader := bitio.NewReader(readerBuf)
-		defer reader.Close()
-
-		// create a decoder around it
-		decoder, err := arithc.NewDecoder(reader)
-		DIE_ON_ERR(err, "Couldn't create decoder!")
-
-		// create the output file
-		log.Printf("Writing to %s", outFile)
-		outF, err := os.Create(outFile)
-		DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
-		defer outF.Close()
-
-		<-waitForReference
-		<-waitForBuckets
-		<-waitForCounts
-		<-waitForFlipped
-		<-waitForNLocations
-        <-waitForReference
-		log.Printf("Read length = %d", readlen)
-		decodeReads(kmers, counts, flipped, NLocations, km, readlen, outF, decoder)
-	}
-	log.Printf("Default interval used %v times and context used %v times",
-		defaultIntervalSum, contextExists)
+	switch mode {
+	case ENCODE:
+		encodeArchive(refFile, readFile, outFile)
+	case REENCODE:
+		reencodeArchive(refFile, readFile, outFile)
+	case APPEND:
+		appendArchive(refFile, readFile, outFile)
+	case COUNTS:
+		indexCounts(readFile, outFile)
+	case REFSTATS:
+		referenceStatsReport(refFile, outFile)
+	case ORIENT:
+		orientReads(refFile, readFile, outFile)
+	case TRACE:
+		dumpIntervals(refFile, encodeFlags.Arg(0))
+	case SWEEP:
+		sweepReport(refFile, readFile, outFile)
+	case EXPORT:
+		exportCounts(refFile, outFile)
+	case BATCH:
+		batchDecode(refFile, encodeFlags.Args(), outFile)
+	case COMPARE:
+		a1, a2 := encodeFlags.Arg(0), encodeFlags.Arg(1)
+		diff := compareArchives(refFile, a1, a2)
+		log.Println(compareReport(a1, a2, diff))
+		if diff >= 0 {
+			os.Exit(1)
+		}
+	default:
+		decodeArchive(refFile, readFile, outFile)
+	}
+	if memProfile != "" {
+		writeHeapProfile(memProfile)
+	}
+	log.Println(contexts)
 
 	endTime := time.Now()
 	log.Printf("kpath took %v to run.", endTime.Sub(startTime).Seconds())
@@ -0,0 +1,2340 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"kingsford/kpath/arithc"
+	"kingsford/kpath/bitio"
+)
+
+// setTestOptions() resets every command line option to its default and sets
+// the kmer size to k.
+func setTestOptions(k int) {
+	encodeFlags.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+	globalK = k
+	setShiftKmerMask()
+	dictionaryModel = nil
+}
+
+// randomSequence() returns a random string of ACGTs of length n.
+func randomSequence(rng *rand.Rand, n int) string {
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = ALPHA[rng.Intn(len(ALPHA))]
+	}
+	return string(s)
+}
+
+// sampleReads() draws n reads of length readLen from the reference sequences,
+// from either strand, with the given per-base error rate. A few reads get Ns
+// and a few are exact duplicates of the previous read.
+func sampleReads(rng *rand.Rand, ref []string, n, readLen int, errRate float64) []string {
+	reads := make([]string, 0, n)
+	for len(reads) < n {
+		if len(reads) > 0 && rng.Intn(10) == 0 {
+			reads = append(reads, reads[len(reads)-1])
+			continue
+		}
+		s := ref[rng.Intn(len(ref))]
+		p := rng.Intn(len(s) - readLen)
+		r := []byte(s[p : p+readLen])
+		for i := range r {
+			if rng.Float64() < errRate {
+				r[i] = ALPHA[rng.Intn(len(ALPHA))]
+			}
+		}
+		if rng.Intn(20) == 0 {
+			r[rng.Intn(readLen)] = 'N'
+		}
+		if rng.Intn(2) == 0 {
+			r = []byte(reverseComplement(string(r)))
+		}
+		reads = append(reads, string(r))
+	}
+	return reads
+}
+
+// writeTestReference() writes the sequences as a gzipped multifasta file.
+func writeTestReference(t testing.TB, fn string, seqs []string) {
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Couldn't create reference: %v", err)
+	}
+	defer f.Close()
+	z := gzip.NewWriter(f)
+	defer z.Close()
+	for i, s := range seqs {
+		fmt.Fprintf(z, ">seq%d\n", i)
+		for len(s) > 60 {
+			fmt.Fprintf(z, "%s\n", s[:60])
+			s = s[60:]
+		}
+		fmt.Fprintf(z, "%s\n", s)
+	}
+}
+
+// writeTestReads() writes the reads as a fastq file.
+func writeTestReads(t testing.TB, fn string, reads []string) {
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Couldn't create reads: %v", err)
+	}
+	defer f.Close()
+	for i, r := range reads {
+		fmt.Fprintf(f, "@r%d\n%s\n+\n%s\n", i, r, strings.Repeat("I", len(r)))
+	}
+}
+
+// readDecodedSeqs() reads the sequences from a decoded fasta (or one read
+// per line) file.
+func readDecodedSeqs(t *testing.T, fn string) []string {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open decoded reads: %v", err)
+	}
+	defer f.Close()
+	seqs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); len(line) > 0 && line[0] != '>' {
+			seqs = append(seqs, line)
+		}
+	}
+	return seqs
+}
+
+// sameReads() returns true if a and b contain the same reads, ignoring order.
+func sameReads(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// testData is a small reference and a set of reads sampled from it.
+type testData struct {
+	dir     string
+	refFile string
+	reads   []string
+	readFN  string
+}
+
+// newTestData() creates a temporary directory holding a random reference and
+// reads sampled from it.
+func newTestData(t testing.TB, seed int64, nreads, readLen int) *testData {
+	dir, err := ioutil.TempDir("", "kpath-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	ref := []string{
+		randomSequence(rng, 3000),
+		randomSequence(rng, 2000),
+		randomSequence(rng, 1000),
+	}
+	td := &testData{
+		dir:     dir,
+		refFile: filepath.Join(dir, "ref.fa.gz"),
+		reads:   sampleReads(rng, ref, nreads, readLen, 0.01),
+		readFN:  filepath.Join(dir, "reads.fq"),
+	}
+	writeTestReference(t, td.refFile, ref)
+	writeTestReads(t, td.readFN, td.reads)
+	return td
+}
+
+func (td *testData) path(name string) string {
+	return filepath.Join(td.dir, name)
+}
+
+func (td *testData) Close() {
+	os.RemoveAll(td.dir)
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 1, 500, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+func TestReferenceFromReads(t *testing.T) {
+	setTestOptions(8)
+	refFromReads = true
+	td := newTestData(t, 2, 500, 40)
+	defer td.Close()
+
+	encodeArchive("", td.readFN, td.path("out"))
+	if !fileExists(td.path("out.model")) {
+		t.Fatalf("No model was written")
+	}
+	decodeArchive("", td.path("out"), td.path("decoded.fa"))
+
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+func TestEmbeddedReference(t *testing.T) {
+	setTestOptions(8)
+	embedRefOption = true
+	td := newTestData(t, 3, 500, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	if !fileExists(td.path("out.model")) {
+		t.Fatalf("No model was written")
+	}
+	// the reference is gone; decoding must not need it
+	if err := os.Remove(td.refFile); err != nil {
+		t.Fatalf("Couldn't remove the reference: %v", err)
+	}
+	decodeArchive("", td.path("out"), td.path("decoded.fa"))
+
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+// modelString() lists every context of the model with its distribution.
+func modelString(km KmerModel) string {
+	var buf bytes.Buffer
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		fmt.Fprintf(&buf, "%d %v\n", k, dist)
+	})
+	return buf.String()
+}
+
+func TestParallelReferenceCount(t *testing.T) {
+	defer func(min int) { parallelCountMin = min }(parallelCountMin)
+	rng := rand.New(rand.NewSource(33))
+	seqs := []string{randomSequence(rng, 5000), "ACGTA", randomSequence(rng, 777), randomSequence(rng, 9)}
+
+	for _, c := range []struct {
+		name string
+		seed string
+		dict bool
+	}{{"plain", "", false}, {"seed", "11011011", false}, {"dictionary", "", true}} {
+		setTestOptions(8)
+		DIE_ON_ERR(setSeed(c.seed), "bad seed")
+		if c.dict {
+			dictionaryModel = NewSmallKmerModel(8)
+			for i := 0; i < 300; i++ {
+				dictionaryModel.SetCount(Kmer(rng.Intn(1<<16)), byte(rng.Intn(4)), byte(1+rng.Intn(5)))
+			}
+		}
+		parallelCountMin = 1 << 30
+		want := modelString(countKmersInReference(8, seqs))
+		for _, threads := range []int{2, 3, 16, 64} {
+			maxThreads = threads
+			parallelCountMin = 0
+			if got := modelString(countKmersInReference(8, seqs)); got != want {
+				t.Fatalf("%s: counting with %d threads gives a different model", c.name, threads)
+			}
+		}
+	}
+}
+
+func TestModelSerialization(t *testing.T) {
+	for _, array := range []bool{false, true} {
+		setTestOptions(6)
+		useArrayModel = array
+		km := newKmerModel(6)
+		km.SetCount(stringToKmer("ACGTAC"), 1, 2)
+		km.SetCount(stringToKmer("TTTTTT"), 3, 7)
+		for i := 0; i < 1000; i++ {
+			km.Increment(stringToKmer("GGGAAA"), 2, 1)
+		}
+
+		fn := filepath.Join(os.TempDir(), fmt.Sprintf("kpath-model-%d.gz", os.Getpid()))
+		defer os.Remove(fn)
+		saveKmerModel(fn, km, 6)
+		km2, order := loadKmerModel(fn)
+		if order != 6 {
+			t.Fatalf("Order %d != 6", order)
+		}
+		for _, s := range []string{"ACGTAC", "TTTTTT", "GGGAAA", "CCCCCC"} {
+			e1, d1 := km.Distribution(stringToKmer(s))
+			e2, d2 := km2.Distribution(stringToKmer(s))
+			if e1 != e2 || d1 != d2 {
+				t.Fatalf("Model differs at %s: %v %v != %v %v", s, e1, d1, e2, d2)
+			}
+		}
+	}
+}
+
+func TestModelOrderMismatch(t *testing.T) {
+	setTestOptions(6)
+	useArrayModel = true
+	if err := checkModelOrder(6); err != nil {
+		t.Fatalf("Model of order 6 rejected with k=6: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeKmerModel(&buf, newKmerModel(6), 6); err != nil {
+		t.Fatalf("Couldn't write model: %v", err)
+	}
+
+	// a model of another order would index the array out of range
+	setTestOptions(8)
+	useArrayModel = true
+	if err := checkModelOrder(6); err == nil {
+		t.Fatalf("Model of order 6 accepted with k=8")
+	}
+	if _, _, err := readKmerModel(&buf); err == nil {
+		t.Fatalf("Read a model of order 6 with k=8")
+	}
+}
+
+func TestShortBucketPrefix(t *testing.T) {
+	setTestOptions(10)
+	bucketK = 6
+	td := newTestData(t, 5, 500, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	for _, k := range decodeKmersFromFile(td.path("out.bittree"), 6) {
+		if len(k) != 6 {
+			t.Fatalf("Bucket %s is not of length 6", k)
+		}
+	}
+
+	// the decoder must pick up the bucket length from the archive
+	bucketK = 0
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+// TestZeroCountBuckets checks that a bucket with a count of 0 has nothing in
+// the stream: encoding skips it without reading a read for it, and decoding
+// passes over it.
+func TestZeroCountBuckets(t *testing.T) {
+	seqs := []string{
+		"AAAAAAAACGTA", "AAAAAAAATTGC",
+		"CCCCCCCCAAGT", "CCCCCCCCAAGT", "CCCCCCCCAAGT",
+		"GGGGGGGGTACA",
+	}
+	temp := strings.Join(seqs, "\n") + "\n"
+	encode := func(buckets []string, counts []int) []byte {
+		resetModelState()
+		var buf bytes.Buffer
+		w := bitio.NewWriter(&buf)
+		coder := arithc.NewEncoder(w)
+		encodeReadsFromTempFile(strings.NewReader(temp), buckets, counts, nil, nil,
+			NewSmallKmerModel(8), coder, nil, nil)
+		coder.Finish()
+		w.Close()
+		return buf.Bytes()
+	}
+
+	setTestOptions(8)
+	bucketK = 8
+	want := encode([]string{"AAAAAAAA", "CCCCCCCC", "GGGGGGGG"}, []int{2, -3, 1})
+
+	// empty buckets at the start, in the middle and at the end
+	buckets := []string{"AAAAAAAA", "AAAAAAAA", "AAAAAAAA", "CCCCCCCC", "CCCCCCCC", "GGGGGGGG", "GGGGGGGG", "TTTTTTTT"}
+	counts := []int{0, 0, 2, -3, 0, 0, 1, 0}
+	got := encode(buckets, counts)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Empty buckets changed the encoded stream")
+	}
+
+	resetModelState()
+	decoder, err := arithc.NewDecoder(bitio.NewReader(bufio.NewReader(bytes.NewReader(got))))
+	if err != nil {
+		t.Fatalf("Couldn't start decoder: %v", err)
+	}
+	var out bytes.Buffer
+	outputFastaOption = false
+	decodeReads(buckets, counts, nil, nil, NewSmallKmerModel(8), 12, &out, decoder, -1)
+	if out.String() != temp {
+		t.Fatalf("Decoded %q, not %q", out.String(), temp)
+	}
+}
+
+func TestMaxBuckets(t *testing.T) {
+	reads := make([]*FastQ, 0)
+	for _, s := range []string{"AAAACC", "AAAAGG", "AACCCC", "ACGTAA", "ACGTTT", "CCCCCC"} {
+		reads = append(reads, &FastQ{Seq: []byte(s)})
+	}
+	// there are 2, 3, 4, 4, 6 and 6 buckets at lengths 1 to 6
+	for limit, want := range map[int]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 4, 6: 6, 100: 6} {
+		if got := bucketKForLimit(readSlice(reads), 6, limit); got != want {
+			t.Fatalf("With at most %d buckets, the prefix length is %d, not %d", limit, got, want)
+		}
+	}
+	if got := bucketKForLimit(readSlice(reads), 4, 100); got != 4 {
+		t.Fatalf("Prefix length %d is longer than k", got)
+	}
+
+	setTestOptions(8)
+	maxBucketsOption = 20
+	td := newTestData(t, 31, 500, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	meta := loadArchiveMeta(td.path("out.meta"))
+	if meta.BucketK != 2 {
+		t.Fatalf("Prefix length is %d, not 2, with -maxbuckets=20", meta.BucketK)
+	}
+	if n := len(decodeKmersFromFile(td.path("out.bittree"), 2)); n > 20 {
+		t.Fatalf("Wrote %d buckets with -maxbuckets=20", n)
+	}
+
+	// the id covers the shortened prefixes, so it differs from that of the
+	// same reads bucketed by the full prefixes
+	setTestOptions(8)
+	encodeArchive(td.refFile, td.readFN, td.path("full"))
+	if encodedID(t, td.path("out.enc")) == encodedID(t, td.path("full.enc")) {
+		t.Fatalf("Archives with different prefix lengths have the same id")
+	}
+
+	setTestOptions(8)
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+func TestQualityFlip(t *testing.T) {
+	setTestOptions(8)
+	s1, s2 := "ACGGTCATTGCAGT", "TTAGCCGATAAC"
+	ks := kmerSetFromReference(4, []string{s1, s2})
+
+	// the read matches s1 for 12 bases, in low quality, and the reverse
+	// complement of s2 for 8 bases, in high quality
+	seq := s1[:12] + reverseComplement(s2[:8])
+	qual := strings.Repeat("#", 12) + strings.Repeat("I", 8)
+	n1 := countMatchingObservations(ks, seq)
+	n2 := countMatchingObservations(ks, reverseComplement(seq))
+	if n1 <= n2 {
+		t.Fatalf("Forward read has %d matches and reverse complement %d", n1, n2)
+	}
+
+	for _, weighted := range []bool{false, true} {
+		qualFlipOption = weighted
+		read := NewFastQ([]byte(seq), []byte(qual))
+		if flipRange([]*FastQ{read}, ks); read.IsFlipped != weighted {
+			t.Fatalf("With -qualflip=%v, the read was flipped = %v", weighted, read.IsFlipped)
+		}
+		// reads without qualities are scored as before
+		read = NewFastQ([]byte(seq), nil)
+		if flipRange([]*FastQ{read}, ks); read.IsFlipped {
+			t.Fatalf("With -qualflip=%v, a read without qualities was flipped", weighted)
+		}
+	}
+
+	// flipping reverses the qualities along with the sequence
+	read := NewFastQ([]byte("ACGT"), []byte("#+5I"))
+	read.SetReverseComplement("ACGT")
+	if string(read.Quals) != "I5+#" {
+		t.Fatalf("Qualities are %s after flipping", read.Quals)
+	}
+
+	setTestOptions(8)
+	qualFlipOption = true
+	td := newTestData(t, 32, 500, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads with -qualflip")
+	}
+}
+
+func TestFlipWindow(t *testing.T) {
+	setTestOptions(8)
+	s1, s2 := "ACGGTCATTGCAGT", "TTAGCCGATAAC"
+	ks := kmerSetFromReference(4, []string{s1, s2})
+
+	// the start of the read matches s1, and its reverse complement matches
+	// s2 better, but only in the middle of the read
+	seq := s1[:10] + reverseComplement(s2) + strings.Repeat("A", 10)
+	if n1, n2 := countMatchingObservations(ks, seq), countMatchingObservations(ks, reverseComplement(seq)); n1 >= n2 {
+		t.Fatalf("Forward read has %d matches and reverse complement %d", n1, n2)
+	}
+	for _, c := range []struct {
+		window  int
+		flipped bool
+	}{{0, true}, {len(seq), true}, {1000, true}, {10, false}} {
+		flipWindowOption = c.window
+		read := NewFastQ([]byte(seq), nil)
+		if flipRange([]*FastQ{read}, ks); read.IsFlipped != c.flipped {
+			t.Fatalf("With -flipwindow=%d, the read was flipped = %v", c.window, read.IsFlipped)
+		}
+	}
+
+	// a window as long as the reads flips just as the whole read does
+	rng := rand.New(rand.NewSource(34))
+	ref := []string{randomSequence(rng, 5000)}
+	ks = kmerSetFromReference(8, ref)
+	seqs := sampleReads(rng, ref, 500, 60, 0.05)
+	flipped := make(map[int][]bool)
+	for _, w := range []int{0, 60, 61} {
+		flipWindowOption = w
+		for _, s := range seqs {
+			read := NewFastQ([]byte(s), nil)
+			flipRange([]*FastQ{read}, ks)
+			flipped[w] = append(flipped[w], read.IsFlipped)
+		}
+	}
+	for i := range seqs {
+		if flipped[60][i] != flipped[0][i] || flipped[61][i] != flipped[0][i] {
+			t.Fatalf("Read %d flipped differently with a full window", i)
+		}
+	}
+}
+
+func BenchmarkFlipWindow(b *testing.B) {
+	setTestOptions(12)
+	rng := rand.New(rand.NewSource(35))
+	ref := []string{randomSequence(rng, 100000)}
+	ks := kmerSetFromReference(12, ref)
+	seqs := sampleReads(rng, ref, 1000, 1000, 0.01)
+	for _, w := range []int{0, 100} {
+		b.Run(fmt.Sprintf("window=%d", w), func(b *testing.B) {
+			flipWindowOption = w
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				reads := make([]*FastQ, len(seqs))
+				for j, s := range seqs {
+					reads[j] = NewFastQ([]byte(s), nil)
+				}
+				b.StartTimer()
+				flipRange(reads, ks)
+			}
+		})
+	}
+}
+
+func TestAdaptivePseudo(t *testing.T) {
+	dist := [len(ALPHA)]KmerCount{4, 0, 1, 0}
+	setTestOptions(8)
+	if w := contextWeight(1, dist); w != pseudoCount {
+		t.Fatalf("Fixed pseudocount is %d", w)
+	}
+	adaptivePseudoOption = 20
+	if w := contextWeight(1, dist); w != pseudoCount+5 {
+		t.Fatalf("Adaptive pseudocount is %d, not %d", w, pseudoCount+5)
+	}
+	if w := contextWeight(0, dist); w != uint64(observationWeight)*4 {
+		t.Fatalf("A seen base has weight %d", w)
+	}
+
+	td := newTestData(t, 48, 500, 40)
+	defer td.Close()
+	var fixed []byte
+	for _, n := range []int{0, 64} {
+		setTestOptions(8)
+		adaptivePseudoOption = n
+		out := td.path(fmt.Sprintf("out%d", n))
+		encodeArchive(td.refFile, td.readFN, out)
+
+		// the value is recorded, so decoding doesn't need it
+		adaptivePseudoOption = 0
+		decodeArchive(td.refFile, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, td.reads) {
+			t.Fatalf("-adaptivepseudo=%d: decoded reads differ from the encoded reads", n)
+		}
+		if meta := loadArchiveMeta(out + ".meta"); meta.AdaptivePseudo != n {
+			t.Fatalf("Metadata records -adaptivepseudo=%d, not %d", meta.AdaptivePseudo, n)
+		}
+		enc, err := ioutil.ReadFile(out + ".enc")
+		if err != nil {
+			t.Fatalf("Couldn't read the archive: %v", err)
+		}
+		if n == 0 {
+			fixed = enc
+		} else if bytes.Equal(enc, fixed) {
+			t.Fatalf("-adaptivepseudo=%d made no difference", n)
+		}
+	}
+}
+
+func TestCodingPrecision(t *testing.T) {
+	setTestOptions(8)
+	if err := checkCodingPrecision(); err != nil {
+		t.Fatalf("The default -mul is rejected: %v", err)
+	}
+	if worstCaseTotal() != uint64(len(ALPHA))*10*uint64(MAX_OBSERVATION-1) {
+		t.Fatalf("Worst case total %d", worstCaseTotal())
+	}
+
+	// the largest -mul allowed still decodes every base
+	largest := int(maxCodingTotal / (uint64(len(ALPHA)) * uint64(MAX_OBSERVATION-1)))
+	for _, c := range []struct {
+		mul int
+		ok  bool
+	}{{largest, true}, {largest + 1, false}, {1 << 30, false}, {0, false}} {
+		observationWeight = c.mul
+		err := checkCodingPrecision()
+		if (err == nil) != c.ok {
+			t.Fatalf("-mul=%d: got %v", c.mul, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "-mul") {
+			t.Fatalf("-mul=%d: the error doesn't name -mul: %v", c.mul, err)
+		}
+		if c.ok {
+			var dist [len(ALPHA)]KmerCount
+			for i := range dist {
+				dist[i] = MAX_OBSERVATION - 1
+			}
+			for i := range dist {
+				a, b, total := intervalFor(byte(i), dist)
+				if _, _, got := dart(dist, uint32((a+b)/2)); got != uint64(i) || total > maxCodingTotal {
+					t.Fatalf("-mul=%d: base %d decodes as %d (total %d)", c.mul, i, got, total)
+				}
+			}
+		}
+	}
+	observationWeight = 10
+}
+
+// BenchmarkAdaptivePseudo reports the size of the tails of error-prone reads
+// coded with several scales of adaptive pseudocount.
+func BenchmarkAdaptivePseudo(b *testing.B) {
+	dir, err := ioutil.TempDir("", "kpath-bench-")
+	if err != nil {
+		b.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	rng := rand.New(rand.NewSource(49))
+	ref := []string{randomSequence(rng, 50000)}
+	refFN := filepath.Join(dir, "ref.fa.gz")
+	writeTestReference(b, refFN, ref)
+	readFN := filepath.Join(dir, "reads.fq")
+	writeTestReads(b, readFN, sampleReads(rng, ref, 5000, 100, 0.02))
+
+	for _, n := range []int{0, 4, 16, 64} {
+		b.Run(fmt.Sprintf("adaptivepseudo=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				setTestOptions(12)
+				adaptivePseudoOption = n
+				out := filepath.Join(dir, "out")
+				encodeArchive(refFN, readFN, out)
+				fi, err := os.Stat(out + ".enc")
+				if err != nil {
+					b.Fatalf("Couldn't stat the archive: %v", err)
+				}
+				b.ReportMetric(float64(fi.Size()), "enc-bytes")
+			}
+		})
+	}
+}
+
+func TestLengthReport(t *testing.T) {
+	setTestOptions(8)
+	lenReportOption = true
+	td := newTestData(t, 6, 200, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	resetModelState()
+	kmers := decodeKmersFromFile(td.path("out.bittree"), 8)
+	sort.Strings(kmers)
+	counts, readLen := readBucketCounts(td.path("out.counts"))
+	km := countKmersInReference(8, readReferenceFile(td.refFile))
+	enc, decoder, ntails := openTails(td.path("out.enc"))
+	defer enc.Close()
+	lengths := decodeReads(kmers, counts, nil, nil, km, readLen, ioutil.Discard, decoder, ntails)
+
+	report, err := lengthReport(lengths, readLen)
+	if err != nil || lengths[40] != 200 || len(lengths) != 1 {
+		t.Fatalf("Bad length report for good reads: %s (%v)", report, err)
+	}
+
+	lengths[39] = 3
+	if _, err := lengthReport(lengths, readLen); err == nil {
+		t.Fatalf("Reads of the wrong length were not reported")
+	}
+}
+
+func TestReadBits(t *testing.T) {
+	setTestOptions(8)
+	readBitsOption = true
+	dupsOption = false
+	td := newTestData(t, 8, 400, 40)
+	defer td.Close()
+
+	// add some reads that don't come from the reference
+	rng := rand.New(rand.NewSource(9))
+	offTarget := make(map[string]bool)
+	for i := 0; i < 40; i++ {
+		r := randomSequence(rng, 40)
+		offTarget[r] = true
+		td.reads = append(td.reads, r)
+	}
+	writeTestReads(t, td.readFN, td.reads)
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+
+	// the decoded reads come out in the order they were encoded
+	decoded := readDecodedSeqs(t, td.path("decoded.fa"))
+	f, err := os.Open(td.path("out.readbits"))
+	if err != nil {
+		t.Fatalf("No read size file: %v", err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't unzip read sizes: %v", err)
+	}
+	bits := make([]int, 0)
+	scanner := bufio.NewScanner(z)
+	for scanner.Scan() {
+		var b int
+		fmt.Sscanf(scanner.Text(), "%d", &b)
+		bits = append(bits, b)
+	}
+	if len(bits) != len(decoded) {
+		t.Fatalf("Have %d read sizes for %d reads", len(bits), len(decoded))
+	}
+
+	var on, off, non, noff int
+	for i, r := range decoded {
+		if offTarget[r] {
+			off += bits[i]
+			noff++
+		} else {
+			on += bits[i]
+			non++
+		}
+	}
+	if noff != 40 {
+		t.Fatalf("Found %d of 40 off target reads", noff)
+	}
+	if float64(off)/float64(noff) < 2*float64(on)/float64(non) {
+		t.Fatalf("Off target reads (%v bits) not much bigger than others (%v bits)",
+			float64(off)/float64(noff), float64(on)/float64(non))
+	}
+}
+
+func TestReencodeTails(t *testing.T) {
+	setTestOptions(8)
+	keepSortedOption = true
+	td := newTestData(t, 12, 500, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	// a full encode and a re-encode of the tails with the same new settings
+	// must give the same stream
+	observationWeight = 5
+	updateReference = false
+	keepSortedOption = false
+	encodeArchive(td.refFile, td.readFN, td.path("full"))
+	reencodeArchive(td.refFile, td.path("out"), td.path("tails"))
+
+	full, err := ioutil.ReadFile(td.path("full.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't read full encode: %v", err)
+	}
+	tails, err := ioutil.ReadFile(td.path("tails.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't read re-encode: %v", err)
+	}
+	if string(full) != string(tails) {
+		t.Fatalf("Re-encoded tails (%d bytes) differ from a full encode (%d bytes)",
+			len(tails), len(full))
+	}
+
+	decodeArchive(td.refFile, td.path("tails"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+func TestDecodeFirstReads(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 14, 500, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("full.fa"))
+	full := readDecodedSeqs(t, td.path("full.fa"))
+
+	// stop partway through a uniform bucket, too
+	counts, _ := readBucketCounts(td.path("out.counts"))
+	split := 0
+	for _, c := range counts {
+		if c < -1 {
+			split++
+			break
+		}
+		split += AbsInt(c)
+	}
+
+	for _, n := range []int{1, 37, split, len(full), len(full) + 10} {
+		maxDecodeReads = n
+		decodeArchive(td.refFile, td.path("out"), td.path("first.fa"))
+		got := readDecodedSeqs(t, td.path("first.fa"))
+		want := full
+		if n < len(full) {
+			want = full[:n]
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("-n=%d gave %d reads that are not the first of the full decode", n, len(got))
+		}
+	}
+}
+
+// randomFasta() returns the text of a multifasta file holding seqs, wrapped at
+// random widths, partly in lowercase, with stray whitespace and blank lines.
+func randomFasta(rng *rand.Rand, seqs []string) string {
+	text := ""
+	for i, s := range seqs {
+		text += fmt.Sprintf(">seq%d some description\n", i)
+		for len(s) > 0 {
+			w := 1 + rng.Intn(80)
+			if w > len(s) {
+				w = len(s)
+			}
+			line := s[:w]
+			if rng.Intn(3) == 0 {
+				line = strings.ToLower(line)
+			}
+			text += line + []string{"", " ", "\t", "\r"}[rng.Intn(4)] + "\n"
+			if rng.Intn(10) == 0 {
+				text += "\n"
+			}
+			s = s[w:]
+		}
+	}
+	return text
+}
+
+func TestReadReferenceFileWrapping(t *testing.T) {
+	td := newTestData(t, 16, 1, 40)
+	defer td.Close()
+	rng := rand.New(rand.NewSource(17))
+	fn := td.path("wrapped.fa.gz")
+
+	for trial := 0; trial < 50; trial++ {
+		// some records are empty, and the file may end with one
+		seqs := make([]string, 1+rng.Intn(6))
+		want := make([]string, 0)
+		for i := range seqs {
+			if rng.Intn(4) != 0 {
+				seqs[i] = randomSequence(rng, 1+rng.Intn(300))
+				want = append(want, seqs[i])
+			}
+		}
+
+		f, err := os.Create(fn)
+		if err != nil {
+			t.Fatalf("Couldn't create reference: %v", err)
+		}
+		z := gzip.NewWriter(f)
+		fmt.Fprint(z, randomFasta(rng, seqs))
+		z.Close()
+		f.Close()
+
+		got := readReferenceFile(fn)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("Trial %d: read %v, not %v", trial, got, want)
+		}
+	}
+}
+
+func TestReferenceEncoding(t *testing.T) {
+	// a byte order mark is skipped, and headers may have any bytes
+	fasta := "\xEF\xBB\xBF>chr1 \xC3\xA9chantillon\nacgt\nACgt\n>chr2\ntttt\n"
+	got, err := parseReference(strings.NewReader(fasta))
+	if err != nil {
+		t.Fatalf("Couldn't read reference with a byte order mark: %v", err)
+	}
+	if want := []string{"ACGTACGT", "TTTT"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Read %v, not %v", got, want)
+	}
+
+	// a byte order mark without a header is not taken as part of the
+	// sequence either
+	got, err = parseReference(strings.NewReader("\xEF\xBB\xBFACGT\n"))
+	if err != nil || len(got) != 1 || got[0] != "ACGT" {
+		t.Fatalf("Read %v, %v, not [ACGT]", got, err)
+	}
+
+	// but non-ASCII in a sequence is an error, not a garbled sequence; the
+	// lowercase long s uppercases to an ASCII S
+	for _, bad := range []string{">chr1\nAC\xC3\xA9GT\n", ">chr1\nACGT\n\xC5\xBFAC\n", ">chr1\nAC\xEF\xBB\xBFGT\n"} {
+		if got, err := parseReference(strings.NewReader(bad)); err == nil {
+			t.Fatalf("Reading %q gave %v, not an error", bad, got)
+		}
+	}
+}
+
+func TestOneThread(t *testing.T) {
+	setTestOptions(8)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	maxThreads = 1
+	setThreads()
+	if maxThreads != 2 || runtime.GOMAXPROCS(0) != 2 {
+		t.Fatalf("-p=1 gave maxThreads=%d and GOMAXPROCS=%d, not 2",
+			maxThreads, runtime.GOMAXPROCS(0))
+	}
+
+	// with a single flipper
+	td := newTestData(t, 19, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+// TestEncodeGOMAXPROCS checks that the archive doesn't depend on how many
+// threads Go may use, whatever the number of flippers, with the encoder
+// locked to its thread while the other streams are written alongside.
+func TestEncodeGOMAXPROCS(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	td := newTestData(t, 43, 400, 40)
+	defer td.Close()
+
+	var want string
+	for _, procs := range []int{1, 2, 4} {
+		for _, threads := range []int{2, 4} {
+			setTestOptions(8)
+			maxThreads = threads
+			runtime.GOMAXPROCS(procs)
+			out := td.path(fmt.Sprintf("out.%d.%d", procs, threads))
+			encodeArchive(td.refFile, td.readFN, out)
+			decodeArchive(td.refFile, out, out+".fa")
+			if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, td.reads) {
+				t.Fatalf("GOMAXPROCS=%d, -p=%d: decoded reads differ", procs, threads)
+			}
+			enc, err := ioutil.ReadFile(out + ".enc")
+			if err != nil {
+				t.Fatalf("Couldn't read the archive: %v", err)
+			}
+			if want == "" {
+				want = string(enc)
+			} else if string(enc) != want {
+				t.Fatalf("GOMAXPROCS=%d, -p=%d: the archive differs", procs, threads)
+			}
+		}
+	}
+}
+
+// TestUniformBuckets checks that listBuckets() finds the uniform buckets and
+// the runs of identical reads wherever the duplicates are in a bucket.
+func TestUniformBuckets(t *testing.T) {
+	const p = "ACGTACGT"
+	for _, c := range []struct {
+		name  string
+		tails []string
+		count int
+		runs  string // the runs recorded for the bucket with -runs
+	}{
+		{"single read", []string{"AAAA"}, 1, "[]"},
+		{"two same", []string{"AAAA", "AAAA"}, -2, "[]"},
+		{"two different", []string{"AAAA", "CCCC"}, 2, "[]"},
+		{"all same", []string{"AAAA", "AAAA", "AAAA"}, -3, "[]"},
+		{"all different", []string{"AAAA", "CCCC", "GGGG"}, 3, "[]"},
+		{"duplicates at start", []string{"AAAA", "AAAA", "CCCC", "GGGG"}, 4, "[2]"},
+		{"duplicates at end", []string{"AAAA", "CCCC", "GGGG", "GGGG"}, 4, "[1 1 2]"},
+		{"duplicates in middle", []string{"AAAA", "CCCC", "CCCC", "GGGG"}, 4, "[1 2]"},
+		{"two runs", []string{"AAAA", "AAAA", "CCCC", "CCCC"}, 4, "[2 2]"},
+	} {
+		// the bucket is between two others, whose reads must not affect it
+		seqs := []string{"AAAAAAAA" + "TTTT"}
+		for _, tail := range c.tails {
+			seqs = append(seqs, p+tail)
+		}
+		seqs = append(seqs, "TTTTTTTT"+"TTTT")
+		reads := make([]*FastQ, len(seqs))
+		for i, s := range seqs {
+			reads[i] = &FastQ{Seq: []byte(s)}
+		}
+
+		setTestOptions(8)
+		bucketK = 8
+		dupRunsOption = true
+		buckets, counts, runs := listBuckets(readSlice(reads))
+		if len(buckets) != 3 || buckets[1] != p {
+			t.Fatalf("%s: buckets are %v", c.name, buckets)
+		}
+		if counts[0] != 1 || counts[1] != c.count || counts[2] != 1 {
+			t.Fatalf("%s: counts are %v, not [1 %d 1]", c.name, counts, c.count)
+		}
+		if fmt.Sprint(runs[1]) != c.runs || len(runs) > 1 || (len(runs) == 1 && runs[1] == nil) {
+			t.Fatalf("%s: runs are %v, not %s for bucket 1", c.name, runs, c.runs)
+		}
+
+		// without -dups a uniform bucket is a run like any other
+		dupsOption = false
+		_, counts, runs = listBuckets(readSlice(reads))
+		if counts[1] != len(c.tails) {
+			t.Fatalf("%s: count is %d without -dups", c.name, counts[1])
+		}
+		if c.count < 0 && fmt.Sprint(runs[1]) != fmt.Sprintf("[%d]", len(c.tails)) {
+			t.Fatalf("%s: runs are %v without -dups", c.name, runs)
+		}
+	}
+}
+
+func TestBucketBoundaries(t *testing.T) {
+	// neighbouring buckets of one read, two identical reads and two
+	// different reads, in every order, at the ends of the list as well as
+	// in the middle
+	kinds := map[string][]string{
+		"1": {"AAAA"},
+		"=": {"CCCC", "CCCC"},
+		"2": {"GGGG", "TTTT"},
+	}
+	want := map[string]int{"1": 1, "=": -2, "2": 2}
+	for _, order := range []string{"1=2", "12=", "=12", "=21", "2=1", "21=", "==", "1=1", "2==2"} {
+		setTestOptions(8)
+		bucketK = 8
+		var seqs []string
+		var counts []int
+		for i, kind := range order {
+			prefix := strings.Repeat("AC", 3) + string(ALPHA[i/4]) + string(ALPHA[i%4])
+			for _, tail := range kinds[string(kind)] {
+				seqs = append(seqs, prefix+tail)
+			}
+			counts = append(counts, want[string(kind)])
+		}
+		reads := make([]*FastQ, len(seqs))
+		for i, s := range seqs {
+			reads[i] = &FastQ{Seq: []byte(s)}
+		}
+		if _, got, _ := listBuckets(readSlice(reads)); fmt.Sprint(got) != fmt.Sprint(counts) {
+			t.Fatalf("%s: counts are %v, not %v", order, got, counts)
+		}
+
+		// and the negated counts decode to the right reads
+		td := newTestData(t, 36, 1, 12)
+		writeTestReads(t, td.readFN, seqs)
+		encodeArchive(td.refFile, td.readFN, td.path("out"))
+		decodeArchive(td.refFile, td.path("out"), td.path("out.seq"))
+		if got := readDecodedSeqs(t, td.path("out.seq")); !sameReads(got, seqs) {
+			t.Fatalf("%s: decoded %v, not %v", order, got, seqs)
+		}
+		td.Close()
+	}
+}
+
+func TestBucketSizeReport(t *testing.T) {
+	// buckets of 1, 1, 2, 3 identical reads, 5, 17 and 40 reads
+	setTestOptions(8)
+	bucketK = 4
+	var reads []*FastQ
+	for i, size := range []int{1, 1, 2, -3, 5, 17, 40} {
+		prefix := string(ALPHA[i/4]) + string(ALPHA[i%4]) + "AC"
+		for j := 0; j < AbsInt(size); j++ {
+			tail := fmt.Sprintf("%08b", j)
+			if size < 0 {
+				tail = "00000000"
+			}
+			tail = strings.NewReplacer("0", "A", "1", "T").Replace(tail)
+			reads = append(reads, &FastQ{Seq: []byte(prefix + tail)})
+		}
+	}
+	_, counts, _ := listBuckets(readSlice(reads))
+	want := "Bucket sizes: 7 buckets of 69 reads; 1 uniform; largest 40\n" +
+		"  1: 2\n  2: 1\n  3: 1\n  5: 1\n  17-32: 1\n  33-64: 1"
+	if got := bucketSizeReport(counts); got != want {
+		t.Fatalf("Reported\n%s\nnot\n%s", got, want)
+	}
+
+	// the edges of the ranges
+	for size, want := range map[int]string{16: "  16: 1", 32: "  17-32: 1", 33: "  33-64: 1", 1000: "  513-1024: 1"} {
+		if got := bucketSizeReport([]int{size}); !strings.HasSuffix(got, "\n"+want) {
+			t.Fatalf("A bucket of %d reads reported as\n%s", size, got)
+		}
+	}
+}
+
+func TestDuplicateRuns(t *testing.T) {
+	setTestOptions(8)
+	bucketK = 8
+	dupRunsOption = true
+
+	// one bucket with mixed duplicates, one uniform bucket, one without
+	// duplicates
+	a := "ACGTACGT"
+	c := "CCCCGGGG"
+	g := "GGGGTTTT"
+	seqs := []string{
+		a + "AAAA", a + "AAAA", a + "AAAA", a + "CCCC", a + "GGGG", a + "GGGG", a + "TTTT",
+		c + "TTTT", c + "TTTT",
+		g + "AAAA", g + "CCCC",
+	}
+	reads := make([]*FastQ, len(seqs))
+	for i, s := range seqs {
+		reads[i] = &FastQ{Seq: []byte(s)}
+	}
+	buckets, counts, runs := listBuckets(readSlice(reads))
+	if fmt.Sprint(buckets) != fmt.Sprint([]string{a, c, g}) {
+		t.Fatalf("Buckets are %v", buckets)
+	}
+	if fmt.Sprint(counts) != "[7 -2 2]" {
+		t.Fatalf("Counts are %v", counts)
+	}
+	// the read after the last run is left off
+	if len(runs) != 1 || fmt.Sprint(runs[0]) != "[3 1 2]" {
+		t.Fatalf("Runs are %v", runs)
+	}
+
+	// duplicate some reads so that buckets have runs, and check that they
+	// round trip and save space
+	td := newTestData(t, 14, 500, 40)
+	defer td.Close()
+	rng := rand.New(rand.NewSource(14))
+	for i := 0; i < 200; i++ {
+		td.reads = append(td.reads, td.reads[rng.Intn(len(td.reads))])
+	}
+	writeTestReads(t, td.readFN, td.reads)
+
+	sizes := make(map[bool]int64)
+	for _, useRuns := range []bool{false, true} {
+		setTestOptions(8)
+		dupRunsOption = useRuns
+		out := td.path(fmt.Sprintf("runs%v", useRuns))
+		encodeArchive(td.refFile, td.readFN, out)
+		decodeArchive(td.refFile, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, td.reads) {
+			t.Fatalf("Decoded reads differ from the encoded reads with -runs=%v", useRuns)
+		}
+		if fileExists(out+".runs") != useRuns {
+			t.Fatalf("%s.runs exists = %v with -runs=%v", out, !useRuns, useRuns)
+		}
+		fi, err := os.Stat(out + ".enc")
+		if err != nil {
+			t.Fatalf("Couldn't stat %s.enc: %v", out, err)
+		}
+		sizes[useRuns] = fi.Size()
+	}
+	if sizes[true] >= sizes[false] {
+		t.Fatalf("Recording runs gave %d bytes, not fewer than %d", sizes[true], sizes[false])
+	}
+}
+
+func TestMemEncode(t *testing.T) {
+	// the in-memory reads give the same stream as the file, however they
+	// are read
+	r := &seqReader{seqs: [][]byte{[]byte("ACGT"), []byte(""), []byte("GG")}}
+	if b, err := ioutil.ReadAll(iotest.OneByteReader(r)); err != nil || string(b) != processedMagic+"\x04ACGT\x00\x02GG" {
+		t.Fatalf("seqReader gave %q, %v", b, err)
+	}
+
+	setTestOptions(8)
+	td := newTestData(t, 15, 500, 40)
+	defer td.Close()
+
+	// encode once through a temp file and once in memory
+	defer func(threshold int64) { memEncodeThreshold = threshold }(memEncodeThreshold)
+	memEncodeThreshold = 0
+	encodeArchive(td.refFile, td.readFN, td.path("temp"))
+	memEncodeOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("mem"))
+
+	// with no writable temp dir the reads stay in memory instead; a missing
+	// dir under a read-only one is unwritable even by root
+	memEncodeOption = false
+	readOnly := td.path("readonly")
+	DIE_ON_ERR(os.Mkdir(readOnly, 0555), "Couldn't create %s", readOnly)
+	defer func(tmp string) { os.Setenv("TMPDIR", tmp) }(os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", filepath.Join(readOnly, "missing"))
+	if f, err := ioutil.TempFile("", "kpath-test-"); err == nil {
+		f.Close()
+		os.Remove(f.Name())
+		t.Fatalf("Created a temp file in an unwritable dir")
+	}
+	encodeArchive(td.refFile, td.readFN, td.path("notemp"))
+
+	// the options recorded in .meta differ, but nothing else
+	read := func(fn string) ([]byte, error) {
+		if filepath.Ext(fn) == ".meta" {
+			return readGoldenFile(t, fn), nil
+		}
+		return ioutil.ReadFile(fn)
+	}
+	for _, ext := range []string{".enc", ".bittree", ".counts", ".flipped", ".ns", ".meta"} {
+		temp, err := read(td.path("temp" + ext))
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", "temp"+ext, err)
+		}
+		for _, name := range []string{"mem", "notemp"} {
+			mem, err := read(td.path(name + ext))
+			if err != nil {
+				t.Fatalf("Couldn't read %s: %v", name+ext, err)
+			}
+			if string(temp) != string(mem) {
+				t.Fatalf("%s differs between the temp file and %s encodes", ext, name)
+			}
+		}
+	}
+
+	decodeArchive(td.refFile, td.path("mem"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	setTestOptions(8)
+	bucketK = 8
+	entropyOption = true
+	updateReference = false
+	resetModelState()
+
+	// with an empty model every base is coded with the default interval,
+	// which starts at 2 for each base and counts the bases seen: A is 2/8,
+	// then C is 2/9, then C is 3/10, for log2(8/2 * 9/2 * 10/3) = log2(60)
+	var buf bytes.Buffer
+	w := bitio.NewWriter(&buf)
+	coder := arithc.NewEncoder(w)
+	encodeSingleReadWithBucket(coding, stringToKmer("AAAAAAAA"), "AAAAAAAAACC",
+		NewSmallKmerModel(8), coder)
+	before := coder.BitPosition()
+	coder.Finish()
+	w.Close()
+
+	if modelBases != 3 || math.Abs(modelBits-math.Log2(60)) > 1e-9 {
+		t.Fatalf("Entropy of %d bases is %v, not log2(60)", modelBases, modelBits)
+	}
+	// until it finishes, the coder commits to about as many bits as the
+	// entropy
+	if float64(before) > modelBits+2 {
+		t.Fatalf("Coder used %d bits for an entropy of %v bits", before, modelBits)
+	}
+	want := "Entropy: the model predicts 6 bits (1.9690 bits/base); " +
+		"the coder wrote 8 bits (2.6667 bits/base), 35.44% more"
+	if got := entropyReport(modelBits, modelBases, 8); got != want {
+		t.Fatalf("Report is %q, not %q", got, want)
+	}
+}
+
+func TestCoderStats(t *testing.T) {
+	setTestOptions(8)
+	bucketK = 8
+	resetModelState()
+	var buf bytes.Buffer
+	w := bitio.NewWriter(&buf)
+	coder := arithc.NewEncoder(w)
+	if got := coderStatsReport(coder.Stats()); got != "Coder: no symbols were encoded" {
+		t.Fatalf("Report for an empty encode is %q", got)
+	}
+
+	rng := rand.New(rand.NewSource(32))
+	r := randomSequence(rng, 100)
+	encodeSingleReadWithBucket(coding, stringToKmer(r[:8]), r, NewSmallKmerModel(8), coder)
+	coder.Finish()
+	w.Close()
+	s := coder.Stats()
+	if s.Symbols != 92 || s.Renormalizations == 0 {
+		t.Fatalf("Encoding a read gave stats %+v", s)
+	}
+	if got := coderStatsReport(s); !strings.HasPrefix(got, "Coder: 92 symbols, ") {
+		t.Fatalf("Report is %q", got)
+	}
+}
+
+func TestMultipleReadFiles(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 16, 500, 40)
+	defer td.Close()
+
+	// split the reads across two files, as if from two lanes
+	lane1, lane2 := td.path("lane1.fq"), td.path("lane2.fq")
+	writeTestReads(t, lane1, td.reads[:200])
+	writeTestReads(t, lane2, td.reads[200:])
+
+	encodeArchive(td.refFile, lane1+","+lane2, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the reads of both files")
+	}
+}
+
+func TestContextStats(t *testing.T) {
+	// with an empty model, the first base of AAAAAAAA+AAAA misses its
+	// context; with -update that creates the context, which the other three
+	// bases find
+	for _, update := range []bool{true, false} {
+		setTestOptions(8)
+		bucketK = 8
+		updateReference = update
+		resetModelState()
+		var buf bytes.Buffer
+		coder := arithc.NewEncoder(bitio.NewWriter(&buf))
+		encodeSingleReadWithBucket(coding, stringToKmer("AAAAAAAA"), "AAAAAAAAAAAA",
+			NewSmallKmerModel(8), coder)
+
+		want := contextStats{found: 3, missed: 1, created: 1}
+		if !update {
+			want = contextStats{missed: 4}
+		}
+		if contexts != want {
+			t.Fatalf("With -update=%v, stats are %+v, not %+v", update, contexts, want)
+		}
+	}
+	want := "Contexts: found for 3 bases (75.00%), missed for 1 (25.00%); 1 (25.00%) were created by -update"
+	if got := (contextStats{found: 3, missed: 1, created: 1}).String(); got != want {
+		t.Fatalf("Report is %q, not %q", got, want)
+	}
+}
+
+func TestMaxNs(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 17, 500, 40)
+	defer td.Close()
+
+	// give every tenth read 3 Ns, so it is dropped with -maxn=1
+	rng := rand.New(rand.NewSource(17))
+	reads := append([]string{}, td.reads...)
+	kept := make([]string, 0, len(reads))
+	dropped := make([]string, 0)
+	for i := range reads {
+		if i%10 == 0 {
+			r := []byte(reads[i])
+			for _, p := range rng.Perm(len(r))[:3] {
+				r[p] = 'N'
+			}
+			reads[i] = string(r)
+		}
+		if strings.Count(reads[i], "N") > 1 {
+			dropped = append(dropped, reads[i])
+		} else {
+			kept = append(kept, reads[i])
+		}
+	}
+	writeTestReads(t, td.readFN, reads)
+
+	maxNOption = 1
+	keepDroppedOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, kept) {
+		t.Fatalf("Decoded %d reads, not the %d with at most 1 N", len(got), len(kept))
+	}
+
+	f, err := os.Open(td.path("out.dropped"))
+	if err != nil {
+		t.Fatalf("Couldn't open dropped reads: %v", err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't read dropped reads: %v", err)
+	}
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatalf("Couldn't read dropped reads: %v", err)
+	}
+	if want := strings.Join(dropped, "\n") + "\n"; string(b) != want {
+		t.Fatalf("Dropped reads are\n%s\nnot\n%s", b, want)
+	}
+
+	// without -keepdropped the stale file goes away
+	keepDroppedOption = false
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	if fileExists(td.path("out.dropped")) {
+		t.Fatalf("Stale out.dropped was left behind")
+	}
+}
+
+func TestMalformedBitTree(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 19, 500, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	f, err := os.Open(td.path("out.bittree"))
+	if err != nil {
+		t.Fatalf("Couldn't open bittree: %v", err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't read bittree: %v", err)
+	}
+	tree, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatalf("Couldn't read bittree: %v", err)
+	}
+	gzipped := func(b []byte) io.Reader {
+		var buf bytes.Buffer
+		z := gzip.NewWriter(&buf)
+		z.Write(b)
+		z.Close()
+		return &buf
+	}
+
+	kmers, err := readKmers(gzipped(tree), 8)
+	if err != nil {
+		t.Fatalf("Couldn't decode an intact bittree: %v", err)
+	}
+	counts, _ := readBucketCounts(td.path("out.counts"))
+	if err := checkBucketCounts(kmers, counts); err != nil {
+		t.Fatalf("Intact bittree doesn't match its counts: %v", err)
+	}
+	if err := checkBucketCounts(kmers[1:], counts); err == nil {
+		t.Fatalf("Missing bucket was not noticed")
+	}
+
+	whole := gzipped(tree).(*bytes.Buffer).Bytes()
+	for _, c := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{"empty", bytes.NewReader(nil)},
+		{"empty tree", gzipped(nil)},
+		{"truncated", gzipped(tree[:len(tree)/2])},
+		{"truncated gzip", bytes.NewReader(whole[:len(whole)/2])},
+		{"trailing data", gzipped(append(append([]byte{}, tree...), 0xff))},
+	} {
+		if _, err := readKmers(c.r, 8); err == nil {
+			t.Fatalf("Decoding a %s bittree didn't fail", c.name)
+		}
+	}
+}
+
+// A slowWriter is a writer that takes its time over each write and records
+// the largest.
+type slowWriter struct {
+	bytes.Buffer
+	delay   time.Duration
+	largest int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	if len(p) > w.largest {
+		w.largest = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSlowTempWriter(t *testing.T) {
+	defer func(size int) { tempBufferSize = size }(tempBufferSize)
+	tempBufferSize = 64
+
+	reads := make([]*FastQ, 0)
+	want := processedMagic
+	seqs := ""
+	for _, s := range []string{"ACGT", "NNGG", "TTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTTT", "CA"} {
+		for i := 0; i < 20; i++ {
+			reads = append(reads, NewFastQ([]byte(s), nil))
+			seq := strings.Replace(s, "N", "A", -1)
+			want += string(rune(len(seq))) + seq
+			seqs += seq
+		}
+	}
+	slow := &slowWriter{delay: time.Millisecond}
+	var fast bytes.Buffer
+	md5Hash := md5.New()
+	if err := writeProcessedReads(readSlice(reads), md5Hash, nil, slow, &fast); err != nil {
+		t.Fatalf("Couldn't write the reads: %v", err)
+	}
+	if slow.String() != want || fast.String() != want {
+		t.Fatalf("Processed reads are %q and %q, not %q", slow.String(), fast.String(), want)
+	}
+	if slow.largest > tempBufferSize {
+		t.Fatalf("Wrote %d bytes at once with a %d byte buffer", slow.largest, tempBufferSize)
+	}
+	if got, want := md5Hash.Sum(nil), md5.Sum([]byte(seqs)); !bytes.Equal(got, want[:]) {
+		t.Fatalf("MD5 hash of the reads is %x, not %x", got, want)
+	}
+
+	// errors from the output are not lost
+	if err := writeProcessedReads(readSlice(reads), md5.New(), nil, failingWriter{}); err == nil {
+		t.Fatalf("Failed write was not reported")
+	}
+
+	// a tiny buffer still gives a working archive through the temp file
+	setTestOptions(8)
+	tempBufferSize = 16
+	td := newTestData(t, 20, 500, 40)
+	defer td.Close()
+	defer func(threshold int64) { memEncodeThreshold = threshold }(memEncodeThreshold)
+	memEncodeThreshold = 0
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+}
+
+// A failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("disk full")
+}
+
+func TestFlipK(t *testing.T) {
+	setTestOptions(8)
+
+	// the kmers of the set are those of length flipk, not k
+	ref := "ACGTTGCAAGGCTTAC"
+	ks := kmerSetFromReference(12, []string{ref})
+	for i := 0; i+12 < len(ref); i++ {
+		if !ks.Contains(stringToKmer(ref[i : i+12])) {
+			t.Fatalf("%s is missing from the set", ref[i:i+12])
+		}
+	}
+	if n := countMatchingObservations(ks, ref[:14]); n != 2*seenThreshold {
+		t.Fatalf("Found %d observations in the reference itself, not %d", n, 2*seenThreshold)
+	}
+
+	td := newTestData(t, 21, 500, 40)
+	defer td.Close()
+	for _, fk := range []int{4, 12} {
+		setTestOptions(8)
+		flipK = fk
+		out := td.path(fmt.Sprintf("flipk%d", fk))
+		encodeArchive(td.refFile, td.readFN, out)
+		if meta := loadArchiveMeta(out + ".meta"); meta.FlipK != fk {
+			t.Fatalf("Metadata records -flipk=%d, not %d", meta.FlipK, fk)
+		}
+
+		// decoding doesn't need -flipk
+		flipK = 0
+		decodeArchive(td.refFile, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, td.reads) {
+			t.Fatalf("Decoded reads differ from the encoded reads with -flipk=%d", fk)
+		}
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 22, 500, 40)
+	defer td.Close()
+
+	// give some reads lowercase bases, IUPAC codes and both kinds of N
+	rng := rand.New(rand.NewSource(22))
+	reads := append([]string{}, td.reads...)
+	for i := range reads {
+		r := []byte(reads[i])
+		switch i % 5 {
+		case 0:
+			p := rng.Intn(len(r) - 5)
+			copy(r[p:], strings.ToLower(string(r[p:p+5])))
+		case 1:
+			r[rng.Intn(len(r))] = "RYKMSWn"[rng.Intn(7)]
+			r[rng.Intn(len(r))] = 'N'
+		case 2:
+			r[0] = 'r'
+		}
+		reads[i] = string(r)
+	}
+	writeTestReads(t, td.readFN, reads)
+
+	exactCaseOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+
+	// without -exact, lowercase bases are uppercased but other bytes are
+	// still restored
+	exactCaseOption = false
+	encodeArchive(td.refFile, td.readFN, td.path("upper"))
+	decodeArchive(td.refFile, td.path("upper"), td.path("upper.fa"))
+	upper := make([]string, len(reads))
+	for i, r := range reads {
+		upper[i] = strings.ToUpper(r)
+	}
+	if got := readDecodedSeqs(t, td.path("upper.fa")); !sameReads(got, upper) {
+		t.Fatalf("Decoded reads differ from the uppercased reads")
+	}
+
+	// reads without exceptions leave no exceptions file
+	writeTestReads(t, td.readFN, td.reads)
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	if fileExists(td.path("out.exc")) {
+		t.Fatalf("Stale out.exc was left behind")
+	}
+}
+
+// BenchmarkForcedGC compares encoding with and without the forced garbage
+// collections between stages.
+func BenchmarkForcedGC(b *testing.B) {
+	td := newTestData(b, 23, 20000, 100)
+	defer td.Close()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, force := range []bool{true, false} {
+		b.Run(fmt.Sprintf("forcegc=%v", force), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				setTestOptions(12)
+				forceGCOption = force
+				encodeArchive(td.refFile, td.readFN, td.path("out"))
+			}
+		})
+	}
+}
+
+// BenchmarkReadSmallInput measures the memory allocated to read a small
+// read file, which should be proportional to the file and not to the largest
+// input kpath expects.
+func BenchmarkReadSmallInput(b *testing.B) {
+	td := newTestData(b, 23, 1000, 100)
+	defer td.Close()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	setTestOptions(12)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		readAndFlipReads(td.readFN, nil, nil, false)
+	}
+}
+
+// TestSmallInputAllocations checks that listing the buckets of a small set of
+// reads, and reading them back from its archive, allocates memory in
+// proportion to the reads rather than to the largest input kpath expects.
+func TestSmallInputAllocations(t *testing.T) {
+	setTestOptions(12)
+	td := newTestData(t, 23, 1000, 100)
+	defer td.Close()
+	exceptions := make([]string, len(td.reads))
+	for i, r := range td.reads {
+		exceptions[i] = "R" + r[1:]
+	}
+	writeTestReads(t, td.readFN, exceptions)
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	reads, _ := readAndFlipReads(td.readFN, nil, nil, false)
+	if !fileExists(td.path("out.flipped")) || !fileExists(td.path("out.exc")) {
+		t.Fatalf("The archive has no flipped bits or exceptions to read")
+	}
+
+	allocated := func(f func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	const limit = 4 << 20
+	if n := allocated(func() { listBuckets(readSlice(reads)) }); n > limit {
+		t.Fatalf("Listing the buckets of %d reads allocated %d bytes", len(reads), n)
+	}
+	if n := allocated(func() { readSegment(td.path("out"), 12, &archiveSegment{}) }); n > limit {
+		t.Fatalf("Reading a segment of %d reads allocated %d bytes", len(reads), n)
+	}
+}
+
+func TestSpacedSeed(t *testing.T) {
+	setTestOptions(8)
+	for _, bad := range []string{"1101", "11011x11", "110110111"} {
+		if err := setSeed(bad); err == nil {
+			t.Fatalf("Seed %q was accepted", bad)
+		}
+	}
+	if err := setSeed("11011011"); err != nil || seedContext(stringToKmer("CCCCCCCC")) != stringToKmer("CCACCACC") {
+		t.Fatalf("Seed 11011011 gives context %s (%v)",
+			kmerToString(seedContext(stringToKmer("CCCCCCCC")), 8), err)
+	}
+
+	td := newTestData(t, 26, 2000, 60)
+	defer td.Close()
+	sizes := make(map[string]int64)
+	for _, seed := range []string{"", "11011011"} {
+		setTestOptions(8)
+		seedOption = seed
+		out := td.path("seed" + seed)
+		encodeArchive(td.refFile, td.readFN, out)
+
+		// decoding takes the seed from the archive
+		seedOption = ""
+		decodeArchive(td.refFile, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, td.reads) {
+			t.Fatalf("Decoded reads differ from the encoded reads with -seed=%s", seed)
+		}
+		fi, err := os.Stat(out + ".enc")
+		if err != nil {
+			t.Fatalf("Couldn't stat %s: %v", out+".enc", err)
+		}
+		sizes[seed] = fi.Size()
+	}
+	t.Logf("Encoded tails: %d bytes with contiguous contexts, %d with seed 11011011",
+		sizes[""], sizes["11011011"])
+}
+
+func TestParseBucketCounts(t *testing.T) {
+	counts, readLen, err := parseBucketCounts(strings.NewReader("40 3 -2 1 "))
+	if err != nil || readLen != 40 || fmt.Sprint(counts) != "[3 -2 1]" {
+		t.Fatalf("Counts are %v, length %d (%v)", counts, readLen, err)
+	}
+	// a bad count is an error rather than the end of the counts, as is one
+	// too large for an int
+	for _, bad := range []string{"40 3 x 1", "40 3 99999999999999999999 1", ""} {
+		if counts, _, err := parseBucketCounts(strings.NewReader(bad)); err == nil {
+			t.Fatalf("Counts %q read as %v", bad, counts)
+		}
+	}
+}
+
+func TestIdenticalReads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("encodes 10 million reads")
+	}
+	setTestOptions(8)
+	td := newTestData(t, 37, 1, 30)
+	defer td.Close()
+
+	// a spike-in control: one read, 10 million times
+	const n = 10000000
+	read := td.reads[0]
+	f, err := os.Create(td.path("same.fq.gz"))
+	if err != nil {
+		t.Fatalf("Couldn't create reads: %v", err)
+	}
+	z, _ := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	rec := []byte(fmt.Sprintf("@r\n%s\n+\n%s\n", read, strings.Repeat("I", len(read))))
+	w := bufio.NewWriter(z)
+	for i := 0; i < n; i++ {
+		w.Write(rec)
+	}
+	w.Flush()
+	z.Close()
+	f.Close()
+
+	archive := td.path("same")
+	encodeArchive(td.refFile, td.path("same.fq.gz"), archive)
+	counts, _ := readBucketCounts(archive + ".counts")
+	if len(counts) != 1 || counts[0] != -n {
+		t.Fatalf("Counts are %v, not one uniform bucket of %d", counts, n)
+	}
+	size := int64(0)
+	for _, ext := range []string{".enc", ".bittree", ".counts", ".flipped", ".ns", ".meta"} {
+		fi, err := os.Stat(archive + ext)
+		if err != nil {
+			t.Fatalf("Couldn't stat %s: %v", archive+ext, err)
+		}
+		size += fi.Size()
+	}
+	if size > 32<<10 {
+		t.Fatalf("Archive of one read takes %d bytes", size)
+	}
+	t.Logf("%d identical reads take %d bytes", n, size)
+
+	ar := openArchive(td.refFile, archive)
+	defer ar.Close()
+	it := ar.Reads(newCodingState())
+	for s, ok := it.Next(); ok; s, ok = it.Next() {
+		if s != read {
+			t.Fatalf("Read %d decoded as %s, not %s", it.n-1, s, read)
+		}
+	}
+	if it.n != n || it.tails != 1 {
+		t.Fatalf("Decoded %d reads from %d tails, not %d from 1", it.n, it.tails, n)
+	}
+}
+
+func TestMinLength(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 27, 300, 40)
+	defer td.Close()
+
+	// mix in some adapter dimers; these are dropped, as is a read with too
+	// many Ns
+	reads := append([]string{}, td.reads...)
+	short := []string{"ACGTTG", "ACGTACGTACGTACGTACGTAC", "GATTACA"}
+	reads = append(reads, short...)
+	nheavy := strings.Repeat("N", 3) + td.reads[0][3:]
+	reads = append(reads, nheavy)
+	writeTestReads(t, td.readFN, reads)
+
+	minLenOption = 40
+	maxNOption = 2
+	keepDroppedOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the reads of full length")
+	}
+
+	f, err := os.Open(td.path("out.dropped"))
+	if err != nil {
+		t.Fatalf("Couldn't open dropped reads: %v", err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't read dropped reads: %v", err)
+	}
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatalf("Couldn't read dropped reads: %v", err)
+	}
+	if want := strings.Join(append(short, nheavy), "\n") + "\n"; string(b) != want {
+		t.Fatalf("Dropped reads are\n%s\nnot\n%s", b, want)
+	}
+
+	// without the filter, the short reads are an error
+	rs := []*FastQ{NewFastQ([]byte("ACGT"), nil), NewFastQ([]byte("ACGT"), nil), NewFastQ([]byte("ACG"), nil)}
+	if err := checkReadLengths(rs, 4, 0); err == nil || !strings.Contains(err.Error(), "read 3 has length 3") {
+		t.Fatalf("Reads of different lengths not noticed: %v", err)
+	}
+}
+
+func TestOddFirstRead(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 29, 300, 40)
+	defer td.Close()
+
+	// the length is the most common one, even when an adapter dimer comes
+	// first (and, being all As, sorts first too)
+	if l := modalReadLength(map[int]int{12: 1, 40: 299}); l != 40 {
+		t.Fatalf("Read length is %d, not 40", l)
+	}
+	if l := modalReadLength(map[int]int{36: 5, 40: 5}); l != 40 {
+		t.Fatalf("Read length of a tie is %d, not the longer 40", l)
+	}
+	rs := []*FastQ{NewFastQ([]byte("ACG"), nil), NewFastQ([]byte("ACGT"), nil), NewFastQ([]byte("ACGT"), nil)}
+	if err := checkReadLengths(rs, 4, 0); err == nil || !strings.Contains(err.Error(), "read 1 has length 3") {
+		t.Fatalf("Odd first read not blamed: %v", err)
+	}
+
+	dimer := "AAAAAAAAAAAA"
+	writeTestReads(t, td.readFN, append([]string{dimer}, td.reads...))
+	dropOddOption = true
+	keepDroppedOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the reads of the most common length")
+	}
+	if b := readGoldenFile(t, td.path("out.dropped")); string(b) != dimer+"\n" {
+		t.Fatalf("Dropped reads are %q, not the dimer", b)
+	}
+}
+
+func TestNLocationFormats(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 28, 1000, 100)
+	defer td.Close()
+
+	// give many reads clusters of Ns, as from a bad cycle or a bad tile
+	rng := rand.New(rand.NewSource(28))
+	reads := append([]string{}, td.reads...)
+	for i := range reads {
+		if rng.Intn(3) == 0 {
+			r := []byte(reads[i])
+			p := rng.Intn(len(r) - 10)
+			for j := 0; j < 1+rng.Intn(10); j++ {
+				r[p+j] = 'N'
+			}
+			reads[i] = string(r)
+		}
+	}
+	writeTestReads(t, td.readFN, reads)
+
+	sizes := make(map[string]int64)
+	for _, format := range []string{"text", "varint"} {
+		setTestOptions(8)
+		nsFormatOption = format
+		out := td.path(format)
+		encodeArchive(td.refFile, td.readFN, out)
+
+		// decoding reads either format
+		nsFormatOption = "text"
+		decodeArchive(td.refFile, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, reads) {
+			t.Fatalf("Decoded reads differ from the encoded reads with -nsformat=%s", format)
+		}
+		fi, err := os.Stat(out + ".ns")
+		if err != nil {
+			t.Fatalf("Couldn't stat %s: %v", out+".ns", err)
+		}
+		sizes[format] = fi.Size()
+	}
+	t.Logf("N locations: %d bytes as text, %d as varints", sizes["text"], sizes["varint"])
+
+	// the two formats give the same locations, and a bad varint file is an
+	// error
+	text, varint := readNLocations(td.path("text.ns")), readNLocations(td.path("varint.ns"))
+	if len(text) != len(varint) {
+		t.Fatalf("Read %d reads' N locations as text but %d as varints", len(text), len(varint))
+	}
+	for i := range text {
+		a := append([]byte{}, text[i]...)
+		sort.Slice(a, func(x, y int) bool { return a[x] < a[y] })
+		if !bytes.Equal(a, varint[i]) {
+			t.Fatalf("Read %d has Ns at %v as text but %v as varints", i, text[i], varint[i])
+		}
+	}
+	for _, bad := range [][]byte{{nsVarintVersion, 2, 5}, {nsVarintVersion, 1, 0x80}, {nsVarintVersion, 2, 200, 100}} {
+		if locs, err := readNLocationsVarint(bufio.NewReader(bytes.NewReader(bad))); err == nil {
+			t.Fatalf("Bad varint N locations %v read as %v", bad, locs)
+		}
+	}
+}
+
+func TestNEndRuns(t *testing.T) {
+	interior, runs := splitNEndRuns([]int{99, 0, 98, 1, 50, 97}, 100)
+	if fmt.Sprint(interior, runs) != "[50] [[0 2] [97 3]]" {
+		t.Fatalf("Split Ns into %v and %v", interior, runs)
+	}
+	interior, runs = splitNEndRuns([]int{0, 1, 2, 3}, 4)
+	if fmt.Sprint(interior, runs) != "[] [[0 4]]" {
+		t.Fatalf("Split a read of Ns into %v and %v", interior, runs)
+	}
+
+	setTestOptions(8)
+	td := newTestData(t, 30, 300, 100)
+	defer td.Close()
+
+	// mask the last 20 bases of many reads, and give them an interior N
+	reads := append([]string{}, td.reads...)
+	for i := 0; i < len(reads); i += 3 {
+		reads[i] = reads[i][:40] + "N" + reads[i][41:80] + strings.Repeat("N", 20)
+	}
+	writeTestReads(t, td.readFN, reads)
+
+	for _, format := range []string{"text", "varint"} {
+		setTestOptions(8)
+		nsFormatOption = format
+		out := td.path(format)
+		encodeArchive(td.refFile, td.readFN, out)
+		decodeArchive(td.refFile, out, out+".fa")
+		if got := readDecodedSeqs(t, out+".fa"); !sameReads(got, reads) {
+			t.Fatalf("Decoded reads differ from the encoded reads with -nsformat=%s", format)
+		}
+	}
+
+	// the runs are written as runs, at the end of a read that was not
+	// flipped and at the start of one that was
+	f, err := os.Open(td.path("text.ns"))
+	if err != nil {
+		t.Fatalf("Couldn't open N locations: %v", err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Couldn't read N locations: %v", err)
+	}
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatalf("Couldn't read N locations: %v", err)
+	}
+	if !strings.Contains(string(b), "40 80+20\n") || !strings.Contains(string(b), "59 0+20\n") {
+		t.Fatalf("End runs not found in N locations:\n%s", b)
+	}
+}
+
+func TestStreamedNLocations(t *testing.T) {
+	setTestOptions(8)
+	dir, err := ioutil.TempDir("", "kpath-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// testdata/ns holds reads with scattered Ns and end runs, and the .ns
+	// files the batch writer wrote for them before the Ns were streamed
+	fixture := filepath.Join("testdata", "ns")
+	reads := make([]*FastQ, 0)
+	for _, r := range readTestReads(t, filepath.Join(fixture, "reads.fq")) {
+		reads = append(reads, NewFastQ([]byte(r), nil))
+	}
+
+	for _, format := range []string{"text", "varint"} {
+		nsFormatOption = format
+		fn := filepath.Join(dir, format+".ns")
+		f, err := os.Create(fn)
+		if err != nil {
+			t.Fatalf("Couldn't create %s: %v", fn, err)
+		}
+		z := gzip.NewWriter(f)
+		if err := writeProcessedReads(readSlice(reads), md5.New(), newNLocationWriter(z), ioutil.Discard); err != nil {
+			t.Fatalf("Couldn't write the processed reads: %v", err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatalf("Couldn't close %s: %v", fn, err)
+		}
+		f.Close()
+
+		got := readGoldenFile(t, fn)
+		want, err := ioutil.ReadFile(filepath.Join(fixture, format+".ns"))
+		if err != nil {
+			t.Fatalf("Couldn't read the fixture: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Streamed N locations differ from the batch writer's with -nsformat=%s", format)
+		}
+
+		locs := readNLocations(fn)
+		if len(locs) != len(reads) {
+			t.Fatalf("Read %d reads' N locations, not %d", len(locs), len(reads))
+		}
+		for i, fq := range reads {
+			want := append([]byte{}, fq.NLocations...)
+			got := append([]byte{}, locs[i]...)
+			sort.Slice(want, func(x, y int) bool { return want[x] < want[y] })
+			sort.Slice(got, func(x, y int) bool { return got[x] < got[y] })
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Read %d has Ns at %v, not %v, with -nsformat=%s", i, got, want, format)
+			}
+		}
+	}
+	nsFormatOption = "text"
+}
+
+func TestLowComplexity(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 29, 300, 40)
+	defer td.Close()
+	lowComplexOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("plain"))
+	if fileExists(td.path("plain.homo")) {
+		t.Fatalf("Wrote plain.homo for reads without homopolymers")
+	}
+
+	// add polyG reads, some with Ns, and a polyA read
+	polyG := strings.Repeat("G", 40)
+	reads := append([]string{}, td.reads...)
+	for i := 0; i < 20; i++ {
+		reads = append(reads, polyG)
+	}
+	reads = append(reads, "N"+polyG[1:], polyG[:10]+"NN"+polyG[12:], strings.Repeat("A", 40))
+	writeTestReads(t, td.readFN, reads)
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+
+	// the homopolymers cost nothing in the coded tails
+	plain, err := os.Stat(td.path("plain.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't stat plain.enc: %v", err)
+	}
+	out, err := os.Stat(td.path("out.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't stat out.enc: %v", err)
+	}
+	if out.Size() != plain.Size() {
+		t.Fatalf("Homopolymers changed the tails from %d to %d bytes", plain.Size(), out.Size())
+	}
+	if !fileExists(td.path("out.homo")) {
+		t.Fatalf("No out.homo written")
+	}
+
+	// the homopolymer tails are numbered the same when identical reads are
+	// coded one by one, or in runs
+	for _, runs := range []bool{false, true} {
+		dupsOption = false
+		dupRunsOption = runs
+		encodeArchive(td.refFile, td.readFN, td.path("out"))
+		decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+		if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, reads) {
+			t.Fatalf("Decoded reads differ from the encoded reads with -dups=false -runs=%v", runs)
+		}
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 31, 100, 40)
+	defer td.Close()
+
+	// two samples of a genome that differs from the reference by many
+	// mutations, which the model has to learn from the reads
+	ref, err := os.Open(td.refFile)
+	if err != nil {
+		t.Fatalf("Couldn't open reference: %v", err)
+	}
+	z, err := gzip.NewReader(ref)
+	if err != nil {
+		t.Fatalf("Couldn't read reference: %v", err)
+	}
+	seqs, err := parseReference(z)
+	ref.Close()
+	if err != nil {
+		t.Fatalf("Couldn't parse reference: %v", err)
+	}
+	rng := rand.New(rand.NewSource(31))
+	genome := make([]string, len(seqs))
+	for i, s := range seqs {
+		g := []byte(s)
+		for j := range g {
+			if rng.Intn(10) == 0 {
+				g[j] = ALPHA[rng.Intn(len(ALPHA))]
+			}
+		}
+		genome[i] = string(g)
+	}
+	sample1, sample2 := td.path("sample1.fq"), td.path("sample2.fq")
+	writeTestReads(t, sample1, sampleReads(rng, genome, 2000, 40, 0.01))
+	reads2 := sampleReads(rng, genome, 2000, 40, 0.01)
+	writeTestReads(t, sample2, reads2)
+
+	// the model after encoding the first sample is the dictionary
+	saveModelOption = td.path("dict.model")
+	encodeArchive(td.refFile, sample1, td.path("first"))
+	saveModelOption = ""
+
+	encodeArchive(td.refFile, sample2, td.path("plain"))
+	dictionaryOption = td.path("dict.model")
+	encodeArchive(td.refFile, sample2, td.path("dict"))
+	decodeArchive(td.refFile, td.path("dict"), td.path("dict.fa"))
+	if got := readDecodedSeqs(t, td.path("dict.fa")); !sameReads(got, reads2) {
+		t.Fatalf("Decoded reads differ from the encoded reads with a dictionary")
+	}
+
+	plain, err := os.Stat(td.path("plain.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't stat plain.enc: %v", err)
+	}
+	dict, err := os.Stat(td.path("dict.enc"))
+	if err != nil {
+		t.Fatalf("Couldn't stat dict.enc: %v", err)
+	}
+	t.Logf("Second sample: %d bytes without a dictionary, %d with", plain.Size(), dict.Size())
+	if dict.Size() >= plain.Size() {
+		t.Fatalf("The dictionary didn't help: %d bytes with it, %d without", dict.Size(), plain.Size())
+	}
+
+	// the decoder needs the same dictionary, and only if there was one
+	meta := loadArchiveMeta(td.path("dict.meta"))
+	if err := archiveDictionary(meta, ""); err == nil {
+		t.Fatalf("Decoding without the dictionary not noticed")
+	}
+	if err := archiveDictionary(meta, td.path("first.bittree")); err == nil {
+		t.Fatalf("Decoding with a different dictionary not noticed")
+	}
+	if err := archiveDictionary(loadArchiveMeta(td.path("plain.meta")), td.path("dict.model")); err == nil {
+		t.Fatalf("Decoding with a dictionary the archive wasn't encoded with not noticed")
+	}
+}
+
+// md5FromLog() returns the hash from the last "MD5 hash of reads" line in
+// the log output.
+func md5FromLog(t *testing.T, out string) string {
+	i := strings.LastIndex(out, "MD5 hash of reads = ")
+	if i < 0 {
+		t.Fatalf("No MD5 hash was logged")
+	}
+	return strings.Fields(out[i+len("MD5 hash of reads = "):])[0]
+}
+
+func TestDecodeNoWrite(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 27, 500, 50)
+	defer td.Close()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	want := md5FromLog(t, logged.String())
+
+	noWriteOption = true
+	logged.Reset()
+	decodeArchive(td.refFile, td.path("out"), td.path("out.seq"))
+	if got := md5FromLog(t, logged.String()); got != want {
+		t.Fatalf("Decoding with -nowrite hashed the reads to %s, not %s", got, want)
+	}
+	if fileExists(td.path("out.seq")) {
+		t.Fatalf("Decoding with -nowrite wrote the reads")
+	}
+
+	// -out can be left out with -nowrite
+	logged.Reset()
+	decodeArchive(td.refFile, td.path("out"), "")
+	if got := md5FromLog(t, logged.String()); got != want {
+		t.Fatalf("Decoding with -nowrite and no -out hashed the reads to %s, not %s", got, want)
+	}
+
+	noWriteOption = false
+	logged.Reset()
+	decodeArchive(td.refFile, td.path("out"), os.DevNull)
+	if got := md5FromLog(t, logged.String()); got != want {
+		t.Fatalf("Decoding to %s hashed the reads to %s, not %s", os.DevNull, got, want)
+	}
+}
+
+func TestProcessedReads(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	reads := make([]*FastQ, 0)
+	for _, n := range []int{0, 1, 40, 127, 128, 300, 1000, 0, 5} {
+		reads = append(reads, NewFastQ([]byte(randomSequence(rng, n)), nil))
+	}
+	var buf bytes.Buffer
+	if err := writeProcessedReads(readSlice(reads), md5.New(), nil, &buf); err != nil {
+		t.Fatalf("Couldn't write the reads: %v", err)
+	}
+	whole := buf.Bytes()
+
+	r := newProcessedReader(iotest.OneByteReader(bytes.NewReader(whole)))
+	for i, fq := range reads {
+		if s, err := r.Next(); err != nil || s != string(fq.Seq) {
+			t.Fatalf("Read %d is %q, %v, not %q", i, s, err, fq.Seq)
+		}
+	}
+	if s, err := r.Next(); err != io.EOF {
+		t.Fatalf("Got %q, %v after the last read, not EOF", s, err)
+	}
+
+	// a stream cut off in the middle of a read is an error, not a short read
+	r = newProcessedReader(bytes.NewReader(whole[:len(whole)-3]))
+	var err error
+	for err == nil {
+		_, err = r.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Truncated stream gave %v, not %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// .sorted files from before the magic have one read per line
+	r = newProcessedReader(strings.NewReader("ACGT\n\nGG\n"))
+	for _, want := range []string{"ACGT", "", "GG"} {
+		if s, err := r.Next(); err != nil || s != want {
+			t.Fatalf("Old read is %q, %v, not %q", s, err, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Got %v after the last old read, not EOF", err)
+	}
+}
+
+func TestAtomicDecodeOutput(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 28, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	// a decode that fails partway leaves neither the output nor the
+	// temporary file behind
+	outFN := td.path("out.seq")
+	outF := createDecodeOutput(outFN)
+	if _, ok := outF.(*atomicFile); !ok {
+		t.Fatalf("Decode output is a %T, not an *atomicFile", outF)
+	}
+	fmt.Fprintf(outF, ">R0\nACGTACGT\n>R1\nAC")
+	outF.Close()
+	if fileExists(outFN) {
+		t.Fatalf("Failed decode left %s behind", outFN)
+	}
+	if tmp, _ := filepath.Glob(td.path(".out.seq.tmp*")); len(tmp) != 0 {
+		t.Fatalf("Failed decode left temporary files %v behind", tmp)
+	}
+
+	// ... and doesn't touch an existing output
+	DIE_ON_ERR(ioutil.WriteFile(outFN, []byte("old\n"), 0644), "Couldn't write %s", outFN)
+	outF = createDecodeOutput(outFN)
+	fmt.Fprintf(outF, ">R0\nAC")
+	outF.Close()
+	if b, err := ioutil.ReadFile(outFN); err != nil || string(b) != "old\n" {
+		t.Fatalf("Failed decode changed %s to %q, %v", outFN, b, err)
+	}
+
+	// a decode that succeeds replaces it
+	decodeArchive(td.refFile, td.path("out"), outFN)
+	if got := readDecodedSeqs(t, outFN); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads don't match the input")
+	}
+	if fi, err := os.Stat(outFN); err != nil || fi.Mode().Perm() != 0644 {
+		t.Fatalf("Decoded reads have mode %v, %v", fi.Mode(), err)
+	}
+	if tmp, _ := filepath.Glob(td.path(".out.seq.tmp*")); len(tmp) != 0 {
+		t.Fatalf("Decode left temporary files %v behind", tmp)
+	}
+
+	// without -atomic the output is written in place
+	atomicOption = false
+	outF = createDecodeOutput(outFN)
+	if _, ok := outF.(*atomicFile); ok {
+		t.Fatalf("Decode output is an *atomicFile with -atomic=false")
+	}
+	outF.Close()
+}
+
+// TestAtomicDecodeOutputOnDie decodes a corrupted archive in a child process,
+// which dies part way through the decode, and checks that the temporary
+// output file is removed even though the deferred Close() never runs.
+func TestAtomicDecodeOutputOnDie(t *testing.T) {
+	if dir := os.Getenv("KPATH_TEST_DIE_DIR"); dir != "" {
+		setTestOptions(8)
+		decodeArchive(filepath.Join(dir, "ref.fa.gz"), filepath.Join(dir, "out"), filepath.Join(dir, "out.seq"))
+		return
+	}
+
+	setTestOptions(8)
+	td := newTestData(t, 28, 3000, 60)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	enc, err := ioutil.ReadFile(td.path("out.enc"))
+	if err != nil || len(enc) < 1000 {
+		t.Fatalf("Couldn't read out.enc (%d bytes): %v", len(enc), err)
+	}
+	for i := 500; i < 900; i++ {
+		enc[i] ^= 0x5a
+	}
+	DIE_ON_ERR(ioutil.WriteFile(td.path("out.enc"), enc, 0644), "Couldn't write out.enc")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAtomicDecodeOutputOnDie$")
+	cmd.Env = append(os.Environ(), "KPATH_TEST_DIE_DIR="+td.dir)
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("Decoding the corrupted archive didn't fail:\n%s", out)
+	}
+	if fileExists(td.path("out.seq")) {
+		t.Fatalf("Failed decode left out.seq behind")
+	}
+	if tmp, _ := filepath.Glob(td.path(".out.seq.tmp*")); len(tmp) != 0 {
+		t.Fatalf("Failed decode left temporary files %v behind", tmp)
+	}
+}
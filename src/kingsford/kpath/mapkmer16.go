@@ -1,5 +1,7 @@
 package main
 
+import "sort"
+
 type FullMapKmerModel map[Kmer][len(ALPHA)]KmerCount
 
 func NewFullMapKmerModel(order uint) *FullMapKmerModel {
@@ -11,8 +13,9 @@ func (km *FullMapKmerModel) NextCount(k Kmer, c byte) KmerCount {
     return (*km)[k][c]
 }
 
-func (km *FullMapKmerModel) Distribution(k Kmer) [len(ALPHA)]KmerCount {
-    return (*km)[k]
+func (km *FullMapKmerModel) Distribution(k Kmer) (bool, [len(ALPHA)]KmerCount) {
+    d, ok := (*km)[k]
+    return ok, d
 }
 
 // check if the kmer is in the map
@@ -30,8 +33,18 @@ func (km *FullMapKmerModel) SetCount(k Kmer, c, v byte) {
 
 func (km *FullMapKmerModel) Increment(k Kmer, c, by byte) {
     entry := (*km)[k]
-    if uint64(entry[c]) + uint64(by) < MAX_OBSERVATION { 
-        entry[c] += KmerCount(by)
-        (*km)[k] = entry
+    entry[c] = saturatingAdd(entry[c], by)
+    (*km)[k] = entry
+}
+
+// call f for every kmer that exists in the model, in increasing kmer order
+func (km *FullMapKmerModel) Iterate(f func(k Kmer, dist [len(ALPHA)]KmerCount)) {
+    keys := make([]Kmer, 0, len(*km))
+    for k := range *km {
+        keys = append(keys, k)
+    }
+    sort.Sort(kmerSlice(keys))
+    for _, k := range keys {
+        f(k, (*km)[k])
     }
 }
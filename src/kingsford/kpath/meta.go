@@ -0,0 +1,548 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// archiveFormat is the format of the archives this kpath writes, as far as
+// rebuilding their model from the reference goes. Archives without a format
+// (format 1) were encoded with a model that left out the last sequence of the
+// reference, and with a fingerprint of the reference file rather than of its
+// sequences, so rebuilding the model from -ref would silently decode the
+// wrong reads.
+const archiveFormat = 2
+
+// An ArchiveMeta records the facts about an encode that the decoder needs to
+// check before it can trust its own options. It is written to OUT.meta as
+// lines of "key value".
+type ArchiveMeta struct {
+	Format   int    // see archiveFormat; 0 in archives that predate it
+	K        int    // the kmer size used to encode
+	BucketK  int    // the length of the bucket prefixes
+	FlipK    int    // the kmer size used to decide which reads to flip; 0 means K
+	Seed     string // the spaced seed of the model contexts; "" means contiguous
+	RefIUPAC string // how IUPAC codes in the reference seeded the model; "" means expand
+	RefSize  int64  // the number of bases in the reference (0 if none)
+	RefMD5   string // hex md5 of the reference sequences ("" if none)
+	DictMD5  string // hex md5 of the dictionary model file ("" if none)
+
+	// the order the buckets were coded in (see walkBucketOrder()); "" means
+	// the sorted order of their prefixes
+	BucketOrder string
+
+	// the -adaptivepseudo the tails were coded with; 0 means a fixed
+	// pseudocount
+	AdaptivePseudo int
+
+	// the -backoff and -backoffmin the tails were coded with; "" means the
+	// coder never backed off to a shorter context
+	Backoff    string
+	BackoffMin int
+
+	// the number of segments (batches of reads encoded separately); 0 in
+	// archives that predate appending, which have a single segment
+	Segments int
+
+	// the extensions of the optional files written for each segment (such
+	// as .flipped and .ns); segments not listed predate the list
+	Sidecars map[int][]string
+
+	// the number of reads encoded in each segment, which decode checks that
+	// it wrote; segments not listed predate recording it
+	Reads map[int]int
+
+	// where the archive came from, for reproducing it and for making sense
+	// of reports about it: the kpath version and command line that encoded
+	// it, the kind of model ("array" or "map") and the options that were
+	// not at their defaults. None of these are needed to decode.
+	Version string
+	Command string
+	Model   string
+	Options map[string]string
+}
+
+// referenceFingerprint() returns the number of bases and the md5 hash of the
+// sequences of the gzipped fasta file, as readReferenceFile() reads them, so
+// that the same reference gzipped again, as bgzf, or with its lines wrapped
+// differently has the same fingerprint.
+func referenceFingerprint(filename string) (int64, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, "", err
+	}
+	defer z.Close()
+	seqs, err := parseReference(z)
+	if err != nil {
+		return 0, "", err
+	}
+	n, hash := sequenceFingerprint(seqs)
+	return n, hash, nil
+}
+
+// sequenceFingerprint() returns the number of bases and the md5 hash of the
+// reference sequences; each sequence ends with a newline in the hash, so
+// that moving a base from one sequence to the next changes it.
+func sequenceFingerprint(seqs []string) (int64, string) {
+	h := md5.New()
+	n := int64(0)
+	for _, s := range seqs {
+		io.WriteString(h, s)
+		io.WriteString(h, "\n")
+		n += int64(len(s))
+	}
+	return n, fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// fileFingerprint() returns the size and md5 hash of the given file.
+func fileFingerprint(filename string) (int64, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// newArchiveMeta() creates the metadata for an archive encoded with the
+// reference sequences refSeqs (which may be nil if there is no reference).
+func newArchiveMeta(refSeqs []string, k int) *ArchiveMeta {
+	meta := &ArchiveMeta{Format: archiveFormat, K: k, Segments: 1}
+	if refSeqs != nil {
+		meta.RefSize, meta.RefMD5 = sequenceFingerprint(refSeqs)
+	}
+	return meta
+}
+
+// recordProvenance() records the kpath version, the command line and the
+// options that differ from their defaults in the metadata.
+func recordProvenance(meta *ArchiveMeta, args []string, flags *flag.FlagSet) {
+	meta.Version = kpathVersion
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = quoteMetaValue(a)
+	}
+	meta.Command = strings.Join(quoted, " ")
+	meta.Model = "map"
+	if useArrayModel {
+		meta.Model = "array"
+	}
+	meta.Options = make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); v != f.DefValue {
+			meta.Options[f.Name] = v
+		}
+	})
+}
+
+// quoteMetaValue() quotes s as a Go string if it has spaces, quotes or
+// control characters, so that it fits on one line of the metadata and can
+// be told apart from its neighbours.
+func quoteMetaValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '"' }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// unquoteMetaValue() undoes quoteMetaValue().
+func unquoteMetaValue(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
+// versionWarning() returns a warning if the archive was encoded by another
+// version of kpath, or "" if it wasn't (or predates recording the version).
+func versionWarning(meta *ArchiveMeta) string {
+	if meta.Version == "" || meta.Version == kpathVersion {
+		return ""
+	}
+	return fmt.Sprintf("Warning: the archive was encoded by kpath version %s, not this "+
+		"version (%s), with: %s", meta.Version, kpathVersion, meta.Command)
+}
+
+// writeArchiveMeta() writes the metadata to w.
+func writeArchiveMeta(w io.Writer, meta *ArchiveMeta) error {
+	_, err := fmt.Fprintf(w, "format %d\nk %d\nbucketk %d\nrefsize %d\nrefmd5 %s\nsegments %d\n",
+		meta.Format, meta.K, meta.BucketK, meta.RefSize, meta.RefMD5, meta.Segments)
+	if err == nil && meta.FlipK > 0 {
+		_, err = fmt.Fprintf(w, "flipk %d\n", meta.FlipK)
+	}
+	if err == nil && meta.Seed != "" {
+		_, err = fmt.Fprintf(w, "seed %s\n", meta.Seed)
+	}
+	if err == nil && meta.DictMD5 != "" {
+		_, err = fmt.Fprintf(w, "dictmd5 %s\n", meta.DictMD5)
+	}
+	if err == nil && meta.RefIUPAC != "" {
+		_, err = fmt.Fprintf(w, "refiupac %s\n", meta.RefIUPAC)
+	}
+	if err == nil && meta.BucketOrder != "" {
+		_, err = fmt.Fprintf(w, "bucketorder %s\n", meta.BucketOrder)
+	}
+	if err == nil && meta.AdaptivePseudo > 0 {
+		_, err = fmt.Fprintf(w, "adaptivepseudo %d\n", meta.AdaptivePseudo)
+	}
+	if err == nil && meta.Backoff != "" {
+		_, err = fmt.Fprintf(w, "backoff %s\nbackoffmin %d\n", meta.Backoff, meta.BackoffMin)
+	}
+	if err == nil && meta.Version != "" {
+		_, err = fmt.Fprintf(w, "version %s\ncommand %s\nmodel %s\n", meta.Version, meta.Command, meta.Model)
+	}
+	names := make([]string, 0, len(meta.Options))
+	for name := range meta.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "option %s %s\n", name, quoteMetaValue(meta.Options[name]))
+		}
+	}
+	segs := make([]int, 0, len(meta.Sidecars))
+	for seg := range meta.Sidecars {
+		segs = append(segs, seg)
+	}
+	sort.Ints(segs)
+	for _, seg := range segs {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "sidecars %s\n",
+				strings.Join(append([]string{strconv.Itoa(seg)}, meta.Sidecars[seg]...), " "))
+		}
+	}
+	segs = segs[:0]
+	for seg := range meta.Reads {
+		segs = append(segs, seg)
+	}
+	sort.Ints(segs)
+	for _, seg := range segs {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "reads %d %d\n", seg, meta.Reads[seg])
+		}
+	}
+	return err
+}
+
+// flipKFor() returns the kmer size used to decide which reads of the archive
+// with the given metadata to flip.
+func flipKFor(meta *ArchiveMeta) int {
+	if meta.FlipK > 0 {
+		return meta.FlipK
+	}
+	return meta.K
+}
+
+// iupacFor() returns how IUPAC codes in the reference seeded the model of
+// the archive with the given metadata (see resolveIUPAC()).
+func iupacFor(meta *ArchiveMeta) string {
+	if meta.RefIUPAC != "" {
+		return meta.RefIUPAC
+	}
+	return "expand"
+}
+
+// readArchiveMeta() parses metadata written by writeArchiveMeta(). Unknown keys
+// are ignored.
+func readArchiveMeta(r io.Reader) (*ArchiveMeta, error) {
+	meta := &ArchiveMeta{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields[0]) == 0 {
+			continue
+		}
+		val := ""
+		if len(fields) > 1 {
+			val = fields[1]
+		}
+
+		var err error
+		switch fields[0] {
+		case "format":
+			meta.Format, err = strconv.Atoi(val)
+		case "k":
+			meta.K, err = strconv.Atoi(val)
+		case "bucketk":
+			meta.BucketK, err = strconv.Atoi(val)
+		case "refsize":
+			meta.RefSize, err = strconv.ParseInt(val, 10, 64)
+		case "refmd5":
+			meta.RefMD5 = val
+		case "segments":
+			meta.Segments, err = strconv.Atoi(val)
+		case "flipk":
+			meta.FlipK, err = strconv.Atoi(val)
+		case "seed":
+			meta.Seed = val
+		case "dictmd5":
+			meta.DictMD5 = val
+		case "refiupac":
+			meta.RefIUPAC = val
+			err = checkIUPACMode(val)
+		case "bucketorder":
+			meta.BucketOrder = val
+			err = checkBucketOrder(val)
+		case "adaptivepseudo":
+			meta.AdaptivePseudo, err = strconv.Atoi(val)
+		case "backoff":
+			meta.Backoff = val
+		case "backoffmin":
+			meta.BackoffMin, err = strconv.Atoi(val)
+		case "version":
+			meta.Version = val
+		case "command":
+			meta.Command = val
+		case "model":
+			meta.Model = val
+		case "option":
+			nv := strings.SplitN(val, " ", 2)
+			if meta.Options == nil {
+				meta.Options = make(map[string]string)
+			}
+			if len(nv) == 1 {
+				err = fmt.Errorf("no value given for %s", nv[0])
+			} else {
+				meta.Options[nv[0]], err = unquoteMetaValue(nv[1])
+			}
+		case "sidecars":
+			exts := strings.Fields(val)
+			var seg int
+			if len(exts) == 0 {
+				err = fmt.Errorf("no segment given")
+			} else if seg, err = strconv.Atoi(exts[0]); err == nil {
+				if meta.Sidecars == nil {
+					meta.Sidecars = make(map[int][]string)
+				}
+				meta.Sidecars[seg] = exts[1:]
+			}
+		case "reads":
+			var seg, n int
+			if _, err = fmt.Sscanf(val, "%d %d", &seg, &n); err == nil {
+				if meta.Reads == nil {
+					meta.Reads = make(map[int]int)
+				}
+				meta.Reads[seg] = n
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %v", fields[0], err)
+		}
+	}
+	return meta, scanner.Err()
+}
+
+// checkSidecars() returns an error if any of the optional files that the
+// metadata lists for segment seg, with basename base, is missing. If partial
+// is set, a missing .flipped, .ns, .gc, .order or .pos file is allowed, since
+// the reads can be decoded without them (but not in their original
+// orientation, with Ns, with their GC counts, in input order or in position
+// order).
+func checkSidecars(meta *ArchiveMeta, seg int, base string, partial bool) error {
+	for _, ext := range meta.Sidecars[seg] {
+		if partial && (ext == ".flipped" || ext == ".ns" || ext == ".gc" || ext == ".order" || ext == ".pos") {
+			continue
+		}
+		if !fileExists(base + ext) {
+			return fmt.Errorf("%s is missing, but the archive was written with it", base+ext)
+		}
+	}
+	return nil
+}
+
+// recordedReads() returns the number of reads recorded for the first nsegs
+// segments of the archive, or -1 if any of them predates recording it.
+func recordedReads(meta *ArchiveMeta, nsegs int) int {
+	total := 0
+	for seg := 0; seg < nsegs; seg++ {
+		n, ok := meta.Reads[seg]
+		if !ok {
+			return -1
+		}
+		total += n
+	}
+	return total
+}
+
+// checkReadCount() returns an error if n, the number of reads decoded from
+// the whole archive, is not the number recorded when it was encoded (if it
+// was recorded). A mismatch means the counts and the tails are out of step.
+func checkReadCount(meta *ArchiveMeta, nsegs, n int) error {
+	if want := recordedReads(meta, nsegs); want >= 0 && n != want {
+		return fmt.Errorf("decoded %d reads, but %d were encoded", n, want)
+	}
+	return nil
+}
+
+// saveArchiveMeta() writes the metadata to the given file.
+func saveArchiveMeta(filename string, meta *ArchiveMeta) {
+	f, err := os.Create(filename)
+	DIE_ON_ERR(err, "Couldn't create metadata file %s", filename)
+	defer f.Close()
+	DIE_ON_ERR(writeArchiveMeta(f, meta), "Couldn't write metadata file %s", filename)
+}
+
+// loadArchiveMeta() reads the metadata file with the given name. If the file
+// does not exist (the archive predates metadata) it returns nil.
+func loadArchiveMeta(filename string) *ArchiveMeta {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Printf("No metadata file (%s) found; options will not be checked.", filename)
+		return nil
+	}
+	defer f.Close()
+	meta, err := readArchiveMeta(f)
+	DIE_ON_ERR(err, "Couldn't read metadata file %s", filename)
+	return meta
+}
+
+// checkArchiveReference() returns an error if the given k or reference file
+// are not the ones the archive was encoded with. refFile may be "" when the
+// model is read from the archive itself.
+func checkArchiveReference(meta *ArchiveMeta, refFile string, k int) error {
+	if meta.K != k {
+		return fmt.Errorf("archive was encoded with -k=%d but decoding with -k=%d", meta.K, k)
+	}
+	if refFile == "" || meta.RefMD5 == "" {
+		return nil
+	}
+	if err := checkArchiveFormat(meta); err != nil {
+		return err
+	}
+	size, hash, err := referenceFingerprint(refFile)
+	if err != nil {
+		return err
+	}
+	if size != meta.RefSize || hash != meta.RefMD5 {
+		return fmt.Errorf("reference %s (size %d, md5 %s) is not the reference "+
+			"used to encode (size %d, md5 %s)", refFile, size, hash, meta.RefSize, meta.RefMD5)
+	}
+	return nil
+}
+
+// checkArchiveFormat() returns an error if the archive described by meta (nil
+// if it has no metadata) can't have its model rebuilt from the reference by
+// this kpath; see archiveFormat.
+func checkArchiveFormat(meta *ArchiveMeta) error {
+	format := 1
+	if meta != nil && meta.Format > 0 {
+		format = meta.Format
+	}
+	switch {
+	case format < archiveFormat:
+		return fmt.Errorf("the archive is in format %d, written by an older kpath that built "+
+			"its model without the last sequence of the reference; decode it with that kpath", format)
+	case format > archiveFormat:
+		return fmt.Errorf("the archive is in format %d, written by a newer kpath "+
+			"(this one reads format %d)", format, archiveFormat)
+	}
+	return nil
+}
+
+// recordedMul() returns the -mul the tails of the archive were coded with,
+// from the options recorded in its metadata (where it is left out if it was
+// the default), and false if the archive predates recording them.
+func recordedMul(meta *ArchiveMeta) (int, bool) {
+	if meta.Version == "" {
+		return 0, false
+	}
+	v, ok := meta.Options["mul"]
+	if !ok {
+		v = encodeFlags.Lookup("mul").DefValue
+	}
+	mul, err := strconv.Atoi(v)
+	return mul, err == nil
+}
+
+// checkArchiveMul() returns an error if the tails of the archive were coded
+// with a -mul other than mul. The weight of an observation shapes every
+// distribution the coder uses, so a different one decodes garbage.
+func checkArchiveMul(meta *ArchiveMeta, mul int) error {
+	if recorded, ok := recordedMul(meta); ok && recorded != mul {
+		return fmt.Errorf("archive was encoded with -mul=%d but decoding with -mul=%d", recorded, mul)
+	}
+	return nil
+}
+
+// recordedUpdate() returns the -update the tails of the archive were coded
+// with, from the options recorded in its metadata, and false if the archive
+// predates recording them.
+func recordedUpdate(meta *ArchiveMeta) (bool, bool) {
+	if meta.Version == "" {
+		return false, false
+	}
+	v, ok := meta.Options["update"]
+	if !ok {
+		v = encodeFlags.Lookup("update").DefValue
+	}
+	update, err := strconv.ParseBool(v)
+	return update, err == nil
+}
+
+// checkArchiveUpdate() returns an error if the tails of the archive were
+// coded with an -update other than update. A coder that updates the model
+// and one that doesn't see different distributions after the first read, so
+// the other setting decodes garbage. The read-only model of -mphf can't
+// decode an archive coded with -update=true at all.
+func checkArchiveUpdate(meta *ArchiveMeta, update bool) error {
+	recorded, ok := recordedUpdate(meta)
+	switch {
+	case !ok || recorded == update:
+		return nil
+	case mphfOption:
+		return fmt.Errorf("archive was encoded with -update=%v, which the read-only model of -mphf can't decode", recorded)
+	}
+	return fmt.Errorf("archive was encoded with -update=%v but decoding with -update=%v", recorded, update)
+}
+
+// segmentBase() returns the basename of the sidecar files (.bittree, .counts,
+// .flipped, .ns) of the given segment of the archive with basename archive.
+// The first segment uses the archive's own basename.
+func segmentBase(archive string, seg int) string {
+	if seg == 0 {
+		return archive
+	}
+	return fmt.Sprintf("%s.seg%d", archive, seg)
+}
@@ -0,0 +1,268 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeWithWrongReference(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 3, 100, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	meta := loadArchiveMeta(td.path("out.meta"))
+	if meta == nil {
+		t.Fatalf("No metadata was written")
+	}
+	if err := checkArchiveReference(meta, td.refFile, 8); err != nil {
+		t.Fatalf("Correct reference rejected: %v", err)
+	}
+
+	// the same sequences compressed and wrapped differently, and in
+	// lowercase, are the same reference
+	var fa bytes.Buffer
+	for i, s := range readReferenceFile(td.refFile) {
+		fmt.Fprintf(&fa, ">seq%d\n", i)
+		for ; len(s) > 17; s = s[17:] {
+			fmt.Fprintf(&fa, "%s\n", strings.ToLower(s[:17]))
+		}
+		fmt.Fprintf(&fa, "%s\n", s)
+	}
+	sameRef := td.path("same.fa.gz")
+	f, err := os.Create(sameRef)
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %v", sameRef, err)
+	}
+	z, _ := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	z.Write(fa.Bytes())
+	z.Close()
+	f.Close()
+	if err := checkArchiveReference(meta, sameRef, 8); err != nil {
+		t.Fatalf("The reference compressed differently was rejected: %v", err)
+	}
+
+	wrongRef := td.path("wrong.fa.gz")
+	rng := rand.New(rand.NewSource(4))
+	writeTestReference(t, wrongRef, []string{randomSequence(rng, 3000)})
+	err = checkArchiveReference(meta, wrongRef, 8)
+	if err == nil || !strings.Contains(err.Error(), "is not the reference used to encode") {
+		t.Fatalf("Wrong reference not detected: %v", err)
+	}
+
+	// an archive from before the format was recorded can't be decoded
+	// with the reference, even the right one
+	old := *meta
+	old.Format = 0
+	err = checkArchiveReference(&old, td.refFile, 8)
+	if err == nil || !strings.Contains(err.Error(), "format 1") {
+		t.Fatalf("Archive in an old format not detected: %v", err)
+	}
+	if err := checkArchiveFormat(nil); err == nil {
+		t.Fatalf("Archive with no metadata not detected")
+	}
+	old.Format = archiveFormat + 1
+	if err := checkArchiveReference(&old, td.refFile, 8); err == nil {
+		t.Fatalf("Archive in a newer format not detected")
+	}
+
+	err = checkArchiveReference(meta, td.refFile, 9)
+	if err == nil || !strings.Contains(err.Error(), "-k=8") {
+		t.Fatalf("Wrong k not detected: %v", err)
+	}
+}
+
+func TestMissingSidecar(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 24, 100, 40)
+	defer td.Close()
+	dupRunsOption = true
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	meta := loadArchiveMeta(td.path("out.meta"))
+	if got := strings.Join(meta.Sidecars[0], " "); got != ".flipped .ns .runs" {
+		t.Fatalf("Metadata lists sidecars %q, not .flipped .ns .runs", got)
+	}
+	if err := checkSidecars(meta, 0, td.path("out"), false); err != nil {
+		t.Fatalf("Complete archive rejected: %v", err)
+	}
+
+	// a deleted .ns is noticed, unless a partial decode is asked for
+	os.Remove(td.path("out.ns"))
+	err := checkSidecars(meta, 0, td.path("out"), false)
+	if err == nil || !strings.Contains(err.Error(), "out.ns is missing") {
+		t.Fatalf("Missing .ns not detected: %v", err)
+	}
+	if err := checkSidecars(meta, 0, td.path("out"), true); err != nil {
+		t.Fatalf("Missing .ns rejected by a partial decode: %v", err)
+	}
+
+	// but the reads can't be decoded at all without the runs
+	os.Remove(td.path("out.runs"))
+	if err := checkSidecars(meta, 0, td.path("out"), true); err == nil {
+		t.Fatalf("Missing .runs not detected")
+	}
+
+	// segments (and archives) that predate the list are not checked
+	if err := checkSidecars(meta, 1, td.path("out.seg1"), false); err != nil {
+		t.Fatalf("Unlisted segment rejected: %v", err)
+	}
+}
+
+func TestArchiveProvenance(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 5, 100, 40)
+	defer td.Close()
+	encodeFlags.Set("mul", "5")
+	encodeFlags.Set("sep", `\t x`)
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	meta := loadArchiveMeta(td.path("out.meta"))
+	if meta.Version != kpathVersion || meta.Model != "map" || meta.Command == "" {
+		t.Fatalf("Recorded version %q, model %q and command %q", meta.Version, meta.Model, meta.Command)
+	}
+	if meta.Options["mul"] != "5" || meta.Options["sep"] != `\t x` || meta.Options["k"] != "8" {
+		t.Fatalf("Recorded options %v", meta.Options)
+	}
+	if _, ok := meta.Options["flip"]; ok {
+		t.Fatalf("Recorded -flip, which is at its default")
+	}
+	if w := versionWarning(meta); w != "" {
+		t.Fatalf("Warned about the same version: %s", w)
+	}
+
+	// awkward values survive being written and read back
+	recordProvenance(meta, []string{"kpath", "encode", "-reads=my \"reads\".fq\n"}, encodeFlags)
+	if meta.Command != `kpath encode "-reads=my \"reads\".fq\n"` {
+		t.Fatalf("Recorded the command line as %s", meta.Command)
+	}
+	meta.Options["sep"] = "\x00"
+	meta.Options["out"] = `"quoted"`
+	meta.Options["ref"] = ""
+	var buf bytes.Buffer
+	if err := writeArchiveMeta(&buf, meta); err != nil {
+		t.Fatalf("Couldn't write metadata: %v", err)
+	}
+	got, err := readArchiveMeta(&buf)
+	if err != nil {
+		t.Fatalf("Couldn't read metadata back: %v", err)
+	}
+	if !reflect.DeepEqual(got, meta) {
+		t.Fatalf("Metadata read back as\n%+v\nnot\n%+v", got, meta)
+	}
+
+	// another version still decodes, with a warning
+	meta.Version = "0.1"
+	if w := versionWarning(meta); !strings.Contains(w, "version 0.1") {
+		t.Fatalf("Warned %q about another version", w)
+	}
+	saveArchiveMeta(td.path("out.meta"), meta)
+	decodeArchive(td.refFile, td.path("out"), td.path("out.fa"))
+	if got := readDecodedSeqs(t, td.path("out.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Archive from another version decoded wrongly")
+	}
+}
+
+func TestArchiveMul(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 6, 200, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("default"))
+	observationWeight = 5
+	encodeArchive(td.refFile, td.readFN, td.path("mul5"))
+
+	for _, c := range []struct {
+		archive string
+		mul     int
+		want    string
+	}{
+		{"default", 10, ""},
+		{"default", 5, "archive was encoded with -mul=10 but decoding with -mul=5"},
+		{"mul5", 5, ""},
+		{"mul5", 10, "archive was encoded with -mul=5 but decoding with -mul=10"},
+	} {
+		err := checkArchiveMul(loadArchiveMeta(td.path(c.archive+".meta")), c.mul)
+		if (c.want == "" && err != nil) || (c.want != "" && (err == nil || err.Error() != c.want)) {
+			t.Fatalf("%s decoded with -mul=%d gave error %v", c.archive, c.mul, err)
+		}
+	}
+
+	// the recorded -mul decodes the archive
+	decodeArchive(td.refFile, td.path("mul5"), td.path("mul5.fa"))
+	if got := readDecodedSeqs(t, td.path("mul5.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads with -mul=5")
+	}
+
+	// archives from before the options were recorded aren't checked
+	if err := checkArchiveMul(&ArchiveMeta{K: 8}, 3); err != nil {
+		t.Fatalf("Archive without recorded options gave error %v", err)
+	}
+}
+
+func TestArchiveUpdate(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 7, 200, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("default"))
+	updateReference = false
+	encodeArchive(td.refFile, td.readFN, td.path("static"))
+
+	for _, c := range []struct {
+		archive string
+		update  bool
+		mphf    bool
+		want    string
+	}{
+		{"default", true, false, ""},
+		{"default", false, false, "archive was encoded with -update=true but decoding with -update=false"},
+		{"default", false, true, "archive was encoded with -update=true, which the read-only model of -mphf can't decode"},
+		{"static", false, false, ""},
+		{"static", false, true, ""},
+		{"static", true, false, "archive was encoded with -update=false but decoding with -update=true"},
+	} {
+		mphfOption = c.mphf
+		err := checkArchiveUpdate(loadArchiveMeta(td.path(c.archive+".meta")), c.update)
+		if (c.want == "" && err != nil) || (c.want != "" && (err == nil || err.Error() != c.want)) {
+			t.Fatalf("%s decoded with -update=%v -mphf=%v gave error %v", c.archive, c.update, c.mphf, err)
+		}
+	}
+	mphfOption = false
+
+	// the recorded -update decodes the archive
+	decodeArchive(td.refFile, td.path("static"), td.path("static.fa"))
+	if got := readDecodedSeqs(t, td.path("static.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads with -update=false")
+	}
+
+	// archives from before the options were recorded aren't checked
+	if err := checkArchiveUpdate(&ArchiveMeta{K: 8}, false); err != nil {
+		t.Fatalf("Archive without recorded options gave error %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+)
+
+/*
+A serialized model is stored (gzipped) as:
+
+    "KPMD"        4 byte magic
+    version       1 byte (currently 1)
+    order         1 byte
+    n             uint64, the number of kmers that follow
+    n records of  kmer (uint32) followed by len(ALPHA) counts (uint16)
+
+All integers are big endian and the kmers are written in increasing order, so
+the same model always serializes to the same bytes.
+*/
+
+const (
+	modelMagic   string = "KPMD"
+	modelVersion byte   = 1
+)
+
+// checkModelOrder() returns an error if a model of the given order can't be
+// used with the current k. The array model is indexed by kmer, so without
+// this check a mismatch would show up as an index out of range while counting.
+func checkModelOrder(order uint) error {
+	if int(order) != globalK {
+		return fmt.Errorf("a model of order %d can't be used with k=%d", order, globalK)
+	}
+	return nil
+}
+
+// newKmerModel() creates an empty model of the given order using the kind of
+// model selected by the command line options.
+func newKmerModel(order uint) KmerModel {
+	DIE_ON_ERR(checkModelOrder(order), "Can't create the kmer model")
+	if useArrayModel {
+		return NewArrayKmerModel(order)
+	}
+	return NewSmallKmerModel(order)
+}
+
+// A modelChoice is the value of -bigmem: "true" for the array model, "false"
+// for the map model, or "auto" to choose by how dense the reference is (see
+// isDenseReference()). As for a boolean flag, -bigmem alone means true.
+type modelChoice string
+
+func (m *modelChoice) String() string { return string(*m) }
+
+func (m *modelChoice) IsBoolFlag() bool { return true }
+
+func (m *modelChoice) Set(s string) error {
+	if s == "auto" {
+		*m = "auto"
+		useArrayModel = false
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("must be true, false or auto")
+	}
+	*m = modelChoice(strconv.FormatBool(b))
+	useArrayModel = b
+	return nil
+}
+
+// isDenseReference() returns true if the kmers set in bv, the contexts of a
+// reference, are at least arrayDensityOption percent of all the kmers of
+// length k. The array model takes 4 bytes for every possible context, the
+// map model several times that for each context it holds, so the array is
+// the smaller of the two only for a dense reference.
+func isDenseReference(bv BitSet, k int) bool {
+	n, all := bv.Count(), uint64(1)<<(2*uint(k))
+	dense := n*100 >= uint64(arrayDensityOption)*all
+	kind := "map"
+	if dense {
+		kind = "array"
+	}
+	log.Printf("The reference has %d of the %d contexts (%.2f%%); using the %s model",
+		n, all, 100*float64(n)/float64(all), kind)
+	return dense
+}
+
+// setDistribution() makes the counts for kmer k in the model equal to dist.
+// Counts that are too large to be set directly are built up by increments so
+// that the model creates its overflow entries as it would have during coding.
+func setDistribution(km KmerModel, k Kmer, dist [len(ALPHA)]KmerCount) {
+	for c, v := range dist {
+		if v < math.MaxUint8 {
+			km.SetCount(k, byte(c), byte(v))
+		}
+	}
+	for c, v := range dist {
+		if v < math.MaxUint8 {
+			continue
+		}
+		for v > 0 {
+			by := v
+			if by >= math.MaxUint8 {
+				by = math.MaxUint8 - 1
+			}
+			km.Increment(k, byte(c), byte(by))
+			v -= by
+		}
+	}
+}
+
+// cloneKmerModel() returns a new model, of the kind selected by the command
+// line options, with the same counts as km.
+func cloneKmerModel(km KmerModel, order uint) KmerModel {
+	c := newKmerModel(order)
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		setDistribution(c, k, dist)
+	})
+	return c
+}
+
+// writeKmerModel() serializes the given model of the given order to w.
+func writeKmerModel(w io.Writer, km KmerModel, order int) error {
+	// count the kmers first so the header can give the number of records
+	var n uint64
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		n++
+	})
+
+	buf := bufio.NewWriter(w)
+	buf.WriteString(modelMagic)
+	buf.WriteByte(modelVersion)
+	buf.WriteByte(byte(order))
+	binary.Write(buf, binary.BigEndian, n)
+
+	var err error
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		if err == nil {
+			err = binary.Write(buf, binary.BigEndian, uint32(k))
+		}
+		if err == nil {
+			err = binary.Write(buf, binary.BigEndian, dist)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// readKmerModel() reads a model written by writeKmerModel() and returns it
+// along with its order, which must be the current k.
+func readKmerModel(r io.Reader) (KmerModel, int, error) {
+	buf := bufio.NewReader(r)
+	header := make([]byte, len(modelMagic)+2)
+	if _, err := io.ReadFull(buf, header); err != nil {
+		return nil, 0, err
+	}
+	if string(header[:len(modelMagic)]) != modelMagic {
+		return nil, 0, fmt.Errorf("not a kpath model file")
+	}
+	if header[len(modelMagic)] != modelVersion {
+		return nil, 0, fmt.Errorf("unsupported model version %d", header[len(modelMagic)])
+	}
+	order := int(header[len(modelMagic)+1])
+	if err := checkModelOrder(uint(order)); err != nil {
+		return nil, order, err
+	}
+
+	var n uint64
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return nil, 0, err
+	}
+
+	km := newKmerModel(uint(order))
+	for i := uint64(0); i < n; i++ {
+		var k uint32
+		var dist [len(ALPHA)]KmerCount
+		if err := binary.Read(buf, binary.BigEndian, &k); err != nil {
+			return nil, 0, err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &dist); err != nil {
+			return nil, 0, err
+		}
+		setDistribution(km, Kmer(k), dist)
+	}
+	return km, order, nil
+}
+
+// saveKmerModel() writes the model to the given file, gzipped.
+func saveKmerModel(filename string, km KmerModel, order int) {
+	log.Printf("Writing %v-mer model to %s", order, filename)
+	f, err := os.Create(filename)
+	DIE_ON_ERR(err, "Couldn't create model file %s", filename)
+	defer f.Close()
+
+	z, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	DIE_ON_ERR(err, "Couldn't create gzipper for model file")
+	defer z.Close()
+
+	DIE_ON_ERR(writeKmerModel(z, km, order), "Couldn't write model file %s", filename)
+}
+
+// loadKmerModel() reads a model saved with saveKmerModel() and returns it and
+// its order.
+func loadKmerModel(filename string) (KmerModel, int) {
+	log.Printf("Reading model from %s", filename)
+	f, err := os.Open(filename)
+	DIE_ON_ERR(err, "Couldn't open model file %s", filename)
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	DIE_ON_ERR(err, "Couldn't create gzip reader for model file %s", filename)
+	defer z.Close()
+
+	km, order, err := readKmerModel(z)
+	DIE_ON_ERR(err, "Couldn't read model file %s", filename)
+	return km, order
+}
+
+// dictionaryModel is the model that countKmersInReference() starts from
+// instead of an empty one, or nil if there is none. It is a model saved by
+// an earlier encode (with -savemodel) of a similar sample, so the contexts it
+// learned don't have to be learned again.
+var dictionaryModel KmerModel
+
+// loadDictionary() makes the model saved in filename the dictionary, or
+// clears the dictionary if filename is "". It returns the md5 hash of the
+// file ("" if there is none), which the decoder needs to check.
+func loadDictionary(filename string) string {
+	dictionaryModel = nil
+	if filename == "" {
+		return ""
+	}
+	_, hash, err := fileFingerprint(filename)
+	DIE_ON_ERR(err, "Couldn't read dictionary %s", filename)
+	dictionaryModel, _ = loadKmerModel(filename)
+	return hash
+}
+
+// archiveDictionary() loads the dictionary in filename for an archive with
+// the given metadata, after checking that it is the one the archive was
+// encoded with: filename must be "" if the archive was encoded without one.
+func archiveDictionary(meta *ArchiveMeta, filename string) error {
+	dictionaryModel = nil
+	if meta.DictMD5 == "" {
+		if filename != "" {
+			return fmt.Errorf("the archive was encoded without a dictionary, but -dictionary was given")
+		}
+		return nil
+	}
+	if filename == "" {
+		return fmt.Errorf("the archive was encoded with a dictionary (md5 %s); give it with -dictionary", meta.DictMD5)
+	}
+	_, hash, err := fileFingerprint(filename)
+	if err != nil {
+		return err
+	}
+	if hash != meta.DictMD5 {
+		return fmt.Errorf("dictionary %s (md5 %s) is not the dictionary used to encode (md5 %s)",
+			filename, hash, meta.DictMD5)
+	}
+	loadDictionary(filename)
+	return nil
+}
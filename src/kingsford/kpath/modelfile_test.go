@@ -0,0 +1,83 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestAutoModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(71))
+	seqs := []string{randomSequence(rng, 20000)}
+
+	for _, c := range []struct {
+		name  string
+		k     int
+		array bool
+	}{{"dense", 6, true}, {"sparse", 12, false}} {
+		setTestOptions(c.k)
+		if err := encodeFlags.Set("bigmem", "auto"); err != nil {
+			t.Fatalf("Couldn't set -bigmem=auto: %v", err)
+		}
+		km := countKmersInReference(c.k, seqs)
+		if _, ok := km.(*ArrayKmerModel); ok != c.array {
+			t.Fatalf("%s: got a %T", c.name, km)
+		}
+
+		// the contexts marked to choose the model are those of the flip set
+		idx := newReferenceIndex(c.k, c.k, seqs)
+		if _, ok := idx.Model.(*ArrayKmerModel); ok != c.array {
+			t.Fatalf("%s: the index got a %T", c.name, idx.Model)
+		}
+		if got, want := idx.Flip.bv.Count(), kmerSetFromReference(c.k, seqs).bv.Count(); got != want {
+			t.Fatalf("%s: the flip set has %d kmers, not %d", c.name, got, want)
+		}
+		if modelString(idx.Model) != modelString(km) {
+			t.Fatalf("%s: the index has a different model", c.name)
+		}
+	}
+
+	// the threshold decides
+	setTestOptions(6)
+	encodeFlags.Set("bigmem", "auto")
+	encodeFlags.Set("arraydensity", "100")
+	km := countKmersInReference(6, []string{randomSequence(rng, 2000)})
+	if _, ok := km.(*SmallKmerModel); !ok {
+		t.Fatalf("Used the array model below the threshold")
+	}
+
+	setTestOptions(6)
+	if err := encodeFlags.Set("bigmem", "maybe"); err == nil {
+		t.Fatalf("-bigmem=maybe was accepted")
+	}
+	for _, v := range []string{"true", "1"} {
+		setTestOptions(6)
+		encodeFlags.Set("bigmem", v)
+		if !useArrayModel {
+			t.Fatalf("-bigmem=%s doesn't use the array model", v)
+		}
+	}
+	setTestOptions(6)
+	if useArrayModel {
+		t.Fatalf("The array model is still used after resetting the options")
+	}
+}
@@ -0,0 +1,146 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMPHF(t *testing.T) {
+	rng := rand.New(rand.NewSource(43))
+	for _, n := range []int{0, 1, 2, 63, 1000, 50000} {
+		seen := make(map[Kmer]bool)
+		keys := make([]Kmer, 0, n)
+		for len(keys) < n {
+			k := Kmer(rng.Uint32())
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		h := newMPHF(keys)
+		slots := make([]bool, n)
+		for _, k := range keys {
+			slot, ok := h.lookup(k)
+			if !ok || int(slot) >= n || slots[slot] {
+				t.Fatalf("%d keys: key %d has slot %d, %v", n, k, slot, ok)
+			}
+			slots[slot] = true
+		}
+		if n >= 1000 && 8*h.size() > 6*n {
+			t.Fatalf("%d keys take %.1f bits per key", n, float64(8*h.size())/float64(n))
+		}
+	}
+}
+
+func TestMPHFKmerModel(t *testing.T) {
+	setTestOptions(10)
+	rng := rand.New(rand.NewSource(44))
+	km := countKmersInReference(10, []string{randomSequence(rng, 20000)})
+	// some counts too large for a byte, and some new contexts
+	for i := 0; i < 2000; i++ {
+		km.Increment(Kmer(rng.Intn(1<<20)), byte(rng.Intn(len(ALPHA))), byte(rng.Intn(200)))
+		km.Increment(Kmer(i%10), byte(i%len(ALPHA)), 100)
+	}
+
+	m := NewMPHFKmerModel(km, 10)
+	for k := Kmer(0); k < 1<<20; k++ {
+		e1, d1 := km.Distribution(k)
+		e2, d2 := m.Distribution(k)
+		if e1 != e2 || d1 != d2 {
+			t.Fatalf("Kmer %s is %v %v in the model, not %v %v", kmerToString(k, 10), e2, d2, e1, d1)
+		}
+		if e1 && m.NextCount(k, 2) != d1[2] {
+			t.Fatalf("NextCount disagrees with Distribution")
+		}
+	}
+	if len(m.overflow) == 0 {
+		t.Fatalf("No overflow entries were needed")
+	}
+	if modelString(m) != modelString(km) {
+		t.Fatalf("Iterate differs from the original model")
+	}
+
+	for name, f := range map[string]func(){
+		"SetCount":  func() { m.SetCount(0, 0, 1) },
+		"Increment": func() { m.Increment(0, 0, 1) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s on a read-only model didn't panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestMPHFDecode(t *testing.T) {
+	setTestOptions(8)
+	updateReference = false
+	td := newTestData(t, 45, 500, 40)
+	defer td.Close()
+
+	// a second segment shares the read-only model
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	writeTestReads(t, td.path("more.fq"), td.reads[:100])
+	appendArchive(td.refFile, td.path("more.fq"), td.path("out"))
+
+	mphfOption = true
+	decodeArchive(td.refFile, td.path("out"), td.path("out.seq"))
+	want := append(append([]string(nil), td.reads...), td.reads[:100]...)
+	if got := readDecodedSeqs(t, td.path("out.seq")); !sameReads(got, want) {
+		t.Fatalf("Decoding with -mphf gave different reads")
+	}
+}
+
+func BenchmarkMPHFDistribution(b *testing.B) {
+	setTestOptions(14)
+	rng := rand.New(rand.NewSource(46))
+	km := countKmersInReference(14, []string{randomSequence(rng, 1<<20)})
+	models := map[string]KmerModel{"map": km, "mphf": NewMPHFKmerModel(km, 14)}
+	// contexts that are in the model, as most are when decoding, and
+	// random ones, which mostly aren't
+	var hits []Kmer
+	km.Iterate(func(k Kmer, dist [len(ALPHA)]KmerCount) {
+		hits = append(hits, k)
+	})
+	rng.Shuffle(len(hits), func(i, j int) { hits[i], hits[j] = hits[j], hits[i] })
+	random := make([]Kmer, 1<<16)
+	for i := range random {
+		random[i] = Kmer(rng.Intn(1 << 28))
+	}
+	for _, probes := range []struct {
+		name  string
+		kmers []Kmer
+	}{{"hits", hits[:1<<16]}, {"random", random}} {
+		for _, name := range []string{"map", "mphf"} {
+			m := models[name]
+			b.Run(probes.name+"/"+name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					m.Distribution(probes.kmers[i%len(probes.kmers)])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// writeOrder() writes the input index of each of the reads (see
+// FastQ.Index), in the order they are encoded, as unsigned varints. The
+// indices are a permutation of 0 to reads.count()-1.
+func writeOrder(w io.Writer, reads readStream) error {
+	buf := bufio.NewWriter(w)
+	var v [binary.MaxVarintLen64]byte
+	err := reads.each(func(fq *FastQ) error {
+		_, err := buf.Write(v[:binary.PutUvarint(v[:], uint64(fq.Index))])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// readOrder() reads the input indices written by writeOrder(). If the file
+// does not exist, returns nil.
+func readOrder(orderFN string) []int {
+	in, err := os.Open(orderFN)
+	if err != nil {
+		return nil
+	}
+	defer in.Close()
+	log.Printf("Reading the read order from %v", orderFN)
+
+	inZ, err := gzip.NewReader(in)
+	DIE_ON_ERR(err, "Couldn't create unzipper for %s", orderFN)
+	defer inZ.Close()
+
+	order, err := parseOrder(bufio.NewReader(inZ))
+	DIE_ON_ERR(err, "Bad read order in %s", orderFN)
+	return order
+}
+
+// parseOrder() parses the varints written by writeOrder(), checking that
+// they are a permutation.
+func parseOrder(in io.ByteReader) ([]int, error) {
+	order := make([]int, 0, 1024)
+	for {
+		n, err := binary.ReadUvarint(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %d: %v", len(order), err)
+		}
+		order = append(order, int(n))
+	}
+	seen := make([]bool, len(order))
+	for i, n := range order {
+		if n >= len(order) || seen[n] {
+			return nil, fmt.Errorf("read %d has input index %d, which is out of range or repeated", i, n)
+		}
+		seen[n] = true
+	}
+	return order, nil
+}
+
+// inputIndex() returns the input index of the read decoded just now by the
+// iterator (see -keeporder).
+func (it *ReadIterator) inputIndex() int {
+	DIE_IF(it.seg.order == nil, "The archive has no read order (encode with -keeporder to record it)")
+	DIE_IF(it.segN > len(it.seg.order), "The read order ends before read %d", it.segN-1)
+	return it.seg.order[it.segN-1]
+}
+
+// wantIndex() returns true if the read with the given input index is one
+// the iterator was asked for (see ReadRange()).
+func (it *ReadIterator) wantIndex(index int) bool {
+	return it.indexRange == nil || (index >= it.indexRange[0] && index < it.indexRange[1])
+}
+
+// ReadRange() returns an iterator over the reads of the archive with
+// basename archive whose input indices are start to end-1; it must have a
+// single segment and have been encoded with -keeporder. The iterator stops
+// at the bucket of the last of those reads, and, if the archive was encoded
+// with -index, starts at the block holding the bucket of the first;
+// otherwise it starts at the beginning. The reads it returns that are
+// outside the range are to be dropped (see wantIndex()). A bucket of
+// identical reads is coded once, but its reads have an input index each,
+// so a range may start or end in the middle of one.
+func (ar *ArchiveReader) ReadRange(archive string, start, end int, st *codingState) *ReadIterator {
+	DIE_IF(len(ar.segs) != 1, "Can't decode a range of reads from an archive with appended reads")
+	seg := ar.segs[0]
+	DIE_IF(seg.order == nil, "No order file %s (encode with -keeporder to create it)", archive+".order")
+
+	// the first and last reads of the archive that are in the range, and
+	// their buckets
+	first, last := -1, -1
+	for i, n := range seg.order {
+		if n >= start && n < end {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	var it *ReadIterator
+	if first < 0 {
+		log.Printf("No reads have input indices in [%d, %d)", start, end)
+		it = newSegmentIterator(st, nil, nil)
+	} else {
+		firstBucket, lastBucket := bucketOfRead(seg.counts, first), bucketOfRead(seg.counts, last)
+		log.Printf("Decoding the reads with input indices in [%d, %d) from buckets [%d, %d]",
+			start, end, firstBucket, lastBucket)
+		if seg.blocks != nil {
+			it = ar.BucketRange(archive, firstBucket, lastBucket+1, st)
+		} else {
+			part := *seg
+			part.kmers = seg.kmers[:lastBucket+1]
+			part.counts = seg.counts[:lastBucket+1]
+			km := ar.km
+			it = newSegmentIterator(st, []*archiveSegment{&part}, func() KmerModel { return km })
+		}
+	}
+	it.indexRange = []int{start, end}
+	return it
+}
+
+// bucketOfRead() returns the bucket that holds read i (counting from 0) of a
+// segment with the given counts.
+func bucketOfRead(counts []int, i int) int {
+	for b, c := range counts {
+		if i < AbsInt(c) {
+			return b
+		}
+		i -= AbsInt(c)
+	}
+	return len(counts) - 1
+}
+
+// An orderedRead is a decoded read waiting to be written in input order.
+type orderedRead struct {
+	index int
+	id    string
+	seq   string
+}
+
+// writeByInputIndex() writes the reads to w in the order they were read
+// when they were encoded.
+func writeByInputIndex(w SeqWriter, reads []orderedRead) {
+	sort.Slice(reads, func(i, j int) bool { return reads[i].index < reads[j].index })
+	for _, r := range reads {
+		w.Write(r.id, r.seq, nil)
+	}
+}
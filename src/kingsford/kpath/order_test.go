@@ -0,0 +1,123 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseOrder(t *testing.T) {
+	order, err := parseOrder(bytes.NewReader([]byte{2, 0, 1}))
+	if err != nil || fmt.Sprint(order) != "[2 0 1]" {
+		t.Fatalf("Parsed %v, %v", order, err)
+	}
+	if _, err := parseOrder(bytes.NewReader([]byte{1, 1})); err == nil {
+		t.Fatalf("Parsed a repeated index")
+	}
+	if _, err := parseOrder(bytes.NewReader([]byte{0, 2})); err == nil {
+		t.Fatalf("Parsed an index out of range")
+	}
+	if _, err := parseOrder(bytes.NewReader([]byte{0, 0x80})); err == nil {
+		t.Fatalf("Parsed a truncated varint")
+	}
+}
+
+func TestKeepOrderRoundTrip(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 53, 500, 40)
+	defer td.Close()
+
+	// reads 100 to 105 are the same, and so are 7 and 300 to 302, so each
+	// group is a uniform bucket whose reads are far apart in the input
+	reads := append([]string(nil), td.reads...)
+	for i := 101; i < 106; i++ {
+		reads[i] = reads[100]
+	}
+	for i := 300; i < 303; i++ {
+		reads[i] = reads[7]
+	}
+	fn := td.path("dups.fq")
+	writeTestReads(t, fn, reads)
+
+	configs := []struct {
+		name string
+		set  func()
+	}{
+		{"uniform", func() {}},
+		{"runs", func() {
+			dupsOption = false
+			dupRunsOption = true
+		}},
+		{"index", func() {
+			updateReference = false
+			indexBlockBuckets = 5
+		}},
+	}
+	for _, c := range configs {
+		setTestOptions(8)
+		c.set()
+		keepOrderOption = true
+		out := td.path(c.name)
+		encodeArchive(td.refFile, fn, out)
+		if c.name == "uniform" {
+			counts, _ := readBucketCounts(out + ".counts")
+			uniform := 0
+			for _, n := range counts {
+				if n < 0 {
+					uniform++
+				}
+			}
+			if uniform < 2 {
+				t.Fatalf("Only %d uniform buckets", uniform)
+			}
+		}
+
+		setTestOptions(8)
+		c.set()
+		keepOrderOption = true
+		decodeArchive(td.refFile, out, out+".fa")
+		full := readDecodedSeqs(t, out+".fa")
+		if strings.Join(full, " ") != strings.Join(reads, " ") {
+			t.Fatalf("%s: -keeporder didn't decode the reads in input order", c.name)
+		}
+
+		// ranges that start and end inside the groups of identical reads,
+		// and at the ends of the input
+		for _, r := range [][2]int{{0, 1}, {98, 103}, {103, 301}, {7, 8}, {250, 260}, {490, 500}, {0, 500}, {600, 700}} {
+			setTestOptions(8)
+			c.set()
+			readRange = fmt.Sprintf("%d:%d", r[0], r[1])
+			decodeArchive(td.refFile, out, out+".range.fa")
+			got := readDecodedSeqs(t, out+".range.fa")
+			var want []string
+			if r[0] < len(full) {
+				want = full[r[0]:r[1]]
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Fatalf("%s: -readrange=%s decoded %d reads that are not those of the full decode",
+					c.name, readRange, len(got))
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// orientReads() reads the reads in readFile, reverse complements those that
+// match the reference better that way round, as encoding does, and writes
+// them to outFile as fastq, in the order they were read. Only the bit vector
+// of the reference's kmers is built, not the model. The Ns of each read are
+// kept; other bytes are written as the base they would be encoded as.
+func orientReads(refFile, readFile, outFile string) {
+	DIE_IF(refFile == "", "Must specify gzipped fasta as reference with -ref")
+	k := globalK
+	if flipK > 0 {
+		k = flipK
+	}
+	ks := kmerSetFromReference(k, readReferenceFile(refFile))
+
+	log.Printf("Reading reads from %s", readFile)
+	fq := make(chan *FastQ, readBufferSize)
+	go ReadFastQ(readFile, fq)
+	reads := make([]*FastQ, 0, estimateReadCount(readFile))
+	for rec := range fq {
+		reads = append(reads, rec)
+	}
+	DIE_IF(len(reads) == 0, "No reads to orient.")
+	n := flipReads(reads, ks)
+
+	log.Printf("Writing to %s", outFile)
+	outF, err := os.Create(outFile)
+	DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+	defer outF.Close()
+	w := newFastqWriter(outF)
+	for i, r := range reads {
+		w.Write("R"+strconv.Itoa(i), putbackNs(string(r.Seq), r.NLocations), nil)
+	}
+	DIE_ON_ERR(w.Flush(), "Couldn't write the oriented reads")
+	log.Printf("done. Wrote %v reads; flipped %v of them", len(reads), n)
+}
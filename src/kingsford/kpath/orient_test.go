@@ -0,0 +1,75 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 28, 1000, 50)
+	defer td.Close()
+
+	// the flip bits of the encoder, by the original read
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("out.seq"))
+	decoded := readDecodedSeqs(t, td.path("out.seq"))
+	bits := readFlipped(td.path("out.flipped"), 0)
+	encoderFlipped := make(map[string]bool)
+	for i, s := range decoded {
+		encoderFlipped[s] = bits[i]
+	}
+
+	orientReads(td.refFile, td.readFN, td.path("oriented.fq"))
+	f, err := os.Open(td.path("oriented.fq"))
+	if err != nil {
+		t.Fatalf("Couldn't open the oriented reads: %v", err)
+	}
+	defer f.Close()
+	oriented := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for line := 0; scanner.Scan(); line++ {
+		if line%4 == 1 {
+			oriented = append(oriented, scanner.Text())
+		}
+	}
+	if len(oriented) != len(td.reads) {
+		t.Fatalf("Wrote %d oriented reads, not %d", len(oriented), len(td.reads))
+	}
+
+	flips := 0
+	for i, r := range td.reads {
+		want := r
+		if encoderFlipped[r] {
+			want = reverseComplement(r)
+			flips++
+		}
+		if oriented[i] != want {
+			t.Fatalf("Read %d is oriented as %s, but the encoder made it %s", i, oriented[i], want)
+		}
+	}
+	if flips == 0 || flips == len(td.reads) {
+		t.Fatalf("%d of %d reads were flipped", flips, len(td.reads))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// perfEventAttr is the start of struct perf_event_attr from
+// <linux/perf_event.h>, as far as PERF_ATTR_SIZE_VER0.
+type perfEventAttr struct {
+	Type         uint32
+	Size         uint32
+	Config       uint64
+	SamplePeriod uint64
+	SampleType   uint64
+	ReadFormat   uint64
+	Flags        uint64
+	WakeupEvents uint32
+	BpType       uint32
+	Config1      uint64
+}
+
+const (
+	perfTypeHardware       = 0
+	perfCountHWCacheMisses = 3
+	perfFlagDisabled       = 1 << 0
+	perfFlagInherit        = 1 << 1
+	perfFlagExcludeKernel  = 1 << 5
+	perfFlagExcludeHV      = 1 << 6
+	perfIocEnable          = 0x2400
+	perfIocDisable         = 0x2401
+	perfIocReset           = 0x2403
+)
+
+// A cacheMissCounter counts the hardware cache misses of every thread of the
+// process (and of the threads they start) while it runs.
+type cacheMissCounter struct {
+	fds []int
+}
+
+// openCacheMissCounter() opens a stopped counter of the cache misses of the
+// threads of the process, or returns an error if the kernel or the hardware
+// won't count them (as in most virtual machines and containers).
+func openCacheMissCounter() (*cacheMissCounter, error) {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	attr := perfEventAttr{
+		Type:   perfTypeHardware,
+		Config: perfCountHWCacheMisses,
+		Flags:  perfFlagDisabled | perfFlagInherit | perfFlagExcludeKernel | perfFlagExcludeHV,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	c := &cacheMissCounter{}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN,
+			uintptr(unsafe.Pointer(&attr)), uintptr(tid), ^uintptr(0), ^uintptr(0), 0, 0)
+		if errno != 0 {
+			c.close()
+			return nil, errno
+		}
+		c.fds = append(c.fds, int(fd))
+	}
+	return c, nil
+}
+
+func (c *cacheMissCounter) ioctl(req uintptr) {
+	for _, fd := range c.fds {
+		syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, 0)
+	}
+}
+
+// start() zeroes the counter and starts it.
+func (c *cacheMissCounter) start() {
+	c.ioctl(perfIocReset)
+	c.ioctl(perfIocEnable)
+}
+
+// stop() stops the counter and returns the misses counted since start().
+func (c *cacheMissCounter) stop() uint64 {
+	c.ioctl(perfIocDisable)
+	var total uint64
+	buf := make([]byte, 8)
+	for _, fd := range c.fds {
+		if n, err := syscall.Read(fd, buf); err == nil && n == len(buf) {
+			total += binary.LittleEndian.Uint64(buf)
+		}
+	}
+	return total
+}
+
+func (c *cacheMissCounter) close() {
+	for _, fd := range c.fds {
+		syscall.Close(fd)
+	}
+	c.fds = nil
+}
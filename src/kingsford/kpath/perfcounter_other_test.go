@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// A cacheMissCounter would count the hardware cache misses of the process;
+// only Linux has the counters.
+type cacheMissCounter struct{}
+
+func openCacheMissCounter() (*cacheMissCounter, error) {
+	return nil, errors.New("hardware counters are only read on Linux")
+}
+
+func (c *cacheMissCounter) start()       {}
+func (c *cacheMissCounter) stop() uint64 { return 0 }
+func (c *cacheMissCounter) close()       {}
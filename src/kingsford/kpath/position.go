@@ -0,0 +1,170 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+With -positions, encode records where in the reference the prefix of each
+bucket first occurs, so that decode can write the reads roughly in reference
+order. Reads are flipped to agree with the reference, so the prefix of a read
+that was sampled from the reference is the start of where it maps, give or
+take the first occurrence of a repeated prefix; it is a quick view of the
+coverage without an alignment, not a placement.
+
+The positions are offsets into the reference sequences laid end to end in the
+order of the fasta file, and are written to OUT.pos, one unsigned varint per
+bucket: 0 for a prefix that doesn't occur in the reference, and the offset
+plus 1 otherwise.
+*/
+
+// bucketPositions() returns the offset of the first occurrence of each of the
+// buckets in the reference sequences laid end to end, or -1 if it doesn't
+// occur. The positions are found in one pass over the reference, looking up
+// only the prefixes of the buckets, so the index takes memory for the buckets
+// rather than for every kmer of the reference. Lowercase bases match.
+func bucketPositions(seqs []string, buckets []string) []int {
+	pos := make([]int, len(buckets))
+	if len(buckets) == 0 {
+		return pos
+	}
+	want := make(map[string]int, len(buckets))
+	for b, s := range buckets {
+		want[s] = b
+		pos[b] = -1
+	}
+	bk := len(buckets[0])
+	found := 0
+	offset := 0
+	for _, seq := range seqs {
+		seq = strings.ToUpper(seq)
+		for i := 0; i+bk <= len(seq) && found < len(buckets); i++ {
+			if b, ok := want[seq[i:i+bk]]; ok && pos[b] < 0 {
+				pos[b] = offset + i
+				found++
+			}
+		}
+		offset += len(seq)
+	}
+	log.Printf("Found %d of %d bucket prefixes in the reference", found, len(buckets))
+	return pos
+}
+
+// writePositions() writes the positions found by bucketPositions() as
+// unsigned varints, each one more than the position.
+func writePositions(w io.Writer, pos []int) error {
+	buf := bufio.NewWriter(w)
+	var v [binary.MaxVarintLen64]byte
+	for _, p := range pos {
+		buf.Write(v[:binary.PutUvarint(v[:], uint64(p+1))])
+	}
+	return buf.Flush()
+}
+
+// writeBucketPositions() finds the positions of the buckets of br in the
+// reference and writes them to the sidecar fn.
+func writeBucketPositions(fn string, br *bucketedReads, seqs []string) error {
+	f, err := createSidecar(fn, sidecarWrapper(br.id))
+	if err != nil {
+		return err
+	}
+	return f.close(writePositions(f.w, bucketPositions(seqs, br.buckets)))
+}
+
+// readPositions() reads the positions written by writePositions(). If the
+// file does not exist, returns nil.
+func readPositions(posFN string) []int {
+	in, err := os.Open(posFN)
+	if err != nil {
+		return nil
+	}
+	defer in.Close()
+	log.Printf("Reading bucket positions from %v", posFN)
+
+	inZ, err := openSidecar(in)
+	DIE_ON_ERR(err, "Couldn't create unzipper for %s", posFN)
+	defer inZ.Close()
+
+	pos, err := parsePositions(bufio.NewReader(inZ))
+	DIE_ON_ERR(err, "Bad positions in %s", posFN)
+	return pos
+}
+
+// parsePositions() parses the varints written by writePositions().
+func parsePositions(in io.ByteReader) ([]int, error) {
+	pos := make([]int, 0, 1024)
+	for {
+		p, err := binary.ReadUvarint(in)
+		if err == io.EOF {
+			return pos, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bucket %d: %v", len(pos), err)
+		}
+		pos = append(pos, int(p)-1)
+	}
+}
+
+// position() returns the recorded position of the bucket of the read decoded
+// just now by the iterator (-1 if it isn't in the reference).
+func (it *ReadIterator) position() int {
+	DIE_IF(it.seg.positions == nil, "The archive has no bucket positions (encode with -positions to record them)")
+	DIE_IF(it.bucket >= len(it.seg.positions), "The bucket positions end before bucket %d", it.bucket)
+	return it.seg.positions[it.bucket]
+}
+
+// A placedRead is a decoded read waiting to be written in position order.
+type placedRead struct {
+	pos int
+	id  string
+	seq string
+}
+
+// writeByPosition() writes the reads to w in order of their positions, with
+// the reads that have none last; reads at the same position keep the order
+// they were decoded in. The position is added to the ids of the placed
+// reads, as in "R12 pos=5031".
+func writeByPosition(w SeqWriter, reads []placedRead) {
+	sort.SliceStable(reads, func(i, j int) bool {
+		pi, pj := reads[i].pos, reads[j].pos
+		if pi < 0 || pj < 0 {
+			return pi >= 0 && pj < 0
+		}
+		return pi < pj
+	})
+	for _, r := range reads {
+		id := r.id
+		if r.pos >= 0 {
+			id += " pos=" + strconv.Itoa(r.pos)
+		}
+		w.Write(id, r.seq, nil)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBucketPositions(t *testing.T) {
+	seqs := []string{"ACGTACGT", "ttgcaCCC"}
+	buckets := []string{"AAA", "CGT", "GCA", "TAC", "TTG"}
+	want := []int{-1, 1, 10, 3, 8}
+	if got := bucketPositions(seqs, buckets); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Found the buckets at %v, not %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := writePositions(&buf, want); err != nil {
+		t.Fatalf("Couldn't write the positions: %v", err)
+	}
+	got, err := parsePositions(&buf)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Read back %v (%v), not %v", got, err, want)
+	}
+}
+
+func TestPositionsRoundTrip(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 26, 600, 40)
+	defer td.Close()
+	ref := strings.Join(readReferenceFile(td.refFile), "")
+
+	positionsOption = true
+	archive := td.path("pos")
+	encodeArchive(td.refFile, td.readFN, archive)
+	decodeArchive(td.refFile, archive, archive+".fa")
+
+	f, err := os.Open(archive + ".fa")
+	if err != nil {
+		t.Fatalf("Couldn't open decoded reads: %v", err)
+	}
+	defer f.Close()
+	seqs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	pos, last, placed := -1, -1, 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ">") {
+			pos = -1
+			if i := strings.Index(line, " pos="); i >= 0 {
+				pos, err = strconv.Atoi(line[i+len(" pos="):])
+				if err != nil || pos < 0 || pos+bucketK > len(ref) {
+					t.Fatalf("Bad position in %q", line)
+				}
+			}
+			continue
+		}
+		seqs = append(seqs, line)
+		// the reads come out in order of position, with the unplaced
+		// ones last
+		switch {
+		case pos < 0:
+			last = len(ref)
+			continue
+		case pos < last:
+			t.Fatalf("Read %d at %d comes after one at %d", len(seqs)-1, pos, last)
+		}
+		last = pos
+		placed++
+		// and the bucket of each placed read is in the reference there,
+		// in whichever orientation the read was encoded
+		if strings.Contains(line, "N") {
+			continue
+		}
+		prefix := ref[pos : pos+bucketK]
+		if line[:bucketK] != prefix && reverseComplement(line)[:bucketK] != prefix {
+			t.Fatalf("Read %d (%s) doesn't start with %s from position %d", len(seqs)-1, line, prefix, pos)
+		}
+	}
+	if !sameReads(seqs, td.reads) {
+		t.Fatalf("The reads decoded with -positions are wrong")
+	}
+	if placed < len(seqs)*9/10 {
+		t.Fatalf("Only %d of %d reads were placed in the reference", placed, len(seqs))
+	}
+}
@@ -0,0 +1,62 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+// A ReferenceIndex holds what the encoder builds from the reference: the set
+// of kmers used to decide which reads to flip, and the model used to code
+// them. Building both together from the one list of sequences means they
+// can't be built from different references, or with a k other than the one
+// recorded for the archive.
+type ReferenceIndex struct {
+	Flip  *kmerSet  // the kmers of length FlipK
+	Model KmerModel // the transitions from the contexts of length K
+	K     int       // the k of the model
+	FlipK int       // the k of the flip set; the same as K unless -flipk
+}
+
+// newReferenceIndex() builds the flip set and the model for the reference
+// sequences, with the given k for the model and flipK for the flip set. If
+// the two ks are the same, both are built in one pass over the sequences.
+func newReferenceIndex(k, flipK int, seqs []string) *ReferenceIndex {
+	idx := &ReferenceIndex{K: k, FlipK: flipK}
+	if flipK == k {
+		bv := newKmerBits(k)
+		idx.Model = countReferenceKmers(k, seqs, bv)
+		idx.Flip = &kmerSet{bv, k, kmerMask(k)}
+	} else {
+		idx.Flip = kmerSetFromReference(flipK, seqs)
+		idx.Model = countKmersInReference(k, seqs)
+	}
+	return idx
+}
+
+// ContainsKmer() returns true if the reference has the kmer k, of length
+// FlipK, followed by a base; the last kmer of each sequence is left out, as
+// it is not a context. With a flip set too large for -bvbits it may wrongly
+// return true (see newKmerBits()).
+func (idx *ReferenceIndex) ContainsKmer(k Kmer) bool {
+	return idx.Flip.Contains(k)
+}
+
+// referenceIndexFor() builds the index for the archive described by meta.
+func referenceIndexFor(meta *ArchiveMeta, seqs []string) *ReferenceIndex {
+	return newReferenceIndex(meta.K, flipKFor(meta), seqs)
+}
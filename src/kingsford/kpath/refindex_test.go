@@ -0,0 +1,113 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestReferenceIndex(t *testing.T) {
+	setTestOptions(8)
+	rng := rand.New(rand.NewSource(41))
+	seqs := []string{randomSequence(rng, 3000), "ACGT", randomSequence(rng, 500)}
+
+	for _, flipK := range []int{8, 6} {
+		idx := newReferenceIndex(8, flipK, seqs)
+		if idx.K != 8 || idx.FlipK != flipK || idx.Flip.k != flipK {
+			t.Fatalf("Index has k = %d and flip k = %d (set of %d-mers), not 8 and %d",
+				idx.K, idx.FlipK, idx.Flip.k, flipK)
+		}
+
+		// each is what it would be if built on its own
+		want := kmerSetFromReference(flipK, seqs)
+		for i := range want.bv.(*BitVec).data {
+			if idx.Flip.bv.(*BitVec).data[i] != want.bv.(*BitVec).data[i] {
+				t.Fatalf("Flip set of %d-mers differs at word %d", flipK, i)
+			}
+		}
+		if modelString(idx.Model) != modelString(countKmersInReference(8, seqs)) {
+			t.Fatalf("Model differs from one built on its own")
+		}
+	}
+
+	// the one pass gives the same set when the workers share it
+	func(min, threads int) {
+		defer func() { parallelCountMin, maxThreads = min, threads }()
+		parallelCountMin, maxThreads = 1, 4
+		idx := newReferenceIndex(8, 8, seqs)
+		want := kmerSetFromReference(8, seqs)
+		for i := range want.bv.(*BitVec).data {
+			if idx.Flip.bv.(*BitVec).data[i] != want.bv.(*BitVec).data[i] {
+				t.Fatalf("Flip set built by 4 workers differs at word %d", i)
+			}
+		}
+		if modelString(idx.Model) != modelString(countKmersInReference(8, seqs)) {
+			t.Fatalf("Model built by 4 workers differs from one built on its own")
+		}
+	}(parallelCountMin, maxThreads)
+
+	// with the same k, the flip set is exactly the contexts of the model
+	idx := newReferenceIndex(8, 8, seqs)
+	fromModel := kmerSetFromModel(idx.Model)
+	for i := range fromModel.bv.(*BitVec).data {
+		if idx.Flip.bv.(*BitVec).data[i] != fromModel.bv.(*BitVec).data[i] {
+			t.Fatalf("Flip set and model disagree at word %d", i)
+		}
+	}
+	if n := idx.Flip.bv.Count(); n == 0 {
+		t.Fatalf("Flip set is empty")
+	}
+}
+
+func BenchmarkReferenceIndex(b *testing.B) {
+	setTestOptions(12)
+	rng := rand.New(rand.NewSource(42))
+	seqs := []string{randomSequence(rng, 1<<20)}
+	b.Run("separate", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			kmerSetFromReference(12, seqs)
+			countKmersInReference(12, seqs)
+		}
+	})
+	b.Run("onepass", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			newReferenceIndex(12, 12, seqs)
+		}
+	})
+}
+
+func TestContainsKmer(t *testing.T) {
+	setTestOptions(4)
+	idx := newReferenceIndex(4, 4, []string{"ACGTACGGT", "TTTTT"})
+
+	// every kmer followed by a base, but not the last of each sequence
+	want := map[string]bool{"ACGT": true, "CGTA": true, "GTAC": true, "TACG": true, "ACGG": true, "TTTT": true}
+	for k := Kmer(0); k < 256; k++ {
+		s := kmerToString(k, 4)
+		if idx.ContainsKmer(k) != want[s] {
+			t.Fatalf("ContainsKmer(%s) = %v", s, idx.ContainsKmer(k))
+		}
+	}
+	if idx.ContainsKmer(stringToKmer("CGGT")) {
+		t.Fatalf("The last kmer of a sequence is in the index")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// A referenceStats summarizes a reference: its size, GC content, and how
+// many of the possible kmers it has. The kmers counted are those
+// kmerSetFromReference() finds, which are the contexts the model can use: the
+// kmers followed by another base, so the last kmer of each sequence is left
+// out.
+type referenceStats struct {
+	K             int     `json:"k"`
+	Sequences     int     `json:"sequences"`
+	Length        int     `json:"length"`
+	Ns            int     `json:"ns"`
+	GC            float64 `json:"gc"`
+	DistinctKmers uint64  `json:"distinct_kmers"`
+	KmerSpace     uint64  `json:"kmer_space"`
+	Occupancy     float64 `json:"occupancy"`
+}
+
+// computeReferenceStats() returns the statistics of the reference sequences
+// for kmers of length k. The GC content is the fraction of the bases other
+// than N that are G or C.
+func computeReferenceStats(k int, seqs []string) referenceStats {
+	st := referenceStats{K: k, Sequences: len(seqs)}
+	gc := 0
+	for _, s := range seqs {
+		st.Length += len(s)
+		for i := 0; i < len(s); i++ {
+			switch s[i] {
+			case 'G', 'C':
+				gc++
+			case 'N':
+				st.Ns++
+			}
+		}
+	}
+	if acgt := st.Length - st.Ns; acgt > 0 {
+		st.GC = float64(gc) / float64(acgt)
+	}
+	st.DistinctKmers = kmerSetFromReference(k, seqs).bv.Count()
+	st.KmerSpace = 1 << (2 * uint(k))
+	st.Occupancy = float64(st.DistinctKmers) / float64(st.KmerSpace)
+	return st
+}
+
+func (st referenceStats) String() string {
+	return fmt.Sprintf("Sequences:        %d\n"+
+		"Total length:     %d\n"+
+		"Ns:               %d\n"+
+		"GC content:       %.2f%%\n"+
+		"Distinct %2d-mers: %d\n"+
+		"Kmer space:       %d\n"+
+		"Occupancy:        %.4f%%\n",
+		st.Sequences, st.Length, st.Ns, 100*st.GC,
+		st.K, st.DistinctKmers, st.KmerSpace, 100*st.Occupancy)
+}
+
+// writeReferenceStats() writes the statistics to w, as JSON if asJSON is
+// set and as a report otherwise.
+func writeReferenceStats(w io.Writer, st referenceStats, asJSON bool) error {
+	if asJSON {
+		b, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	_, err := io.WriteString(w, st.String())
+	return err
+}
+
+// referenceStatsReport() writes the statistics of the reference in refFile
+// for kmers of length globalK to outFile, or to stdout if outFile is "".
+func referenceStatsReport(refFile, outFile string) {
+	DIE_IF(refFile == "", "Must specify gzipped fasta as reference with -ref")
+	st := computeReferenceStats(globalK, readReferenceFile(refFile))
+	out := os.Stdout
+	if outFile != "" {
+		var err error
+		out, err = os.Create(outFile)
+		DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+		defer out.Close()
+		log.Printf("Writing the statistics of %s to %s", refFile, outFile)
+	}
+	DIE_ON_ERR(writeReferenceStats(out, st, jsonOption), "Couldn't write the statistics")
+}
@@ -0,0 +1,80 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReferenceStats(t *testing.T) {
+	setTestOptions(2)
+	dir, err := ioutil.TempDir("", "kpath-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	refFN := filepath.Join(dir, "ref.fa.gz")
+	writeTestReference(t, refFN, []string{"ACGTACGT", "GGCCNA", "AT"})
+
+	// the 2-mers followed by a base are AC CG GT TA in the first sequence
+	// and GG GC CC CA (the N is an A) in the second; the third is too short
+	want := referenceStats{
+		K:             2,
+		Sequences:     3,
+		Length:        16,
+		Ns:            1,
+		GC:            8.0 / 15.0,
+		DistinctKmers: 8,
+		KmerSpace:     16,
+		Occupancy:     0.5,
+	}
+
+	jsonOption = true
+	referenceStatsReport(refFN, filepath.Join(dir, "stats.json"))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stats.json"))
+	if err != nil {
+		t.Fatalf("Couldn't read stats: %v", err)
+	}
+	var got referenceStats
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Couldn't parse stats %s: %v", b, err)
+	}
+	if got != want {
+		t.Fatalf("Stats are %+v, not %+v", got, want)
+	}
+
+	jsonOption = false
+	referenceStatsReport(refFN, filepath.Join(dir, "stats.txt"))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "stats.txt"))
+	if err != nil {
+		t.Fatalf("Couldn't read stats: %v", err)
+	}
+	for _, line := range []string{"GC content:       53.33%", "Distinct  2-mers: 8", "Occupancy:        50.0000%"} {
+		if !strings.Contains(string(b), line) {
+			t.Fatalf("Report doesn't have %q:\n%s", line, b)
+		}
+	}
+}
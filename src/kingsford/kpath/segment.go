@@ -0,0 +1,166 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"kingsford/kpath/arithc"
+	"kingsford/kpath/bitio"
+)
+
+/*
+The arithmetic coded stream in a .enc file is preceded by a segment header:
+
+    "KPE2"    4 byte magic
+    ntails    uint64, the number of read tails encoded in the stream
+    nbytes    uint64, the length in bytes of the stream that follows
+    id        8 bytes, the archive id of the segment (see archiveid.go)
+
+(big endian). The stream itself is exactly what arithc.Encoder writes,
+including the bits written by Finish(), padded to a whole byte. The header
+lets the decoder stop at the end of the stream without trusting the .counts
+file, and nbytes lets a reader skip over a segment to the one after it.
+
+Files written before the header existed start directly with the stream;
+they are recognized by the missing magic.
+*/
+
+const (
+	segmentMagic     string = "KPE2"
+	segmentHeaderLen int64  = int64(len(segmentMagic)) + 8 + 8 + archiveIDLen
+)
+
+// A segmentHeader is the header of one segment of a .enc file.
+type segmentHeader struct {
+	ntails uint64
+	nbytes uint64
+	id     archiveID
+}
+
+// writeSegmentHeader() writes a segment header to w.
+func writeSegmentHeader(w io.Writer, h *segmentHeader) error {
+	if _, err := io.WriteString(w, segmentMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, [2]uint64{h.ntails, h.nbytes}); err != nil {
+		return err
+	}
+	_, err := w.Write(h.id[:])
+	return err
+}
+
+// readSegmentHeader() reads a segment header from r.
+func readSegmentHeader(r io.Reader) (*segmentHeader, error) {
+	magic := make([]byte, len(segmentMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != segmentMagic {
+		return nil, fmt.Errorf("bad segment header")
+	}
+	var n [2]uint64
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	h := &segmentHeader{ntails: n[0], nbytes: n[1]}
+	if _, err := io.ReadFull(r, h.id[:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// beginSegment() reserves space for a segment header at the current end of f
+// and returns the offset of the header.
+func beginSegment(f *os.File) int64 {
+	start, err := f.Seek(0, os.SEEK_END)
+	DIE_ON_ERR(err, "Couldn't seek in %s", f.Name())
+	DIE_ON_ERR(writeSegmentHeader(f, &segmentHeader{}), "Couldn't write to %s", f.Name())
+	return start
+}
+
+// endSegment() fills in the header of the segment that starts at the given
+// offset, once its stream has been completely written to f.
+func endSegment(f *os.File, start int64, ntails uint64, id archiveID) {
+	end, err := f.Seek(0, os.SEEK_END)
+	DIE_ON_ERR(err, "Couldn't seek in %s", f.Name())
+	nbytes := uint64(end - start - segmentHeaderLen)
+
+	_, err = f.Seek(start, os.SEEK_SET)
+	DIE_ON_ERR(err, "Couldn't seek in %s", f.Name())
+	DIE_ON_ERR(writeSegmentHeader(f, &segmentHeader{ntails: ntails, nbytes: nbytes, id: id}),
+		"Couldn't write to %s", f.Name())
+	_, err = f.Seek(0, os.SEEK_END)
+	DIE_ON_ERR(err, "Couldn't seek in %s", f.Name())
+	log.Printf("Wrote %d read tails in %d bytes", ntails, nbytes)
+}
+
+// openTails() opens the .enc file with the given name and returns it and a
+// decoder for its stream, along with the number of tails in the stream (-1 if
+// the file predates segment headers and so the number is unknown).
+func openTails(filename string) (*os.File, *arithc.Decoder, int) {
+	encIn, err := os.Open(filename)
+	DIE_ON_ERR(err, "Can't open encoded read file %s", filename)
+
+	decoder, h, _ := openSegment(encIn, 0)
+	ntails := -1
+	if h != nil {
+		ntails = int(h.ntails)
+	}
+	return encIn, decoder, ntails
+}
+
+// openSegment() returns a decoder for the stream of the segment that starts
+// at the given offset of f, the segment's header, and the offset at which
+// the next segment starts. A file that predates segment headers holds a
+// single stream that runs to the end of the file; the header is nil and the
+// next offset is -1 for it. The decoder reads f with ReadAt(), so the
+// decoders for several segments of one file can be used at once.
+func openSegment(f *os.File, offset int64) (*arithc.Decoder, *segmentHeader, int64) {
+	const toEnd = math.MaxInt64 / 2
+
+	readerBuf := bufio.NewReader(io.NewSectionReader(f, offset, toEnd))
+
+	var h *segmentHeader
+	next := int64(-1)
+	if magic, err := readerBuf.Peek(len(segmentMagic)); err == nil && string(magic) == segmentMagic {
+		h, err = readSegmentHeader(readerBuf)
+		DIE_ON_ERR(err, "Couldn't read segment header from %s", f.Name())
+		next = offset + segmentHeaderLen + int64(h.nbytes)
+
+		// read only this segment's stream
+		readerBuf = bufio.NewReader(io.NewSectionReader(f, offset+segmentHeaderLen, int64(h.nbytes)))
+	}
+
+	// create a bit reader wrapper around it
+	reader := bitio.NewReader(readerBuf)
+
+	// create a decoder around it
+	decoder, err := arithc.NewDecoder(reader)
+	DIE_ON_ERR(err, "Couldn't create decoder!")
+	return decoder, h, next
+}
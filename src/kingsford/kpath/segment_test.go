@@ -0,0 +1,63 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestDecodeStopsAtEndOfStream(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 10, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	resetModelState()
+	kmers := decodeKmersFromFile(td.path("out.bittree"), 8)
+	sort.Strings(kmers)
+	counts, readLen := readBucketCounts(td.path("out.counts"))
+	km := countKmersInReference(8, readReferenceFile(td.refFile))
+	flips := readFlipped(td.path("out.flipped"), 0)
+	ns := readNLocations(td.path("out.ns"))
+
+	enc, decoder, ntails := openTails(td.path("out.enc"))
+	defer enc.Close()
+	if ntails <= 0 || ntails > len(td.reads) {
+		t.Fatalf("Bad number of tails in segment header: %d", ntails)
+	}
+
+	// claim there are more buckets than were encoded
+	counts = append(counts, 5, -3, 7)
+	kmers = append(kmers, "TTTTTTTT", "TTTTTTTT", "TTTTTTTT")
+
+	out, err := os.Create(td.path("decoded.fa"))
+	if err != nil {
+		t.Fatalf("Couldn't create output: %v", err)
+	}
+	decodeReads(kmers, counts, flips, ns, km, readLen, out, decoder, ntails)
+	out.Close()
+
+	if got := readDecodedSeqs(t, td.path("decoded.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoding didn't stop at the end of the stream (%d reads)", len(got))
+	}
+}
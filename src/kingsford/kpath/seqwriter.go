@@ -0,0 +1,325 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A SeqWriter writes sequences, with their ids and qualities, in some
+// format. Formats that have no place for ids or qualities ignore them.
+// Flush() must be called after the last sequence is written.
+type SeqWriter interface {
+	Write(id, seq string, qual []byte) error
+	Flush() error
+}
+
+// A multiSeqWriter writes each sequence to all of its writers, so that reads
+// decoded once can be written in several places and formats.
+type multiSeqWriter []SeqWriter
+
+func (m multiSeqWriter) Write(id, seq string, qual []byte) error {
+	for _, w := range m {
+		if err := w.Write(id, seq, qual); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiSeqWriter) Flush() error {
+	for _, w := range m {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingQual is written for each base of a sequence written as fastq
+// without qualities.
+const missingQual byte = 'I'
+
+// A fastaWriter writes each sequence as a fasta record, ">id" followed by the
+// sequence on one line.
+type fastaWriter struct {
+	*bufio.Writer
+}
+
+func newFastaWriter(w io.Writer) SeqWriter {
+	return fastaWriter{bufio.NewWriter(w)}
+}
+
+func (w fastaWriter) Write(id, seq string, qual []byte) error {
+	w.WriteByte('>')
+	w.WriteString(id)
+	w.WriteByte('\n')
+	w.WriteString(seq)
+	return w.WriteByte('\n')
+}
+
+// A fastqWriter writes each sequence as a four line fastq record. Sequences
+// without qualities get missingQual for every base.
+type fastqWriter struct {
+	*bufio.Writer
+}
+
+func newFastqWriter(w io.Writer) SeqWriter {
+	return fastqWriter{bufio.NewWriter(w)}
+}
+
+func (w fastqWriter) Write(id, seq string, qual []byte) error {
+	w.WriteByte('@')
+	w.WriteString(id)
+	w.WriteByte('\n')
+	w.WriteString(seq)
+	w.WriteString("\n+\n")
+	if qual != nil {
+		w.Writer.Write(qual)
+	} else {
+		for i := 0; i < len(seq); i++ {
+			w.WriteByte(missingQual)
+		}
+	}
+	return w.WriteByte('\n')
+}
+
+// A rawWriter writes just the sequences, each followed by sep.
+type rawWriter struct {
+	*bufio.Writer
+	sep string
+}
+
+// newRawWriter() returns a rawWriter that writes one sequence per line.
+func newRawWriter(w io.Writer) SeqWriter {
+	return newSeparatedWriter(w, "\n")
+}
+
+// newSeparatedWriter() returns a rawWriter that ends each sequence with sep.
+func newSeparatedWriter(w io.Writer, sep string) SeqWriter {
+	return rawWriter{bufio.NewWriter(w), sep}
+}
+
+func (w rawWriter) Write(id, seq string, qual []byte) error {
+	w.WriteString(seq)
+	_, err := w.WriteString(w.sep)
+	return err
+}
+
+// parseSeparator() interprets the escapes (such as \t, \x00 or \000) in a
+// record separator given on the command line.
+func parseSeparator(s string) (string, error) {
+	sep, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil {
+		return "", fmt.Errorf("bad separator %q", s)
+	}
+	if sep == "" {
+		return "", fmt.Errorf("the separator can't be empty")
+	}
+	return sep, nil
+}
+
+/*
+A record stream is a binary format for reads that other programs can read
+without parsing text. It starts with the 4 bytes "KPR1", followed by one
+record per read. All integers are unsigned varints (as in encoding/binary).
+A record is:
+
+    the length of the id, and the id
+    the length n of the sequence
+    the sequence, 2 bits per base (A=0, C=1, G=2, T=3), 4 bases per byte
+        with the first base in the high bits, in (n+3)/4 bytes
+    the number of exceptions, and for each its position and the original
+        byte: bases other than ACGT (such as N) are packed as A and listed
+        here
+    the length of the qualities (0 if there are none), and the qualities
+*/
+
+// recordMagic starts a record stream.
+const recordMagic = "KPR1"
+
+// A recordWriter writes each sequence as a binary record.
+type recordWriter struct {
+	*bufio.Writer
+	started bool
+	v       [binary.MaxVarintLen64]byte
+}
+
+func newRecordWriter(w io.Writer) SeqWriter {
+	return &recordWriter{Writer: bufio.NewWriter(w)}
+}
+
+func (w *recordWriter) putUvarint(x int) {
+	w.Writer.Write(w.v[:binary.PutUvarint(w.v[:], uint64(x))])
+}
+
+func (w *recordWriter) Write(id, seq string, qual []byte) error {
+	if !w.started {
+		w.WriteString(recordMagic)
+		w.started = true
+	}
+	w.putUvarint(len(id))
+	w.WriteString(id)
+
+	w.putUvarint(len(seq))
+	exceptions := make([]int, 0)
+	var packed byte
+	for i := 0; i < len(seq); i++ {
+		b := byte(0)
+		switch seq[i] {
+		case 'A':
+		case 'C':
+			b = 1
+		case 'G':
+			b = 2
+		case 'T':
+			b = 3
+		default:
+			exceptions = append(exceptions, i)
+		}
+		packed = packed<<2 | b
+		if i%4 == 3 {
+			w.WriteByte(packed)
+			packed = 0
+		}
+	}
+	if r := len(seq) % 4; r != 0 {
+		w.WriteByte(packed << uint(2*(4-r)))
+	}
+
+	w.putUvarint(len(exceptions))
+	for _, p := range exceptions {
+		w.putUvarint(p)
+		w.WriteByte(seq[p])
+	}
+
+	w.putUvarint(len(qual))
+	_, err := w.Writer.Write(qual)
+	return err
+}
+
+// Flush() writes the magic even if there were no records, so that an empty
+// stream is still a record stream.
+func (w *recordWriter) Flush() error {
+	if !w.started {
+		w.WriteString(recordMagic)
+		w.started = true
+	}
+	return w.Writer.Flush()
+}
+
+// A RecordReader reads the records of a record stream.
+type RecordReader struct {
+	r       *bufio.Reader
+	started bool
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Read() returns the id, sequence and qualities (nil if there are none) of the
+// next record, or io.EOF if there are no more.
+func (rr *RecordReader) Read() (id, seq string, qual []byte, err error) {
+	if !rr.started {
+		magic := make([]byte, len(recordMagic))
+		if _, err := io.ReadFull(rr.r, magic); err != nil || string(magic) != recordMagic {
+			return "", "", nil, fmt.Errorf("not a record stream")
+		}
+		rr.started = true
+	}
+
+	// only the end of a whole record is the end of the stream
+	idLen, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return "", "", nil, err
+	}
+	b, err := rr.bytes(idLen)
+	if err != nil {
+		return "", "", nil, err
+	}
+	id = string(b)
+
+	n, err := rr.uvarint()
+	if err != nil {
+		return "", "", nil, err
+	}
+	packed, err := rr.bytes((n + 3) / 4)
+	if err != nil {
+		return "", "", nil, err
+	}
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = ALPHA[(packed[i/4]>>uint(6-2*(i%4)))&3]
+	}
+
+	nexc, err := rr.uvarint()
+	if err != nil {
+		return "", "", nil, err
+	}
+	for ; nexc > 0; nexc-- {
+		p, err := rr.uvarint()
+		if err != nil {
+			return "", "", nil, err
+		}
+		c, err := rr.r.ReadByte()
+		if err != nil {
+			return "", "", nil, io.ErrUnexpectedEOF
+		}
+		if p >= n {
+			return "", "", nil, fmt.Errorf("record %q has an exception at %d, past its end", id, p)
+		}
+		s[p] = c
+	}
+
+	qualLen, err := rr.uvarint()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if qualLen > 0 {
+		if qual, err = rr.bytes(qualLen); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return id, string(s), qual, nil
+}
+
+// uvarint() reads a varint inside a record, where the stream may not end.
+func (rr *RecordReader) uvarint() (uint64, error) {
+	x, err := binary.ReadUvarint(rr.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return x, err
+}
+
+// bytes() reads n bytes inside a record.
+func (rr *RecordReader) bytes(n uint64) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
@@ -0,0 +1,206 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSeqWriters(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		newWriter func(io.Writer) SeqWriter
+		want      string
+	}{
+		{"fasta", newFastaWriter, ">R0\nACGT\n>R1\nGG\n"},
+		{"fastq", newFastqWriter, "@R0\nACGT\n+\n!#%'\n@R1\nGG\n+\nII\n"},
+		{"raw", newRawWriter, "ACGT\nGG\n"},
+		{"nul separated", func(w io.Writer) SeqWriter { return newSeparatedWriter(w, "\x00") }, "ACGT\x00GG\x00"},
+	} {
+		var buf bytes.Buffer
+		w := c.newWriter(&buf)
+		w.Write("R0", "ACGT", []byte("!#%'"))
+		w.Write("R1", "GG", nil)
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%s: couldn't flush: %v", c.name, err)
+		}
+		if buf.String() != c.want {
+			t.Fatalf("%s writer wrote %q, not %q", c.name, buf.String(), c.want)
+		}
+	}
+}
+
+func TestParseSeparator(t *testing.T) {
+	for in, want := range map[string]string{`\n`: "\n", `\x00`: "\x00", `\000`: "\x00", `\t`: "\t", "|": "|", `\r\n`: "\r\n"} {
+		if got, err := parseSeparator(in); err != nil || got != want {
+			t.Fatalf("Separator %q is %q (%v), not %q", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", `\q`, `"`} {
+		if _, err := parseSeparator(bad); err == nil {
+			t.Fatalf("Separator %q was accepted", bad)
+		}
+	}
+}
+
+func TestDecodeSeparator(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 29, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	outputFastaOption = false
+	sepOption = `\x00`
+	decodeArchive(td.refFile, td.path("out"), td.path("out.seq"))
+
+	b, err := ioutil.ReadFile(td.path("out.seq"))
+	if err != nil {
+		t.Fatalf("Couldn't read the decoded reads: %v", err)
+	}
+	if bytes.IndexByte(b, '\n') >= 0 || b[len(b)-1] != 0 {
+		t.Fatalf("Decoded reads aren't separated by NULs")
+	}
+	seqs := strings.Split(string(b[:len(b)-1]), "\x00")
+	if !sameReads(seqs, td.reads) {
+		t.Fatalf("NUL separated output doesn't hold the encoded reads")
+	}
+}
+
+func TestRecordStream(t *testing.T) {
+	type record struct {
+		id, seq string
+		qual    []byte
+	}
+	records := []record{
+		{"R0", "ACGTACGTA", []byte("IIIIIII#!")},
+		{"R1", "NNACGTNN", nil},
+		{"R2", "", nil},
+		{"read three", "TTTT", []byte("!!!!")},
+	}
+	var buf bytes.Buffer
+	w := newRecordWriter(&buf)
+	for _, r := range records {
+		if err := w.Write(r.id, r.seq, r.qual); err != nil {
+			t.Fatalf("Couldn't write record: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Couldn't flush: %v", err)
+	}
+	whole := buf.Bytes()
+
+	rr := NewRecordReader(bytes.NewReader(whole))
+	for _, want := range records {
+		id, seq, qual, err := rr.Read()
+		if err != nil {
+			t.Fatalf("Couldn't read record %s: %v", want.id, err)
+		}
+		if id != want.id || seq != want.seq || !bytes.Equal(qual, want.qual) {
+			t.Fatalf("Read (%q, %q, %q), not (%q, %q, %q)", id, seq, qual, want.id, want.seq, want.qual)
+		}
+	}
+	if _, _, _, err := rr.Read(); err != io.EOF {
+		t.Fatalf("Expected EOF after the last record, got %v", err)
+	}
+
+	// a stream cut inside a record is an error, not the end
+	rr = NewRecordReader(bytes.NewReader(whole[:len(whole)-2]))
+	var err error
+	for err == nil {
+		_, _, _, err = rr.Read()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated stream to give ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecodeRecords(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 26, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	recordsOption = true
+	decodeArchive(td.refFile, td.path("out"), td.path("out.kpr"))
+
+	f, err := os.Open(td.path("out.kpr"))
+	if err != nil {
+		t.Fatalf("Couldn't open record stream: %v", err)
+	}
+	defer f.Close()
+	rr := NewRecordReader(f)
+	seqs := make([]string, 0)
+	for {
+		id, seq, qual, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Couldn't read record %d: %v", len(seqs), err)
+		}
+		if id != fmt.Sprintf("R%d", len(seqs)) || qual != nil {
+			t.Fatalf("Record %d has id %q and qualities %q", len(seqs), id, qual)
+		}
+		seqs = append(seqs, seq)
+	}
+	if !sameReads(seqs, td.reads) {
+		t.Fatalf("Record stream doesn't hold the encoded reads")
+	}
+}
+
+func TestMultipleDecodeOutputs(t *testing.T) {
+	setTestOptions(8)
+	td := newTestData(t, 27, 300, 40)
+	defer td.Close()
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+
+	// each output of one decode is the same as a decode to it alone
+	validateOutOption = true
+	decodeArchive(td.refFile, td.path("out"), td.path("both.fa")+",records:"+td.path("both.kpr")+
+		",fastq:"+td.path("both.fq"))
+	decodeArchive(td.refFile, td.path("out"), td.path("alone.fa"))
+	decodeArchive(td.refFile, td.path("out"), "records:"+td.path("alone.kpr"))
+	decodeArchive(td.refFile, td.path("out"), "fastq:"+td.path("alone.fq"))
+	for _, ext := range []string{".fa", ".kpr", ".fq"} {
+		both, errB := ioutil.ReadFile(td.path("both" + ext))
+		alone, errA := ioutil.ReadFile(td.path("alone" + ext))
+		if errB != nil || errA != nil || len(both) == 0 || !bytes.Equal(both, alone) {
+			t.Fatalf("%s differs between one decode and separate ones (%v, %v)", ext, errB, errA)
+		}
+	}
+	if got := readDecodedSeqs(t, td.path("both.fa")); !sameReads(got, td.reads) {
+		t.Fatalf("Decoded reads differ from the encoded reads")
+	}
+
+	for _, out := range []string{"a.fa,", "a.fa,a.fa", "fastq:"} {
+		if _, err := parseDecodeTargets(out); err == nil {
+			t.Fatalf("-out=%s accepted", out)
+		}
+	}
+	if targets, err := parseDecodeTargets("x:a.fa,raw:b"); err != nil ||
+		fmt.Sprint(targets) != "[{x:a.fa } {b raw}]" {
+		t.Fatalf("Parsed targets %v, %v", targets, err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A sidecarFile is a file of an archive that is written by a producer
+// running in the background. Its writer and the file are only closed once the
+// producer is done, and if the producer fails or panics the file is removed
+// instead, so that an encode that stops half way through doesn't leave a
+// truncated file behind that decodes partially.
+type sidecarFile struct {
+	fn   string
+	f    *os.File
+	w    io.WriteCloser // the compressor wrapping f
+	done chan error     // the result of the producer started by start()
+}
+
+// createSidecar() creates the file fn for writing through the writer that
+// wrap returns for it (such as a gzipper).
+func createSidecar(fn string, wrap func(io.Writer) (io.WriteCloser, error)) (*sidecarFile, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	w, err := wrap(f)
+	if err != nil {
+		f.Close()
+		os.Remove(fn)
+		return nil, err
+	}
+	return &sidecarFile{fn: fn, f: f, w: w}, nil
+}
+
+// sidecarWrapper() returns a wrapper for createSidecar() that writes the
+// file as newSidecarWriter() does.
+func sidecarWrapper(id archiveID) func(io.Writer) (io.WriteCloser, error) {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return newSidecarWriter(w, id)
+	}
+}
+
+// gzipWrapper() returns a wrapper for createSidecar() that gzips the file at
+// the given level, with the archive id in its header.
+func gzipWrapper(id archiveID, level int) func(io.Writer) (io.WriteCloser, error) {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		z, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		setSidecarID(z, id)
+		return z, nil
+	}
+}
+
+// start() runs produce on the file's writer in the background; finish()
+// waits for it.
+func (s *sidecarFile) start(produce func(w io.Writer) error) {
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- runProducer(func() error { return produce(s.w) })
+	}()
+}
+
+// finish() waits for the producer started by start() and then closes the
+// file; see close().
+func (s *sidecarFile) finish() error {
+	return s.close(<-s.done)
+}
+
+// close() closes the file once its producer is done, given what the producer
+// returned. If that is an error, or the file can't be closed, the file is
+// removed and the error returned.
+func (s *sidecarFile) close(err error) error {
+	if err == nil {
+		err = s.w.Close()
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.fn)
+		return fmt.Errorf("couldn't write %s: %v", s.fn, err)
+	}
+	return nil
+}
+
+// runProducer() calls produce and returns its error, or an error if it
+// panics, so that a producer running in the background can't take the
+// process down before the files it shares are cleaned up.
+func runProducer(produce func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return produce()
+}
+
+// removeSidecars() removes the files with basename base and the given
+// extensions, if they exist.
+func removeSidecars(base string, exts []string) {
+	for _, ext := range exts {
+		os.Remove(base + ext)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kingsford/kpath/bitio"
+)
+
+func TestSidecarProducers(t *testing.T) {
+	setTestOptions(8)
+	dir, err := ioutil.TempDir("", "kpath-test-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var id archiveID
+	want := strings.Repeat("ACGT", 10000)
+
+	// a producer that is slow to finish has all it wrote in the file
+	fn := filepath.Join(dir, "slow")
+	s, err := createSidecar(fn, sidecarWrapper(id))
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %v", fn, err)
+	}
+	s.start(func(w io.Writer) error {
+		time.Sleep(50 * time.Millisecond)
+		_, err := io.WriteString(w, want)
+		return err
+	})
+	if err := s.finish(); err != nil {
+		t.Fatalf("Couldn't finish %s: %v", fn, err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", fn, err)
+	}
+	z, err := openSidecar(f)
+	if err != nil {
+		t.Fatalf("Couldn't unzip %s: %v", fn, err)
+	}
+	got, err := ioutil.ReadAll(z)
+	f.Close()
+	if err != nil || string(got) != want {
+		t.Fatalf("Read back %d bytes (%v), not %d", len(got), err, len(want))
+	}
+
+	// a producer that fails or panics part way leaves no file behind, raw
+	// or gzipped
+	producers := map[string]func(w io.Writer) error{
+		"error": func(w io.Writer) error {
+			io.WriteString(w, want)
+			return errors.New("injected")
+		},
+		"panic": func(w io.Writer) error {
+			bits := bitio.NewWriter(w)
+			for i := 0; i < 1000; i++ {
+				bits.WriteBit(1)
+			}
+			bits.Close()
+			panic("injected")
+		},
+	}
+	for _, raw := range []bool{false, true} {
+		rawStreamsOption = raw
+		for name, produce := range producers {
+			fn := filepath.Join(dir, name)
+			s, err := createSidecar(fn, sidecarWrapper(id))
+			if err != nil {
+				t.Fatalf("Couldn't create %s: %v", fn, err)
+			}
+			s.start(produce)
+			err = s.finish()
+			if err == nil || !strings.Contains(err.Error(), "injected") {
+				t.Fatalf("The %s producer finished with %v (raw %v)", name, err, raw)
+			}
+			if fileExists(fn) {
+				t.Fatalf("The %s producer left %s behind (raw %v)", name, fn, raw)
+			}
+		}
+	}
+	rawStreamsOption = false
+}
+
+func TestSidecarWriterErrors(t *testing.T) {
+	setTestOptions(8)
+	reads := []*FastQ{{
+		Seq:         []byte("ACGTACGTACGT"),
+		Exceptions:  []byte{3, 'R'},
+		Corrections: []byte{5, 'A'},
+	}}
+	writers := map[string]func(w io.Writer) error{
+		"runs":        func(w io.Writer) error { return writeRuns(w, map[int][]int{4: {1, 3}}) },
+		"exceptions":  func(w io.Writer) error { return writeExceptions(w, readSlice(reads)) },
+		"corrections": func(w io.Writer) error { return writeCorrections(w, readSlice(reads)) },
+	}
+	for name, write := range writers {
+		if err := write(failingWriter{}); err == nil {
+			t.Fatalf("Failed write of the %s was not reported", name)
+		}
+		if err := write(ioutil.Discard); err != nil {
+			t.Fatalf("Couldn't write the %s: %v", name, err)
+		}
+	}
+}
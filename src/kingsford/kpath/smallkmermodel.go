@@ -3,6 +3,7 @@ package main
 import (
     "math"
     "log"
+    "sort"
 )
 
 //===================================================================
@@ -97,20 +98,25 @@ func (km *SmallKmerModel) KmerExists(k Kmer) bool {
 }
 */
 
-// set the value of the given parameter
+// set the value of the given parameter; once the kmer has overflowed its
+// counts live in the overflow entry, and a count of 255 can only live there
 func (km *SmallKmerModel) SetCount(k Kmer, c, v byte) {
-    entry := km.dist[k]
-    entry[c] = uint8(v)
-    km.dist[k] = entry
+    if idx, entry, over := km.hasOverflow(k); over {
+        km.overflow[idx][c] = KmerCount(v)
+    } else if v == math.MaxUint8 {
+        idx := km.createOverflow(k)
+        km.overflow[idx][c] = KmerCount(v)
+    } else {
+        entry[c] = uint8(v)
+        km.dist[k] = entry
+    }
 }
 
 
-// increment the value of the given count
+// increment the value of the given count; counts stop at MAX_OBSERVATION-1
 func (km *SmallKmerModel) Increment(k Kmer, c, by byte) {
     if idx, entry, over := km.hasOverflow(k); over {
-        if uint64(km.overflow[idx][c]) + uint64(by) < MAX_OBSERVATION {
-            km.overflow[idx][c] += KmerCount(by)
-        }
+        km.overflow[idx][c] = saturatingAdd(km.overflow[idx][c], by)
     } else {
         if uint64(entry[c])+uint64(by) >= math.MaxUint8 {
             idx := km.createOverflow(k)
@@ -121,3 +127,23 @@ func (km *SmallKmerModel) Increment(k Kmer, c, by byte) {
         }
     }
 }
+
+// call f for every kmer that exists in the model, in increasing kmer order
+func (km *SmallKmerModel) Iterate(f func(k Kmer, dist [len(ALPHA)]KmerCount)) {
+    keys := make([]Kmer, 0, len(km.dist))
+    for k := range km.dist {
+        keys = append(keys, k)
+    }
+    sort.Sort(kmerSlice(keys))
+    for _, k := range keys {
+        _, d := km.Distribution(k)
+        f(k, d)
+    }
+}
+
+// support sorting a list of kmers numerically
+type kmerSlice []Kmer
+
+func (a kmerSlice) Len() int           { return len(a) }
+func (a kmerSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a kmerSlice) Less(i, j int) bool { return a[i] < a[j] }
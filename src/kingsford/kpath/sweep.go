@@ -0,0 +1,184 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A sweepResult is the size of the archive of a sample of reads encoded with
+// kmers of length k.
+type sweepResult struct {
+	k       int
+	bytes   int64   // the total size of the files of the archive
+	bases   int64   // the number of bases in the sample
+	seconds float64 // the time taken to encode
+}
+
+// bitsPerBase() returns the size of the archive in bits per base.
+func (r sweepResult) bitsPerBase() float64 {
+	return 8 * float64(r.bytes) / float64(r.bases)
+}
+
+// parseKRange() parses a list of kmer lengths given as MIN:MAX (inclusive)
+// or as a comma-separated list.
+func parseKRange(s string) ([]int, error) {
+	var ks []int
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		lo, err1 := strconv.Atoi(s[:i])
+		hi, err2 := strconv.Atoi(s[i+1:])
+		if err1 != nil || err2 != nil || lo > hi {
+			return nil, fmt.Errorf("bad range of k %q", s)
+		}
+		for k := lo; k <= hi; k++ {
+			ks = append(ks, k)
+		}
+	} else {
+		for _, f := range strings.Split(s, ",") {
+			k, err := strconv.Atoi(f)
+			if err != nil {
+				return nil, fmt.Errorf("bad value of k %q", f)
+			}
+			ks = append(ks, k)
+		}
+	}
+	for _, k := range ks {
+		if k <= 0 || k > 16 {
+			return nil, fmt.Errorf("k must be between 1 and 16, not %d", k)
+		}
+	}
+	return ks, nil
+}
+
+// writeReadSample() writes the first n reads of readFile (all of them if
+// n <= 0) to out as fastq, and returns the number of reads and bases written.
+func writeReadSample(readFile string, n int, out io.Writer) (reads int, bases int64, err error) {
+	fq := make(chan *FastQ, readBufferSize)
+	go ReadFastQ(readFile, fq)
+	w := newFastqWriter(out)
+	for rec := range fq {
+		if n > 0 && reads >= n {
+			// let the reader finish
+			continue
+		}
+		w.Write("R"+strconv.Itoa(reads), rec.Original(), nil)
+		reads++
+		bases += int64(len(rec.Seq))
+	}
+	return reads, bases, w.Flush()
+}
+
+// sweepK() encodes the sample of reads in sampleFile, which has the given
+// number of bases, once for each k in ks, and returns the size of each
+// archive. The archives are written to dir and deleted.
+func sweepK(refFile, sampleFile string, bases int64, ks []int, dir string) []sweepResult {
+	userBucketK := bucketK
+	defer func(k int) {
+		globalK = k
+		setShiftKmerMask()
+		bucketK = userBucketK
+	}(globalK)
+
+	results := make([]sweepResult, 0, len(ks))
+	for _, k := range ks {
+		log.Printf("Encoding the sample with k = %d", k)
+		globalK = k
+		setShiftKmerMask()
+		bucketK = userBucketK
+		if bucketK > k {
+			bucketK = k
+		}
+
+		out := filepath.Join(dir, fmt.Sprintf("k%d", k))
+		start := time.Now()
+		encodeArchive(refFile, sampleFile, out)
+		r := sweepResult{k: k, bases: bases, seconds: time.Now().Sub(start).Seconds()}
+
+		files, err := filepath.Glob(out + ".*")
+		DIE_ON_ERR(err, "Couldn't list the files of %s", out)
+		for _, fn := range files {
+			if fi, err := os.Stat(fn); err == nil {
+				r.bytes += fi.Size()
+			}
+			os.Remove(fn)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// writeSweepReport() writes a table of the results, one row per k, and the k
+// that gave the smallest archive.
+func writeSweepReport(w io.Writer, results []sweepResult) error {
+	fmt.Fprintln(w, "k\tbytes\tbits/base\tseconds")
+	best := -1
+	for i, r := range results {
+		fmt.Fprintf(w, "%d\t%d\t%.4f\t%.2f\n", r.k, r.bytes, r.bitsPerBase(), r.seconds)
+		if best < 0 || r.bytes < results[best].bytes {
+			best = i
+		}
+	}
+	if best < 0 {
+		return fmt.Errorf("no values of k were tried")
+	}
+	_, err := fmt.Fprintf(w, "Best k = %d (%.4f bits/base)\n", results[best].k, results[best].bitsPerBase())
+	return err
+}
+
+// sweepReport() encodes a sample of the reads in readFile with each k in
+// sweepKOption and writes the report to outFile, or to stdout if it is "".
+func sweepReport(refFile, readFile, outFile string) {
+	DIE_IF(refFile == "" && !refFromReads, "Must specify gzipped fasta as reference with -ref")
+	DIE_IF(dictionaryOption != "", "Can't sweep k with -dictionary, whose model has a single k")
+	ks, err := parseKRange(sweepKOption)
+	DIE_ON_ERR(err, "Bad value for -krange")
+
+	dir, err := ioutil.TempDir("", "kpath-sweep-")
+	DIE_ON_ERR(err, "Couldn't create temporary directory in %s", os.TempDir())
+	defer os.RemoveAll(dir)
+
+	sampleFile := filepath.Join(dir, "sample.fq")
+	f, err := os.Create(sampleFile)
+	DIE_ON_ERR(err, "Couldn't create %s", sampleFile)
+	n, bases, err := writeReadSample(readFile, sweepSampleOption, f)
+	DIE_ON_ERR(err, "Couldn't write %s", sampleFile)
+	DIE_ON_ERR(f.Close(), "Couldn't write %s", sampleFile)
+	DIE_IF(n == 0, "No reads in %s", readFile)
+	log.Printf("Sweeping k over a sample of %d reads (%d bases)", n, bases)
+
+	results := sweepK(refFile, sampleFile, bases, ks, dir)
+
+	out := os.Stdout
+	if outFile != "" {
+		out, err = os.Create(outFile)
+		DIE_ON_ERR(err, "Couldn't create output file %s", outFile)
+		defer out.Close()
+	}
+	DIE_ON_ERR(writeSweepReport(out, results), "Couldn't write the report")
+}
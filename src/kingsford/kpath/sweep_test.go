@@ -0,0 +1,73 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseKRange(t *testing.T) {
+	for in, want := range map[string]string{"8:10": "[8 9 10]", "12": "[12]", "8,12,16": "[8 12 16]"} {
+		if ks, err := parseKRange(in); err != nil || fmt.Sprint(ks) != want {
+			t.Fatalf("Range %q is %v (%v), not %s", in, ks, err, want)
+		}
+	}
+	for _, bad := range []string{"", "10:8", "0:4", "8:17", "8,x"} {
+		if _, err := parseKRange(bad); err == nil {
+			t.Fatalf("Range %q was accepted", bad)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	setTestOptions(12)
+	td := newTestData(t, 34, 400, 40)
+	defer td.Close()
+	sweepKOption = "6:9"
+	sweepSampleOption = 300
+	sweepReport(td.refFile, td.readFN, td.path("sweep.txt"))
+	if globalK != 12 {
+		t.Fatalf("k is %d after the sweep, not 12", globalK)
+	}
+
+	b, err := ioutil.ReadFile(td.path("sweep.txt"))
+	if err != nil {
+		t.Fatalf("Couldn't read the report: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 6 || lines[0] != "k\tbytes\tbits/base\tseconds" || !strings.HasPrefix(lines[5], "Best k = ") {
+		t.Fatalf("Report is\n%s", b)
+	}
+	for i, line := range lines[1:5] {
+		var k, bytes int
+		var bpb, secs float64
+		if _, err := fmt.Sscanf(line, "%d\t%d\t%f\t%f", &k, &bytes, &bpb, &secs); err != nil || k != 6+i || bytes <= 0 {
+			t.Fatalf("Row %d of the report is %q", i, line)
+		}
+		// 300 reads of 40 bases, with headers and all
+		if want := 8 * float64(bytes) / (300 * 40); bpb < want-0.001 || bpb > want+0.001 {
+			t.Fatalf("Row %q has %f bits/base, not %f", line, bpb, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// traceRead() writes, for each base of r that the encoder would code, the
+// context it is coded in, whether the model has that context ("backoff" if
+// a shorter context of -backoff is used instead), the distribution used (the
+// default distribution if none is), the interval
+// (a, b, total) given to the arithmetic coder, and the bits it costs. The
+// model and st are updated just as encoding r would update them. The first
+// bucketK bases are in the bucket tree, not the stream, so they are not
+// listed.
+func traceRead(w io.Writer, st *codingState, km KmerModel, r string) error {
+	if len(r) <= bucketK {
+		return fmt.Errorf("read %s is not longer than the bucket prefix (%d bases)", r, bucketK)
+	}
+	for i := range r {
+		if !isACGT(rune(r[i])) {
+			return fmt.Errorf("read has %q at position %d; only A, C, G and T can be traced", r[i], i)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "pos\tbase\tcontext\tfound\tdist\ta\tb\ttotal\tbits")
+	contextMer := stringToKmer(r[:bucketK])
+	for i := bucketK; i < len(r); i++ {
+		char := acgt(r[i])
+		context := seedContext(contextMer)
+		found, dist := km.Distribution(context)
+		foundStr := "no"
+		if found {
+			foundStr = "yes"
+		}
+		if bdist, ok := backoffFor(st, km, context, found, dist); ok {
+			dist, found, foundStr = bdist, true, "backoff"
+		}
+		if !found {
+			for j, c := range st.defaultInterval {
+				dist[j] = KmerCount(c)
+			}
+		}
+		a, b, total := nextInterval(st, km, contextMer, char, true)
+
+		counts := make([]string, len(dist))
+		for j, c := range dist {
+			counts[j] = fmt.Sprint(c)
+		}
+		fmt.Fprintf(out, "%d\t%c\t%s\t%s\t%s\t%d\t%d\t%d\t%.2f\n",
+			i, r[i], kmerToString(context, globalK), foundStr, strings.Join(counts, ","),
+			a, b, total, math.Log2(float64(total)/float64(b-a)))
+		contextMer = shiftKmer(contextMer, char)
+	}
+	return out.Flush()
+}
+
+// dumpIntervals() traces the coding of the read with the model counted from
+// the reference in refFile, writing the trace to stdout.
+func dumpIntervals(refFile, read string) {
+	DIE_IF(refFile == "", "Must specify gzipped fasta as reference with -ref")
+	resetModelState()
+	if bucketK <= 0 {
+		bucketK = globalK
+	}
+	DIE_ON_ERR(setSeed(seedOption), "Bad value for -seed")
+	DIE_ON_ERR(setBackoff(backoffOption), "Bad value for -backoff")
+	loadDictionary(dictionaryOption)
+	km := countKmersInReference(globalK, readReferenceFile(refFile))
+	DIE_ON_ERR(traceRead(os.Stdout, newCodingState(), km, strings.ToUpper(read)), "Can't trace the read")
+}
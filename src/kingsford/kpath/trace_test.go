@@ -0,0 +1,54 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTraceRead(t *testing.T) {
+	setTestOptions(2)
+	bucketK = 2
+	updateReference = false
+	km := NewSmallKmerModel(2)
+	km.SetCount(stringToKmer("AC"), acgt('G'), 3)
+
+	// AC is followed by G 3 times, so A, C and T get the pseudocount 1 and
+	// G gets 10*3: G is [2, 32) of 33. CG is not in the model, so T is
+	// coded with the default distribution, as [6, 8) of 8.
+	want := "pos\tbase\tcontext\tfound\tdist\ta\tb\ttotal\tbits\n" +
+		"2\tG\tAC\tyes\t0,0,3,0\t2\t32\t33\t0.14\n" +
+		"3\tT\tCG\tno\t2,2,2,2\t6\t8\t8\t2.00\n"
+	var buf bytes.Buffer
+	if err := traceRead(&buf, newCodingState(), km, "ACGT"); err != nil {
+		t.Fatalf("Couldn't trace the read: %v", err)
+	}
+	if buf.String() != want {
+		t.Fatalf("Trace is\n%s\nnot\n%s", buf.String(), want)
+	}
+
+	for _, bad := range []string{"AC", "ACNT"} {
+		if err := traceRead(&buf, newCodingState(), km, bad); err == nil {
+			t.Fatalf("Traced %s", bad)
+		}
+	}
+}
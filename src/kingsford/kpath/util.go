@@ -1,10 +1,15 @@
 package main
 
-import "log"
+import (
+	"log"
+	"os"
+	"sync"
+)
 
 func DIE_IF(b bool, msg string, args ...interface{}) {
     if b {
-        log.Fatalf("Error: "+msg, args...)
+        log.Printf("Error: "+msg, args...)
+        exitAfterCleanup()
     }
 }
 
@@ -13,8 +18,38 @@ func DIE_IF(b bool, msg string, args ...interface{}) {
 func DIE_ON_ERR(err error, msg string, args ...interface{}) {
 	if err != nil {
 		log.Printf("Error: "+msg, args...)
-		log.Fatalf("%v", err)
+		log.Printf("%v", err)
+		exitAfterCleanup()
 	}
 }
 
+// the files to remove if the program dies before they are finished, such as
+// the temporary file of an atomicFile; deferred calls don't run on os.Exit()
+var (
+	dieFilesLock sync.Mutex
+	dieFiles     = make(map[string]bool)
+)
 
+// removeOnDie() has the file fn removed if the program dies by DIE_IF() or
+// DIE_ON_ERR() before keepOnDie() is called for it.
+func removeOnDie(fn string) {
+	dieFilesLock.Lock()
+	defer dieFilesLock.Unlock()
+	dieFiles[fn] = true
+}
+
+// keepOnDie() undoes removeOnDie().
+func keepOnDie(fn string) {
+	dieFilesLock.Lock()
+	defer dieFilesLock.Unlock()
+	delete(dieFiles, fn)
+}
+
+// exitAfterCleanup() removes the files given to removeOnDie() and exits.
+func exitAfterCleanup() {
+	dieFilesLock.Lock()
+	for fn := range dieFiles {
+		os.Remove(fn)
+	}
+	os.Exit(1)
+}
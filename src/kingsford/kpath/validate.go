@@ -0,0 +1,240 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// An outputReport lists the problems validateOutput() found in decoded reads.
+type outputReport struct {
+	reads      int    // the number of records read
+	badChars   int    // reads with a byte that isn't expected in a read
+	badLengths int    // reads whose length isn't that of any segment
+	badQuals   int    // fastq records whose qualities don't fit the read
+	malformed  int    // records that aren't in the format at all
+	first      string // the first problem found, if any
+}
+
+// problem() counts a problem with record n in *count, keeping the first.
+func (r *outputReport) problem(count *int, n int, format string, args ...interface{}) {
+	*count++
+	if r.first == "" {
+		r.first = fmt.Sprintf("record %d: ", n) + fmt.Sprintf(format, args...)
+	}
+}
+
+func (r *outputReport) String() string {
+	s := fmt.Sprintf("Validated %d reads: %d with bad characters, %d of the wrong length, "+
+		"%d with bad qualities, %d malformed", r.reads, r.badChars, r.badLengths, r.badQuals, r.malformed)
+	if r.first != "" {
+		s += "; first problem at " + r.first
+	}
+	return s
+}
+
+// Err() returns an error if any problem was found.
+func (r *outputReport) Err() error {
+	if r.badChars+r.badLengths+r.badQuals+r.malformed > 0 {
+		return fmt.Errorf("%s", r.first)
+	}
+	return nil
+}
+
+// An outputFormat describes decoded reads for validateOutput(): format is
+// "fasta", "fastq", "raw" or "records", and sep ends each read of a raw
+// file. lengths are the read lengths allowed (any length if it is empty), and
+// anyBytes allows bytes other than ACGTN in the reads, as an archive with
+// exceptions decodes to.
+type outputFormat struct {
+	format   string
+	sep      string
+	lengths  map[int]bool
+	anyBytes bool
+}
+
+// decodeOutputFormat() returns the given format (see outputFormats), or if
+// it is "", the format decoded reads are written in with the current
+// options, with the read lengths and exceptions of the segments.
+func decodeOutputFormat(segs []*archiveSegment, format string) outputFormat {
+	f := outputFormat{format: format, lengths: make(map[int]bool)}
+	switch {
+	case format != "":
+	case recordsOption:
+		f.format = "records"
+	case outputFastaOption:
+		f.format = "fasta"
+	default:
+		f.format = "raw"
+	}
+	if f.format == "raw" {
+		sep, err := parseSeparator(sepOption)
+		DIE_ON_ERR(err, "Bad value for -sep")
+		f.sep = sep
+	}
+	for _, seg := range segs {
+		f.lengths[seg.readLen] = true
+		if seg.exceptions != nil {
+			f.anyBytes = true
+		}
+	}
+	return f
+}
+
+// validateOutput() reads decoded reads in the given format from r and
+// checks that each is well formed: it has the expected bytes and one of the
+// expected lengths, and (for fastq) a quality for each base.
+func validateOutput(r io.Reader, f outputFormat) *outputReport {
+	rep := &outputReport{}
+	checkSeq := func(seq []byte) {
+		n := rep.reads
+		if len(f.lengths) > 0 && !f.lengths[len(seq)] {
+			rep.problem(&rep.badLengths, n, "length %d", len(seq))
+		}
+		for i, c := range seq {
+			switch {
+			case c == 'A' || c == 'C' || c == 'G' || c == 'T' || c == 'N':
+			case f.anyBytes && c != '\n' && c != '\r':
+			default:
+				rep.problem(&rep.badChars, n, "byte %q at %d", c, i)
+				return
+			}
+		}
+	}
+
+	if f.format == "records" {
+		rr := NewRecordReader(r)
+		for {
+			_, seq, _, err := rr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				rep.problem(&rep.malformed, rep.reads, "%v", err)
+				break
+			}
+			checkSeq([]byte(seq))
+			rep.reads++
+		}
+		return rep
+	}
+
+	in := bufio.NewScanner(r)
+	in.Buffer(make([]byte, 0, 64*1024), maxProcessedRead)
+	if f.format == "raw" && f.sep != "\n" {
+		in.Split(splitOn(f.sep))
+	}
+	next := func() ([]byte, bool) {
+		if !in.Scan() {
+			return nil, false
+		}
+		return in.Bytes(), true
+	}
+	for {
+		line, ok := next()
+		if !ok {
+			break
+		}
+		switch f.format {
+		case "raw":
+			checkSeq(line)
+		case "fasta", "fastq":
+			marker := byte('>')
+			if f.format == "fastq" {
+				marker = '@'
+			}
+			if len(line) == 0 || line[0] != marker {
+				rep.problem(&rep.malformed, rep.reads, "header %q", line)
+				return rep
+			}
+			seq, ok := next()
+			if !ok {
+				rep.problem(&rep.malformed, rep.reads, "no sequence")
+				return rep
+			}
+			checkSeq(seq)
+			if f.format == "fastq" {
+				seqLen := len(seq)
+				if plus, ok := next(); !ok || len(plus) == 0 || plus[0] != '+' {
+					rep.problem(&rep.malformed, rep.reads, "no + line")
+					return rep
+				}
+				qual, ok := next()
+				if !ok {
+					rep.problem(&rep.malformed, rep.reads, "no qualities")
+					return rep
+				}
+				if len(qual) != seqLen {
+					rep.problem(&rep.badQuals, rep.reads, "%d qualities for %d bases", len(qual), seqLen)
+				} else if i := bytes.IndexFunc(qual, func(c rune) bool { return c < '!' || c > '~' }); i >= 0 {
+					rep.problem(&rep.badQuals, rep.reads, "quality %q at %d", qual[i], i)
+				}
+			}
+		}
+		rep.reads++
+	}
+	if err := in.Err(); err != nil {
+		rep.problem(&rep.malformed, rep.reads, "%v", err)
+	}
+	return rep
+}
+
+// splitOn() returns a bufio.SplitFunc that splits at each sep. Data after the
+// last sep is returned as an error, as every read is followed by sep.
+func splitOn(sep string) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, []byte(sep)); i >= 0 {
+			return i + len(sep), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return 0, nil, fmt.Errorf("%d bytes after the last separator", len(data))
+		}
+		return 0, nil, nil
+	}
+}
+
+// validateDecodeOutput() validates the reads written to outF, the output of
+// decoding the given segments to t, before it is committed. It logs a report
+// and returns an error if there is any problem. Output that isn't kept isn't
+// validated.
+func validateDecodeOutput(outF io.WriteCloser, t decodeTarget, segs []*archiveSegment) error {
+	fn := t.file
+	switch f := outF.(type) {
+	case *atomicFile:
+		fn = f.Name()
+	case *os.File:
+	default:
+		log.Printf("Not validating the decoded reads, which weren't written")
+		return nil
+	}
+	in, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	rep := validateOutput(in, decodeOutputFormat(segs, t.format))
+	log.Println(rep)
+	return rep.Err()
+}
@@ -0,0 +1,108 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestValidateOutput(t *testing.T) {
+	setTestOptions(8)
+	validateOutOption = true
+	td := newTestData(t, 47, 300, 40)
+	defer td.Close()
+
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	decodeArchive(td.refFile, td.path("out"), td.path("decoded.fa"))
+	decoded, err := ioutil.ReadFile(td.path("decoded.fa"))
+	if err != nil {
+		t.Fatalf("Couldn't read the decoded reads: %v", err)
+	}
+
+	fasta := outputFormat{format: "fasta", lengths: map[int]bool{40: true}}
+	if rep := validateOutput(bytes.NewReader(decoded), fasta); rep.Err() != nil || rep.reads != len(td.reads) {
+		t.Fatalf("The decoded reads don't validate: %v", rep)
+	}
+
+	// corrupt the first read that has no N in a few ways
+	lines := strings.Split(string(decoded), "\n")
+	i := 1
+	for strings.Contains(lines[i], "N") {
+		i += 2
+	}
+	corrupt := func(f func(l []string)) []byte {
+		l := append([]string(nil), lines...)
+		f(l)
+		return []byte(strings.Join(l, "\n"))
+	}
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		count func(r *outputReport) int
+	}{
+		{"bad base", corrupt(func(l []string) { l[i] = "X" + l[i][1:] }),
+			func(r *outputReport) int { return r.badChars }},
+		{"short read", corrupt(func(l []string) { l[i] = l[i][1:] }),
+			func(r *outputReport) int { return r.badLengths }},
+		{"no header", corrupt(func(l []string) { l[i-1] = "R0" }),
+			func(r *outputReport) int { return r.malformed }},
+	} {
+		rep := validateOutput(bytes.NewReader(c.data), fasta)
+		if rep.Err() == nil || c.count(rep) != 1 {
+			t.Fatalf("%s: got %v", c.name, rep)
+		}
+	}
+
+	// exceptions allow other bytes, but not other lengths
+	exc := fasta
+	exc.anyBytes = true
+	if rep := validateOutput(bytes.NewReader(corrupt(func(l []string) { l[i] = "x" + l[i][1:] })), exc); rep.Err() != nil {
+		t.Fatalf("A lowercase base is flagged with exceptions: %v", rep)
+	}
+
+	// raw reads must each end with the separator
+	raw := outputFormat{format: "raw", sep: "\x00", lengths: map[int]bool{4: true}}
+	if rep := validateOutput(strings.NewReader("ACGT\x00ACGN\x00"), raw); rep.Err() != nil || rep.reads != 2 {
+		t.Fatalf("Good raw reads: %v", rep)
+	}
+	if rep := validateOutput(strings.NewReader("ACGT\x00ACG"), raw); rep.malformed != 1 {
+		t.Fatalf("Unterminated raw read: %v", rep)
+	}
+
+	// fastq qualities must match the reads
+	fastq := outputFormat{format: "fastq"}
+	if rep := validateOutput(strings.NewReader("@r0\nACGT\n+\nIIII\n@r1\nACGT\n+\nIII\n"), fastq); rep.badQuals != 1 || rep.reads != 2 {
+		t.Fatalf("Short qualities: %v", rep)
+	}
+
+	// a truncated record stream
+	var buf bytes.Buffer
+	w := newRecordWriter(&buf)
+	w.Write("R0", "ACGTACGT", nil)
+	w.Flush()
+	records := outputFormat{format: "records", lengths: map[int]bool{8: true}}
+	if rep := validateOutput(bytes.NewReader(buf.Bytes()[:buf.Len()-2]), records); rep.malformed != 1 {
+		t.Fatalf("Truncated records: %v", rep)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// A readCost is the number of bits a read took to encode.
+type readCost struct {
+	index int    // of the read in the segment, in the order decode writes them
+	seq   string // as encoded: flipped, and with As for its Ns
+	bits  uint64
+}
+
+// A worstReads keeps the n reads that took the most bits to encode, which
+// are often contamination, adapters or otherwise not from the reference. It
+// is a min-heap on bits, so the cheapest of those kept is the one to drop.
+type worstReads struct {
+	n     int
+	reads []readCost
+}
+
+// newWorstReads() returns a worstReads that keeps n reads.
+func newWorstReads(n int) *worstReads {
+	return &worstReads{n: n, reads: make([]readCost, 0, n)}
+}
+
+func (w *worstReads) Len() int { return len(w.reads) }
+
+func (w *worstReads) Less(i, j int) bool { return w.reads[i].bits < w.reads[j].bits }
+
+func (w *worstReads) Swap(i, j int) { w.reads[i], w.reads[j] = w.reads[j], w.reads[i] }
+
+func (w *worstReads) Push(x interface{}) { w.reads = append(w.reads, x.(readCost)) }
+
+func (w *worstReads) Pop() interface{} {
+	r := w.reads[len(w.reads)-1]
+	w.reads = w.reads[:len(w.reads)-1]
+	return r
+}
+
+// Add() records that the read with the given index and sequence took the
+// given number of bits, keeping it if it is among the n worst so far.
+func (w *worstReads) Add(index int, seq string, bits uint64) {
+	if len(w.reads) < w.n {
+		heap.Push(w, readCost{index, seq, bits})
+	} else if len(w.reads) > 0 && bits > w.reads[0].bits {
+		w.reads[0] = readCost{index, seq, bits}
+		heap.Fix(w, 0)
+	}
+}
+
+// Worst() returns the reads kept, most bits first (and in stream order
+// among equals).
+func (w *worstReads) Worst() []readCost {
+	worst := append([]readCost(nil), w.reads...)
+	sort.Slice(worst, func(i, j int) bool {
+		if worst[i].bits != worst[j].bits {
+			return worst[i].bits > worst[j].bits
+		}
+		return worst[i].index < worst[j].index
+	})
+	return worst
+}
+
+// String() describes the reads kept, one per line: the read's index, its
+// bits and its sequence.
+func (w *worstReads) String() string {
+	var b bytes.Buffer
+	worst := w.Worst()
+	fmt.Fprintf(&b, "The %d reads that took the most bits:", len(worst))
+	for _, r := range worst {
+		fmt.Fprintf(&b, "\n  read %d: %d bits: %s", r.index, r.bits, r.seq)
+	}
+	return b.String()
+}
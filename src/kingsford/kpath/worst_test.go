@@ -0,0 +1,68 @@
+/*
+   kpath - Compression of short-read sequence data
+   Copyright (C) 2014  Carl Kingsford & Rob Patro
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   Contact: carlk@cs.cmu.edu
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWorstReads(t *testing.T) {
+	w := newWorstReads(3)
+	for i, bits := range []uint64{5, 9, 1, 9, 7, 2, 8} {
+		w.Add(i, fmt.Sprint("r", i), bits)
+	}
+	if got := fmt.Sprint(w.Worst()); got != "[{1 r1 9} {3 r3 9} {6 r6 8}]" {
+		t.Fatalf("Kept %s as the worst reads", got)
+	}
+	none := newWorstReads(0)
+	none.Add(0, "r", 10)
+	if len(none.Worst()) != 0 {
+		t.Fatalf("Kept %v with n = 0", none.Worst())
+	}
+
+	// a read from elsewhere is among the worst of an encode
+	setTestOptions(8)
+	dupsOption = false
+	worstReadsOption = 3
+	td := newTestData(t, 62, 400, 40)
+	defer td.Close()
+	offTarget := randomSequence(rand.New(rand.NewSource(63)), 40)
+	writeTestReads(t, td.readFN, append(td.reads, offTarget))
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	encodeArchive(td.refFile, td.readFN, td.path("out"))
+	log.SetOutput(os.Stderr)
+	report := logged.String()
+	if !strings.Contains(report, "The 3 reads that took the most bits:") {
+		t.Fatalf("No report of the worst reads in the log")
+	}
+	if !strings.Contains(report, ": "+offTarget) && !strings.Contains(report, ": "+reverseComplement(offTarget)) {
+		t.Fatalf("Off target read %s is not among the worst:\n%s", offTarget,
+			report[strings.Index(report, "The 3 reads"):])
+	}
+}